@@ -0,0 +1,246 @@
+package mongonet
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// commands a client may run before it has authenticated to the proxy
+var preAuthCommands = map[string]bool{
+	"ismaster":     true,
+	"hello":        true,
+	"ping":         true,
+	"buildinfo":    true,
+	"getnonce":     true,
+	"getlasterror": true,
+	"whatsmyuri":   true,
+	"saslstart":    true,
+	"saslcontinue": true,
+	"authenticate": true,
+	"logout":       true,
+	"endsessions":  true,
+}
+
+func newUnauthorizedError(cmdName string) MongoError {
+	return NewMongoError(fmt.Errorf("command %s requires authentication", cmdName), 13, "Unauthorized")
+}
+
+// AuthenticatedUser returns the user the client authenticated as against the proxy,
+// or an empty string if it has not authenticated
+func (ps *ProxySession) AuthenticatedUser() string {
+	return ps.authUser
+}
+
+// AuthenticationDB returns the database the client authenticated against
+func (ps *ProxySession) AuthenticationDB() string {
+	return ps.authDB
+}
+
+// interceptClientAuth terminates client authentication in the proxy when ProxyConfig.ClientCredentials is set.
+// It follows the ProxyInterceptor conventions: a nil message means the client has been answered.
+func (ps *ProxySession) interceptClientAuth(m Message) (Message, ResponseInterceptor, error) {
+	db, cmd, err := GetCommand(m)
+	if err == ErrNotCommand {
+		if ps.authUser == "" {
+			return m, nil, newUnauthorizedError(fmt.Sprintf("opcode %d", m.Header().OpCode))
+		}
+		return m, nil, nil
+	}
+	if err != nil {
+		return m, nil, err
+	}
+
+	cmdName := strings.ToLower(CommandName(cmd))
+	switch cmdName {
+	case "saslstart":
+		return ps.saslStart(m, db, cmd)
+	case "saslcontinue":
+		return ps.saslContinue(m, cmd)
+	case "authenticate":
+		return m, nil, NewMongoError(fmt.Errorf("only %s is supported", ScramSHA256), 334, "MechanismUnavailable")
+	case "logout":
+		ps.authUser = ""
+		ps.authDB = ""
+		ps.scram = nil
+		return nil, nil, ps.RespondToCommandMakeBSON(m)
+	case "ismaster", "hello":
+		return ps.rewriteHelloForAuth(m, cmd)
+	}
+
+	if ps.authUser == "" && !preAuthCommands[cmdName] {
+		return m, nil, newUnauthorizedError(CommandName(cmd))
+	}
+
+	return m, nil, nil
+}
+
+func (ps *ProxySession) saslStart(m Message, db string, cmd bson.D) (Message, ResponseInterceptor, error) {
+	mechanism := ""
+	if idx := BSONIndexOf(cmd, "mechanism"); idx >= 0 {
+		mechanism, _, _ = GetAsString(cmd[idx])
+	}
+	if mechanism != ScramSHA256 {
+		return m, nil, NewMongoError(fmt.Errorf("Received authentication for mechanism %s which is not enabled", mechanism), 334, "MechanismUnavailable")
+	}
+
+	payload, err := saslPayload(cmd)
+	if err != nil {
+		return m, nil, err
+	}
+
+	ps.authUser = ""
+	ps.authDB = ""
+	ps.scram = newScramServerConversation(ps.proxy.config.ClientCredentials, db)
+	ps.scramSkipEmptyExchange = false
+	if idx := BSONIndexOf(cmd, "options"); idx >= 0 {
+		if options, _, err := GetAsBSON(cmd[idx]); err == nil {
+			if idx := BSONIndexOf(options, "skipEmptyExchange"); idx >= 0 {
+				ps.scramSkipEmptyExchange, _, _ = GetAsBool(options[idx])
+			}
+		}
+	}
+
+	return ps.saslStep(m, payload)
+}
+
+func (ps *ProxySession) saslContinue(m Message, cmd bson.D) (Message, ResponseInterceptor, error) {
+	if ps.scram == nil {
+		return m, nil, NewMongoError(fmt.Errorf("No SASL session state found"), 17, "ProtocolError")
+	}
+
+	payload, err := saslPayload(cmd)
+	if err != nil {
+		return m, nil, err
+	}
+
+	return ps.saslStep(m, payload)
+}
+
+func (ps *ProxySession) saslStep(m Message, payload []byte) (Message, ResponseInterceptor, error) {
+	conversation := ps.scram
+
+	resp, done, err := conversation.Step(payload)
+	if err != nil {
+		ps.scram = nil
+		ps.logger.Logf(slogger.INFO, "authentication of %s@%s failed: %s", conversation.username, conversation.db, err)
+		return m, nil, err
+	}
+
+	if conversation.authenticated && ps.scramSkipEmptyExchange {
+		done = true
+	}
+
+	if done {
+		ps.scram = nil
+		ps.authUser = conversation.username
+		ps.authDB = conversation.db
+		ps.logger.Logf(slogger.INFO, "authenticated as %s@%s", ps.authUser, ps.authDB)
+	}
+
+	return nil, nil, ps.RespondToCommandMakeBSON(m,
+		"conversationId", 1,
+		"done", done,
+		"payload", resp,
+	)
+}
+
+func saslPayload(cmd bson.D) ([]byte, error) {
+	idx := BSONIndexOf(cmd, "payload")
+	if idx < 0 {
+		return nil, NewMongoError(fmt.Errorf("missing payload"), 9, "FailedToParse")
+	}
+	switch val := cmd[idx].Value.(type) {
+	case []byte:
+		return val, nil
+	case bson.Binary:
+		return val.Data, nil
+	case string:
+		return []byte(val), nil
+	}
+	return nil, NewMongoError(fmt.Errorf("payload has unexpected type %T", cmd[idx].Value), 14, "TypeMismatch")
+}
+
+// rewriteHelloForAuth keeps the upstream service identity out of the handshake:
+// speculative authentication is stripped so the client falls back to saslStart,
+// and saslSupportedMechs is answered from the proxy's credential store.
+func (ps *ProxySession) rewriteHelloForAuth(m Message, cmd bson.D) (Message, ResponseInterceptor, error) {
+	changed := false
+
+	if idx := BSONIndexOf(cmd, "speculativeAuthenticate"); idx >= 0 {
+		cmd = append(cmd[:idx:idx], cmd[idx+1:]...)
+		changed = true
+	}
+
+	var mechs []string
+	askedForMechs := false
+	if idx := BSONIndexOf(cmd, "saslSupportedMechs"); idx >= 0 {
+		askedForMechs = true
+		if userName, _, err := GetAsString(cmd[idx]); err == nil {
+			pieces := strings.SplitN(userName, ".", 2)
+			if len(pieces) == 2 {
+				cred, err := ps.proxy.config.ClientCredentials.GetCredential(pieces[0], pieces[1])
+				if err != nil {
+					return m, nil, err
+				}
+				if cred != nil {
+					mechs = []string{ScramSHA256}
+				}
+			}
+		}
+		cmd = append(cmd[:idx:idx], cmd[idx+1:]...)
+		changed = true
+	}
+
+	if changed {
+		if err := SetCommand(m, cmd); err != nil {
+			return m, nil, err
+		}
+	}
+
+	if !askedForMechs {
+		return m, nil, nil
+	}
+	return m, &saslMechsResponseInterceptor{mechs}, nil
+}
+
+type saslMechsResponseInterceptor struct {
+	mechs []string
+}
+
+func (smri *saslMechsResponseInterceptor) InterceptMongoToClient(m Message) (Message, error) {
+	doc, err := GetResponseDocument(m)
+	if err != nil {
+		return m, err
+	}
+
+	if idx := BSONIndexOf(doc, "saslSupportedMechs"); idx >= 0 {
+		doc = append(doc[:idx:idx], doc[idx+1:]...)
+	}
+	if smri.mechs != nil {
+		doc = append(doc, bson.DocElem{"saslSupportedMechs", smri.mechs})
+	}
+
+	return m, SetResponseDocument(m, doc)
+}
+
+// upstreamAuthHook authenticates every new upstream connection with the proxy's own service identity
+func upstreamAuthHook(pc ProxyConfig, next ConnectionHook) ConnectionHook {
+	return func(conn net.Conn) error {
+		authDB := pc.MongoAuthDB
+		if authDB == "" {
+			authDB = "admin"
+		}
+		err := ScramSHA256Authenticate(conn, authDB, pc.MongoUser, pc.MongoPassword)
+		if err != nil {
+			return NewStackErrorf("cannot authenticate upstream connection as %s@%s: %s", pc.MongoUser, authDB, err)
+		}
+		if next != nil {
+			return next(conn)
+		}
+		return nil
+	}
+}
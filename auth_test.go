@@ -0,0 +1,184 @@
+package mongonet
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// scramUpstream is a server which authenticates clients with SCRAM-SHA-256 like mongod
+type scramUpstream struct {
+	store *MapCredentialStore
+
+	lock  sync.Mutex
+	users []string // who ran each command other than authentication and the handshake
+}
+
+func (su *scramUpstream) CreateWorker(session *Session) (ServerWorker, error) {
+	return &scramUpstreamSession{su, session, nil, ""}, nil
+}
+
+func (su *scramUpstream) GetConnection(conn net.Conn) io.ReadWriteCloser {
+	return conn
+}
+
+func (su *scramUpstream) takeUsers() []string {
+	su.lock.Lock()
+	defer su.lock.Unlock()
+	res := su.users
+	su.users = nil
+	return res
+}
+
+type scramUpstreamSession struct {
+	upstream *scramUpstream
+	session  *Session
+	scram    *scramServerConversation
+	user     string
+}
+
+func (sus *scramUpstreamSession) run(db string, cmd bson.D) bson.D {
+	switch CommandName(cmd) {
+	case "isMaster", "hello":
+		return bson.D{{"ismaster", true}, {"maxWireVersion", 8}, {"saslSupportedMechs", []string{"SCRAM-SHA-1"}}}
+	case "saslStart":
+		sus.scram = newScramServerConversation(sus.upstream.store, db)
+	case "saslContinue":
+	default:
+		sus.upstream.lock.Lock()
+		sus.upstream.users = append(sus.upstream.users, sus.user)
+		sus.upstream.lock.Unlock()
+		return bson.D{}
+	}
+
+	payload, err := saslPayload(cmd)
+	if err != nil || sus.scram == nil {
+		return bson.D{{"ok", 0}, {"code", 17}, {"codeName", "ProtocolError"}}
+	}
+	resp, done, err := sus.scram.Step(payload)
+	if err != nil {
+		return bson.D{{"ok", 0}, {"code", 18}, {"codeName", "AuthenticationFailed"}}
+	}
+	if done {
+		sus.user = sus.scram.username
+	}
+	return bson.D{{"conversationId", 1}, {"done", done}, {"payload", resp}}
+}
+
+func (sus *scramUpstreamSession) DoLoopTemp() {
+	for {
+		m, err := sus.session.ReadMessage()
+		if err != nil {
+			return
+		}
+		db, cmd, err := GetCommand(m)
+		if err != nil {
+			return
+		}
+		doc := sus.run(db, cmd)
+		if BSONIndexOf(doc, "ok") < 0 {
+			doc = append(doc, bson.DocElem{"ok", 1})
+		}
+		raw, err := SimpleBSONConvert(doc)
+		if err != nil {
+			panic(err)
+		}
+		if err = sus.session.RespondToCommand(m, raw); err != nil {
+			return
+		}
+	}
+}
+
+func (sus *scramUpstreamSession) Close() {
+}
+
+func TestClientAuthentication(test *testing.T) {
+	upstream := &scramUpstream{store: NewMapCredentialStore()}
+	if err := upstream.store.AddUser("admin", "proxy", "service"); err != nil {
+		test.Fatal(err)
+	}
+	server := NewServer(
+		ServerConfig{"127.0.0.1", 9958, false, nil, NewSyncTlsConfig(), 0, 0, nil, slogger.OFF, nil},
+		upstream,
+	)
+	go server.Run()
+	defer server.Close()
+	if err := <-server.InitChannel(); err != nil {
+		test.Fatalf("cannot start upstream: %s", err)
+	}
+
+	clients := NewMapCredentialStore()
+	if err := clients.AddUser("admin", "alice", "secret"); err != nil {
+		test.Fatal(err)
+	}
+	pc := NewProxyConfig("127.0.0.1", 9959, "127.0.0.1", 9958)
+	pc.ClientCredentials = clients
+	pc.MongoUser = "proxy"
+	pc.MongoPassword = "service"
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9959")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+
+	unauthorized := func(when string) {
+		_, err := RunCommand(conn, "test", bson.D{{"find", "foo"}})
+		if me, ok := err.(MongoError); !ok || me.Code() != 13 {
+			test.Errorf("find %s should fail with Unauthorized, got %v", when, err)
+		}
+	}
+	unauthorized("before authenticating")
+
+	// the mechanisms come from the proxy's users, not the upstream's
+	for _, c := range []struct {
+		user  string
+		mechs []interface{}
+	}{
+		{"admin.alice", []interface{}{ScramSHA256}},
+		{"admin.bob", nil},
+	} {
+		res, err := RunCommand(conn, "admin", bson.D{{"hello", 1}, {"saslSupportedMechs", c.user}})
+		if err != nil {
+			test.Fatal(err)
+		}
+		var mechs []interface{}
+		if idx := BSONIndexOf(res, "saslSupportedMechs"); idx >= 0 {
+			mechs, _ = res[idx].Value.([]interface{})
+		}
+		if len(mechs) != len(c.mechs) || (len(mechs) > 0 && mechs[0] != c.mechs[0]) {
+			test.Errorf("wrong saslSupportedMechs for %s: %v", c.user, res)
+		}
+	}
+
+	if err = ScramSHA256Authenticate(conn, "admin", "alice", "wrong"); err == nil {
+		test.Errorf("a wrong password should not authenticate")
+	}
+	unauthorized("after a failed authentication")
+
+	if err = ScramSHA256Authenticate(conn, "admin", "alice", "secret"); err != nil {
+		test.Fatalf("authentication failed: %s", err)
+	}
+	if _, err = RunCommand(conn, "test", bson.D{{"find", "foo"}}); err != nil {
+		test.Fatalf("find after authenticating failed: %s", err)
+	}
+	if got := upstream.takeUsers(); len(got) != 1 || got[0] != "proxy" {
+		test.Errorf("the find should have run upstream as the proxy's user, got %v", got)
+	}
+
+	if _, err = RunCommand(conn, "admin", bson.D{{"logout", 1}}); err != nil {
+		test.Fatal(err)
+	}
+	unauthorized("after logging out")
+}
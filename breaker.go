@@ -0,0 +1,118 @@
+package mongonet
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // requests go through
+	BreakerOpen                         // requests fail right away while a probe checks the server
+	BreakerHalfOpen                     // the probe succeeded, the next request decides
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker stops sending requests to a server after consecutive dial or IO failures.
+// While it is open a background probe checks the server, once that succeeds the breaker
+// goes half-open and lets requests through again; their outcome closes or reopens it.
+type CircuitBreaker struct {
+	threshold     int
+	probeInterval time.Duration
+	probe         func() error
+
+	lock     sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	lastErr  error
+	stop     chan struct{}
+}
+
+func NewCircuitBreaker(threshold int, probeInterval time.Duration, probe func() error) *CircuitBreaker {
+	return &CircuitBreaker{threshold, probeInterval, probe, sync.Mutex{}, BreakerClosed, 0, time.Time{}, nil, make(chan struct{})}
+}
+
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.state
+}
+
+// Allow returns an error if requests must not be sent
+func (cb *CircuitBreaker) Allow() error {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.state != BreakerOpen {
+		return nil
+	}
+	return fmt.Errorf("circuit breaker open since %s: %v", cb.openedAt.Format(time.RFC3339), cb.lastErr)
+}
+
+func (cb *CircuitBreaker) Success() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.failures = 0
+	if cb.state == BreakerHalfOpen {
+		cb.state = BreakerClosed
+	}
+}
+
+func (cb *CircuitBreaker) Failure(err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	cb.failures++
+	cb.lastErr = err
+	if cb.state == BreakerOpen {
+		return
+	}
+	if cb.state == BreakerHalfOpen || cb.failures >= cb.threshold {
+		cb.state = BreakerOpen
+		cb.openedAt = time.Now()
+		go cb.runProbe()
+	}
+}
+
+// Close stops a running probe
+func (cb *CircuitBreaker) Close() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	select {
+	case <-cb.stop:
+	default:
+		close(cb.stop)
+	}
+}
+
+func (cb *CircuitBreaker) runProbe() {
+	for {
+		select {
+		case <-cb.stop:
+			return
+		case <-time.After(cb.probeInterval):
+		}
+
+		err := cb.probe()
+
+		cb.lock.Lock()
+		if err == nil {
+			cb.state = BreakerHalfOpen
+			cb.lock.Unlock()
+			return
+		}
+		cb.lastErr = err
+		cb.lock.Unlock()
+	}
+}
@@ -0,0 +1,142 @@
+package mongonet
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCircuitBreakerStates(test *testing.T) {
+	var serverUp int32
+	cb := NewCircuitBreaker(2, 10*time.Millisecond, func() error {
+		if atomic.LoadInt32(&serverUp) == 0 {
+			return fmt.Errorf("still down")
+		}
+		return nil
+	})
+	defer cb.Close()
+
+	cb.Failure(fmt.Errorf("boom"))
+	if cb.State() != BreakerClosed || cb.Allow() != nil {
+		test.Errorf("one failure should not open the breaker")
+	}
+	cb.Success()
+	cb.Failure(fmt.Errorf("boom"))
+	if cb.State() != BreakerClosed {
+		test.Errorf("a success should reset the failures")
+	}
+	cb.Failure(fmt.Errorf("boom"))
+	if cb.State() != BreakerOpen || cb.Allow() == nil {
+		test.Fatalf("two failures in a row should open the breaker")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if cb.State() != BreakerOpen {
+		test.Errorf("failing probes should keep the breaker open")
+	}
+
+	atomic.StoreInt32(&serverUp, 1)
+	waitForState := func(state BreakerState) {
+		for i := 0; i < 100 && cb.State() != state; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if cb.State() != state {
+			test.Fatalf("breaker should be %s, is %s", state, cb.State())
+		}
+	}
+	waitForState(BreakerHalfOpen)
+
+	// a failure while half-open reopens right away
+	cb.Failure(fmt.Errorf("boom"))
+	if cb.State() != BreakerOpen {
+		test.Errorf("failure while half open should reopen")
+	}
+	waitForState(BreakerHalfOpen)
+	cb.Success()
+	if cb.State() != BreakerClosed {
+		test.Errorf("success while half open should close")
+	}
+}
+
+func TestProxyFailsFastWhenMongoIsDown(test *testing.T) {
+	// nothing listens on 9961
+	pc := NewProxyConfig("127.0.0.1", 9962, "127.0.0.1", 9961)
+	pc.CircuitBreakerThreshold = 1
+	pc.CircuitBreakerProbeInterval = time.Hour
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9962")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err = RunCommand(conn, "admin", bson.D{{"ping", 1}})
+		me, ok := err.(MongoError)
+		if !ok || me.code != 6 {
+			test.Fatalf("expected HostUnreachable, got %v", err)
+		}
+		if i == 1 && !strings.Contains(me.err.Error(), "circuit breaker open") {
+			test.Errorf("second ping should be answered by the open breaker: %s", me)
+		}
+	}
+
+	if proxy.connPool.Breaker().State() != BreakerOpen {
+		test.Errorf("breaker should be open")
+	}
+}
+
+func TestProxyFailsFastWhenHookFails(test *testing.T) {
+	shard := startTestShard(test, 9963)
+	defer shard.server.Close()
+
+	pc := NewProxyConfig("127.0.0.1", 9964, "127.0.0.1", 9963)
+	pc.ConnectionPoolHook = func(conn net.Conn) error { return fmt.Errorf("bad credentials") }
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9964")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+
+	_, err = RunCommand(conn, "admin", bson.D{{"ping", 1}})
+	if me, ok := err.(MongoError); !ok || me.code != 6 || !strings.Contains(me.err.Error(), "bad credentials") {
+		test.Fatalf("expected HostUnreachable, got %v", err)
+	}
+
+	// the client stays connected, legacy reads get $err with the QueryFailure flag
+	query := NewQueryMessage("test.foo", 0, 0, 0, SimpleBSONConvertOrPanic(bson.D{}), SimpleBSONEmpty())
+	if err = SendMessage(query, conn); err != nil {
+		test.Fatal(err)
+	}
+	resp, err := ReadMessage(conn)
+	if err != nil {
+		test.Fatalf("the client should still be connected: %s", err)
+	}
+	rm, ok := resp.(*ReplyMessage)
+	if !ok || rm.Flags&2 == 0 || len(rm.Docs) != 1 {
+		test.Fatalf("expected a QueryFailure reply, got %v", resp)
+	}
+	if doc, _ := rm.Docs[0].ToBSOND(); BSONIndexOf(doc, "$err") < 0 || BSONIndexOf(doc, "ok") >= 0 {
+		test.Errorf("expected $err, got %v", doc)
+	}
+}
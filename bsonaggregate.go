@@ -0,0 +1,1047 @@
+package mongonet
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BSONLookup returns the documents of another collection for $lookup
+type BSONLookup func(collection string) ([]bson.D, error)
+
+// BSONPipeline is a compiled aggregation pipeline, see CompileBSONPipeline
+type BSONPipeline struct {
+	pipeline []bson.D
+	stages   []pipelineStage
+}
+
+type pipelineStage func(docs []bson.D) ([]bson.D, error)
+
+func pipelineError(code int, format string, args ...interface{}) MongoError {
+	return NewMongoError(fmt.Errorf(format, args...), code, fmt.Sprintf("Location%d", code))
+}
+
+func newFailedToParseError(format string, args ...interface{}) MongoError {
+	return NewMongoError(fmt.Errorf(format, args...), 9, "FailedToParse")
+}
+
+// CompileBSONPipeline compiles the pipeline of an aggregate command. It knows $match, $project,
+// $addFields/$set, $unset, $unwind, $group, $sort, $skip, $limit, $count and $lookup, which
+// reads the other collections through lookup. Expressions cover field paths, arithmetic,
+// comparisons, $cond/$ifNull and a few string and array operators.
+func CompileBSONPipeline(pipeline []bson.D, lookup BSONLookup) (*BSONPipeline, error) {
+	bp := &BSONPipeline{pipeline, make([]pipelineStage, 0, len(pipeline))}
+	for _, spec := range pipeline {
+		if len(spec) != 1 {
+			return nil, pipelineError(40323, "A pipeline stage specification object must contain exactly one field.")
+		}
+		stage, err := compileStage(spec[0], lookup)
+		if err != nil {
+			return nil, err
+		}
+		bp.stages = append(bp.stages, stage)
+	}
+	return bp, nil
+}
+
+// Run runs the pipeline over docs, the results are ready for NewSliceCursorSource to page
+func (bp *BSONPipeline) Run(docs []bson.D) ([]bson.D, error) {
+	var err error
+	for _, stage := range bp.stages {
+		if docs, err = stage(docs); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// BSONAggregate compiles pipeline and runs it over docs
+func BSONAggregate(docs []bson.D, pipeline []bson.D, lookup BSONLookup) ([]bson.D, error) {
+	bp, err := CompileBSONPipeline(pipeline, lookup)
+	if err != nil {
+		return nil, err
+	}
+	return bp.Run(docs)
+}
+
+func compileStage(stage bson.DocElem, lookup BSONLookup) (pipelineStage, error) {
+	switch stage.Name {
+	case "$match":
+		filter, ok := stage.Value.(bson.D)
+		if !ok {
+			return nil, pipelineError(15959, "the match filter must be an expression in an object")
+		}
+		matcher, err := CompileBSONFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		return func(docs []bson.D) ([]bson.D, error) {
+			res := []bson.D{}
+			for _, doc := range docs {
+				if matcher.Matches(doc) {
+					res = append(res, doc)
+				}
+			}
+			return res, nil
+		}, nil
+
+	case "$project", "$unset":
+		p, err := compileProjectStage(stage)
+		if err != nil {
+			return nil, err
+		}
+		return mapStage(p.apply), nil
+
+	case "$addFields", "$set":
+		spec, ok := stage.Value.(bson.D)
+		if !ok {
+			return nil, pipelineError(40272, "%s specification stage must be an object, got %s", stage.Name, bsonTypeName(stage.Value))
+		}
+		fields := make([]computedField, 0, len(spec))
+		for _, elem := range spec {
+			expr, err := compileExpr(elem.Value)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, computedField{elem.Name, expr})
+		}
+		return mapStage(func(doc bson.D) (bson.D, error) { return addFields(doc, doc, fields) }), nil
+
+	case "$unwind":
+		return compileUnwind(stage.Value)
+
+	case "$group":
+		return compileGroup(stage.Value)
+
+	case "$sort":
+		spec, ok := stage.Value.(bson.D)
+		if !ok || len(spec) == 0 {
+			return nil, pipelineError(15976, "$sort stage must have at least one sort key")
+		}
+		for _, elem := range spec {
+			if dir, ok := BSONNumber(elem.Value); ok && (dir == 1 || dir == -1) {
+				continue
+			}
+			if meta, ok := elem.Value.(bson.D); ok && BSONIndexOf(meta, "$meta") == 0 {
+				continue
+			}
+			return nil, pipelineError(15974, "Illegal key in $sort specification: %s: %v", elem.Name, elem.Value)
+		}
+		return func(docs []bson.D) ([]bson.D, error) {
+			res := append([]bson.D{}, docs...)
+			sort.SliceStable(res, func(i, j int) bool { return BSONCompareBySort(res[i], res[j], spec) < 0 })
+			return res, nil
+		}, nil
+
+	case "$skip", "$limit":
+		n, ok := bsonIntegral(stage.Value)
+		if !ok || n < 0 || (n == 0 && stage.Name == "$limit") {
+			return nil, pipelineError(15956, "invalid argument to %s stage: %v", stage.Name, stage.Value)
+		}
+		return func(docs []bson.D) ([]bson.D, error) {
+			if stage.Name == "$skip" {
+				if n >= len(docs) {
+					return []bson.D{}, nil
+				}
+				return docs[n:], nil
+			}
+			if n < len(docs) {
+				return docs[:n], nil
+			}
+			return docs, nil
+		}, nil
+
+	case "$count":
+		field, ok := stage.Value.(string)
+		if !ok || field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+			return nil, pipelineError(40156, "the count field must be a non-empty string without '$' or '.', got %v", stage.Value)
+		}
+		return func(docs []bson.D) ([]bson.D, error) {
+			if len(docs) == 0 {
+				return []bson.D{}, nil
+			}
+			return []bson.D{{{field, len(docs)}}}, nil
+		}, nil
+
+	case "$lookup":
+		return compileLookup(stage.Value, lookup)
+	}
+	return nil, pipelineError(40324, "Unrecognized pipeline stage name: '%s'", stage.Name)
+}
+
+func mapStage(fn func(doc bson.D) (bson.D, error)) pipelineStage {
+	return func(docs []bson.D) ([]bson.D, error) {
+		res := make([]bson.D, len(docs))
+		for i, doc := range docs {
+			var err error
+			if res[i], err = fn(doc); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+}
+
+// ---
+
+type computedField struct {
+	path string
+	expr bsonExpr
+}
+
+// addFields sets the computed fields of root on doc, a missing value like $$REMOVE removes the field
+func addFields(doc bson.D, root bson.D, fields []computedField) (bson.D, error) {
+	for _, field := range fields {
+		v, exists, err := field.expr(root)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			doc, err = BSONUnsetPath(doc, field.path)
+		} else {
+			doc, err = BSONSetPath(doc, field.path, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// projection is a compiled $project or $unset: the paths it keeps or removes and the fields it computes
+type projection struct {
+	exclude  bool
+	paths    [][]string
+	computed []computedField
+}
+
+// flattenProjection turns {a: {b: 1}} into {"a.b": 1}, leaving expressions alone
+func flattenProjection(spec bson.D, prefix string, out *bson.D) error {
+	for _, elem := range spec {
+		name := prefix + elem.Name
+		if sub, ok := elem.Value.(bson.D); ok && !isOperatorDoc(sub) {
+			if len(sub) == 0 {
+				return pipelineError(51270, "An empty sub-projection is not a valid value. Found empty object at path %s", name)
+			}
+			if err := flattenProjection(sub, name+".", out); err != nil {
+				return err
+			}
+			continue
+		}
+		*out = append(*out, bson.DocElem{name, elem.Value})
+	}
+	return nil
+}
+
+func compileProjectStage(stage bson.DocElem) (*projection, error) {
+	if stage.Name == "$unset" {
+		names := []interface{}{stage.Value}
+		if arr, ok := bsonArrayValue(stage.Value); ok {
+			names = arr
+		}
+		p := &projection{true, nil, nil}
+		for _, name := range names {
+			s, ok := name.(string)
+			if !ok || s == "" {
+				return nil, pipelineError(31120, "$unset specification must be a string or an array containing only string values")
+			}
+			p.paths = append(p.paths, strings.Split(s, "."))
+		}
+		return p, nil
+	}
+
+	spec, ok := stage.Value.(bson.D)
+	if !ok || len(spec) == 0 {
+		return nil, pipelineError(40177, "$project specification must be a non-empty object")
+	}
+	flat := bson.D{}
+	if err := flattenProjection(spec, "", &flat); err != nil {
+		return nil, err
+	}
+
+	p := &projection{}
+	var included, excluded []string
+	keepId := true
+	for _, elem := range flat {
+		_, isBool := elem.Value.(bool)
+		_, isNumber := BSONNumber(elem.Value)
+		switch {
+		case !isBool && !isNumber:
+			expr, err := compileExpr(elem.Value)
+			if err != nil {
+				return nil, err
+			}
+			p.computed = append(p.computed, computedField{elem.Name, expr})
+			included = append(included, elem.Name)
+			continue
+		case elem.Name == "_id":
+			keepId = bsonTruthy(elem.Value)
+			continue
+		case bsonTruthy(elem.Value):
+			included = append(included, elem.Name)
+		default:
+			excluded = append(excluded, elem.Name)
+		}
+		p.paths = append(p.paths, strings.Split(elem.Name, "."))
+	}
+
+	switch {
+	case len(included) > 0 && len(excluded) > 0:
+		return nil, pipelineError(31254, "Invalid $project :: caused by :: Cannot do exclusion on field %s in inclusion projection", excluded[0])
+	case len(included) == 0:
+		p.exclude = true
+		if !keepId {
+			p.paths = append(p.paths, []string{"_id"})
+		}
+	case keepId:
+		p.paths = append(p.paths, []string{"_id"})
+	}
+	return p, nil
+}
+
+func (p *projection) apply(doc bson.D) (bson.D, error) {
+	var res bson.D
+	if p.exclude {
+		res = excludePaths(doc, p.paths).(bson.D)
+	} else {
+		res = includePaths(doc, p.paths).(bson.D)
+	}
+	return addFields(res, doc, p.computed)
+}
+
+// splitPaths returns whether paths has name itself, and the rest of the paths below name
+func splitPaths(paths [][]string, name string) (bool, [][]string) {
+	whole := false
+	sub := [][]string{}
+	for _, path := range paths {
+		if path[0] != name {
+			continue
+		}
+		if len(path) == 1 {
+			whole = true
+		} else {
+			sub = append(sub, path[1:])
+		}
+	}
+	return whole, sub
+}
+
+func isContainer(v interface{}) bool {
+	_, isArray := bsonArrayValue(v)
+	return isArray || bsonDocValue(v) != nil
+}
+
+// includePaths keeps the paths of a document, or of the documents of an array
+func includePaths(v interface{}, paths [][]string) interface{} {
+	if arr, ok := bsonArrayValue(v); ok {
+		res := []interface{}{}
+		for _, elem := range arr {
+			if isContainer(elem) {
+				res = append(res, includePaths(elem, paths))
+			}
+		}
+		return res
+	}
+	res := bson.D{}
+	for _, elem := range bsonDocValue(v) {
+		whole, sub := splitPaths(paths, elem.Name)
+		if whole {
+			res = append(res, elem)
+		} else if len(sub) > 0 && isContainer(elem.Value) {
+			res = append(res, bson.DocElem{elem.Name, includePaths(elem.Value, sub)})
+		}
+	}
+	return res
+}
+
+// excludePaths removes the paths of a document, or of the documents of an array
+func excludePaths(v interface{}, paths [][]string) interface{} {
+	if arr, ok := bsonArrayValue(v); ok {
+		res := make([]interface{}, len(arr))
+		for i, elem := range arr {
+			res[i] = elem
+			if isContainer(elem) {
+				res[i] = excludePaths(elem, paths)
+			}
+		}
+		return res
+	}
+	res := bson.D{}
+	for _, elem := range bsonDocValue(v) {
+		whole, sub := splitPaths(paths, elem.Name)
+		switch {
+		case whole:
+		case len(sub) > 0 && isContainer(elem.Value):
+			res = append(res, bson.DocElem{elem.Name, excludePaths(elem.Value, sub)})
+		default:
+			res = append(res, elem)
+		}
+	}
+	return res
+}
+
+// ---
+
+func compileUnwind(v interface{}) (pipelineStage, error) {
+	path, indexField, preserve := "", "", false
+	switch spec := v.(type) {
+	case string:
+		path = spec
+	case bson.D:
+		for _, elem := range spec {
+			var ok bool
+			switch elem.Name {
+			case "path":
+				path, _ = elem.Value.(string)
+			case "includeArrayIndex":
+				if indexField, ok = elem.Value.(string); !ok || indexField == "" || strings.HasPrefix(indexField, "$") {
+					return nil, pipelineError(28822, "includeArrayIndex option to $unwind stage should be a non-empty string not starting with $, got %v", elem.Value)
+				}
+			case "preserveNullAndEmptyArrays":
+				if preserve, ok = elem.Value.(bool); !ok {
+					return nil, pipelineError(28809, "expected a boolean for the preserveNullAndEmptyArrays option to $unwind stage, got %s", bsonTypeName(elem.Value))
+				}
+			default:
+				return nil, pipelineError(28811, "unrecognized option to $unwind stage: %s", elem.Name)
+			}
+		}
+	default:
+		return nil, pipelineError(15981, "expected either a string or an object as specification for $unwind stage, got %s", bsonTypeName(v))
+	}
+	if !strings.HasPrefix(path, "$") || len(path) < 2 {
+		return nil, pipelineError(28818, "path option to $unwind stage should be prefixed with a '$': %s", path)
+	}
+	path = path[1:]
+
+	return func(docs []bson.D) ([]bson.D, error) {
+		res := []bson.D{}
+		for _, doc := range docs {
+			value, exists := BSONGetPath(doc, path)
+			arr, isArray := bsonArrayValue(value)
+			if exists && value != nil && !isArray {
+				arr, isArray = []interface{}{value}, false
+			}
+			if len(arr) == 0 {
+				if preserve {
+					out := doc
+					if indexField != "" {
+						out = append(append(bson.D{}, doc...), bson.DocElem{indexField, nil})
+					}
+					res = append(res, out)
+				}
+				continue
+			}
+			for i, elem := range arr {
+				out, err := BSONSetPath(doc, path, elem)
+				if err != nil {
+					return nil, err
+				}
+				if indexField != "" {
+					var index interface{}
+					if isArray {
+						index = int64(i)
+					}
+					if out, err = BSONSetPath(out, indexField, index); err != nil {
+						return nil, err
+					}
+				}
+				res = append(res, out)
+			}
+		}
+		return res, nil
+	}, nil
+}
+
+// ---
+
+// missingValue marks a missing field among the values an accumulator collected or a filter path reached
+type missingValue struct{}
+
+type accumulator struct {
+	name string
+	op   string
+	expr bsonExpr
+}
+
+var accumulatorOps = map[string]bool{
+	"$sum": true, "$avg": true, "$min": true, "$max": true, "$first": true, "$last": true,
+	"$push": true, "$addToSet": true, "$count": true,
+}
+
+func compileGroup(v interface{}) (pipelineStage, error) {
+	spec, ok := v.(bson.D)
+	if !ok {
+		return nil, pipelineError(15947, "a group's fields must be specified in an object")
+	}
+	idIdx := BSONIndexOf(spec, "_id")
+	if idIdx < 0 {
+		return nil, pipelineError(15955, "a group specification must include an _id")
+	}
+	idExpr, err := compileExpr(spec[idIdx].Value)
+	if err != nil {
+		return nil, err
+	}
+
+	accs := []accumulator{}
+	for _, elem := range spec {
+		if elem.Name == "_id" {
+			continue
+		}
+		if strings.Contains(elem.Name, ".") {
+			return nil, pipelineError(40235, "The field name '%s' cannot contain '.'", elem.Name)
+		}
+		acc, ok := elem.Value.(bson.D)
+		if !ok || len(acc) != 1 {
+			return nil, pipelineError(40234, "The field '%s' must be an accumulator object", elem.Name)
+		}
+		if !accumulatorOps[acc[0].Name] {
+			return nil, pipelineError(15952, "unknown group operator '%s'", acc[0].Name)
+		}
+		arg := acc[0].Value
+		if acc[0].Name == "$count" {
+			arg = 1
+		}
+		expr, err := compileExpr(arg)
+		if err != nil {
+			return nil, err
+		}
+		accs = append(accs, accumulator{elem.Name, acc[0].Name, expr})
+	}
+
+	return func(docs []bson.D) ([]bson.D, error) {
+		// groups in the order their first document came in
+		ids := []interface{}{}
+		values := [][][]interface{}{}
+		for _, doc := range docs {
+			id, _, err := idExpr(doc)
+			if err != nil {
+				return nil, err
+			}
+			g := 0
+			for g < len(ids) && BSONCompare(ids[g], id) != 0 {
+				g++
+			}
+			if g == len(ids) {
+				ids = append(ids, id)
+				values = append(values, make([][]interface{}, len(accs)))
+			}
+			for i, acc := range accs {
+				v, exists, err := acc.expr(doc)
+				if err != nil {
+					return nil, err
+				}
+				if !exists {
+					v = missingValue{}
+				}
+				values[g][i] = append(values[g][i], v)
+			}
+		}
+
+		res := make([]bson.D, len(ids))
+		for g, id := range ids {
+			out := bson.D{{"_id", id}}
+			for i, acc := range accs {
+				out = append(out, bson.DocElem{acc.name, accumulate(acc.op, values[g][i])})
+			}
+			res[g] = out
+		}
+		return res, nil
+	}, nil
+}
+
+func accumulate(op string, values []interface{}) interface{} {
+	present := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		if _, missing := v.(missingValue); !missing {
+			present = append(present, v)
+		}
+	}
+
+	switch op {
+	case "$sum", "$count", "$avg":
+		var sum interface{} = 0
+		n := 0
+		for _, v := range present {
+			if _, ok := BSONNumber(v); ok {
+				sum, _ = bsonArithmetic(sum, v, false)
+				n++
+			}
+		}
+		if op != "$avg" {
+			return sum
+		}
+		if n == 0 {
+			return nil
+		}
+		f, _ := BSONNumber(sum)
+		return f / float64(n)
+	case "$min", "$max":
+		var best interface{}
+		for _, v := range present {
+			if v == nil {
+				continue
+			}
+			c := BSONCompare(v, best)
+			if best == nil || (op == "$min" && c < 0) || (op == "$max" && c > 0) {
+				best = v
+			}
+		}
+		return best
+	case "$first", "$last":
+		if len(values) == 0 {
+			return nil
+		}
+		v := values[0]
+		if op == "$last" {
+			v = values[len(values)-1]
+		}
+		if _, missing := v.(missingValue); missing {
+			return nil
+		}
+		return v
+	case "$push":
+		return present
+	}
+	// $addToSet
+	res := []interface{}{}
+	for _, v := range present {
+		if !containsValue(res, v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// ---
+
+func compileLookup(v interface{}, lookup BSONLookup) (pipelineStage, error) {
+	spec, ok := v.(bson.D)
+	if !ok {
+		return nil, newFailedToParseError("the $lookup stage specification must be an object, but found %s", bsonTypeName(v))
+	}
+	var from, localField, foreignField, as string
+	var sub *BSONPipeline
+	for _, elem := range spec {
+		var s string
+		var isString bool
+		if s, isString = elem.Value.(string); !isString && elem.Name != "pipeline" {
+			return nil, newFailedToParseError("$lookup argument '%s: %v' must be a string", elem.Name, elem.Value)
+		}
+		switch elem.Name {
+		case "from":
+			from = s
+		case "localField":
+			localField = s
+		case "foreignField":
+			foreignField = s
+		case "as":
+			as = s
+		case "pipeline":
+			stages, _, err := GetAsBSONDocs(elem)
+			if err != nil {
+				return nil, newFailedToParseError("$lookup pipeline must be an array of objects")
+			}
+			if sub, err = CompileBSONPipeline(stages, lookup); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, newFailedToParseError("unknown argument to $lookup: %s", elem.Name)
+		}
+	}
+	switch {
+	case from == "":
+		return nil, newFailedToParseError("must specify 'from' field for a $lookup")
+	case as == "":
+		return nil, newFailedToParseError("must specify 'as' field for a $lookup")
+	case (localField == "") != (foreignField == ""):
+		return nil, newFailedToParseError("$lookup requires both or neither of 'localField' and 'foreignField' to be specified")
+	case localField == "" && sub == nil:
+		return nil, newFailedToParseError("$lookup requires either 'pipeline' or both 'localField' and 'foreignField' to be specified")
+	case lookup == nil:
+		return nil, newBadValueError("$lookup needs a way to read the documents of %s", from)
+	}
+
+	return func(docs []bson.D) ([]bson.D, error) {
+		foreign, err := lookup(from)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]bson.D, len(docs))
+		for i, doc := range docs {
+			matches := foreign
+			if localField != "" {
+				// like mongod, an array local field matches any of its elements and a missing one matches null
+				local, exists := BSONGetPath(doc, localField)
+				locals, isArray := bsonArrayValue(local)
+				if !isArray || !exists {
+					locals = []interface{}{local}
+				}
+				matcher, err := CompileBSONFilter(bson.D{{foreignField, bson.D{{"$in", locals}}}})
+				if err != nil {
+					return nil, err
+				}
+				matches = []bson.D{}
+				for _, f := range foreign {
+					if matcher.Matches(f) {
+						matches = append(matches, f)
+					}
+				}
+			}
+			if sub != nil {
+				if matches, err = sub.Run(matches); err != nil {
+					return nil, err
+				}
+			}
+			joined := make([]interface{}, len(matches))
+			for j, m := range matches {
+				joined[j] = m
+			}
+			if res[i], err = BSONSetPath(doc, as, joined); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}, nil
+}
+
+// ---
+
+// bsonExpr evaluates an aggregation expression against a document, exists is false for a missing value
+type bsonExpr func(doc bson.D) (value interface{}, exists bool, err error)
+
+func constExpr(v interface{}) bsonExpr {
+	return func(bson.D) (interface{}, bool, error) { return v, true, nil }
+}
+
+// compileExpr compiles a field path like "$a.b", a variable like "$$ROOT", an operator
+// expression like {$add: ["$a", 1]}, or a literal, documents and arrays of those
+func compileExpr(v interface{}) (bsonExpr, error) {
+	switch val := v.(type) {
+	case string:
+		if strings.HasPrefix(val, "$$") {
+			name := strings.SplitN(val[2:], ".", 2)
+			switch name[0] {
+			case "REMOVE":
+				return func(bson.D) (interface{}, bool, error) { return nil, false, nil }, nil
+			case "ROOT", "CURRENT":
+				if len(name) == 1 {
+					return func(doc bson.D) (interface{}, bool, error) { return doc, true, nil }, nil
+				}
+				return fieldPathExpr(name[1]), nil
+			}
+			return nil, pipelineError(17276, "Use of undefined variable: %s", name[0])
+		}
+		if strings.HasPrefix(val, "$") {
+			if len(val) == 1 {
+				return nil, pipelineError(16872, "'$' by itself is not a valid FieldPath")
+			}
+			return fieldPathExpr(val[1:]), nil
+		}
+	case bson.D:
+		if isOperatorDoc(val) {
+			if len(val) != 1 {
+				return nil, pipelineError(15983, "An object representing an expression must have exactly one field: %v", val)
+			}
+			return compileOperatorExpr(val[0].Name, val[0].Value)
+		}
+		fields := make([]bsonExpr, len(val))
+		for i, elem := range val {
+			var err error
+			if fields[i], err = compileExpr(elem.Value); err != nil {
+				return nil, err
+			}
+		}
+		return func(doc bson.D) (interface{}, bool, error) {
+			res := bson.D{}
+			for i, field := range fields {
+				v, exists, err := field(doc)
+				if err != nil {
+					return nil, false, err
+				}
+				if exists {
+					res = append(res, bson.DocElem{val[i].Name, v})
+				}
+			}
+			return res, true, nil
+		}, nil
+	case []interface{}:
+		items, err := compileExprs(val)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc bson.D) (interface{}, bool, error) {
+			res, err := evalExprs(items, doc)
+			return res, err == nil, err
+		}, nil
+	}
+	return constExpr(v), nil
+}
+
+func compileExprs(args []interface{}) ([]bsonExpr, error) {
+	exprs := make([]bsonExpr, len(args))
+	for i, arg := range args {
+		var err error
+		if exprs[i], err = compileExpr(arg); err != nil {
+			return nil, err
+		}
+	}
+	return exprs, nil
+}
+
+// evalExprs evaluates the arguments of an operator, missing values become null
+func evalExprs(exprs []bsonExpr, doc bson.D) ([]interface{}, error) {
+	res := make([]interface{}, len(exprs))
+	for i, expr := range exprs {
+		var err error
+		if res[i], _, err = expr(doc); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func fieldPathExpr(path string) bsonExpr {
+	pieces := strings.Split(path, ".")
+	return func(doc bson.D) (interface{}, bool, error) {
+		v, exists := exprPathValue(doc, pieces)
+		return v, exists, nil
+	}
+}
+
+// exprPathValue follows a field path the way expressions do: through an array it
+// collects the values of the path in each of its documents
+func exprPathValue(v interface{}, pieces []string) (interface{}, bool) {
+	if len(pieces) == 0 {
+		return v, true
+	}
+	if arr, ok := bsonArrayValue(v); ok {
+		res := []interface{}{}
+		for _, elem := range arr {
+			if sub, exists := exprPathValue(elem, pieces); exists {
+				res = append(res, sub)
+			}
+		}
+		return res, true
+	}
+	doc := bsonDocValue(v)
+	idx := BSONIndexOf(doc, pieces[0])
+	if idx < 0 {
+		return nil, false
+	}
+	return exprPathValue(doc[idx].Value, pieces[1:])
+}
+
+// exprArity is the number of arguments of the operators that take a fixed number, -1 for any
+var exprArity = map[string]int{
+	"$add": -1, "$multiply": -1, "$subtract": 2, "$divide": 2, "$mod": 2,
+	"$eq": 2, "$ne": 2, "$gt": 2, "$gte": 2, "$lt": 2, "$lte": 2, "$cmp": 2,
+	"$and": -1, "$or": -1, "$not": 1, "$cond": 3, "$ifNull": -1,
+	"$concat": -1, "$toLower": 1, "$toUpper": 1, "$size": 1, "$arrayElemAt": 2, "$in": 2,
+}
+
+func compileOperatorExpr(name string, arg interface{}) (bsonExpr, error) {
+	if name == "$literal" {
+		return constExpr(arg), nil
+	}
+	arity, ok := exprArity[name]
+	if !ok {
+		return nil, NewMongoError(fmt.Errorf("Unrecognized expression '%s'", name), 168, "InvalidPipelineOperator")
+	}
+	args, isArray := arg.([]interface{})
+	if !isArray {
+		args = []interface{}{arg}
+		if cond, ok := arg.(bson.D); ok && name == "$cond" {
+			args = make([]interface{}, 3)
+			for i, field := range []string{"if", "then", "else"} {
+				args[i], _ = BSONGetPath(cond, field)
+			}
+		}
+	}
+	if arity >= 0 && len(args) != arity {
+		return nil, pipelineError(16020, "Expression %s takes exactly %d arguments. %d were passed in.", name, arity, len(args))
+	}
+	if name == "$ifNull" && len(args) < 2 {
+		return nil, pipelineError(1257300, "$ifNull needs at least two arguments, had: %d", len(args))
+	}
+	exprs, err := compileExprs(args)
+	if err != nil {
+		return nil, err
+	}
+	return func(doc bson.D) (interface{}, bool, error) {
+		values, err := evalExprs(exprs, doc)
+		if err != nil {
+			return nil, false, err
+		}
+		res, err := evalOperator(name, values)
+		return res, err == nil, err
+	}, nil
+}
+
+func bsonNegate(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return -n
+	case int32:
+		return -n
+	case int64:
+		return -n
+	}
+	f, _ := BSONNumber(v)
+	return -f
+}
+
+func evalOperator(name string, args []interface{}) (interface{}, error) {
+	switch name {
+	case "$add", "$multiply", "$subtract":
+		for _, arg := range args {
+			if arg == nil {
+				return nil, nil
+			}
+			if _, ok := BSONNumber(arg); !ok {
+				return nil, pipelineError(16554, "%s only supports numeric types, not %s", name, bsonTypeName(arg))
+			}
+		}
+		if name == "$subtract" {
+			res, _ := bsonArithmetic(args[0], bsonNegate(args[1]), false)
+			return res, nil
+		}
+		var res interface{} = 0
+		if name == "$multiply" {
+			res = 1
+		}
+		for _, arg := range args {
+			res, _ = bsonArithmetic(res, arg, name == "$multiply")
+		}
+		return res, nil
+
+	case "$divide", "$mod":
+		if args[0] == nil || args[1] == nil {
+			return nil, nil
+		}
+		a, okA := BSONNumber(args[0])
+		b, okB := BSONNumber(args[1])
+		if !okA || !okB {
+			return nil, pipelineError(16609, "%s only supports numeric types, not %s and %s", name, bsonTypeName(args[0]), bsonTypeName(args[1]))
+		}
+		if b == 0 {
+			return nil, pipelineError(16608, "can't %s by zero", name)
+		}
+		if name == "$divide" {
+			return a / b, nil
+		}
+		_, floatA := args[0].(float64)
+		_, floatB := args[1].(float64)
+		if floatA || floatB {
+			return math.Mod(a, b), nil
+		}
+		n := int64(a) % int64(b)
+		_, longA := args[0].(int64)
+		_, longB := args[1].(int64)
+		if longA || longB {
+			return n, nil
+		}
+		return int(n), nil
+
+	case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$cmp":
+		c := BSONCompare(args[0], args[1])
+		switch name {
+		case "$eq":
+			return c == 0, nil
+		case "$ne":
+			return c != 0, nil
+		case "$gt":
+			return c > 0, nil
+		case "$gte":
+			return c >= 0, nil
+		case "$lt":
+			return c < 0, nil
+		case "$lte":
+			return c <= 0, nil
+		}
+		return c, nil
+
+	case "$and", "$or":
+		for _, arg := range args {
+			if bsonTruthy(arg) == (name == "$or") {
+				return name == "$or", nil
+			}
+		}
+		return name == "$and", nil
+	case "$not":
+		return !bsonTruthy(args[0]), nil
+	case "$cond":
+		if bsonTruthy(args[0]) {
+			return args[1], nil
+		}
+		return args[2], nil
+	case "$ifNull":
+		for _, arg := range args[:len(args)-1] {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return args[len(args)-1], nil
+
+	case "$concat":
+		res := ""
+		for _, arg := range args {
+			if arg == nil {
+				return nil, nil
+			}
+			s, ok := arg.(string)
+			if !ok {
+				return nil, pipelineError(16702, "$concat only supports strings, not %s", bsonTypeName(arg))
+			}
+			res += s
+		}
+		return res, nil
+	case "$toLower", "$toUpper":
+		if args[0] == nil {
+			return "", nil
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			s = fmt.Sprint(args[0])
+		}
+		if name == "$toLower" {
+			return strings.ToLower(s), nil
+		}
+		return strings.ToUpper(s), nil
+
+	case "$size":
+		arr, ok := bsonArrayValue(args[0])
+		if !ok {
+			return nil, pipelineError(17124, "The argument to $size must be an array. Type of input: %s", bsonTypeName(args[0]))
+		}
+		return len(arr), nil
+	case "$arrayElemAt":
+		if args[0] == nil || args[1] == nil {
+			return nil, nil
+		}
+		arr, ok := bsonArrayValue(args[0])
+		if !ok {
+			return nil, pipelineError(28689, "$arrayElemAt's first argument must be an array, but is %s", bsonTypeName(args[0]))
+		}
+		i, ok := bsonIntegral(args[1])
+		if !ok {
+			return nil, pipelineError(28691, "$arrayElemAt's second argument must be a numeric value, but is %s", bsonTypeName(args[1]))
+		}
+		if i < 0 {
+			i += len(arr)
+		}
+		if i < 0 || i >= len(arr) {
+			return nil, nil
+		}
+		return arr[i], nil
+	}
+
+	// $in
+	arr, ok := bsonArrayValue(args[1])
+	if !ok {
+		return nil, pipelineError(40081, "$in requires an array as a second argument, found: %s", bsonTypeName(args[1]))
+	}
+	return containsValue(arr, args[0]), nil
+}
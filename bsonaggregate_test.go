@@ -0,0 +1,170 @@
+package mongonet
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func aggregateOrders() []bson.D {
+	return []bson.D{
+		{{"_id", 1}, {"item", "abc"}, {"price", 10}, {"qty", 2}, {"tags", []interface{}{"a", "b"}}},
+		{{"_id", 2}, {"item", "jkl"}, {"price", 20}, {"qty", 1}, {"tags", []interface{}{"b"}}},
+		{{"_id", 3}, {"item", "abc"}, {"price", 10}, {"qty", 5}, {"tags", []interface{}{}}},
+		{{"_id", 4}, {"item", "xyz"}, {"price", 5.5}, {"qty", 10}},
+	}
+}
+
+func TestBSONAggregate(test *testing.T) {
+	tests := []struct {
+		pipeline []bson.D
+		want     []bson.D
+	}{
+		{
+			[]bson.D{{{"$match", bson.D{{"qty", bson.D{{"$gte", 2}}}}}}, {{"$sort", bson.D{{"qty", -1}}}}, {{"$skip", 1}}, {{"$limit", 1}}, {{"$project", bson.D{{"item", 1}}}}},
+			[]bson.D{{{"_id", 3}, {"item", "abc"}}},
+		},
+		{
+			[]bson.D{{{"$group", bson.D{
+				{"_id", "$item"},
+				{"total", bson.D{{"$sum", bson.D{{"$multiply", []interface{}{"$price", "$qty"}}}}}},
+				{"n", bson.D{{"$sum", 1}}},
+				{"avgQty", bson.D{{"$avg", "$qty"}}},
+				{"maxQty", bson.D{{"$max", "$qty"}}},
+				{"ids", bson.D{{"$push", "$_id"}}},
+			}}}},
+			[]bson.D{
+				{{"_id", "abc"}, {"total", 70}, {"n", 2}, {"avgQty", 3.5}, {"maxQty", 5}, {"ids", []interface{}{1, 3}}},
+				{{"_id", "jkl"}, {"total", 20}, {"n", 1}, {"avgQty", 1.0}, {"maxQty", 1}, {"ids", []interface{}{2}}},
+				{{"_id", "xyz"}, {"total", 55.0}, {"n", 1}, {"avgQty", 10.0}, {"maxQty", 10}, {"ids", []interface{}{4}}},
+			},
+		},
+		{
+			[]bson.D{{{"$unwind", "$tags"}}, {{"$group", bson.D{{"_id", nil}, {"tags", bson.D{{"$addToSet", "$tags"}}}, {"count", bson.D{{"$count", bson.D{}}}}}}}},
+			[]bson.D{{{"_id", nil}, {"tags", []interface{}{"a", "b"}}, {"count", 3}}},
+		},
+		{
+			[]bson.D{{{"$unwind", bson.D{{"path", "$tags"}, {"includeArrayIndex", "i"}, {"preserveNullAndEmptyArrays", true}}}}, {{"$project", bson.D{{"_id", 1}, {"i", 1}}}}},
+			[]bson.D{{{"_id", 1}, {"i", int64(0)}}, {{"_id", 1}, {"i", int64(1)}}, {{"_id", 2}, {"i", int64(0)}}, {{"_id", 3}, {"i", nil}}, {{"_id", 4}, {"i", nil}}},
+		},
+		{
+			[]bson.D{
+				{{"$match", bson.D{{"_id", 4}}}},
+				{{"$addFields", bson.D{{"total", bson.D{{"$multiply", []interface{}{"$price", "$qty"}}}}, {"info.cheap", bson.D{{"$lt", []interface{}{"$price", 10}}}}}}},
+				{{"$project", bson.D{{"_id", 0}, {"total", 1}, {"info", 1}, {"label", bson.D{{"$concat", []interface{}{"$item", "-", bson.D{{"$toUpper", "$item"}}}}}}}}},
+			},
+			[]bson.D{{{"total", 55.0}, {"info", bson.D{{"cheap", true}}}, {"label", "xyz-XYZ"}}},
+		},
+		{
+			[]bson.D{
+				{{"$match", bson.D{{"_id", 1}}}},
+				{{"$project", bson.D{
+					{"first", bson.D{{"$arrayElemAt", []interface{}{"$tags", 0}}}},
+					{"n", bson.D{{"$size", "$tags"}}},
+					{"big", bson.D{{"$cond", bson.D{{"if", bson.D{{"$gte", []interface{}{"$qty", 2}}}}, {"then", "yes"}, {"else", "no"}}}}},
+					{"none", bson.D{{"$ifNull", []interface{}{"$missing", "default"}}}},
+					{"gone", "$$REMOVE"},
+					{"diff", bson.D{{"$subtract", []interface{}{"$price", "$qty"}}}},
+				}}},
+				{{"$unset", "_id"}},
+			},
+			[]bson.D{{{"first", "a"}, {"n", 2}, {"big", "yes"}, {"none", "default"}, {"diff", 8}}},
+		},
+		{
+			[]bson.D{{{"$match", bson.D{{"item", "abc"}}}}, {{"$count", "n"}}},
+			[]bson.D{{{"n", 2}}},
+		},
+		{
+			[]bson.D{{{"$match", bson.D{{"item", "none"}}}}, {{"$count", "n"}}},
+			[]bson.D{},
+		},
+	}
+
+	for _, t := range tests {
+		got, err := BSONAggregate(aggregateOrders(), t.pipeline, nil)
+		if err != nil {
+			test.Errorf("%v failed: %s", t.pipeline, err)
+			continue
+		}
+		if BSONCompare(bsonArray(got), bsonArray(t.want)) != 0 {
+			test.Errorf("%v should give %v, got %v", t.pipeline, t.want, got)
+		}
+	}
+}
+
+func TestBSONAggregateLookup(test *testing.T) {
+	inventory := []bson.D{
+		{{"_id", 1}, {"sku", "abc"}, {"instock", 120}},
+		{{"_id", 2}, {"sku", "def"}, {"instock", 80}},
+		{{"_id", 3}, {"sku", "abc"}, {"instock", 60}},
+	}
+	lookup := func(collection string) ([]bson.D, error) {
+		if collection != "inventory" {
+			return nil, nil
+		}
+		return inventory, nil
+	}
+
+	pipeline := []bson.D{
+		{{"$lookup", bson.D{{"from", "inventory"}, {"localField", "item"}, {"foreignField", "sku"}, {"as", "stock"}}}},
+		{{"$project", bson.D{{"n", bson.D{{"$size", "$stock"}}}, {"instock", "$stock.instock"}}}},
+	}
+	got, err := BSONAggregate(aggregateOrders(), pipeline, lookup)
+	if err != nil {
+		test.Fatal(err)
+	}
+	want := []bson.D{
+		{{"_id", 1}, {"n", 2}, {"instock", []interface{}{120, 60}}},
+		{{"_id", 2}, {"n", 0}, {"instock", []interface{}{}}},
+		{{"_id", 3}, {"n", 2}, {"instock", []interface{}{120, 60}}},
+		{{"_id", 4}, {"n", 0}, {"instock", []interface{}{}}},
+	}
+	if BSONCompare(bsonArray(got), bsonArray(want)) != 0 {
+		test.Errorf("expected %v, got %v", want, got)
+	}
+
+	pipeline = []bson.D{
+		{{"$limit", 1}},
+		{{"$lookup", bson.D{{"from", "inventory"}, {"pipeline", []interface{}{bson.D{{"$match", bson.D{{"instock", bson.D{{"$lt", 100}}}}}}}}, {"as", "low"}}}},
+	}
+	if got, err = BSONAggregate(aggregateOrders(), pipeline, lookup); err != nil {
+		test.Fatal(err)
+	}
+	if low, _ := BSONGetPath(got[0], "low"); len(low.([]interface{})) != 2 {
+		test.Errorf("expected two low stock items, got %v", got)
+	}
+
+	if _, err = CompileBSONPipeline(pipeline, nil); err == nil {
+		test.Errorf("$lookup should need a way to read other collections")
+	}
+}
+
+func TestBSONAggregateErrors(test *testing.T) {
+	bad := []struct {
+		pipeline []bson.D
+		code     int
+	}{
+		{[]bson.D{{{"$match", bson.D{}}, {"$limit", 1}}}, 40323},
+		{[]bson.D{{{"$foo", 1}}}, 40324},
+		{[]bson.D{{{"$limit", 0}}}, 15956},
+		{[]bson.D{{{"$sort", bson.D{}}}}, 15976},
+		{[]bson.D{{{"$group", bson.D{{"n", bson.D{{"$sum", 1}}}}}}}, 15955},
+		{[]bson.D{{{"$group", bson.D{{"_id", nil}, {"n", bson.D{{"$median", 1}}}}}}}, 15952},
+		{[]bson.D{{{"$project", bson.D{{"a", 1}, {"b", 0}}}}}, 31254},
+		{[]bson.D{{{"$project", bson.D{{"a", bson.D{{"$foo", 1}}}}}}}, 168},
+		{[]bson.D{{{"$project", bson.D{{"a", bson.D{{"$size", []interface{}{1, 2}}}}}}}}, 16020},
+		{[]bson.D{{{"$unwind", "tags"}}}, 28818},
+		{[]bson.D{{{"$lookup", bson.D{{"from", "x"}}}}}, 9},
+	}
+	for _, t := range bad {
+		_, err := CompileBSONPipeline(t.pipeline, nil)
+		if me, ok := err.(MongoError); !ok || me.Code() != t.code {
+			test.Errorf("%v should fail with %d, got %v", t.pipeline, t.code, err)
+		}
+	}
+
+	runtime := []bson.D{{{"$project", bson.D{{"x", bson.D{{"$add", []interface{}{"$item", 1}}}}}}}}
+	if _, err := BSONAggregate(aggregateOrders(), runtime, nil); err == nil {
+		test.Errorf("adding a string should fail")
+	}
+}
@@ -0,0 +1,366 @@
+package mongonet
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// canonical type order mongod sorts values of different types by
+const (
+	bsonOrderMinKey = iota
+	bsonOrderNull
+	bsonOrderNumber
+	bsonOrderString
+	bsonOrderObject
+	bsonOrderArray
+	bsonOrderBinary
+	bsonOrderObjectId
+	bsonOrderBool
+	bsonOrderDate
+	bsonOrderTimestamp
+	bsonOrderRegex
+	bsonOrderMaxKey
+	bsonOrderOther
+)
+
+func bsonTypeOrder(v interface{}) int {
+	switch val := v.(type) {
+	case nil:
+		return bsonOrderNull
+	case int, int32, int64, float64, bson.Decimal128:
+		return bsonOrderNumber
+	case string, bson.Symbol:
+		return bsonOrderString
+	case bson.D, bson.M, map[string]interface{}:
+		return bsonOrderObject
+	case []interface{}, []bson.D:
+		return bsonOrderArray
+	case []byte, bson.Binary:
+		return bsonOrderBinary
+	case bson.ObjectId:
+		return bsonOrderObjectId
+	case bool:
+		return bsonOrderBool
+	case time.Time:
+		return bsonOrderDate
+	case bson.MongoTimestamp:
+		return bsonOrderTimestamp
+	case bson.RegEx:
+		return bsonOrderRegex
+	default:
+		if val == bson.Undefined {
+			return bsonOrderNull
+		}
+		if val == bson.MinKey {
+			return bsonOrderMinKey
+		}
+		if val == bson.MaxKey {
+			return bsonOrderMaxKey
+		}
+		return bsonOrderOther
+	}
+}
+
+// BSONNumber returns a numeric bson value as a float64
+func BSONNumber(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case int:
+		return float64(val), true
+	case int32:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case float64:
+		return val, true
+	case bson.Decimal128:
+		f, err := strconv.ParseFloat(val.String(), 64)
+		if err != nil {
+			return math.NaN(), true
+		}
+		return f, true
+	}
+	return 0, false
+}
+
+// bsonInteger returns an int, int32 or int64 bson value as an int64
+func bsonInteger(v interface{}) (int64, bool) {
+	switch val := v.(type) {
+	case int:
+		return int64(val), true
+	case int32:
+		return int64(val), true
+	case int64:
+		return val, true
+	}
+	return 0, false
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// BSONCompare compares two bson values the way mongod sorts them:
+// first by the canonical type order, then by value. It returns -1, 0 or 1.
+func BSONCompare(a, b interface{}) int {
+	oa, ob := bsonTypeOrder(a), bsonTypeOrder(b)
+	if oa != ob {
+		return compareInts(oa, ob)
+	}
+
+	switch oa {
+	case bsonOrderNumber:
+		return compareNumbers(a, b)
+
+	case bsonOrderString:
+		return strings.Compare(bsonString(a), bsonString(b))
+
+	case bsonOrderObject:
+		return compareDocs(bsonDoc(a), bsonDoc(b))
+
+	case bsonOrderArray:
+		aa, ba := bsonArray(a), bsonArray(b)
+		for i := 0; i < len(aa) && i < len(ba); i++ {
+			if c := BSONCompare(aa[i], ba[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(aa), len(ba))
+
+	case bsonOrderBinary:
+		ab, bb := bsonBinary(a), bsonBinary(b)
+		if c := compareInts(len(ab.Data), len(bb.Data)); c != 0 {
+			return c
+		}
+		if c := compareInts(int(ab.Kind), int(bb.Kind)); c != 0 {
+			return c
+		}
+		return bytes.Compare(ab.Data, bb.Data)
+
+	case bsonOrderObjectId:
+		return strings.Compare(string(a.(bson.ObjectId)), string(b.(bson.ObjectId)))
+
+	case bsonOrderBool:
+		return compareInts(boolToInt(a.(bool)), boolToInt(b.(bool)))
+
+	case bsonOrderDate:
+		ta, tb := a.(time.Time), b.(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+
+	case bsonOrderTimestamp:
+		ta, tb := a.(bson.MongoTimestamp), b.(bson.MongoTimestamp)
+		switch {
+		case uint64(ta) < uint64(tb):
+			return -1
+		case uint64(ta) > uint64(tb):
+			return 1
+		}
+		return 0
+
+	case bsonOrderRegex:
+		ra, rb := a.(bson.RegEx), b.(bson.RegEx)
+		if c := strings.Compare(ra.Pattern, rb.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(ra.Options, rb.Options)
+	}
+
+	return 0
+}
+
+// compareNumbers compares integers as integers, so longs above 2^53 stay apart, and everything else as doubles
+func compareNumbers(a, b interface{}) int {
+	ia, intA := bsonInteger(a)
+	ib, intB := bsonInteger(b)
+	fa, _ := BSONNumber(a)
+	fb, _ := BSONNumber(b)
+	switch {
+	case intA && intB:
+		return compareInt64s(ia, ib)
+	case intA:
+		return compareIntToDouble(ia, fb)
+	case intB:
+		return -compareIntToDouble(ib, fa)
+	}
+	switch {
+	case fa < fb:
+		return -1
+	case fa > fb:
+		return 1
+	case fa == fb:
+		return 0
+	}
+	// NaN sorts before every other number
+	return compareInts(boolToInt(!math.IsNaN(fa)), boolToInt(!math.IsNaN(fb)))
+}
+
+func compareInt64s(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareIntToDouble compares exactly, without rounding i to the nearest double
+func compareIntToDouble(i int64, f float64) int {
+	switch {
+	case math.IsNaN(f):
+		return 1
+	case f >= math.MaxInt64: // 2^63, MaxInt64 itself isn't a double
+		return -1
+	case f < math.MinInt64:
+		return 1
+	}
+	whole := math.Trunc(f)
+	if c := compareInt64s(i, int64(whole)); c != 0 {
+		return c
+	}
+	// the same whole part, the fraction decides
+	return -compareFloats(f, whole)
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// BSONCompareBySort compares documents by a sort specification like {a: 1, b: -1}
+func BSONCompareBySort(a, b bson.D, sortSpec bson.D) int {
+	for _, elem := range sortSpec {
+		dir, ok := BSONNumber(elem.Value)
+		if !ok {
+			// $meta sorts have no order of their own
+			continue
+		}
+		va, _ := BSONGetPath(a, elem.Name)
+		vb, _ := BSONGetPath(b, elem.Name)
+		c := BSONCompare(va, vb)
+		if dir < 0 {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareDocs(a, b bson.D) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareInts(bsonTypeOrder(a[i].Value), bsonTypeOrder(b[i].Value)); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a[i].Name, b[i].Name); c != 0 {
+			return c
+		}
+		if c := BSONCompare(a[i].Value, b[i].Value); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func bsonString(v interface{}) string {
+	if s, ok := v.(bson.Symbol); ok {
+		return string(s)
+	}
+	return v.(string)
+}
+
+func bsonDoc(v interface{}) bson.D {
+	switch val := v.(type) {
+	case bson.D:
+		return val
+	case bson.M:
+		return mapToDoc(val)
+	case map[string]interface{}:
+		return mapToDoc(val)
+	}
+	return nil
+}
+
+func mapToDoc(m map[string]interface{}) bson.D {
+	doc := make(bson.D, 0, len(m))
+	for k, v := range m {
+		doc = append(doc, bson.DocElem{k, v})
+	}
+	return doc
+}
+
+func bsonArray(v interface{}) []interface{} {
+	switch val := v.(type) {
+	case []interface{}:
+		return val
+	case []bson.D:
+		res := make([]interface{}, len(val))
+		for i, d := range val {
+			res[i] = d
+		}
+		return res
+	}
+	return nil
+}
+
+func bsonBinary(v interface{}) bson.Binary {
+	if b, ok := v.([]byte); ok {
+		return bson.Binary{0, b}
+	}
+	return v.(bson.Binary)
+}
+
+// BSONGetPath looks up a dotted path like "a.b.0.c" in a document.
+// Numeric path pieces index into arrays.
+func BSONGetPath(doc bson.D, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, piece := range strings.Split(path, ".") {
+		switch val := current.(type) {
+		case bson.D:
+			idx := BSONIndexOf(val, piece)
+			if idx < 0 {
+				return nil, false
+			}
+			current = val[idx].Value
+		case []interface{}, []bson.D:
+			arr := bsonArray(val)
+			n, err := strconv.Atoi(piece)
+			if err != nil || n < 0 || n >= len(arr) {
+				return nil, false
+			}
+			current = arr[n]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
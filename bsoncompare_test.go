@@ -0,0 +1,82 @@
+package mongonet
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBSONCompare(test *testing.T) {
+	ordered := []interface{}{
+		bson.MinKey,
+		nil,
+		-3.5,
+		int32(1),
+		int64(2),
+		"a",
+		"b",
+		bson.D{{"a", 1}},
+		bson.D{{"a", 2}},
+		[]interface{}{1, 2},
+		[]byte("x"),
+		bson.ObjectIdHex("5a0000000000000000000000"),
+		false,
+		true,
+		time.Unix(10, 0),
+		bson.MongoTimestamp(1),
+		bson.RegEx{"a", ""},
+		bson.MaxKey,
+	}
+	for i := range ordered {
+		for j := range ordered {
+			want := compareInts(i, j)
+			if got := BSONCompare(ordered[i], ordered[j]); got != want {
+				test.Errorf("comparing %v and %v gave %d, expected %d", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+
+	if BSONCompare(1, 1.0) != 0 || BSONCompare(int64(5), int32(5)) != 0 {
+		test.Errorf("numbers of different types should be equal")
+	}
+
+	// longs past 2^53 don't fit a double
+	big := int64(1 << 53)
+	numbers := []struct {
+		a, b interface{}
+		want int
+	}{
+		{big + 1, big, 1},
+		{big, big + 1, -1},
+		{big + 1, float64(big), 1},
+		{float64(big), big + 1, -1},
+		{int64(math.MaxInt64), math.Pow(2, 63), -1},
+		{int64(math.MinInt64), -math.Pow(2, 63), 0},
+		{2, 2.5, -1},
+		{-2, -2.5, 1},
+		{3, 2.5, 1},
+		{0, math.NaN(), 1},
+	}
+	for _, n := range numbers {
+		if got := BSONCompare(n.a, n.b); got != n.want {
+			test.Errorf("comparing %v and %v gave %d, expected %d", n.a, n.b, got, n.want)
+		}
+	}
+	if match, _ := BSONMatch(bson.D{{"a", big + 1}}, bson.D{{"a", big}}); match {
+		test.Errorf("%d should not match %d", big+1, big)
+	}
+}
+
+func TestBSONGetPath(test *testing.T) {
+	doc := bson.D{{"a", bson.D{{"b", []interface{}{bson.D{{"c", 5}}}}}}}
+	if v, ok := BSONGetPath(doc, "a.b.0.c"); !ok || v != 5 {
+		test.Errorf("a.b.0.c should be 5, got %v", v)
+	}
+	for _, path := range []string{"x", "a.x", "a.b.1.c", "a.b.c"} {
+		if _, ok := BSONGetPath(doc, path); ok {
+			test.Errorf("%s shouldn't be found", path)
+		}
+	}
+}
@@ -0,0 +1,640 @@
+package mongonet
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BSONMatcher is a compiled query filter, see CompileBSONFilter
+type BSONMatcher struct {
+	filter bson.D
+	match  func(doc bson.D) bool
+}
+
+// CompileBSONFilter compiles a query filter like {a: {$gt: 1}, $or: [...]}.
+// It supports comparisons, $and/$or/$nor/$not, $in/$nin, $exists, $type, $regex,
+// $elemMatch, $size and $all, with dotted paths reaching into arrays like mongod does.
+func CompileBSONFilter(filter bson.D) (*BSONMatcher, error) {
+	match, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	return &BSONMatcher{filter, match}, nil
+}
+
+// Matches evaluates the filter against a document
+func (bm *BSONMatcher) Matches(doc bson.D) bool {
+	return bm.match(doc)
+}
+
+// BSONMatch compiles filter and evaluates it against doc
+func BSONMatch(doc bson.D, filter bson.D) (bool, error) {
+	bm, err := CompileBSONFilter(filter)
+	if err != nil {
+		return false, err
+	}
+	return bm.Matches(doc), nil
+}
+
+// valuePredicate decides a field from the values its path reaches.
+// A document on the path without the field adds missingValue, so {a: [{b: 1}, {c: 1}]} reaches 1 and missing for a.b.
+type valuePredicate func(values []interface{}) bool
+
+// isMissing is true if the field is missing where the path ends or in one of the documents of an array on the way
+func isMissing(values []interface{}) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if _, missing := v.(missingValue); missing {
+			return true
+		}
+	}
+	return false
+}
+
+// exists is true if the path reaches a value
+func exists(values []interface{}) bool {
+	for _, v := range values {
+		if _, missing := v.(missingValue); !missing {
+			return true
+		}
+	}
+	return false
+}
+
+func compileFilter(filter bson.D) (func(bson.D) bool, error) {
+	clauses := make([]func(bson.D) bool, 0, len(filter))
+	for _, elem := range filter {
+		clause, err := compileClause(elem)
+		if err != nil {
+			return nil, err
+		}
+		if clause != nil {
+			clauses = append(clauses, clause)
+		}
+	}
+	return func(doc bson.D) bool {
+		for _, clause := range clauses {
+			if !clause(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileClause(elem bson.DocElem) (func(bson.D) bool, error) {
+	switch elem.Name {
+	case "$and", "$or", "$nor":
+		subs, err := compileFilterList(elem)
+		if err != nil {
+			return nil, err
+		}
+		switch elem.Name {
+		case "$and":
+			return func(doc bson.D) bool {
+				for _, sub := range subs {
+					if !sub(doc) {
+						return false
+					}
+				}
+				return true
+			}, nil
+		case "$or":
+			return func(doc bson.D) bool {
+				for _, sub := range subs {
+					if sub(doc) {
+						return true
+					}
+				}
+				return false
+			}, nil
+		}
+		return func(doc bson.D) bool {
+			for _, sub := range subs {
+				if sub(doc) {
+					return false
+				}
+			}
+			return true
+		}, nil
+
+	case "$comment":
+		return nil, nil
+	}
+	if strings.HasPrefix(elem.Name, "$") {
+		return nil, newBadValueError("unknown top level operator: %s", elem.Name)
+	}
+
+	pred, err := compileFieldValue(elem.Value)
+	if err != nil {
+		return nil, err
+	}
+	path := elem.Name
+	return func(doc bson.D) bool {
+		return pred(bsonPathValues(doc, path))
+	}, nil
+}
+
+func compileFilterList(elem bson.DocElem) ([]func(bson.D) bool, error) {
+	arr, ok := bsonArrayValue(elem.Value)
+	if !ok || len(arr) == 0 {
+		return nil, newBadValueError("%s must be a nonempty array", elem.Name)
+	}
+	subs := make([]func(bson.D) bool, len(arr))
+	for i, v := range arr {
+		sub, ok := v.(bson.D)
+		if !ok {
+			return nil, newBadValueError("%s argument's entries must be objects", elem.Name)
+		}
+		var err error
+		if subs[i], err = compileFilter(sub); err != nil {
+			return nil, err
+		}
+	}
+	return subs, nil
+}
+
+func isOperatorDoc(v interface{}) bool {
+	doc, ok := v.(bson.D)
+	return ok && len(doc) > 0 && strings.HasPrefix(doc[0].Name, "$")
+}
+
+// compileFieldValue compiles what a field is compared to, an operator document, a regex or a value to equal
+func compileFieldValue(v interface{}) (valuePredicate, error) {
+	if re, ok := v.(bson.RegEx); ok {
+		return compileRegex(re.Pattern, re.Options)
+	}
+	if isOperatorDoc(v) {
+		return compileOperators(v.(bson.D))
+	}
+	return equalPredicate(v), nil
+}
+
+func compileOperators(ops bson.D) (valuePredicate, error) {
+	preds := make([]valuePredicate, 0, len(ops))
+	for _, op := range ops {
+		var pred valuePredicate
+		var err error
+		switch op.Name {
+		case "$eq":
+			pred = equalPredicate(op.Value)
+		case "$ne":
+			pred = negate(equalPredicate(op.Value))
+		case "$gt", "$gte", "$lt", "$lte":
+			pred = comparePredicate(op.Name, op.Value)
+		case "$in", "$nin":
+			pred, err = inPredicate(op)
+		case "$exists":
+			want := bsonTruthy(op.Value)
+			pred = func(values []interface{}) bool { return exists(values) == want }
+		case "$type":
+			pred, err = typePredicate(op.Value)
+		case "$regex":
+			pred, err = regexOperator(op.Value, ops)
+		case "$options":
+			if BSONIndexOf(ops, "$regex") < 0 {
+				return nil, newBadValueError("$options needs a $regex")
+			}
+			continue
+		case "$size":
+			pred, err = sizePredicate(op.Value)
+		case "$all":
+			pred, err = allPredicate(op.Value)
+		case "$elemMatch":
+			pred, err = elemMatchPredicate(op.Value)
+		case "$not":
+			if _, isRegex := op.Value.(bson.RegEx); !isRegex && !isOperatorDoc(op.Value) {
+				return nil, newBadValueError("$not needs a regex or a document of operators")
+			}
+			pred, err = compileFieldValue(op.Value)
+			pred = negate(pred)
+		default:
+			if !strings.HasPrefix(op.Name, "$") {
+				err = newBadValueError("cannot mix operators and fields: %s", op.Name)
+			} else {
+				err = newBadValueError("unknown operator: %s", op.Name)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+	return func(values []interface{}) bool {
+		for _, pred := range preds {
+			if !pred(values) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func negate(pred valuePredicate) valuePredicate {
+	if pred == nil {
+		return nil
+	}
+	return func(values []interface{}) bool { return !pred(values) }
+}
+
+// ---
+
+func bsonArrayValue(v interface{}) ([]interface{}, bool) {
+	switch v.(type) {
+	case []interface{}, []bson.D:
+		return bsonArray(v), true
+	}
+	return nil, false
+}
+
+// bsonPathValues returns the values a dotted path reaches. Arrays on the way are looked into:
+// a numeric piece indexes them, and documents in them are followed as well.
+func bsonPathValues(doc bson.D, path string) []interface{} {
+	values := []interface{}{}
+	collectPathValues(doc, strings.Split(path, "."), &values)
+	return values
+}
+
+func collectPathValues(v interface{}, pieces []string, out *[]interface{}) {
+	if len(pieces) == 0 {
+		*out = append(*out, v)
+		return
+	}
+	if arr, ok := bsonArrayValue(v); ok {
+		if n, err := strconv.Atoi(pieces[0]); err == nil {
+			if n >= 0 && n < len(arr) {
+				collectPathValues(arr[n], pieces[1:], out)
+			}
+			return
+		}
+		for _, item := range arr {
+			if _, isArray := bsonArrayValue(item); !isArray {
+				collectPathValues(item, pieces, out)
+			}
+		}
+		return
+	}
+	if doc := bsonDocValue(v); doc != nil {
+		if idx := BSONIndexOf(doc, pieces[0]); idx >= 0 {
+			collectPathValues(doc[idx].Value, pieces[1:], out)
+		} else {
+			*out = append(*out, missingValue{})
+		}
+	}
+}
+
+func bsonDocValue(v interface{}) bson.D {
+	switch v.(type) {
+	case bson.D, bson.M, map[string]interface{}:
+		return bsonDoc(v)
+	}
+	return nil
+}
+
+// candidates are the values a path reaches plus the elements of the arrays among them,
+// {a: 1} matches a document where a is [1, 2]
+func candidates(values []interface{}) []interface{} {
+	res := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		if _, missing := v.(missingValue); missing {
+			continue
+		}
+		res = append(res, v)
+		if arr, ok := bsonArrayValue(v); ok {
+			res = append(res, arr...)
+		}
+	}
+	return res
+}
+
+func anyCandidate(values []interface{}, test func(interface{}) bool) bool {
+	for _, v := range candidates(values) {
+		if test(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalPredicate(want interface{}) valuePredicate {
+	return func(values []interface{}) bool {
+		if want == nil && isMissing(values) {
+			return true
+		}
+		return anyCandidate(values, func(v interface{}) bool {
+			return BSONCompare(v, want) == 0
+		})
+	}
+}
+
+// comparePredicate only compares values of the same type, like mongod's type bracketing
+func comparePredicate(op string, want interface{}) valuePredicate {
+	if want == nil {
+		if op == "$gte" || op == "$lte" {
+			return equalPredicate(nil)
+		}
+		return func([]interface{}) bool { return false }
+	}
+	order := bsonTypeOrder(want)
+	return func(values []interface{}) bool {
+		return anyCandidate(values, func(v interface{}) bool {
+			if order != bsonOrderMinKey && order != bsonOrderMaxKey && bsonTypeOrder(v) != order {
+				return false
+			}
+			c := BSONCompare(v, want)
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			}
+			return c <= 0
+		})
+	}
+}
+
+func inPredicate(op bson.DocElem) (valuePredicate, error) {
+	arr, ok := bsonArrayValue(op.Value)
+	if !ok {
+		return nil, newBadValueError("%s needs an array", op.Name)
+	}
+	preds := make([]valuePredicate, len(arr))
+	for i, v := range arr {
+		if isOperatorDoc(v) {
+			return nil, newBadValueError("cannot nest operators in %s", op.Name)
+		}
+		var err error
+		if preds[i], err = compileFieldValue(v); err != nil {
+			return nil, err
+		}
+	}
+	pred := func(values []interface{}) bool {
+		for _, p := range preds {
+			if p(values) {
+				return true
+			}
+		}
+		return false
+	}
+	if op.Name == "$nin" {
+		return negate(pred), nil
+	}
+	return pred, nil
+}
+
+func sizePredicate(v interface{}) (valuePredicate, error) {
+	n, ok := BSONNumber(v)
+	if !ok || n != float64(int(n)) || n < 0 {
+		return nil, newBadValueError("$size needs a non-negative whole number")
+	}
+	return func(values []interface{}) bool {
+		for _, v := range values {
+			if arr, ok := bsonArrayValue(v); ok && len(arr) == int(n) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func allPredicate(v interface{}) (valuePredicate, error) {
+	arr, ok := bsonArrayValue(v)
+	if !ok {
+		return nil, newBadValueError("$all needs an array")
+	}
+	preds := make([]valuePredicate, len(arr))
+	for i, item := range arr {
+		var err error
+		if doc, ok := item.(bson.D); ok && len(doc) == 1 && doc[0].Name == "$elemMatch" {
+			preds[i], err = elemMatchPredicate(doc[0].Value)
+		} else if isOperatorDoc(item) {
+			err = newBadValueError("no $ expressions in $all, except $elemMatch")
+		} else {
+			preds[i], err = compileFieldValue(item)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func(values []interface{}) bool {
+		if len(preds) == 0 {
+			return false
+		}
+		for _, pred := range preds {
+			if !pred(values) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// elemMatchPredicate matches arrays with an element satisfying either operators, {$gt: 1, $lt: 5},
+// or a filter on the element as a document, {a: 1, b: {$gt: 2}}
+func elemMatchPredicate(v interface{}) (valuePredicate, error) {
+	spec, ok := v.(bson.D)
+	if !ok {
+		return nil, newBadValueError("$elemMatch needs an object")
+	}
+
+	var test func(interface{}) bool
+	if isOperatorDoc(spec) && spec[0].Name != "$and" && spec[0].Name != "$or" && spec[0].Name != "$nor" {
+		pred, err := compileOperators(spec)
+		if err != nil {
+			return nil, err
+		}
+		test = func(item interface{}) bool { return pred([]interface{}{item}) }
+	} else {
+		match, err := compileFilter(spec)
+		if err != nil {
+			return nil, err
+		}
+		test = func(item interface{}) bool {
+			doc := bsonDocValue(item)
+			return doc != nil && match(doc)
+		}
+	}
+
+	return func(values []interface{}) bool {
+		for _, v := range values {
+			arr, ok := bsonArrayValue(v)
+			if !ok {
+				continue
+			}
+			for _, item := range arr {
+				if test(item) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// ---
+
+var bsonTypeAliases = map[string]int{
+	"double": 1, "string": 2, "object": 3, "array": 4, "binData": 5, "undefined": 6,
+	"objectId": 7, "bool": 8, "date": 9, "null": 10, "regex": 11, "javascript": 13,
+	"int": 16, "timestamp": 17, "long": 18, "decimal": 19, "minKey": -1, "maxKey": 127,
+}
+
+// bsonTypeCode returns the bson type number of a value the way mgo decodes them
+func bsonTypeCode(v interface{}) int {
+	switch val := v.(type) {
+	case float64:
+		return 1
+	case string, bson.Symbol:
+		return 2
+	case bson.D, bson.M, map[string]interface{}:
+		return 3
+	case []interface{}, []bson.D:
+		return 4
+	case []byte, bson.Binary:
+		return 5
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	case nil:
+		return 10
+	case bson.RegEx:
+		return 11
+	case bson.JavaScript:
+		return 13
+	case int, int32:
+		return 16
+	case bson.MongoTimestamp:
+		return 17
+	case int64:
+		return 18
+	case bson.Decimal128:
+		return 19
+	default:
+		switch val {
+		case bson.Undefined:
+			return 6
+		case bson.MinKey:
+			return -1
+		case bson.MaxKey:
+			return 127
+		}
+	}
+	return 0
+}
+
+// bsonTypeName returns the alias of the bson type of a value, like "int" or "array"
+func bsonTypeName(v interface{}) string {
+	code := bsonTypeCode(v)
+	for name, c := range bsonTypeAliases {
+		if c == code {
+			return name
+		}
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func typePredicate(v interface{}) (valuePredicate, error) {
+	specs := []interface{}{v}
+	if arr, ok := bsonArrayValue(v); ok {
+		specs = arr
+	}
+	codes := map[int]bool{}
+	for _, spec := range specs {
+		if alias, ok := spec.(string); ok {
+			if alias == "number" {
+				codes[1], codes[16], codes[18], codes[19] = true, true, true, true
+				continue
+			}
+			code, ok := bsonTypeAliases[alias]
+			if !ok {
+				return nil, newBadValueError("unknown type name alias: %s", alias)
+			}
+			codes[code] = true
+			continue
+		}
+		code, ok := BSONNumber(spec)
+		if !ok {
+			return nil, newBadValueError("type must be represented as a number or a string")
+		}
+		codes[int(code)] = true
+	}
+	return func(values []interface{}) bool {
+		return anyCandidate(values, func(v interface{}) bool { return codes[bsonTypeCode(v)] })
+	}, nil
+}
+
+// regexOperator compiles $regex with the $options next to it
+func regexOperator(v interface{}, ops bson.D) (valuePredicate, error) {
+	options := ""
+	if idx := BSONIndexOf(ops, "$options"); idx >= 0 {
+		var ok bool
+		if options, ok = ops[idx].Value.(string); !ok {
+			return nil, newBadValueError("$options has to be a string")
+		}
+	}
+	switch re := v.(type) {
+	case string:
+		return compileRegex(re, options)
+	case bson.RegEx:
+		if options == "" {
+			options = re.Options
+		}
+		return compileRegex(re.Pattern, options)
+	}
+	return nil, newBadValueError("$regex has to be a string")
+}
+
+func compileRegex(pattern, options string) (valuePredicate, error) {
+	flags := ""
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		default:
+			return nil, newBadValueError("invalid regex flag: %c", o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, newBadValueError("invalid regular expression: %s", err)
+	}
+	return func(values []interface{}) bool {
+		return anyCandidate(values, func(v interface{}) bool {
+			switch s := v.(type) {
+			case string:
+				return re.MatchString(s)
+			case bson.Symbol:
+				return re.MatchString(string(s))
+			}
+			return false
+		})
+	}, nil
+}
+
+func bsonTruthy(v interface{}) bool {
+	switch val := v.(type) {
+	case bool:
+		return val
+	case nil:
+		return false
+	}
+	if n, ok := BSONNumber(v); ok {
+		return n != 0
+	}
+	return true
+}
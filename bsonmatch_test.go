@@ -0,0 +1,125 @@
+package mongonet
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBSONMatch(test *testing.T) {
+	doc := bson.D{
+		{"_id", 1},
+		{"name", "Widget"},
+		{"price", 9.5},
+		{"qty", 3},
+		{"tags", []interface{}{"red", "blue"}},
+		{"sizes", []interface{}{bson.D{{"w", 1}, {"h", 2}}, bson.D{{"w", 3}, {"h", 4}}}},
+		{"dims", bson.D{{"w", 10}, {"h", 20}}},
+		{"nothing", nil},
+		{"parts", []interface{}{bson.D{{"b", 1}}, bson.D{{"c", 1}}}},
+	}
+
+	tests := []struct {
+		filter bson.D
+		want   bool
+	}{
+		{bson.D{}, true},
+		{bson.D{{"_id", 1}}, true},
+		{bson.D{{"_id", 1.0}}, true},
+		{bson.D{{"_id", "1"}}, false},
+		{bson.D{{"dims.w", 10}}, true},
+		{bson.D{{"dims", bson.D{{"w", 10}, {"h", 20}}}}, true},
+		{bson.D{{"dims", bson.D{{"h", 20}, {"w", 10}}}}, false},
+		{bson.D{{"tags", "red"}}, true},
+		{bson.D{{"tags", []interface{}{"red", "blue"}}}, true},
+		{bson.D{{"tags.1", "blue"}}, true},
+		{bson.D{{"sizes.w", 3}}, true},
+		{bson.D{{"sizes.1.h", 4}}, true},
+		{bson.D{{"sizes.w", 2}}, false},
+		{bson.D{{"missing", nil}}, true},
+		{bson.D{{"nothing", nil}}, true},
+		{bson.D{{"name", nil}}, false},
+		{bson.D{{"parts.b", nil}}, true}, // missing in one of the array's documents
+		{bson.D{{"parts.b", 1}}, true},
+		{bson.D{{"parts.b", bson.D{{"$ne", nil}}}}, false},
+		{bson.D{{"sizes.w", nil}}, false},
+
+		{bson.D{{"price", bson.D{{"$gt", 9}, {"$lt", 10}}}}, true},
+		{bson.D{{"price", bson.D{{"$gte", 9.5}}}}, true},
+		{bson.D{{"qty", bson.D{{"$lt", 3}}}}, false},
+		{bson.D{{"name", bson.D{{"$gt", 5}}}}, false}, // no comparisons across types
+		{bson.D{{"name", bson.D{{"$gt", "A"}}}}, true},
+		{bson.D{{"sizes.w", bson.D{{"$gt", 2}}}}, true},
+		{bson.D{{"qty", bson.D{{"$ne", 3}}}}, false},
+		{bson.D{{"tags", bson.D{{"$ne", "green"}}}}, true},
+		{bson.D{{"tags", bson.D{{"$ne", "red"}}}}, false},
+		{bson.D{{"missing", bson.D{{"$gte", nil}}}}, true},
+
+		{bson.D{{"qty", bson.D{{"$in", []interface{}{1, 2, 3}}}}}, true},
+		{bson.D{{"tags", bson.D{{"$in", []interface{}{"green", bson.RegEx{"^bl", ""}}}}}}, true},
+		{bson.D{{"tags", bson.D{{"$nin", []interface{}{"green", "red"}}}}}, false},
+		{bson.D{{"missing", bson.D{{"$nin", []interface{}{1}}}}}, true},
+
+		{bson.D{{"missing", bson.D{{"$exists", false}}}}, true},
+		{bson.D{{"nothing", bson.D{{"$exists", true}}}}, true},
+		{bson.D{{"dims.d", bson.D{{"$exists", 1}}}}, false},
+		{bson.D{{"parts.c", bson.D{{"$exists", true}}}}, true},
+		{bson.D{{"parts.d", bson.D{{"$exists", true}}}}, false},
+
+		{bson.D{{"qty", bson.D{{"$type", "int"}}}}, true},
+		{bson.D{{"price", bson.D{{"$type", "number"}}}}, true},
+		{bson.D{{"tags", bson.D{{"$type", "array"}}}}, true},
+		{bson.D{{"tags", bson.D{{"$type", 2}}}}, true},
+		{bson.D{{"nothing", bson.D{{"$type", []interface{}{"string", "null"}}}}}, true},
+
+		{bson.D{{"name", bson.D{{"$regex", "^wid"}, {"$options", "i"}}}}, true},
+		{bson.D{{"name", bson.D{{"$regex", "^wid"}}}}, false},
+		{bson.D{{"name", bson.RegEx{"get$", ""}}}, true},
+		{bson.D{{"name", bson.D{{"$not", bson.RegEx{"^W", ""}}}}}, false},
+		{bson.D{{"qty", bson.D{{"$not", bson.D{{"$gt", 5}}}}}}, true},
+
+		{bson.D{{"tags", bson.D{{"$size", 2}}}}, true},
+		{bson.D{{"tags", bson.D{{"$size", 1}}}}, false},
+		{bson.D{{"tags", bson.D{{"$all", []interface{}{"blue", "red"}}}}}, true},
+		{bson.D{{"tags", bson.D{{"$all", []interface{}{"blue", "green"}}}}}, false},
+		{bson.D{{"tags", bson.D{{"$all", []interface{}{}}}}}, false},
+		{bson.D{{"sizes", bson.D{{"$elemMatch", bson.D{{"w", 3}, {"h", bson.D{{"$gt", 3}}}}}}}}, true},
+		{bson.D{{"sizes", bson.D{{"$elemMatch", bson.D{{"w", 1}, {"h", 4}}}}}}, false},
+		{bson.D{{"sizes", bson.D{{"$all", []interface{}{bson.D{{"$elemMatch", bson.D{{"w", 1}}}}}}}}}, true},
+		{bson.D{{"tags", bson.D{{"$elemMatch", bson.D{{"$gte", "b"}, {"$lt", "c"}}}}}}, true},
+
+		{bson.D{{"$or", []interface{}{bson.D{{"qty", 5}}, bson.D{{"name", "Widget"}}}}}, true},
+		{bson.D{{"$and", []interface{}{bson.D{{"qty", 3}}, bson.D{{"name", "Gadget"}}}}}, false},
+		{bson.D{{"$nor", []interface{}{bson.D{{"qty", 5}}, bson.D{{"name", "Gadget"}}}}}, true},
+		{bson.D{{"$comment", "why"}, {"qty", 3}}, true},
+	}
+
+	for _, t := range tests {
+		got, err := BSONMatch(doc, t.filter)
+		if err != nil {
+			test.Errorf("%v failed: %s", t.filter, err)
+			continue
+		}
+		if got != t.want {
+			test.Errorf("%v should be %v", t.filter, t.want)
+		}
+	}
+
+	bad := []bson.D{
+		{{"$where", "true"}},
+		{{"a", bson.D{{"$foo", 1}}}},
+		{{"a", bson.D{{"$gt", 1}, {"b", 1}}}},
+		{{"$or", []interface{}{}}},
+		{{"a", bson.D{{"$in", 1}}}},
+		{{"a", bson.D{{"$type", "nope"}}}},
+		{{"a", bson.D{{"$regex", "("}}}},
+		{{"a", bson.D{{"$size", -1}}}},
+	}
+	for _, filter := range bad {
+		if _, err := CompileBSONFilter(filter); err == nil {
+			test.Errorf("%v should not compile", filter)
+		} else if me, ok := err.(MongoError); !ok || me.Code() != 2 {
+			test.Errorf("%v should fail with BadValue, got %v", filter, err)
+		}
+	}
+}
@@ -0,0 +1,862 @@
+package mongonet
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BSONUpdater is a compiled update document, see CompileBSONUpdate
+type BSONUpdater struct {
+	update       bson.D
+	replacement  bson.D // nil unless the update is a replacement document
+	mods         []*updateMod
+	arrayFilters map[string]*BSONMatcher
+	positional   bool
+}
+
+// updateMod is one field of an update operator, {$inc: {a: 1, b: 1}} has two
+type updateMod struct {
+	op     string
+	path   string
+	pieces []string
+	target []string // where $rename moves the field to
+	create bool     // whether the operator creates missing fields
+	leaf   func(ctx *updateContext, old interface{}, exists bool) (interface{}, bool, error)
+}
+
+// updateContext is what applying an update to one document needs besides the update
+type updateContext struct {
+	id           interface{}
+	arrayFilters map[string]*BSONMatcher
+	query        *BSONMatcher
+	upsert       bool
+	now          time.Time
+}
+
+func updateError(code int, codeName string, format string, args ...interface{}) MongoError {
+	return NewMongoError(fmt.Errorf(format, args...), code, codeName)
+}
+
+// CompileBSONUpdate compiles an update document, either a replacement or operators like
+// {$set: {"a.b": 1}, $push: {c: {$each: [1, 2], $slice: -5}}}. Paths can use the positional $
+// and $[identifier] with arrayFilters. It fails with the errors mongod reports for bad updates.
+func CompileBSONUpdate(update bson.D, arrayFilters []bson.D) (*BSONUpdater, error) {
+	filters, err := compileArrayFilters(arrayFilters)
+	if err != nil {
+		return nil, err
+	}
+	bu := &BSONUpdater{update, nil, nil, filters, false}
+	used := map[string]bool{}
+
+	if len(update) == 0 || !strings.HasPrefix(update[0].Name, "$") {
+		for _, elem := range update {
+			if strings.HasPrefix(elem.Name, "$") {
+				return nil, updateError(52, "DollarPrefixedFieldName", "The dollar ($) prefixed field '%s' in '%s' is not valid for storage.", elem.Name, elem.Name)
+			}
+		}
+		bu.replacement = update
+	} else {
+		for _, op := range update {
+			if !updateOperators[op.Name] {
+				return nil, updateError(9, "FailedToParse", "Unknown modifier: %s. Expected a valid update modifier or pipeline-style update specified as an array", op.Name)
+			}
+			fields, ok := op.Value.(bson.D)
+			if !ok {
+				return nil, updateError(9, "FailedToParse", "Modifiers operate on fields but we found type %s instead. For example: {$mod: {<field>: ...}} not {%s: %v}", bsonTypeName(op.Value), op.Name, op.Value)
+			}
+			if len(fields) == 0 {
+				return nil, updateError(9, "FailedToParse", "'%s' is empty. You must specify a field like so: {%s: {<field_name>: ...}}", op.Name, op.Name)
+			}
+			for _, field := range fields {
+				mod, err := compileUpdateMod(op.Name, field, filters, used)
+				if err != nil {
+					return nil, err
+				}
+				for _, piece := range mod.pieces {
+					bu.positional = bu.positional || piece == "$"
+				}
+				bu.mods = append(bu.mods, mod)
+			}
+		}
+		if err := checkUpdateConflicts(bu.mods); err != nil {
+			return nil, err
+		}
+		// like mongod, fields are processed in lexicographic order, numeric ones in numeric order
+		sort.SliceStable(bu.mods, func(i, j int) bool {
+			return compareUpdatePaths(bu.mods[i].pieces, bu.mods[j].pieces) < 0
+		})
+	}
+
+	for _, filter := range arrayFilters {
+		if id, _ := arrayFilterIdentifier(filter); !used[id] {
+			return nil, updateError(9, "FailedToParse", "The array filter for identifier '%s' was not used in the update %v", id, update)
+		}
+	}
+	return bu, nil
+}
+
+// IsReplacement is true for a replacement document rather than operators
+func (bu *BSONUpdater) IsReplacement() bool {
+	return bu.replacement != nil
+}
+
+// Apply returns the updated copy of doc, doc itself isn't changed. query is the filter doc was
+// found with, the positional $ stands for the position of the array element it matched.
+func (bu *BSONUpdater) Apply(doc bson.D, query bson.D) (bson.D, error) {
+	return bu.apply(doc, query, false)
+}
+
+// Upsert returns the document an upsert inserts when nothing matches query: the fields query
+// tests for equality, updated with $setOnInsert as well. A replacement only keeps the _id of query.
+func (bu *BSONUpdater) Upsert(query bson.D) (bson.D, error) {
+	base, err := upsertEqualities(bson.D{}, query)
+	if err != nil {
+		return nil, err
+	}
+	if idx := BSONIndexOf(base, "_id"); idx > 0 {
+		base = append(bson.D{base[idx]}, append(base[:idx:idx], base[idx+1:]...)...)
+	}
+	if bu.replacement != nil && len(base) > 0 {
+		if base[0].Name == "_id" {
+			base = base[:1]
+		} else {
+			base = bson.D{}
+		}
+	}
+	return bu.apply(base, nil, true)
+}
+
+// BSONApplyUpdate compiles update and applies it to doc
+func BSONApplyUpdate(doc bson.D, update bson.D) (bson.D, error) {
+	bu, err := CompileBSONUpdate(update, nil)
+	if err != nil {
+		return nil, err
+	}
+	return bu.Apply(doc, nil)
+}
+
+func (bu *BSONUpdater) apply(doc bson.D, query bson.D, upsert bool) (bson.D, error) {
+	var id interface{}
+	idIdx := BSONIndexOf(doc, "_id")
+	if idIdx >= 0 {
+		id = doc[idIdx].Value
+	}
+	if bu.replacement != nil {
+		return replaceDoc(doc, idIdx, bu.replacement)
+	}
+
+	ctx := &updateContext{id, bu.arrayFilters, nil, upsert, time.Now()}
+	if bu.positional && len(query) > 0 {
+		var err error
+		if ctx.query, err = CompileBSONFilter(query); err != nil {
+			return nil, err
+		}
+	}
+	res := doc
+	for _, mod := range bu.mods {
+		var err error
+		if res, err = mod.apply(res, ctx); err != nil {
+			return nil, err
+		}
+	}
+	if idIdx >= 0 {
+		if newIdx := BSONIndexOf(res, "_id"); newIdx < 0 || BSONCompare(res[newIdx].Value, id) != 0 {
+			return nil, updateError(66, "ImmutableField", "Performing an update on the path '_id' would modify the immutable field '_id'")
+		}
+	}
+	return res, nil
+}
+
+func replaceDoc(doc bson.D, idIdx int, replacement bson.D) (bson.D, error) {
+	res := make(bson.D, 0, len(replacement)+1)
+	if idIdx >= 0 {
+		res = append(res, doc[idIdx])
+	}
+	for _, elem := range replacement {
+		if elem.Name != "_id" {
+			res = append(res, elem)
+			continue
+		}
+		if idIdx < 0 {
+			res = append(bson.D{elem}, res...)
+			continue
+		}
+		if BSONCompare(elem.Value, doc[idIdx].Value) != 0 {
+			return nil, updateError(66, "ImmutableField", "After applying the update, the (immutable) field '_id' was found to have been altered to _id: %v", elem.Value)
+		}
+	}
+	return res, nil
+}
+
+// upsertEqualities adds the fields query tests for equality, {a: 1}, {"b.c": {$eq: 2}} or within $and
+func upsertEqualities(doc bson.D, query bson.D) (bson.D, error) {
+	var err error
+	for _, elem := range query {
+		value := elem.Value
+		switch {
+		case elem.Name == "$and":
+			for _, sub := range bsonArray(value) {
+				if doc, err = upsertEqualities(doc, bsonDocValue(sub)); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case strings.HasPrefix(elem.Name, "$"):
+			continue
+		case isOperatorDoc(value):
+			ops := value.(bson.D)
+			if len(ops) != 1 || ops[0].Name != "$eq" {
+				continue
+			}
+			value = ops[0].Value
+		}
+		if _, isRegex := value.(bson.RegEx); isRegex {
+			continue
+		}
+		if doc, err = BSONSetPath(doc, elem.Name, value); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// ---
+
+var updateOperators = map[string]bool{
+	"$set": true, "$setOnInsert": true, "$unset": true, "$inc": true, "$mul": true, "$min": true, "$max": true,
+	"$rename": true, "$currentDate": true, "$push": true, "$addToSet": true, "$pop": true, "$pull": true, "$pullAll": true,
+}
+
+var arrayFilterIdentifierPattern = regexp.MustCompile("^[a-z][a-zA-Z0-9]*$")
+
+// arrayFilterIdentifier returns the top level field name all the paths of an array filter start with
+func arrayFilterIdentifier(filter bson.D) (string, error) {
+	id := ""
+	for _, elem := range filter {
+		var name string
+		switch {
+		case elem.Name == "$and" || elem.Name == "$or" || elem.Name == "$nor":
+			for _, sub := range bsonArray(elem.Value) {
+				subId, err := arrayFilterIdentifier(bsonDocValue(sub))
+				if err != nil {
+					return "", err
+				}
+				if subId != "" && name != "" && subId != name {
+					return "", updateError(9, "FailedToParse", "Error parsing array filter :: caused by :: Expected a single top-level field name, found '%s' and '%s'", name, subId)
+				}
+				if subId != "" {
+					name = subId
+				}
+			}
+		case strings.HasPrefix(elem.Name, "$"):
+			continue
+		default:
+			name = strings.Split(elem.Name, ".")[0]
+		}
+		if name == "" {
+			continue
+		}
+		if id != "" && name != id {
+			return "", updateError(9, "FailedToParse", "Error parsing array filter :: caused by :: Expected a single top-level field name, found '%s' and '%s'", id, name)
+		}
+		id = name
+	}
+	return id, nil
+}
+
+func compileArrayFilters(arrayFilters []bson.D) (map[string]*BSONMatcher, error) {
+	filters := map[string]*BSONMatcher{}
+	for _, filter := range arrayFilters {
+		id, err := arrayFilterIdentifier(filter)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			return nil, updateError(9, "FailedToParse", "Cannot use an expression without a top-level field name in arrayFilters")
+		}
+		if !arrayFilterIdentifierPattern.MatchString(id) {
+			return nil, newBadValueError("Error parsing array filter :: caused by :: The top-level field name must be an alphanumeric string beginning with a lowercase letter, found '%s'", id)
+		}
+		if _, dup := filters[id]; dup {
+			return nil, updateError(9, "FailedToParse", "Found multiple array filters with the same top-level field name %s", id)
+		}
+		if filters[id], err = CompileBSONFilter(filter); err != nil {
+			return nil, err
+		}
+	}
+	return filters, nil
+}
+
+// parseUpdatePath splits an update path, checking its positional pieces and marking the array filters it uses
+func parseUpdatePath(path string, filters map[string]*BSONMatcher, used map[string]bool) ([]string, error) {
+	if path == "" {
+		return nil, updateError(56, "EmptyFieldName", "An empty update path is not valid.")
+	}
+	pieces := strings.Split(path, ".")
+	positional := 0
+	for i, piece := range pieces {
+		if piece == "" {
+			return nil, updateError(56, "EmptyFieldName", "The update path '%s' contains an empty field name, which is not allowed.", path)
+		}
+		if piece == "$" {
+			if i == 0 {
+				return nil, newBadValueError("Cannot have positional (i.e. '$') element in the first position in path '%s'", path)
+			}
+			if positional++; positional > 1 {
+				return nil, newBadValueError("Too many positional (i.e. '$') elements found in path '%s'", path)
+			}
+			continue
+		}
+		if id, ok := bsonArrayIdentifier(piece); ok {
+			if i == 0 {
+				return nil, newBadValueError("Cannot have array filter identifier (i.e. '$[<id>]') element in the first position in path '%s'", path)
+			}
+			if id != "" && filters[id] == nil {
+				return nil, newBadValueError("No array filter found for identifier '%s' in path '%s'", id, path)
+			}
+			used[id] = true
+			continue
+		}
+		if strings.HasPrefix(piece, "$") {
+			return nil, updateError(52, "DollarPrefixedFieldName", "The dollar ($) prefixed field '%s' in '%s' is not valid for storage.", piece, path)
+		}
+	}
+	return pieces, nil
+}
+
+func isDynamicPath(pieces []string) bool {
+	for _, piece := range pieces {
+		if _, ok := bsonArrayIdentifier(piece); ok || piece == "$" {
+			return true
+		}
+	}
+	return false
+}
+
+func pathHasPrefix(pieces, prefix []string) bool {
+	if len(prefix) > len(pieces) {
+		return false
+	}
+	for i := range prefix {
+		if pieces[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkUpdateConflicts fails if two fields of an update are the same or one contains the other
+func checkUpdateConflicts(mods []*updateMod) error {
+	paths := [][]string{}
+	for _, mod := range mods {
+		paths = append(paths, mod.pieces)
+		if mod.target != nil {
+			paths = append(paths, mod.target)
+		}
+	}
+	for i, a := range paths {
+		for _, b := range paths[i+1:] {
+			if pathHasPrefix(a, b) || pathHasPrefix(b, a) {
+				return updateError(40, "ConflictingUpdateOperators", "Updating the path '%s' would create a conflict at '%s'", strings.Join(b, "."), strings.Join(a, "."))
+			}
+		}
+	}
+	return nil
+}
+
+func compareUpdatePaths(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		na, errA := strconv.Atoi(a[i])
+		nb, errB := strconv.Atoi(b[i])
+		if errA == nil && errB == nil {
+			if c := compareInts(na, nb); c != 0 {
+				return c
+			}
+			continue
+		}
+		if c := strings.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+// ---
+
+func compileUpdateMod(op string, field bson.DocElem, filters map[string]*BSONMatcher, used map[string]bool) (*updateMod, error) {
+	pieces, err := parseUpdatePath(field.Name, filters, used)
+	if err != nil {
+		return nil, err
+	}
+	mod := &updateMod{op, field.Name, pieces, nil, true, nil}
+	arg := field.Value
+
+	switch op {
+	case "$set", "$setOnInsert":
+		mod.leaf = func(*updateContext, interface{}, bool) (interface{}, bool, error) { return arg, false, nil }
+	case "$unset":
+		mod.create = false
+		mod.leaf = func(*updateContext, interface{}, bool) (interface{}, bool, error) { return nil, true, nil }
+	case "$inc", "$mul":
+		err = mod.compileArithmetic(arg)
+	case "$min", "$max":
+		want := 1
+		if op == "$min" {
+			want = -1
+		}
+		mod.leaf = func(_ *updateContext, old interface{}, exists bool) (interface{}, bool, error) {
+			if !exists || BSONCompare(arg, old) == want {
+				return arg, false, nil
+			}
+			return old, false, nil
+		}
+	case "$currentDate":
+		err = mod.compileCurrentDate(arg)
+	case "$rename":
+		err = mod.compileRename(arg, filters, used)
+	case "$push":
+		err = mod.compilePush(arg)
+	case "$addToSet":
+		err = mod.compileAddToSet(arg)
+	case "$pop":
+		err = mod.compilePop(arg)
+	case "$pull", "$pullAll":
+		err = mod.compilePull(arg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mod, nil
+}
+
+func (mod *updateMod) apply(doc bson.D, ctx *updateContext) (bson.D, error) {
+	switch {
+	case mod.op == "$setOnInsert" && !ctx.upsert:
+		return doc, nil
+	case mod.op == "$rename":
+		return mod.rename(doc)
+	}
+	pieces, err := ctx.resolvePositional(doc, mod.pieces)
+	if err != nil {
+		return nil, err
+	}
+	pu := bsonPathUpdate{pieces, mod.create, ctx.arrayFilters, func(old interface{}, exists bool) (interface{}, bool, error) {
+		return mod.leaf(ctx, old, exists)
+	}}
+	return pu.apply(doc)
+}
+
+// resolvePositional replaces the $ of a path with the position of the array element the query matched
+func (ctx *updateContext) resolvePositional(doc bson.D, pieces []string) ([]string, error) {
+	at := -1
+	for i, piece := range pieces {
+		if piece == "$" {
+			at = i
+		}
+	}
+	if at < 0 {
+		return pieces, nil
+	}
+
+	notFound := newBadValueError("The positional operator did not find the match needed from the query.")
+	if ctx.query == nil {
+		return nil, notFound
+	}
+	prefix := strings.Join(pieces[:at], ".")
+	v, _ := BSONGetPath(doc, prefix)
+	arr, ok := bsonArrayValue(v)
+	if !ok {
+		return nil, notFound
+	}
+	// the matched element is the first one the query still matches when it's alone in the array,
+	// as long as the query looks at the array at all
+	if empty, err := BSONSetPath(doc, prefix, []interface{}{}); err != nil || ctx.query.Matches(empty) {
+		return nil, notFound
+	}
+	for i, elem := range arr {
+		trial, err := BSONSetPath(doc, prefix, []interface{}{elem})
+		if err == nil && ctx.query.Matches(trial) {
+			res := append([]string{}, pieces...)
+			res[at] = strconv.Itoa(i)
+			return res, nil
+		}
+	}
+	return nil, notFound
+}
+
+// bsonArithmetic adds or multiplies two numbers, the result has the widest type of the two
+func bsonArithmetic(a, b interface{}, multiply bool) (interface{}, bool) {
+	fa, okA := BSONNumber(a)
+	fb, okB := BSONNumber(b)
+	if !okA || !okB {
+		return nil, false
+	}
+	_, decimalA := a.(bson.Decimal128)
+	_, decimalB := b.(bson.Decimal128)
+	_, floatA := a.(float64)
+	_, floatB := b.(float64)
+	if decimalA || decimalB || floatA || floatB {
+		f := fa + fb
+		if multiply {
+			f = fa * fb
+		}
+		if decimalA || decimalB {
+			d, err := bson.ParseDecimal128(strconv.FormatFloat(f, 'g', -1, 64))
+			return d, err == nil
+		}
+		return f, true
+	}
+
+	ia, _ := bsonInteger(a)
+	ib, _ := bsonInteger(b)
+	n := ia + ib
+	if multiply {
+		n = ia * ib
+	}
+	_, longA := a.(int64)
+	_, longB := b.(int64)
+	if longA || longB || n > math.MaxInt32 || n < math.MinInt32 {
+		return n, true
+	}
+	return int(n), true
+}
+
+func (mod *updateMod) compileArithmetic(arg interface{}) error {
+	multiply := mod.op == "$mul"
+	verb, name := "increment", "$inc"
+	if multiply {
+		verb, name = "multiply", "$mul"
+	}
+	if _, ok := BSONNumber(arg); !ok {
+		return updateError(14, "TypeMismatch", "Cannot %s with non-numeric argument: {%s: %v}", verb, mod.path, arg)
+	}
+	mod.leaf = func(ctx *updateContext, old interface{}, exists bool) (interface{}, bool, error) {
+		if !exists {
+			if multiply {
+				// a missing field is multiplied as a 0 of the argument's type
+				zero, _ := bsonArithmetic(arg, 0, true)
+				return zero, false, nil
+			}
+			return arg, false, nil
+		}
+		res, ok := bsonArithmetic(old, arg, multiply)
+		if !ok {
+			return nil, false, updateError(14, "TypeMismatch", "Cannot apply %s to a value of non-numeric type. {_id: %v} has the field '%s' of non-numeric type %s", name, ctx.id, mod.path, bsonTypeName(old))
+		}
+		return res, false, nil
+	}
+	return nil
+}
+
+func (mod *updateMod) compileCurrentDate(arg interface{}) error {
+	timestamp := false
+	switch val := arg.(type) {
+	case bool:
+	case bson.D:
+		t, _ := BSONGetPath(val, "$type")
+		if len(val) != 1 || (t != "date" && t != "timestamp") {
+			return newBadValueError("The '$type' string field is required to be 'date' or 'timestamp': {$currentDate: {field : {$type: 'date'}}}")
+		}
+		timestamp = t == "timestamp"
+	default:
+		return newBadValueError("%s is not valid type for $currentDate. Please use a boolean ('true') or a $type expression ({$type: 'timestamp/date'}).", bsonTypeName(arg))
+	}
+	mod.leaf = func(ctx *updateContext, _ interface{}, _ bool) (interface{}, bool, error) {
+		if timestamp {
+			return bson.MongoTimestamp(ctx.now.Unix()<<32 | 1), false, nil
+		}
+		return ctx.now.Truncate(time.Millisecond), false, nil
+	}
+	return nil
+}
+
+func (mod *updateMod) compileRename(arg interface{}, filters map[string]*BSONMatcher, used map[string]bool) error {
+	to, ok := arg.(string)
+	if !ok {
+		return newBadValueError("The 'to' field for $rename must be a string: %s: %v", mod.path, arg)
+	}
+	target, err := parseUpdatePath(to, filters, used)
+	if err != nil {
+		return err
+	}
+	switch {
+	case isDynamicPath(mod.pieces):
+		return newBadValueError("The source field for $rename may not be dynamic: %s", mod.path)
+	case isDynamicPath(target):
+		return newBadValueError("The destination field for $rename may not be dynamic: %s", to)
+	case to == mod.path:
+		return newBadValueError("The source and target field for $rename must differ: %s: %q", mod.path, to)
+	case pathHasPrefix(target, mod.pieces) || pathHasPrefix(mod.pieces, target):
+		return newBadValueError("The source and target field for $rename must not be on the same path: %s: %q", mod.path, to)
+	}
+	mod.target = target
+	return nil
+}
+
+func (mod *updateMod) rename(doc bson.D) (bson.D, error) {
+	value, exists, err := renameValue(doc, mod.pieces, "source")
+	if err != nil || !exists {
+		return doc, err
+	}
+	if _, _, err = renameValue(doc, mod.target, "destination"); err != nil {
+		return nil, err
+	}
+	if doc, err = BSONUnsetPath(doc, mod.path); err != nil {
+		return nil, err
+	}
+	return BSONSetPath(doc, strings.Join(mod.target, "."), value)
+}
+
+// renameValue follows a path through documents only, $rename doesn't reach into arrays
+func renameValue(doc bson.D, pieces []string, which string) (interface{}, bool, error) {
+	var current interface{} = doc
+	for i, piece := range pieces {
+		if _, isArray := bsonArrayValue(current); isArray {
+			return nil, false, newBadValueError("The %s field cannot be an array element, '%s' in doc with %s: %v", which, strings.Join(pieces, "."), pieces[i-1], current)
+		}
+		d, ok := current.(bson.D)
+		if !ok {
+			return nil, false, nil
+		}
+		idx := BSONIndexOf(d, piece)
+		if idx < 0 {
+			return nil, false, nil
+		}
+		current = d[idx].Value
+	}
+	return current, true, nil
+}
+
+// ---
+
+// arrayField returns the current value of a field array operators work on, nil if it's missing
+func arrayField(old interface{}, exists bool) ([]interface{}, bool) {
+	if !exists {
+		return nil, true
+	}
+	return bsonArrayValue(old)
+}
+
+func bsonIntegral(v interface{}) (int, bool) {
+	n, ok := BSONNumber(v)
+	if !ok || n != math.Trunc(n) {
+		return 0, false
+	}
+	return int(n), true
+}
+
+func (mod *updateMod) compilePush(arg interface{}) error {
+	each := []interface{}{arg}
+	position, slice := -1, 0
+	hasPosition, hasSlice := false, false
+	var sortSpec interface{}
+
+	if mods, ok := arg.(bson.D); ok && BSONIndexOf(mods, "$each") >= 0 {
+		for _, elem := range mods {
+			var ok bool
+			switch elem.Name {
+			case "$each":
+				if each, ok = bsonArrayValue(elem.Value); !ok {
+					return newBadValueError("The argument to $each in $push must be an array but it was of type: %s", bsonTypeName(elem.Value))
+				}
+			case "$position":
+				if position, ok = bsonIntegral(elem.Value); !ok {
+					return newBadValueError("The value for $position must be an integer value, not of type: %s", bsonTypeName(elem.Value))
+				}
+				hasPosition = true
+			case "$slice":
+				if slice, ok = bsonIntegral(elem.Value); !ok {
+					return newBadValueError("The value for $slice must be an integer value but was given type: %s", bsonTypeName(elem.Value))
+				}
+				hasSlice = true
+			case "$sort":
+				if !validPushSort(elem.Value) {
+					return newBadValueError("The $sort is invalid: use 1/-1 to sort the whole element, or {field:1/-1} to sort embedded fields")
+				}
+				sortSpec = elem.Value
+			default:
+				return newBadValueError("Unrecognized clause in $push: %s", elem.Name)
+			}
+		}
+	}
+
+	mod.leaf = func(ctx *updateContext, old interface{}, exists bool) (interface{}, bool, error) {
+		arr, ok := arrayField(old, exists)
+		if !ok {
+			return nil, false, newBadValueError("The field '%s' must be an array but is of type %s in document {_id: %v}", mod.path, bsonTypeName(old), ctx.id)
+		}
+		at := len(arr)
+		if hasPosition {
+			at = position
+			if at < 0 {
+				at += len(arr)
+			}
+			if at < 0 {
+				at = 0
+			} else if at > len(arr) {
+				at = len(arr)
+			}
+		}
+		res := make([]interface{}, 0, len(arr)+len(each))
+		res = append(append(append(res, arr[:at]...), each...), arr[at:]...)
+
+		switch spec := sortSpec.(type) {
+		case bson.D:
+			sort.SliceStable(res, func(i, j int) bool {
+				return BSONCompareBySort(bsonDocValue(res[i]), bsonDocValue(res[j]), spec) < 0
+			})
+		case nil:
+		default:
+			dir, _ := BSONNumber(spec)
+			sort.SliceStable(res, func(i, j int) bool {
+				return float64(BSONCompare(res[i], res[j]))*dir < 0
+			})
+		}
+		if hasSlice {
+			if slice >= 0 && slice < len(res) {
+				res = res[:slice]
+			} else if slice < 0 && -slice < len(res) {
+				res = res[len(res)+slice:]
+			}
+		}
+		return res, false, nil
+	}
+	return nil
+}
+
+func validPushSort(v interface{}) bool {
+	if spec, ok := v.(bson.D); ok {
+		for _, elem := range spec {
+			if dir, ok := BSONNumber(elem.Value); !ok || (dir != 1 && dir != -1) || elem.Name == "" {
+				return false
+			}
+		}
+		return len(spec) > 0
+	}
+	dir, ok := BSONNumber(v)
+	return ok && (dir == 1 || dir == -1)
+}
+
+func (mod *updateMod) compileAddToSet(arg interface{}) error {
+	each := []interface{}{arg}
+	if mods, ok := arg.(bson.D); ok && len(mods) > 0 && mods[0].Name == "$each" {
+		if len(mods) > 1 {
+			return newBadValueError("Found unexpected fields after $each in $addToSet: %v", mods)
+		}
+		if each, ok = bsonArrayValue(mods[0].Value); !ok {
+			return newBadValueError("The argument to $each in $addToSet must be an array but it was of type %s", bsonTypeName(mods[0].Value))
+		}
+	}
+	mod.leaf = func(ctx *updateContext, old interface{}, exists bool) (interface{}, bool, error) {
+		arr, ok := arrayField(old, exists)
+		if !ok {
+			return nil, false, newBadValueError("Cannot apply $addToSet to non-array field. Field named '%s' has non-array type %s", mod.path, bsonTypeName(old))
+		}
+		res := append([]interface{}{}, arr...)
+		for _, v := range each {
+			if !containsValue(res, v) {
+				res = append(res, v)
+			}
+		}
+		return res, false, nil
+	}
+	return nil
+}
+
+func containsValue(arr []interface{}, v interface{}) bool {
+	for _, elem := range arr {
+		if BSONCompare(elem, v) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (mod *updateMod) compilePop(arg interface{}) error {
+	n, ok := BSONNumber(arg)
+	if !ok || (n != 1 && n != -1) {
+		return updateError(9, "FailedToParse", "$pop expects 1 or -1, found: %v", arg)
+	}
+	mod.create = false
+	mod.leaf = func(ctx *updateContext, old interface{}, exists bool) (interface{}, bool, error) {
+		if !exists {
+			return nil, true, nil
+		}
+		arr, ok := bsonArrayValue(old)
+		switch {
+		case !ok:
+			return nil, false, updateError(14, "TypeMismatch", "Path '%s' contains an element of non-array type '%s'", mod.path, bsonTypeName(old))
+		case len(arr) == 0:
+			return arr, false, nil
+		case n < 0:
+			return append([]interface{}{}, arr[1:]...), false, nil
+		}
+		return append([]interface{}{}, arr[:len(arr)-1]...), false, nil
+	}
+	return nil
+}
+
+// compilePull removes the elements equal to the argument, matching its operators like {$gte: 6},
+// or for a document, the elements it matches as a query like {a: 1, b: {$gt: 2}}
+func (mod *updateMod) compilePull(arg interface{}) error {
+	var remove func(elem interface{}) bool
+	switch {
+	case mod.op == "$pullAll":
+		values, ok := bsonArrayValue(arg)
+		if !ok {
+			return newBadValueError("$pullAll requires an array argument but was given a %s", bsonTypeName(arg))
+		}
+		remove = func(elem interface{}) bool { return containsValue(values, elem) }
+	case isOperatorDoc(arg):
+		pred, err := compileOperators(arg.(bson.D))
+		if err != nil {
+			return err
+		}
+		remove = func(elem interface{}) bool { return pred([]interface{}{elem}) }
+	case bsonDocValue(arg) != nil:
+		matcher, err := CompileBSONFilter(bsonDocValue(arg))
+		if err != nil {
+			return err
+		}
+		remove = func(elem interface{}) bool {
+			doc := bsonDocValue(elem)
+			return doc != nil && matcher.Matches(doc)
+		}
+	default:
+		if re, ok := arg.(bson.RegEx); ok {
+			pred, err := compileRegex(re.Pattern, re.Options)
+			if err != nil {
+				return err
+			}
+			remove = func(elem interface{}) bool { return pred([]interface{}{elem}) }
+			break
+		}
+		remove = func(elem interface{}) bool { return BSONCompare(elem, arg) == 0 }
+	}
+
+	mod.create = false
+	mod.leaf = func(ctx *updateContext, old interface{}, exists bool) (interface{}, bool, error) {
+		if !exists {
+			return nil, true, nil
+		}
+		arr, ok := bsonArrayValue(old)
+		if !ok {
+			return nil, false, newBadValueError("Cannot apply %s to a non-array value", mod.op)
+		}
+		res := make([]interface{}, 0, len(arr))
+		for _, elem := range arr {
+			if !remove(elem) {
+				res = append(res, elem)
+			}
+		}
+		return res, false, nil
+	}
+	return nil
+}
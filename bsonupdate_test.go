@@ -0,0 +1,237 @@
+package mongonet
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBSONApplyUpdate(test *testing.T) {
+	doc := bson.D{
+		{"_id", 1},
+		{"name", "Widget"},
+		{"qty", 3},
+		{"tags", []interface{}{"red", "blue"}},
+		{"sizes", []interface{}{bson.D{{"w", 1}, {"h", 2}}, bson.D{{"w", 3}, {"h", 4}}}},
+		{"dims", bson.D{{"w", 10}, {"h", 20}}},
+	}
+
+	tests := []struct {
+		update bson.D
+		path   string
+		want   interface{}
+	}{
+		{bson.D{{"$set", bson.D{{"dims.w", 11}}}}, "dims.w", 11},
+		{bson.D{{"$set", bson.D{{"a.b.c", true}}}}, "a", bson.D{{"b", bson.D{{"c", true}}}}},
+		{bson.D{{"$set", bson.D{{"tags.3", "green"}}}}, "tags", []interface{}{"red", "blue", nil, "green"}},
+		{bson.D{{"$set", bson.D{{"sizes.1.w", 5}}}}, "sizes.1", bson.D{{"w", 5}, {"h", 4}}},
+		{bson.D{{"$unset", bson.D{{"dims.w", ""}}}}, "dims", bson.D{{"h", 20}}},
+		{bson.D{{"$unset", bson.D{{"tags.0", ""}}}}, "tags", []interface{}{nil, "blue"}},
+		{bson.D{{"$unset", bson.D{{"missing.a", ""}}}}, "name", "Widget"},
+
+		{bson.D{{"$inc", bson.D{{"qty", 2}}}}, "qty", 5},
+		{bson.D{{"$inc", bson.D{{"qty", 0.5}}}}, "qty", 3.5},
+		{bson.D{{"$inc", bson.D{{"qty", int64(1)}}}}, "qty", int64(4)},
+		{bson.D{{"$inc", bson.D{{"n", 1}}}}, "n", 1},
+		{bson.D{{"$mul", bson.D{{"qty", 3}}}}, "qty", 9},
+		{bson.D{{"$mul", bson.D{{"n", 2.5}}}}, "n", 0.0},
+		{bson.D{{"$mul", bson.D{{"n", int64(2)}}}}, "n", int64(0)},
+		{bson.D{{"$mul", bson.D{{"n", 2}}}}, "n", 0},
+		{bson.D{{"$min", bson.D{{"qty", 1}}}}, "qty", 1},
+		{bson.D{{"$min", bson.D{{"qty", 10}}}}, "qty", 3},
+		{bson.D{{"$max", bson.D{{"qty", 10}}}}, "qty", 10},
+
+		{bson.D{{"$rename", bson.D{{"name", "title"}}}}, "title", "Widget"},
+		{bson.D{{"$rename", bson.D{{"dims.w", "width"}}}}, "dims", bson.D{{"h", 20}}},
+
+		{bson.D{{"$push", bson.D{{"tags", "green"}}}}, "tags", []interface{}{"red", "blue", "green"}},
+		{bson.D{{"$push", bson.D{{"list", 1}}}}, "list", []interface{}{1}},
+		{bson.D{{"$push", bson.D{{"tags", bson.D{{"$each", []interface{}{"a", "z"}}, {"$sort", 1}, {"$slice", -3}}}}}}, "tags", []interface{}{"blue", "red", "z"}},
+		{bson.D{{"$push", bson.D{{"tags", bson.D{{"$each", []interface{}{"x"}}, {"$position", 0}}}}}}, "tags", []interface{}{"x", "red", "blue"}},
+		{bson.D{{"$push", bson.D{{"sizes", bson.D{{"$each", []interface{}{}}, {"$sort", bson.D{{"w", -1}}}}}}}}, "sizes.0.w", 3},
+		{bson.D{{"$addToSet", bson.D{{"tags", "red"}}}}, "tags", []interface{}{"red", "blue"}},
+		{bson.D{{"$addToSet", bson.D{{"tags", bson.D{{"$each", []interface{}{"blue", "green", "green"}}}}}}}, "tags", []interface{}{"red", "blue", "green"}},
+		{bson.D{{"$pop", bson.D{{"tags", 1}}}}, "tags", []interface{}{"red"}},
+		{bson.D{{"$pop", bson.D{{"tags", -1}}}}, "tags", []interface{}{"blue"}},
+		{bson.D{{"$pull", bson.D{{"tags", "red"}}}}, "tags", []interface{}{"blue"}},
+		{bson.D{{"$pull", bson.D{{"sizes", bson.D{{"w", bson.D{{"$gt", 2}}}}}}}}, "sizes", []interface{}{bson.D{{"w", 1}, {"h", 2}}}},
+		{bson.D{{"$pull", bson.D{{"tags", bson.D{{"$in", []interface{}{"red", "blue"}}}}}}}, "tags", []interface{}{}},
+		{bson.D{{"$pullAll", bson.D{{"tags", []interface{}{"blue"}}}}}, "tags", []interface{}{"red"}},
+
+		{bson.D{{"$set", bson.D{{"sizes.$[].h", 0}}}}, "sizes", []interface{}{bson.D{{"w", 1}, {"h", 0}}, bson.D{{"w", 3}, {"h", 0}}}},
+		{bson.D{{"$setOnInsert", bson.D{{"qty", 100}}}}, "qty", 3},
+	}
+
+	for _, t := range tests {
+		res, err := BSONApplyUpdate(doc, t.update)
+		if err != nil {
+			test.Errorf("%v failed: %s", t.update, err)
+			continue
+		}
+		got, _ := BSONGetPath(res, t.path)
+		if BSONCompare(got, t.want) != 0 {
+			test.Errorf("%v should give %s: %v, got %v", t.update, t.path, t.want, got)
+		}
+		if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", t.want) {
+			test.Errorf("%v should give a %T, got %T", t.update, t.want, got)
+		}
+	}
+
+	if doc[2].Value != 3 || len(doc[3].Value.([]interface{})) != 2 {
+		test.Errorf("the original document should not change: %v", doc)
+	}
+
+	// new fields are added in lexicographic order
+	res, err := BSONApplyUpdate(bson.D{{"_id", 1}}, bson.D{{"$set", bson.D{{"b", 1}, {"a", 1}}}, {"$inc", bson.D{{"c", 1}}}})
+	if err != nil || len(res) != 4 || res[1].Name != "a" || res[2].Name != "b" || res[3].Name != "c" {
+		test.Errorf("expected _id, a, b and c, got %v %v", res, err)
+	}
+
+	res, err = BSONApplyUpdate(doc, bson.D{{"$currentDate", bson.D{{"d", true}, {"t", bson.D{{"$type", "timestamp"}}}}}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if d, _ := BSONGetPath(res, "d"); time.Since(d.(time.Time)) > time.Minute {
+		test.Errorf("d should be now, got %v", d)
+	}
+	if t, _ := BSONGetPath(res, "t"); bsonTypeCode(t) != 17 {
+		test.Errorf("t should be a timestamp, got %v", t)
+	}
+
+	res, err = BSONApplyUpdate(doc, bson.D{{"name", "Gadget"}})
+	if err != nil || len(res) != 2 || res[0].Name != "_id" || res[1].Value != "Gadget" {
+		test.Errorf("a replacement should keep the _id, got %v %v", res, err)
+	}
+}
+
+func TestBSONUpdaterPositional(test *testing.T) {
+	doc := bson.D{
+		{"_id", 1},
+		{"grades", []interface{}{bson.D{{"grade", 80}, {"mean", 75}}, bson.D{{"grade", 85}, {"mean", 90}}, bson.D{{"grade", 90}, {"mean", 85}}}},
+		{"scores", []interface{}{1, 5, 9}},
+	}
+
+	bu, err := CompileBSONUpdate(bson.D{{"$set", bson.D{{"grades.$.mean", 100}}}}, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	res, err := bu.Apply(doc, bson.D{{"grades.grade", bson.D{{"$gte", 85}}}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if m, _ := BSONGetPath(res, "grades.1.mean"); m != 100 {
+		test.Errorf("the second grade should be updated, got %v", res)
+	}
+	if _, err = bu.Apply(doc, bson.D{{"_id", 1}}); err == nil {
+		test.Errorf("the positional operator needs the query to match an array element")
+	}
+
+	bu, err = CompileBSONUpdate(bson.D{{"$inc", bson.D{{"scores.$[big]", 10}, {"grades.$[g].mean", 1}}}},
+		[]bson.D{{{"big", bson.D{{"$gte", 5}}}}, {{"g.grade", bson.D{{"$lt", 90}}}, {"g.mean", bson.D{{"$gt", 80}}}}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	res, err = bu.Apply(doc, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if s, _ := BSONGetPath(res, "scores"); BSONCompare(s, []interface{}{1, 15, 19}) != 0 {
+		test.Errorf("expected scores 1, 15, 19, got %v", s)
+	}
+	if g, _ := BSONGetPath(res, "grades"); BSONCompare(g, []interface{}{bson.D{{"grade", 80}, {"mean", 75}}, bson.D{{"grade", 85}, {"mean", 91}}, bson.D{{"grade", 90}, {"mean", 85}}}) != 0 {
+		test.Errorf("only the second grade should change, got %v", g)
+	}
+
+	bu, err = CompileBSONUpdate(bson.D{{"$set", bson.D{{"x", 1}}}, {"$setOnInsert", bson.D{{"created", true}}}}, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	res, err = bu.Upsert(bson.D{{"a.b", 1}, {"_id", 7}, {"c", bson.D{{"$gt", 1}}}, {"$and", []interface{}{bson.D{{"d", bson.D{{"$eq", 2}}}}}}})
+	want := bson.D{{"_id", 7}, {"a", bson.D{{"b", 1}}}, {"d", 2}, {"created", true}, {"x", 1}}
+	if err != nil || BSONCompare(res, want) != 0 {
+		test.Errorf("expected %v, got %v %v", want, res, err)
+	}
+}
+
+func TestBSONUpdateErrors(test *testing.T) {
+	doc := bson.D{{"_id", 1}, {"name", "Widget"}, {"tags", []interface{}{"red"}}, {"n", 5}}
+
+	compileErrors := []struct {
+		update bson.D
+		code   int
+	}{
+		{bson.D{{"$foo", bson.D{{"a", 1}}}}, 9},
+		{bson.D{{"$set", bson.D{{"a", 1}}}, {"b", 1}}, 9},
+		{bson.D{{"$set", 1}}, 9},
+		{bson.D{{"$set", bson.D{}}}, 9},
+		{bson.D{{"a", 1}, {"$set", bson.D{{"b", 1}}}}, 52},
+		{bson.D{{"$set", bson.D{{"a..b", 1}}}}, 56},
+		{bson.D{{"$set", bson.D{{"$a", 1}}}}, 52},
+		{bson.D{{"$set", bson.D{{"a", 1}, {"a.b", 1}}}}, 40},
+		{bson.D{{"$set", bson.D{{"a", 1}}}, {"$inc", bson.D{{"a", 1}}}}, 40},
+		{bson.D{{"$inc", bson.D{{"a", "x"}}}}, 14},
+		{bson.D{{"$mul", bson.D{{"a", nil}}}}, 14},
+		{bson.D{{"$pop", bson.D{{"a", 2}}}}, 9},
+		{bson.D{{"$rename", bson.D{{"a", 1}}}}, 2},
+		{bson.D{{"$rename", bson.D{{"a", "a"}}}}, 2},
+		{bson.D{{"$rename", bson.D{{"a", "a.b"}}}}, 2},
+		{bson.D{{"$rename", bson.D{{"a.$", "b"}}}}, 2},
+		{bson.D{{"$currentDate", bson.D{{"a", bson.D{{"$type", "int"}}}}}}, 2},
+		{bson.D{{"$push", bson.D{{"a", bson.D{{"$each", 1}}}}}}, 2},
+		{bson.D{{"$push", bson.D{{"a", bson.D{{"$each", []interface{}{}}, {"$foo", 1}}}}}}, 2},
+		{bson.D{{"$push", bson.D{{"a", bson.D{{"$each", []interface{}{}}, {"$sort", 2}}}}}}, 2},
+		{bson.D{{"$set", bson.D{{"a.$.b.$", 1}}}}, 2},
+		{bson.D{{"$set", bson.D{{"a.$[x]", 1}}}}, 2},
+	}
+	for _, t := range compileErrors {
+		_, err := CompileBSONUpdate(t.update, nil)
+		if me, ok := err.(MongoError); !ok || me.Code() != t.code {
+			test.Errorf("%v should fail with %d, got %v", t.update, t.code, err)
+		}
+	}
+
+	filterErrors := []struct {
+		arrayFilters []bson.D
+		code         int
+	}{
+		{[]bson.D{{{"x", 1}}, {{"y", 1}}}, 9},
+		{[]bson.D{{{"x", 1}}, {{"x", 2}}}, 9},
+		{[]bson.D{{{"x", 1}, {"y", 1}}}, 9},
+		{[]bson.D{{{"X", 1}}}, 2},
+	}
+	for _, t := range filterErrors {
+		_, err := CompileBSONUpdate(bson.D{{"$set", bson.D{{"a.$[x]", 1}}}}, t.arrayFilters)
+		if me, ok := err.(MongoError); !ok || me.Code() != t.code {
+			test.Errorf("%v should fail with %d, got %v", t.arrayFilters, t.code, err)
+		}
+	}
+
+	applyErrors := []struct {
+		update bson.D
+		code   int
+	}{
+		{bson.D{{"$set", bson.D{{"_id", 2}}}}, 66},
+		{bson.D{{"_id", 2}}, 66},
+		{bson.D{{"$set", bson.D{{"name.first", "W"}}}}, 28},
+		{bson.D{{"$set", bson.D{{"tags.x", 1}}}}, 28},
+		{bson.D{{"$inc", bson.D{{"name", 1}}}}, 14},
+		{bson.D{{"$push", bson.D{{"n", 1}}}}, 2},
+		{bson.D{{"$addToSet", bson.D{{"n", 1}}}}, 2},
+		{bson.D{{"$pop", bson.D{{"n", 1}}}}, 14},
+		{bson.D{{"$pull", bson.D{{"n", 1}}}}, 2},
+		{bson.D{{"$set", bson.D{{"n.$[]", 1}}}}, 2},
+		{bson.D{{"$set", bson.D{{"missing.$[]", 1}}}}, 2},
+		{bson.D{{"$set", bson.D{{"tags.$", 1}}}}, 2},
+		{bson.D{{"$rename", bson.D{{"tags.0", "t"}}}}, 2},
+		{bson.D{{"$rename", bson.D{{"tags.x", "c"}}}}, 2},
+		{bson.D{{"$rename", bson.D{{"name", "tags.name"}}}}, 2},
+	}
+	for _, t := range applyErrors {
+		_, err := BSONApplyUpdate(doc, t.update)
+		if me, ok := err.(MongoError); !ok || me.Code() != t.code {
+			test.Errorf("%v should fail with %d, got %v", t.update, t.code, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package mongonet
 
 import "fmt"
+import "strconv"
 import "strings"
 
 import "gopkg.in/mgo.v2/bson"
@@ -333,3 +334,176 @@ func BSONWalkHelp(doc bson.D, path []string, visitor BSONWalkVisitor, inArray bo
 
 	return doc, nil
 }
+
+// ---
+
+// bsonPathLeaf computes the new value of the field at the end of a path from the current one,
+// exists is false if the field is missing. unset removes the field, array elements become null instead.
+type bsonPathLeaf func(old interface{}, exists bool) (value interface{}, unset bool, err error)
+
+// bsonPathUpdate rewrites the field at the end of a path, copying the documents and arrays on
+// the way rather than changing them in place. Unlike BSONWalk it doesn't fan out over arrays of
+// documents: array elements are reached with numeric pieces, or all of them with $[], or those
+// matching the filter of the identifier with $[identifier].
+type bsonPathUpdate struct {
+	pieces       []string
+	create       bool // create missing fields on the way, or leave the document alone
+	arrayFilters map[string]*BSONMatcher
+	leaf         bsonPathLeaf
+}
+
+func (pu *bsonPathUpdate) apply(doc bson.D) (bson.D, error) {
+	res, err := pu.walk(doc, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res.(bson.D), nil
+}
+
+// bsonArrayIdentifier returns the identifier of a $[identifier] path piece, empty for $[]
+func bsonArrayIdentifier(piece string) (string, bool) {
+	if strings.HasPrefix(piece, "$[") && strings.HasSuffix(piece, "]") {
+		return piece[2 : len(piece)-1], true
+	}
+	return "", false
+}
+
+func (pu *bsonPathUpdate) walk(v interface{}, at int) (interface{}, error) {
+	piece := pu.pieces[at]
+	if arr, ok := bsonArrayValue(v); ok {
+		return pu.walkArray(arr, at)
+	}
+	if _, ok := bsonArrayIdentifier(piece); ok {
+		return nil, newBadValueError("Cannot apply array updates to non-array element %s: %v", strings.Join(pu.pieces[:at], "."), v)
+	}
+	doc, ok := v.(bson.D)
+	if !ok {
+		if !pu.create {
+			return v, nil
+		}
+		return nil, pu.notViable(v, at)
+	}
+
+	idx := BSONIndexOf(doc, piece)
+	var child interface{}
+	var err error
+	switch {
+	case at == len(pu.pieces)-1:
+		var old interface{}
+		if idx >= 0 {
+			old = doc[idx].Value
+		}
+		var unset bool
+		if child, unset, err = pu.leaf(old, idx >= 0); err != nil {
+			return nil, err
+		}
+		if unset {
+			if idx < 0 {
+				return doc, nil
+			}
+			return append(append(bson.D{}, doc[:idx]...), doc[idx+1:]...), nil
+		}
+	case idx >= 0:
+		if child, err = pu.walk(doc[idx].Value, at+1); err != nil {
+			return nil, err
+		}
+	case !pu.create:
+		return doc, nil
+	default:
+		if _, ok := bsonArrayIdentifier(pu.pieces[at+1]); ok {
+			return nil, newBadValueError("The path '%s' must exist in the document in order to apply array updates.", strings.Join(pu.pieces[:at+1], "."))
+		}
+		if child, err = pu.walk(bson.D{}, at+1); err != nil {
+			return nil, err
+		}
+	}
+
+	res := append(bson.D{}, doc...)
+	if idx < 0 {
+		return append(res, bson.DocElem{piece, child}), nil
+	}
+	res[idx].Value = child
+	return res, nil
+}
+
+func (pu *bsonPathUpdate) walkArray(arr []interface{}, at int) (interface{}, error) {
+	piece := pu.pieces[at]
+	res := append([]interface{}{}, arr...)
+	var err error
+
+	if id, ok := bsonArrayIdentifier(piece); ok {
+		var filter *BSONMatcher
+		if id != "" {
+			if filter = pu.arrayFilters[id]; filter == nil {
+				return nil, newBadValueError("No array filter found for identifier '%s' in path '%s'", id, strings.Join(pu.pieces, "."))
+			}
+		}
+		for i, elem := range arr {
+			if filter != nil && !filter.Matches(bson.D{{id, elem}}) {
+				continue
+			}
+			if res[i], err = pu.walkElement(elem, true, at); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	i, err := strconv.Atoi(piece)
+	switch {
+	case err != nil || i < 0:
+		if !pu.create {
+			return arr, nil
+		}
+		return nil, pu.notViable(arr, at)
+	case i < len(arr):
+		res[i], err = pu.walkElement(arr[i], true, at)
+	case !pu.create:
+		return arr, nil
+	default:
+		for len(res) <= i {
+			res = append(res, nil)
+		}
+		res[i], err = pu.walkElement(nil, false, at)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// walkElement updates an array element, which can't be removed so it's set to null instead
+func (pu *bsonPathUpdate) walkElement(elem interface{}, exists bool, at int) (interface{}, error) {
+	if at < len(pu.pieces)-1 {
+		if !exists {
+			elem = bson.D{}
+		}
+		return pu.walk(elem, at+1)
+	}
+	value, unset, err := pu.leaf(elem, exists)
+	if err != nil || unset {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (pu *bsonPathUpdate) notViable(v interface{}, at int) error {
+	return NewMongoError(fmt.Errorf("Cannot create field '%s' in element {%s: %v}", pu.pieces[at], pu.pieces[at-1], v), 28, "PathNotViable")
+}
+
+// BSONSetPath returns a copy of doc with the dotted path set to value, creating the documents on
+// the way. Numeric pieces index into arrays, which are padded with nulls when they are too short.
+func BSONSetPath(doc bson.D, path string, value interface{}) (bson.D, error) {
+	pu := bsonPathUpdate{strings.Split(path, "."), true, nil, func(interface{}, bool) (interface{}, bool, error) {
+		return value, false, nil
+	}}
+	return pu.apply(doc)
+}
+
+// BSONUnsetPath returns a copy of doc without the dotted path. Array elements are set to null.
+func BSONUnsetPath(doc bson.D, path string) (bson.D, error) {
+	pu := bsonPathUpdate{strings.Split(path, "."), false, nil, func(interface{}, bool) (interface{}, bool, error) {
+		return nil, true, nil
+	}}
+	return pu.apply(doc)
+}
@@ -390,3 +390,35 @@ func TestBSONWalkAll6(test *testing.T) {
 		test.Errorf("element should've been deleted %s", doc)
 	}
 }
+
+func TestBSONSetPath(test *testing.T) {
+	doc := bson.D{{"a", 1}, {"b", bson.D{{"c", []interface{}{1, bson.D{{"d", 2}}}}}}}
+
+	res, err := BSONSetPath(doc, "b.c.1.d", 5)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if v, _ := BSONGetPath(res, "b.c.1.d"); v != 5 {
+		test.Errorf("b.c.1.d should be 5, got %v", res)
+	}
+	if v, _ := BSONGetPath(doc, "b.c.1.d"); v != 2 {
+		test.Errorf("the original document should not change, got %v", doc)
+	}
+
+	if res, err = BSONSetPath(doc, "x.y", true); err != nil || BSONIndexOf(res, "x") != 2 {
+		test.Errorf("x.y should be created, got %v %v", res, err)
+	}
+	if _, err = BSONSetPath(doc, "a.y", true); err == nil {
+		test.Errorf("a is a number, a.y can't be set")
+	}
+
+	if res, err = BSONUnsetPath(doc, "b.c.0"); err != nil {
+		test.Fatal(err)
+	}
+	if v, ok := BSONGetPath(res, "b.c.0"); !ok || v != nil {
+		test.Errorf("b.c.0 should be null, got %v", res)
+	}
+	if res, err = BSONUnsetPath(doc, "a"); err != nil || len(res) != 1 {
+		test.Errorf("a should be removed, got %v %v", res, err)
+	}
+}
@@ -0,0 +1,126 @@
+package mongonet
+
+import (
+	"context"
+	"time"
+)
+
+// InterceptorChain is a ProxyInterceptorFactoryV2 combining several, so logging, auth, rewriting
+// and metrics can be written as separate interceptors. Requests pass the links in order, each
+// seeing the Message the previous one produced, until one answers the client itself or fails.
+// Responses pass the response interceptors of the links the request went through in reverse order.
+// Every link gets the request's context, ProxyInterceptorFactory links join with AdaptInterceptorFactory.
+type InterceptorChain struct {
+	factories []ProxyInterceptorFactoryV2
+}
+
+func NewInterceptorChain(factories ...ProxyInterceptorFactoryV2) *InterceptorChain {
+	return &InterceptorChain{factories}
+}
+
+func (ic *InterceptorChain) NewInterceptor(ps *ProxySession) (ProxyInterceptorV2, error) {
+	links := make([]ProxyInterceptorV2, 0, len(ic.factories))
+	for _, factory := range ic.factories {
+		link, err := factory.NewInterceptor(ps)
+		if err != nil {
+			for _, made := range links {
+				made.Close()
+			}
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return &chainInterceptor{links}, nil
+}
+
+type chainInterceptor struct {
+	links []ProxyInterceptorV2
+}
+
+func (ci *chainInterceptor) InterceptClientToMongo(ctx context.Context, m Message) (Message, ResponseInterceptorV2, error) {
+	var respInters chainResponseInterceptor
+	for _, link := range ci.links {
+		next, respInter, err := link.InterceptClientToMongo(ctx, m)
+		if err != nil || next == nil {
+			// answered or failed, the rest of the chain doesn't see the request
+			return next, nil, err
+		}
+		if respInter != nil {
+			respInters = append(respInters, respInter)
+		}
+		m = next
+	}
+
+	if len(respInters) == 0 {
+		return m, nil, nil
+	}
+	return m, respInters, nil
+}
+
+func (ci *chainInterceptor) Close() {
+	for _, link := range ci.links {
+		link.Close()
+	}
+}
+
+func (ci *chainInterceptor) TrackRequest(h MessageHeader) {
+	for _, link := range ci.links {
+		link.TrackRequest(h)
+	}
+}
+
+func (ci *chainInterceptor) TrackRequestMessage(m Message) {
+	for _, link := range ci.links {
+		link.TrackRequestMessage(m)
+	}
+}
+
+func (ci *chainInterceptor) TrackResponse(h MessageHeader) {
+	for _, link := range ci.links {
+		link.TrackResponse(h)
+	}
+}
+
+func (ci *chainInterceptor) TrackResponseMessage(m Message) {
+	for _, link := range ci.links {
+		link.TrackResponseMessage(m)
+	}
+}
+
+// CheckConnection asks every link, the first error wins
+func (ci *chainInterceptor) CheckConnection() error {
+	var first error
+	for _, link := range ci.links {
+		if err := link.CheckConnection(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// CheckConnectionInterval is the shortest interval of the links which want checks,
+// so links may be checked more often than they asked for
+func (ci *chainInterceptor) CheckConnectionInterval() time.Duration {
+	interval := time.Duration(0)
+	for _, link := range ci.links {
+		i := link.CheckConnectionInterval()
+		if i > 0 && (interval == 0 || i < interval) {
+			interval = i
+		}
+	}
+	return interval
+}
+
+// chainResponseInterceptor unwinds the response interceptors of a chain, the last link's first
+type chainResponseInterceptor []ResponseInterceptorV2
+
+func (cri chainResponseInterceptor) InterceptMongoToClient(ctx context.Context, m Message) (Message, error) {
+	for i := len(cri) - 1; i >= 0; i-- {
+		var err error
+		m, err = cri[i].InterceptMongoToClient(ctx, m)
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
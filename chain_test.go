@@ -0,0 +1,99 @@
+package mongonet
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testLink records what it sees and tags requests and responses with its name
+type testLink struct {
+	name     string
+	log      *[]string
+	stop     bool // answer requests itself
+	interval time.Duration
+	checkErr error
+}
+
+func (tl *testLink) NewInterceptor(ps *ProxySession) (ProxyInterceptor, error) {
+	return tl, nil
+}
+
+func (tl *testLink) InterceptClientToMongo(m Message) (Message, ResponseInterceptor, error) {
+	_, cmd, _ := GetCommand(m)
+	*tl.log = append(*tl.log, fmt.Sprintf("%s saw %v", tl.name, cmd[len(cmd)-1].Name))
+	if tl.stop {
+		return nil, nil, nil
+	}
+	SetCommand(m, append(cmd, bson.DocElem{tl.name, 1}))
+	return m, tl, nil
+}
+
+func (tl *testLink) InterceptMongoToClient(m Message) (Message, error) {
+	*tl.log = append(*tl.log, tl.name+" response")
+	return m, nil
+}
+
+func (tl *testLink) Close()                                 { *tl.log = append(*tl.log, tl.name+" closed") }
+func (tl *testLink) TrackRequest(MessageHeader)             {}
+func (tl *testLink) TrackRequestMessage(Message)            {}
+func (tl *testLink) TrackResponse(MessageHeader)            {}
+func (tl *testLink) TrackResponseMessage(Message)           {}
+func (tl *testLink) CheckConnection() error                 { return tl.checkErr }
+func (tl *testLink) CheckConnectionInterval() time.Duration { return tl.interval }
+
+func TestInterceptorChain(test *testing.T) {
+	log := []string{}
+	a := &testLink{"a", &log, false, 0, nil}
+	b := &testLink{"b", &log, false, 5 * time.Second, nil}
+	c := &testLink{"c", &log, false, time.Second, fmt.Errorf("c is done")}
+	ci := &contextInterceptor{make(chan time.Duration, 1), nil}
+	chained, err := NewInterceptorChain(AdaptInterceptorFactory(a), ci, AdaptInterceptorFactory(b), AdaptInterceptorFactory(c)).NewInterceptor(nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, respInter, err := chained.InterceptClientToMongo(ctx, testCommandMessage(bson.D{{"find", "foo"}}))
+	if err != nil || m == nil || respInter == nil {
+		test.Fatalf("the request should go through: %v %v %s", m, respInter, err)
+	}
+	_, cmd, _ := GetCommand(m)
+	if len(cmd) != 4 || cmd[3].Name != "c" {
+		test.Errorf("every link should have changed the request: %v", cmd)
+	}
+	if deadline := <-ci.deadlines; deadline <= 0 {
+		test.Errorf("the request's deadline should reach the links")
+	}
+	respInter.InterceptMongoToClient(ctx, testReply(bson.D{{"ok", 1}}))
+
+	want := "a saw find,b saw a,c saw b,c response,b response,a response"
+	if got := strings.Join(log, ","); got != want {
+		test.Errorf("expected %s, got %s", want, got)
+	}
+
+	if interval := chained.CheckConnectionInterval(); interval != time.Second {
+		test.Errorf("the shortest interval should win, got %s", interval)
+	}
+	if err := chained.CheckConnection(); err == nil || err.Error() != "c is done" {
+		test.Errorf("c's error should come through, got %v", err)
+	}
+
+	// b answers, so c doesn't see the request and no response interceptor runs
+	log = log[:0]
+	b.stop = true
+	m, respInter, err = chained.InterceptClientToMongo(ctx, testCommandMessage(bson.D{{"find", "foo"}}))
+	if m != nil || respInter != nil || err != nil {
+		test.Errorf("b should have answered: %v %v %s", m, respInter, err)
+	}
+	chained.Close()
+	want = "a saw find,b saw a,a closed,b closed,c closed"
+	if got := strings.Join(log, ","); got != want {
+		test.Errorf("expected %s, got %s", want, got)
+	}
+}
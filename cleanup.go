@@ -0,0 +1,84 @@
+package mongonet
+
+import (
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// cleanupUpstream is called when a client goes away and releases what it left open upstream:
+// cursors are killed and transactions aborted, so mongod does not have to wait for them to time out.
+// It returns the connection it used, which the caller still has to release.
+func (ps *ProxySession) cleanupUpstream(pooledConn *PooledConnection) *PooledConnection {
+	if pooledConn != nil && pooledConn.bad {
+		ps.releaseConnection(pooledConn)
+		pooledConn = nil
+	}
+
+	cursors := ps.proxy.cursors.ownedBy(ps)
+	if len(cursors) > 0 {
+		byPool := map[*ConnectionPool][]registeredCursor{}
+		for _, c := range cursors {
+			byPool[c.pool] = append(byPool[c.pool], c)
+		}
+		for pool, poolCursors := range byPool {
+			err := killRemoteCursors(pool, pooledConn, poolCursors)
+			if err != nil {
+				ps.logger.Logf(slogger.INFO, "error killing cursors while cleaning up after client: %s", err)
+			}
+			for _, c := range poolCursors {
+				ps.proxy.cursors.remove(c.id)
+			}
+		}
+	}
+
+	state := &ps.upstreamState
+	endSessions := ps.proxy.config.EndSessionsOnDisconnect && len(state.lsids) > 0
+	if len(state.transactions) == 0 && !endSessions {
+		return pooledConn
+	}
+
+	if pooledConn == nil {
+		pool, err := ps.defaultPool()
+		if err == nil {
+			pooledConn, err = pool.Get()
+		}
+		if err != nil {
+			ps.logger.Logf(slogger.WARN, "cannot get connection to clean up after client: %s", err)
+			return nil
+		}
+	}
+
+	run := func(db string, cmd bson.D) {
+		_, err := RunCommand(pooledConn.conn, db, cmd)
+		if err != nil {
+			ps.logger.Logf(slogger.INFO, "error running %s while cleaning up after client: %s", CommandName(cmd), err)
+			if _, ok := err.(MongoError); !ok {
+				pooledConn.bad = true
+			}
+		}
+	}
+
+	for _, txn := range state.transactions {
+		if pooledConn.bad {
+			break
+		}
+		run("admin", bson.D{
+			{"abortTransaction", 1},
+			{"lsid", txn.lsid},
+			{"txnNumber", txn.txnNumber},
+			{"autocommit", false},
+		})
+	}
+
+	if endSessions && !pooledConn.bad {
+		lsids := make([]bson.D, 0, len(state.lsids))
+		for _, lsid := range state.lsids {
+			lsids = append(lsids, lsid)
+		}
+		run("admin", bson.D{{"endSessions", lsids}})
+	}
+
+	ps.logger.Logf(slogger.DEBUG, "cleaned up %d cursors and %d transactions", len(cursors), len(state.transactions))
+	ps.upstreamState = newUpstreamState()
+	return pooledConn
+}
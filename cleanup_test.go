@@ -0,0 +1,56 @@
+package mongonet_test
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/erh/mongonet"
+	"github.com/erh/mongonet/mongotest"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCleanupOnDisconnect(test *testing.T) {
+	lsid := bson.D{{"id", bson.Binary{4, []byte("0123456789abcdef")}}}
+	ss := mongotest.NewScriptedServer(test)
+	ss.Expect("find").On("test.foo").Reply(bson.D{{"cursor", bson.D{{"firstBatch", []bson.D{{{"x", 1}}}}, {"id", int64(42)}, {"ns", "test.foo"}}}})
+	ss.Expect("insert").On("test.foo").With(bson.D{{"txnNumber", int64(5)}, {"startTransaction", true}})
+	// what the proxy sends once the client is gone
+	ss.Expect("killCursors").On("test.foo").With(bson.D{{"cursors", []interface{}{int64(42)}}, {"lsid", lsid}})
+	ss.Expect("abortTransaction").On("admin").With(bson.D{{"lsid", lsid}, {"txnNumber", int64(5)}, {"autocommit", false}})
+	ss.Expect("endSessions").On("admin").With(bson.D{{"endSessions", []interface{}{lsid}}})
+	defer ss.Finish()
+
+	host, port, _ := net.SplitHostPort(ss.Addr())
+	mongoPort, _ := strconv.Atoi(port)
+	pc := mongonet.NewProxyConfig("127.0.0.1", 9947, host, mongoPort)
+	pc.EndSessionsOnDisconnect = true
+	proxy := mongonet.NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9947")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	if _, err = mongonet.RunCommand(conn, "test", bson.D{{"find", "foo"}, {"lsid", lsid}}); err != nil {
+		test.Fatal(err)
+	}
+	insert := bson.D{{"insert", "foo"}, {"documents", []bson.D{{{"x", 2}}}}, {"lsid", lsid}, {"txnNumber", int64(5)}, {"startTransaction", true}, {"autocommit", false}}
+	if _, err = mongonet.RunCommand(conn, "test", insert); err != nil {
+		test.Fatal(err)
+	}
+	conn.Close()
+
+	for i := 0; i < 500 && ss.Pending() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ss.Pending() != 0 {
+		test.Fatalf("the proxy didn't clean up, %d requests missing", ss.Pending())
+	}
+}
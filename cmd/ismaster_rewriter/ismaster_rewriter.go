@@ -38,30 +38,6 @@ func (myi *MyInterceptor) sniResponse() mongonet.SimpleBSON {
 	return raw
 }
 
-func (myi *MyInterceptor) isMasterResponse() mongonet.SimpleBSON {
-	// doc := bson.D{
-	// 	{"msg", "isdbgrid"},
-	// 	{"maxBsonObjectSize", 16777216},
-	// 	{"maxMessageSizeBytes", 48000000},
-	// 	{"maxWriteBatchSize", 100000},
-	// 	// {"localTime", new Date()},
-	// 	{"maxWireVersion", 7},
-	// 	{"minWireVersion", 5},
-	// 	{"ok", 1},
-	// 	{"readOnly", false},
-	// }
-	doc := bson.D{
-		{"maxWireVersion", 5}, // very important to set this to 5! otherwise it does not work. from wireversion 6 the MessageMessage is used.
-		{"minWireVersion", 0},
-		{"ok", 1},
-	}
-	raw, err := mongonet.SimpleBSONConvert(doc)
-	if err != nil {
-		panic(err)
-	}
-	return raw
-}
-
 func (myi *MyInterceptor) InterceptClientToMongo(m mongonet.Message) (mongonet.Message, mongonet.ResponseInterceptor, error) {
 	switch mm := m.(type) {
 	case *mongonet.QueryMessage:
@@ -80,10 +56,6 @@ func (myi *MyInterceptor) InterceptClientToMongo(m mongonet.Message) (mongonet.M
 		cmdName := strings.ToLower(query[0].Name)
 		log.Println("cmdName:", cmdName)
 		switch cmdName {
-		case "ismaster":
-			err := myi.ps.RespondToCommand(mm, myi.isMasterResponse())
-			return nil, nil, err
-
 		case "sni":
 			return nil, nil, newSNIError(myi.ps.RespondToCommand(mm, myi.sniResponse()))
 		}
@@ -93,23 +65,25 @@ func (myi *MyInterceptor) InterceptClientToMongo(m mongonet.Message) (mongonet.M
 		cmdName := strings.ToLower(mm.CmdName)
 		log.Println("cmdName:", cmdName)
 		switch cmdName {
-		case "ismaster":
-			err := myi.ps.RespondToCommand(mm, myi.isMasterResponse())
-			return nil, nil, err
-
 		case "sni":
 			return nil, nil, newSNIError(myi.ps.RespondToCommand(mm, myi.sniResponse()))
 		}
 		return mm, nil, nil
 
 	case *mongonet.MessageMessage:
-		log.Println("message message:", mm.Serialize())
-		// if mm.CmdName == "sni" {
-		// 	return nil, nil, newSNIError(myi.ps.RespondToCommand(mm, myi.sniResponse()))
-		// }
-		// if mm.CmdName == "isMaster" {
-		// 	return mm, nil, nil
-		// }
+		// clients use OP_MSG from wire version 6, the proxy's hello reply no longer holds them back
+		_, cmd, err := mongonet.GetCommand(mm)
+		if err != nil {
+			// let mongod handle error message
+			log.Println("error reading OP_MSG command:", err)
+			return m, nil, nil
+		}
+		cmdName := strings.ToLower(mongonet.CommandName(cmd))
+		log.Println("cmdName:", cmdName)
+		switch cmdName {
+		case "sni":
+			return nil, nil, newSNIError(myi.ps.RespondToCommand(mm, myi.sniResponse()))
+		}
 		return m, nil, nil
 	}
 
@@ -158,6 +132,9 @@ func main() {
 	bindPort := flag.Int("port", 9999, "what to bind to")
 	mongoHost := flag.String("mongoHost", "127.0.0.1", "host mongo is on")
 	mongoPort := flag.Int("mongoPort", 27017, "port mongo is on")
+	helloMode := flag.String("helloMode", "standalone", "what the proxy presents itself as: standalone, mongos or replicaset")
+	helloHosts := flag.String("helloHosts", "", "comma separated proxy listeners forming the replica set, the first is the primary")
+	helloSetName := flag.String("helloSetName", "proxy", "replica set name the proxy presents")
 
 	flag.Parse()
 
@@ -182,6 +159,21 @@ func main() {
 
 	pc.InterceptorFactory = &MyFactory{}
 
+	switch *helloMode {
+	case "standalone":
+		pc.HelloMode = mongonet.HelloStandalone
+	case "mongos":
+		pc.HelloMode = mongonet.HelloMongos
+	case "replicaset":
+		pc.HelloMode = mongonet.HelloReplicaSet
+		pc.HelloSetName = *helloSetName
+		if *helloHosts != "" {
+			pc.HelloHosts = strings.Split(*helloHosts, ",")
+		}
+	default:
+		log.Fatalf("unknown hello mode %s", *helloMode)
+	}
+
 	// pc.MongoSSLSkipVerify = true
 
 	proxy := mongonet.NewProxy(pc)
@@ -10,11 +10,18 @@ func main() {
 	bindPort := flag.Int("port", 9999, "what to bind to")
 	mongoHost := flag.String("mongoHost", "127.0.0.1", "host mongo is on")
 	mongoPort := flag.Int("mongoPort", 27017, "port mongo is on")
+	mongoURI := flag.String("mongoURI", "", "mongodb:// uri of a replica set, instead of mongoHost and mongoPort")
 
 	flag.Parse()
 
 	pc := mongonet.NewProxyConfig(*bindHost, *bindPort, *mongoHost, *mongoPort)
 	pc.MongoSSLSkipVerify = true
+	if *mongoURI != "" {
+		err := pc.SetMongoURI(*mongoURI)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	proxy := mongonet.NewProxy(pc)
 
@@ -0,0 +1,324 @@
+package mongonet
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ErrNotCommand = errors.New("message is not a command")
+
+var lastRequestID int32
+
+// NextRequestID returns a request id for messages the library originates itself
+func NextRequestID() int32 {
+	return atomic.AddInt32(&lastRequestID, 1)
+}
+
+// GetCommand extracts the database and the command document from a client request.
+// OP_QUERY against a $cmd namespace, OP_COMMAND and OP_MSG are understood,
+// ErrNotCommand is returned for everything else.
+// For OP_QUERY a $query wrapper is removed, for OP_MSG any document sequences
+// are folded into the command as arrays.
+func GetCommand(m Message) (string, bson.D, error) {
+	switch mm := m.(type) {
+	case *QueryMessage:
+		if !NamespaceIsCommand(mm.Namespace) {
+			return "", nil, ErrNotCommand
+		}
+		query, err := mm.Query.ToBSOND()
+		if err != nil {
+			return "", nil, err
+		}
+		return NamespaceToDB(mm.Namespace), unwrapQuery(query), nil
+
+	case *CommandMessage:
+		cmd, err := mm.CommandArgs.ToBSOND()
+		if err != nil {
+			return "", nil, err
+		}
+		return mm.DB, cmd, nil
+
+	case *MessageMessage:
+		var cmd bson.D
+		var sequences []*DocumentSequenceSection
+		for _, section := range mm.Sections {
+			switch s := section.(type) {
+			case *BodySection:
+				body, err := s.Body.ToBSOND()
+				if err != nil {
+					return "", nil, err
+				}
+				cmd = body
+			case *DocumentSequenceSection:
+				sequences = append(sequences, s)
+			}
+		}
+		if cmd == nil {
+			return "", nil, NewStackErrorf("OP_MSG without a body section")
+		}
+		for _, s := range sequences {
+			docs := make([]interface{}, len(s.Documents))
+			for i, raw := range s.Documents {
+				doc, err := raw.ToBSOND()
+				if err != nil {
+					return "", nil, err
+				}
+				docs[i] = doc
+			}
+			cmd = append(cmd, bson.DocElem{s.SequenceId, docs})
+		}
+		db := ""
+		if idx := BSONIndexOf(cmd, "$db"); idx >= 0 {
+			db, _, _ = GetAsString(cmd[idx])
+		}
+		return db, cmd, nil
+	}
+
+	return "", nil, ErrNotCommand
+}
+
+// SetCommand replaces the command document of a request produced by GetCommand.
+// For OP_MSG, array fields which originally came from document sequences are
+// written back as document sequences.
+func SetCommand(m Message, cmd bson.D) error {
+	switch mm := m.(type) {
+	case *QueryMessage:
+		query, err := mm.Query.ToBSOND()
+		if err != nil {
+			return err
+		}
+		// only a wrapper unwrapQuery removed is put back, see there
+		var newQuery interface{} = cmd
+		if len(query) > 0 && (query[0].Name == "$query" || query[0].Name == "query") {
+			if _, _, err := GetAsBSON(query[0]); err == nil {
+				query[0].Value = cmd
+				newQuery = query
+			}
+		}
+		mm.Query, err = SimpleBSONConvert(newQuery)
+		return err
+
+	case *CommandMessage:
+		var err error
+		mm.CommandArgs, err = SimpleBSONConvert(cmd)
+		return err
+
+	case *MessageMessage:
+		body := bson.D{}
+		sections := []MessageMessageSection{}
+		sequences := []MessageMessageSection{}
+		seen := map[string]bool{}
+		for _, section := range mm.Sections {
+			s, ok := section.(*DocumentSequenceSection)
+			if !ok {
+				continue
+			}
+			seen[s.SequenceId] = true
+		}
+		for _, elem := range cmd {
+			if seen[elem.Name] {
+				docs, _, err := GetAsBSONDocs(elem)
+				if err == nil {
+					s := &DocumentSequenceSection{elem.Name, make([]SimpleBSON, len(docs))}
+					for i, doc := range docs {
+						s.Documents[i], err = SimpleBSONConvert(doc)
+						if err != nil {
+							return err
+						}
+					}
+					sequences = append(sequences, s)
+					continue
+				}
+			}
+			body = append(body, elem)
+		}
+		raw, err := SimpleBSONConvert(body)
+		if err != nil {
+			return err
+		}
+		sections = append(sections, &BodySection{raw})
+		mm.Sections = append(sections, sequences...)
+		return nil
+	}
+
+	return ErrNotCommand
+}
+
+// unwrapQuery removes a $query (or query) wrapper, which is always the first field,
+// commands like count and findAndModify have a query field of their own
+func unwrapQuery(query bson.D) bson.D {
+	if len(query) == 0 || (query[0].Name != "$query" && query[0].Name != "query") {
+		return query
+	}
+	if inner, _, err := GetAsBSON(query[0]); err == nil {
+		return inner
+	}
+	return query
+}
+
+// CommandName returns the name of a command, which is its first field
+func CommandName(cmd bson.D) string {
+	if len(cmd) == 0 {
+		return ""
+	}
+	return cmd[0].Name
+}
+
+// IsCommandNamed checks the name of a command case insensitively
+func IsCommandNamed(cmd bson.D, names ...string) bool {
+	name := CommandName(cmd)
+	for _, n := range names {
+		if strings.EqualFold(name, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetResponseDocument returns the main document of a server response.
+// For OP_REPLY that is the first returned document.
+func GetResponseDocument(m Message) (bson.D, error) {
+	switch mm := m.(type) {
+	case *ReplyMessage:
+		if len(mm.Docs) == 0 {
+			return bson.D{}, nil
+		}
+		return mm.Docs[0].ToBSOND()
+	case *CommandReplyMessage:
+		return mm.CommandReply.ToBSOND()
+	case *MessageMessage:
+		for _, section := range mm.Sections {
+			if bs, ok := section.(*BodySection); ok {
+				return bs.Body.ToBSOND()
+			}
+		}
+		return nil, NewStackErrorf("OP_MSG without a body section")
+	}
+	return nil, NewStackErrorf("not a response message %T", m)
+}
+
+// SetResponseDocument replaces the main document of a server response
+func SetResponseDocument(m Message, doc bson.D) error {
+	raw, err := SimpleBSONConvert(doc)
+	if err != nil {
+		return err
+	}
+	switch mm := m.(type) {
+	case *ReplyMessage:
+		if len(mm.Docs) == 0 {
+			mm.Docs = []SimpleBSON{raw}
+			mm.NumberReturned = 1
+		} else {
+			mm.Docs[0] = raw
+		}
+		return nil
+	case *CommandReplyMessage:
+		mm.CommandReply = raw
+		return nil
+	case *MessageMessage:
+		for i, section := range mm.Sections {
+			if _, ok := section.(*BodySection); ok {
+				mm.Sections[i] = &BodySection{raw}
+				return nil
+			}
+		}
+		mm.Sections = append([]MessageMessageSection{&BodySection{raw}}, mm.Sections...)
+		return nil
+	}
+	return NewStackErrorf("not a response message %T", m)
+}
+
+// IsResponseOk checks the ok field of a command response
+func IsResponseOk(doc bson.D) bool {
+	idx := BSONIndexOf(doc, "ok")
+	if idx < 0 {
+		return false
+	}
+	ok, _, err := GetAsBool(doc[idx])
+	return err == nil && ok
+}
+
+// ResponseToError turns a failed command response into a MongoError, it returns nil for ok responses
+func ResponseToError(doc bson.D) error {
+	if IsResponseOk(doc) {
+		return nil
+	}
+	me := MongoError{}
+	if idx := BSONIndexOf(doc, "errmsg"); idx >= 0 {
+		msg, _, _ := GetAsString(doc[idx])
+		me.err = errors.New(msg)
+	} else {
+		me.err = errors.New("command failed")
+	}
+	if idx := BSONIndexOf(doc, "code"); idx >= 0 {
+		me.code, _, _ = GetAsInt(doc[idx])
+	}
+	if idx := BSONIndexOf(doc, "codeName"); idx >= 0 {
+		me.codeName, _, _ = GetAsString(doc[idx])
+	}
+	me.labels = errorLabels(doc)
+	return me
+}
+
+func errorLabels(doc bson.D) []string {
+	idx := BSONIndexOf(doc, "errorLabels")
+	if idx < 0 {
+		return nil
+	}
+	raw, _ := doc[idx].Value.([]interface{})
+	labels := []string{}
+	for _, r := range raw {
+		if label, ok := r.(string); ok {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// RunCommand sends a command over OP_MSG on a raw connection to a mongod and returns the response.
+// An error is returned on network problems and when the command did not succeed.
+func RunCommand(conn io.ReadWriter, db string, cmd bson.D) (bson.D, error) {
+	body := make(bson.D, 0, len(cmd)+1)
+	body = append(body, cmd...)
+	body = append(body, bson.DocElem{"$db", db})
+
+	raw, err := SimpleBSONConvert(body)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &MessageMessage{
+		MessageHeader{
+			0,
+			NextRequestID(),
+			0,
+			OP_MSG},
+		0,
+		[]MessageMessageSection{
+			&BodySection{
+				raw,
+			},
+		},
+	}
+
+	err = SendMessage(msg, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ReadMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := GetResponseDocument(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return doc, ResponseToError(doc)
+}
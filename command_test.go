@@ -0,0 +1,47 @@
+package mongonet
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSetCommandQueryWrapper(test *testing.T) {
+	tests := []struct {
+		query bson.D
+		want  bson.D
+	}{
+		// a wrapper gets the new command and keeps its read preference
+		{
+			bson.D{{"$query", bson.D{{"count", "c"}}}, {"$readPreference", bson.D{{"mode", "secondary"}}}},
+			bson.D{{"$query", bson.D{{"count", "c"}, {"x", 1}}}, {"$readPreference", bson.D{{"mode", "secondary"}}}},
+		},
+		// the query of count or findAndModify is part of the command
+		{
+			bson.D{{"count", "c"}, {"query", bson.D{{"a", 1}}}},
+			bson.D{{"count", "c"}, {"query", bson.D{{"a", 1}}}, {"x", 1}},
+		},
+		{
+			bson.D{{"findAndModify", "c"}, {"query", bson.D{{"a", 1}}}, {"update", bson.D{{"$set", bson.D{{"b", 1}}}}}},
+			bson.D{{"findAndModify", "c"}, {"query", bson.D{{"a", 1}}}, {"update", bson.D{{"$set", bson.D{{"b", 1}}}}}, {"x", 1}},
+		},
+	}
+
+	for _, t := range tests {
+		m := NewQueryMessage("test.$cmd", 0, 0, -1, SimpleBSONConvertOrPanic(t.query), SimpleBSONEmpty())
+		_, cmd, err := GetCommand(m)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if err = SetCommand(m, append(cmd, bson.DocElem{"x", 1})); err != nil {
+			test.Fatal(err)
+		}
+		got, err := m.Query.ToBSOND()
+		if err != nil {
+			test.Fatal(err)
+		}
+		if BSONCompare(got, t.want) != 0 {
+			test.Errorf("expected %v, got %v", t.want, got)
+		}
+	}
+}
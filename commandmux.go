@@ -0,0 +1,235 @@
+package mongonet
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CommandRequest is a command sent by a client, however it was wrapped on the wire
+type CommandRequest struct {
+	Session *Session
+	Message Message
+	DB      string
+	Name    string // as the client spelled it
+	Command bson.D
+}
+
+// CommandHandler answers a command.
+// ok:1 is added to the reply if it has no ok field, an error is sent to the client instead of the reply,
+// use NewMongoError to control its code.
+type CommandHandler func(req *CommandRequest) (bson.D, error)
+
+// CommandMux dispatches commands to handlers registered by name, names are matched case insensitively.
+// It's a ServerWorkerFactory, so NewServer(config, mux) is a complete server.
+type CommandMux struct {
+	lock     sync.RWMutex
+	handlers map[string]CommandHandler
+}
+
+// NewCommandMux makes a mux which already answers hello, ping, buildInfo and getLastError,
+// and getnonce for old drivers
+func NewCommandMux() *CommandMux {
+	mux := &CommandMux{sync.RWMutex{}, map[string]CommandHandler{}}
+	mux.Handle(muxHello, "hello", "isMaster")
+	mux.Handle(muxPing, "ping")
+	mux.Handle(muxBuildInfo, "buildInfo")
+	mux.Handle(muxGetLastError, "getLastError")
+	mux.Handle(muxGetNonce, "getnonce")
+	return mux
+}
+
+// Handle registers a handler under one or more names, replacing what was there
+func (cm *CommandMux) Handle(handler CommandHandler, names ...string) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	for _, name := range names {
+		cm.handlers[strings.ToLower(name)] = handler
+	}
+}
+
+// Remove unregisters commands, they'll be answered with CommandNotFound
+func (cm *CommandMux) Remove(names ...string) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	for _, name := range names {
+		delete(cm.handlers, strings.ToLower(name))
+	}
+}
+
+func (cm *CommandMux) handler(name string) (CommandHandler, bool) {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	handler, ok := cm.handlers[strings.ToLower(name)]
+	return handler, ok
+}
+
+// Serve answers one message from the client.
+// The returned error is about talking to the client, errors of the command go to the client.
+func (cm *CommandMux) Serve(session *Session, m Message) error {
+	switch m.Header().OpCode {
+	case OP_INSERT, OP_UPDATE, OP_DELETE:
+		// unacknowledged, there's no one to answer
+		return nil
+	}
+
+	db, cmd, err := GetCommand(m)
+	if err == ErrNotCommand {
+		db, cmd, err = legacyCommand(m)
+	}
+	if err != nil {
+		if err == ErrNotCommand {
+			err = NewMongoError(NewStackErrorf("only commands are supported, got opcode %d", m.Header().OpCode), 352, "UnsupportedOpQueryCommand")
+		}
+		return session.RespondWithError(m, err)
+	}
+	if len(cmd) == 0 {
+		return session.RespondWithError(m, NewMongoError(NewStackErrorf("empty command"), 59, "CommandNotFound"))
+	}
+
+	name := CommandName(cmd)
+	handler, ok := cm.handler(name)
+	if !ok {
+		return session.RespondWithError(m, NewMongoError(NewStackErrorf("no such command: '%s'", name), 59, "CommandNotFound"))
+	}
+
+	reply, err := handler(&CommandRequest{session, m, db, name, cmd})
+	if err != nil {
+		return session.RespondWithError(m, err)
+	}
+	if BSONIndexOf(reply, "ok") < 0 {
+		reply = append(reply, bson.DocElem{"ok", 1})
+	}
+	doc, err := SimpleBSONConvert(reply)
+	if err != nil {
+		return err
+	}
+	return session.RespondToCommand(m, doc)
+}
+
+// legacyCommand turns OP_QUERY against a collection, OP_GET_MORE and OP_KILL_CURSORS
+// into find, getMore and killCursors, Session.RespondToCommand answers them in the legacy format
+func legacyCommand(m Message) (string, bson.D, error) {
+	switch mm := m.(type) {
+	case *QueryMessage:
+		query, err := mm.Query.ToBSOND()
+		if err != nil {
+			return "", nil, err
+		}
+		cmd := bson.D{{"find", NamespaceToCollection(mm.Namespace)}, {"filter", unwrapQuery(query)}}
+		if idx := BSONIndexOf(query, "$orderby"); idx >= 0 {
+			cmd = append(cmd, bson.DocElem{"sort", query[idx].Value})
+		}
+		if mm.Project.Size > 0 {
+			if project, err := mm.Project.ToBSOND(); err == nil && len(project) > 0 {
+				cmd = append(cmd, bson.DocElem{"projection", project})
+			}
+		}
+		if mm.Skip > 0 {
+			cmd = append(cmd, bson.DocElem{"skip", int(mm.Skip)})
+		}
+		// a negative or 1 nReturn asks for a single batch
+		switch {
+		case mm.NReturn < 0:
+			n := int(-mm.NReturn)
+			cmd = append(cmd, bson.DocElem{"limit", n}, bson.DocElem{"batchSize", n}, bson.DocElem{"singleBatch", true})
+		case mm.NReturn == 1:
+			cmd = append(cmd, bson.DocElem{"limit", 1}, bson.DocElem{"singleBatch", true})
+		case mm.NReturn > 0:
+			cmd = append(cmd, bson.DocElem{"batchSize", int(mm.NReturn)})
+		}
+		return NamespaceToDB(mm.Namespace), cmd, nil
+
+	case *GetMoreMessage:
+		cmd := bson.D{{"getMore", mm.CursorId}, {"collection", NamespaceToCollection(mm.Namespace)}}
+		if mm.NReturn > 0 {
+			cmd = append(cmd, bson.DocElem{"batchSize", int(mm.NReturn)})
+		}
+		return NamespaceToDB(mm.Namespace), cmd, nil
+
+	case *KillCursorsMessage:
+		ids := make([]interface{}, len(mm.CursorIds))
+		for i, id := range mm.CursorIds {
+			ids[i] = id
+		}
+		return "", bson.D{{"killCursors", ""}, {"cursors", ids}}, nil
+	}
+	return "", nil, ErrNotCommand
+}
+
+func (cm *CommandMux) CreateWorker(session *Session) (ServerWorker, error) {
+	return &muxWorker{cm, session}, nil
+}
+
+func (cm *CommandMux) GetConnection(conn net.Conn) io.ReadWriteCloser {
+	return conn
+}
+
+type muxWorker struct {
+	mux     *CommandMux
+	session *Session
+}
+
+func (mw *muxWorker) DoLoopTemp() {
+	for {
+		m, err := mw.session.ReadMessage()
+		if err != nil {
+			if err != io.EOF {
+				mw.session.Logf(slogger.WARN, "error reading message: %s", err)
+			}
+			return
+		}
+		if err = mw.mux.Serve(mw.session, m); err != nil {
+			mw.session.Logf(slogger.WARN, "error writing response: %s", err)
+			return
+		}
+	}
+}
+
+func (mw *muxWorker) Close() {
+}
+
+// ---
+
+func muxHello(req *CommandRequest) (bson.D, error) {
+	writable := "isWritablePrimary"
+	if !strings.EqualFold(req.Name, "hello") {
+		writable = "ismaster"
+	}
+	return bson.D{
+		{writable, true},
+		{"maxBsonObjectSize", 16777216},
+		{"maxMessageSizeBytes", 48000000},
+		{"maxWriteBatchSize", 100000},
+		{"localTime", time.Now()},
+		{"logicalSessionTimeoutMinutes", 30},
+		{"minWireVersion", 0},
+		{"maxWireVersion", 13},
+		{"readOnly", false},
+	}, nil
+}
+
+func muxPing(req *CommandRequest) (bson.D, error) {
+	return bson.D{}, nil
+}
+
+func muxBuildInfo(req *CommandRequest) (bson.D, error) {
+	return bson.D{
+		{"version", "5.0.0"},
+		{"versionArray", []interface{}{5, 0, 0, 0}},
+		{"maxBsonObjectSize", 16777216},
+	}, nil
+}
+
+func muxGetLastError(req *CommandRequest) (bson.D, error) {
+	return bson.D{{"n", 0}, {"err", nil}}, nil
+}
+
+func muxGetNonce(req *CommandRequest) (bson.D, error) {
+	return bson.D{{"nonce", "914653afbdbdb833"}}, nil
+}
@@ -0,0 +1,97 @@
+package mongonet
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCommandMux(test *testing.T) {
+	var lock sync.Mutex
+	data := map[string][]interface{}{}
+
+	mux := NewCommandMux()
+	mux.Handle(func(req *CommandRequest) (bson.D, error) {
+		ns := req.DB + "." + req.Command[0].Value.(string)
+		docs, _, err := GetAsBSONDocs(req.Command[BSONIndexOf(req.Command, "documents")])
+		if err != nil {
+			return nil, err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for _, doc := range docs {
+			data[ns] = append(data[ns], doc)
+		}
+		return bson.D{{"n", len(docs)}}, nil
+	}, "insert")
+	mux.Handle(func(req *CommandRequest) (bson.D, error) {
+		ns := req.DB + "." + req.Command[0].Value.(string)
+		lock.Lock()
+		defer lock.Unlock()
+		return bson.D{{"cursor", bson.D{{"firstBatch", data[ns]}, {"id", int64(0)}, {"ns", ns}}}}, nil
+	}, "find")
+	mux.Handle(func(req *CommandRequest) (bson.D, error) {
+		return nil, NewMongoError(NewStackErrorf("no"), 13, "Unauthorized")
+	}, "dropDatabase")
+
+	server := NewServer(ServerConfig{"127.0.0.1", 9905, false, nil, NewSyncTlsConfig(), 0, 0, nil, slogger.OFF, nil}, mux)
+	go server.Run()
+	defer server.Close()
+	if err := <-server.InitChannel(); err != nil {
+		test.Fatalf("cannot start server: %s", err)
+	}
+
+	// mgo speaks OP_QUERY, starting with isMaster
+	session, err := mgo.Dial("127.0.0.1:9905")
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer session.Close()
+	coll := session.DB("test").C("foo")
+	if err = coll.Insert(bson.D{{"x", 1}}); err != nil {
+		test.Fatalf("can't insert: %s", err)
+	}
+	var doc bson.D
+	if err = coll.Find(nil).One(&doc); err != nil || len(doc) != 1 || doc[0].Value != 1 {
+		test.Errorf("can't find: %v %s", doc, err)
+	}
+	if err = session.DB("test").DropDatabase(); err == nil || err.(*mgo.QueryError).Code != 13 {
+		test.Errorf("the handler's error should reach the client, got %v", err)
+	}
+
+	// OP_MSG, names in any case
+	conn, err := net.Dial("tcp", "127.0.0.1:9905")
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer conn.Close()
+	for _, name := range []string{"hello", "isMaster", "ismaster"} {
+		res, err := RunCommand(conn, "admin", bson.D{{name, 1}})
+		if err != nil {
+			test.Fatalf("%s failed: %s", name, err)
+		}
+		want := "isWritablePrimary"
+		if name != "hello" {
+			want = "ismaster"
+		}
+		if idx := BSONIndexOf(res, want); idx < 0 || res[idx].Value != true {
+			test.Errorf("%s should answer with %s: %v", name, want, res)
+		}
+	}
+	if res, err := RunCommand(conn, "admin", bson.D{{"BUILDINFO", 1}}); err != nil || BSONIndexOf(res, "version") < 0 {
+		test.Errorf("buildInfo should be answered: %v %s", res, err)
+	}
+	if res, err := RunCommand(conn, "test", bson.D{{"find", "foo"}}); err != nil || BSONIndexOf(res, "cursor") < 0 {
+		test.Errorf("find should be answered over OP_MSG too: %v %s", res, err)
+	}
+
+	mux.Remove("ping")
+	_, err = RunCommand(conn, "admin", bson.D{{"ping", 1}})
+	if me, ok := err.(MongoError); !ok || me.Code() != 59 {
+		test.Errorf("unknown commands should fail with CommandNotFound, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package mongonet
 import (
 	"crypto/x509"
 	"fmt"
+	"time"
 
 	"github.com/mongodb/slogger/v2/slogger"
 )
@@ -21,9 +22,81 @@ type ProxyConfig struct {
 	MongoRootCAs       *x509.CertPool
 	MongoSSLSkipVerify bool
 
+	// if set the proxy monitors these servers and everything they report as members
+	// of their replica set, and sends requests to the primary instead of MongoHost:MongoPort
+	MongoSeeds             []string
+	ReplicaSetName         string
+	HeartbeatInterval      time.Duration // defaults to 10 seconds
+	ServerSelectionTimeout time.Duration // defaults to 30 seconds
+
+	MongoDialTimeout time.Duration // 0 means no timeout
+
+	// after this many dial or network failures in a row requests to a server fail right away,
+	// until a probe every CircuitBreakerProbeInterval reaches it again. 0 turns the breaker off.
+	CircuitBreakerThreshold     int
+	CircuitBreakerProbeInterval time.Duration
+
 	InterceptorFactory ProxyInterceptorFactory
 
+	// takes the place of InterceptorFactory for interceptors which want the request's context
+	InterceptorFactoryV2 ProxyInterceptorFactoryV2
+
 	ConnectionPoolHook ConnectionHook
+
+	// if set the proxy authenticates clients itself with SCRAM-SHA-256
+	ClientCredentials CredentialStore
+
+	// if set every upstream connection is authenticated as this service identity
+	MongoUser     string
+	MongoPassword string
+	MongoAuthDB   string // defaults to admin
+
+	// if set a session which authenticates against mongod through the proxy keeps
+	// its upstream connection, and that connection is closed when the session ends
+	PinAuthenticatedConnections bool
+
+	// if set every logical session a client used is ended upstream when it disconnects.
+	// Drivers share logical sessions between their connections, so only turn this on
+	// when clients are known to use one connection each.
+	EndSessionsOnDisconnect bool
+
+	// how the proxy presents itself in hello and isMaster responses, see hello.go.
+	// HelloHosts are the proxy listeners a HelloReplicaSet consists of, the first being its primary,
+	// and HelloMe is how this listener is reached, by default BindHost:BindPort.
+	HelloMode    HelloMode
+	HelloSetName string
+	HelloHosts   []string
+	HelloMe      string
+
+	// if set clients may connect with loadBalanced=true, see loadbalancer.go
+	LoadBalanced bool
+
+	// retry reads, and writes drivers made retryable, once when the upstream fails
+	RetryReads  bool
+	RetryWrites bool
+
+	// if MirrorHost is set a sample of reads and writes, between 0 and 1 of them, is copied
+	// to MirrorHost:MirrorPort in the background, see mirror.go. MirrorConnections bounds the
+	// connections to the mirror and MirrorQueueSize the requests waiting for one, more are dropped.
+	MirrorHost            string
+	MirrorPort            int
+	MirrorSSL             bool
+	MirrorReadSampleRate  float64
+	MirrorWriteSampleRate float64
+	MirrorCompare         bool // log responses which differ from the upstream's
+	MirrorConnections     int
+	MirrorQueueSize       int
+
+	// if set client sessions are split between these upstreams instead of going to MongoHost:MongoPort
+	// or MongoSeeds, see splitter.go. The weights can be changed with Proxy.Splitter while running.
+	Upstreams          []Upstream
+	UpstreamAssignment UpstreamAssignment
+
+	// if set clients can move the proxy to another upstream with the proxyCutover admin command,
+	// see cutover.go. When the proxy authenticates clients only authenticated ones can.
+	CutoverCommand bool
+	// a cutover doesn't wait for cursors unused for that long and kills them, 0 means 10 seconds
+	CutoverCursorIdleTimeout time.Duration
 }
 
 func NewProxyConfig(bindHost string, bindPort int, mongoHost string, mongoPort int) ProxyConfig {
@@ -44,14 +117,99 @@ func NewProxyConfig(bindHost string, bindPort int, mongoHost string, mongoPort i
 		},
 		mongoHost,
 		mongoPort,
-		false, // MongoSSL
-		nil,   // MongoRootCAs
-		false, // MongoSSLSkipVerify
-		nil,   // InterceptorFactory
-		nil,   // ConnectionPoolHook
+		false,            // MongoSSL
+		nil,              // MongoRootCAs
+		false,            // MongoSSLSkipVerify
+		nil,              // MongoSeeds
+		"",               // ReplicaSetName
+		0,                // HeartbeatInterval
+		0,                // ServerSelectionTimeout
+		0,                // MongoDialTimeout
+		0,                // CircuitBreakerThreshold
+		time.Second,      // CircuitBreakerProbeInterval
+		nil,              // InterceptorFactory
+		nil,              // InterceptorFactoryV2
+		nil,              // ConnectionPoolHook
+		nil,              // ClientCredentials
+		"",               // MongoUser
+		"",               // MongoPassword
+		"",               // MongoAuthDB
+		false,            // PinAuthenticatedConnections
+		false,            // EndSessionsOnDisconnect
+		HelloPassthrough, // HelloMode
+		"",               // HelloSetName
+		nil,              // HelloHosts
+		"",               // HelloMe
+		false,            // LoadBalanced
+		false,            // RetryReads
+		false,            // RetryWrites
+		"",               // MirrorHost
+		0,                // MirrorPort
+		false,            // MirrorSSL
+		1,                // MirrorReadSampleRate
+		1,                // MirrorWriteSampleRate
+		false,            // MirrorCompare
+		4,                // MirrorConnections
+		1000,             // MirrorQueueSize
+		nil,              // Upstreams
+		AssignByWeight,   // UpstreamAssignment
+		false,            // CutoverCommand
+		0,                // CutoverCursorIdleTimeout
 	}
 }
 
 func (pc *ProxyConfig) MongoAddress() string {
 	return fmt.Sprintf("%s:%d", pc.MongoHost, pc.MongoPort)
 }
+
+func (pc *ProxyConfig) MirrorAddress() string {
+	return fmt.Sprintf("%s:%d", pc.MirrorHost, pc.MirrorPort)
+}
+
+// SetMongoURI configures the upstream servers from a mongodb:// connection string
+func (pc *ProxyConfig) SetMongoURI(uri string) error {
+	parsed, err := ParseMongoURI(uri)
+	if err != nil {
+		return err
+	}
+
+	pc.MongoSeeds = parsed.Hosts
+	pc.ReplicaSetName = parsed.ReplicaSet
+	pc.MongoSSL = parsed.SSL
+	pc.MongoSSLSkipVerify = parsed.SSLSkipVerify
+	if parsed.HeartbeatInterval > 0 {
+		pc.HeartbeatInterval = parsed.HeartbeatInterval
+	}
+	if parsed.ServerSelectionTimeout > 0 {
+		pc.ServerSelectionTimeout = parsed.ServerSelectionTimeout
+	}
+
+	if parsed.Username != "" {
+		pc.MongoUser = parsed.Username
+		pc.MongoPassword = parsed.Password
+		pc.MongoAuthDB = parsed.AuthSource
+		if pc.MongoAuthDB == "" {
+			pc.MongoAuthDB = parsed.Database
+		}
+	}
+	return nil
+}
+
+// UsesTopology reports if the proxy monitors a set of servers instead of using MongoHost:MongoPort
+func (pc *ProxyConfig) UsesTopology() bool {
+	return len(pc.MongoSeeds) > 0 || pc.ReplicaSetName != ""
+}
+
+func (pc *ProxyConfig) heartbeatInterval() time.Duration {
+	if pc.HeartbeatInterval > 0 {
+		return pc.HeartbeatInterval
+	}
+	return 10 * time.Second
+}
+
+func (pc *ProxyConfig) serverSelectionTimeout() time.Duration {
+	if pc.ServerSelectionTimeout > 0 {
+		return pc.ServerSelectionTimeout
+	}
+	return 30 * time.Second
+}
@@ -8,6 +8,8 @@ import "sync"
 import "sync/atomic"
 import "time"
 
+import "gopkg.in/mgo.v2/bson"
+
 type PooledConnection struct {
 	conn         net.Conn
 	lastUsedUnix int64
@@ -20,6 +22,20 @@ func (pc *PooledConnection) Close() {
 	pc.pool.Put(pc)
 }
 
+// ioFailed marks the connection bad after a network error and tells the pool's circuit breaker
+func (pc *PooledConnection) ioFailed(err error) {
+	pc.bad = true
+	if pc.pool.breaker != nil {
+		pc.pool.breaker.Failure(err)
+	}
+}
+
+func (pc *PooledConnection) ioSucceeded() {
+	if pc.pool.breaker != nil {
+		pc.pool.breaker.Success()
+	}
+}
+
 // ---
 
 type ConnectionHook func(net.Conn) error
@@ -38,10 +54,64 @@ type ConnectionPool struct {
 	totalCreated int64
 
 	postCreateHook ConnectionHook
+
+	closed bool // once closed connections are not kept anymore
+
+	dialTimeout time.Duration // 0 means no timeout
+	breaker     *CircuitBreaker
+
+	serviceId bson.ObjectId // identifies the backend to drivers in load balanced mode
 }
 
 func NewConnectionPool(address string, ssl bool, rootCAs *x509.CertPool, sslSkipVerify bool, hook func(net.Conn) error) *ConnectionPool {
-	return &ConnectionPool{address, ssl, rootCAs, sslSkipVerify, 3600, false, []*PooledConnection{}, sync.Mutex{}, 0, hook}
+	return &ConnectionPool{address, ssl, rootCAs, sslSkipVerify, 3600, false, []*PooledConnection{}, sync.Mutex{}, 0, hook, false, 0, nil, bson.NewObjectId()}
+}
+
+func (cp *ConnectionPool) ServiceId() bson.ObjectId {
+	return cp.serviceId
+}
+
+func (cp *ConnectionPool) SetDialTimeout(timeout time.Duration) {
+	cp.dialTimeout = timeout
+}
+
+// EnableCircuitBreaker makes the pool fail fast once threshold dials or requests in a row failed,
+// until a probe run every probeInterval reaches the server again
+func (cp *ConnectionPool) EnableCircuitBreaker(threshold int, probeInterval time.Duration) {
+	if probeInterval <= 0 {
+		probeInterval = time.Second
+	}
+	cp.breaker = NewCircuitBreaker(threshold, probeInterval, cp.probe)
+}
+
+// Breaker returns the pool's circuit breaker, nil if it has none
+func (cp *ConnectionPool) Breaker() *CircuitBreaker {
+	return cp.breaker
+}
+
+func newHostUnreachableError(address string, err error) MongoError {
+	return NewMongoError(fmt.Errorf("cannot reach %s: %s", address, err), 6, "HostUnreachable")
+}
+
+// probe checks if the server answers again
+func (cp *ConnectionPool) probe() error {
+	conn, err := cp.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	timeout := cp.dialTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	_, err = RunCommand(conn, "admin", bson.D{{"isMaster", 1}})
+	return err
+}
+
+func (cp *ConnectionPool) Address() string {
+	return cp.address
 }
 
 func (cp *ConnectionPool) Trace(s string) {
@@ -78,6 +148,12 @@ func (cp *ConnectionPool) rawGet() *PooledConnection {
 func (cp *ConnectionPool) Get() (*PooledConnection, error) {
 	cp.Trace("ConnectionPool::Get\n")
 
+	if cp.breaker != nil {
+		if err := cp.breaker.Allow(); err != nil {
+			return &PooledConnection{}, newHostUnreachableError(cp.address, err)
+		}
+	}
+
 	for {
 		conn := cp.rawGet()
 		if conn == nil {
@@ -93,25 +169,22 @@ func (cp *ConnectionPool) Get() (*PooledConnection, error) {
 		conn.conn.Close()
 	}
 
-	var err error
-	var newConn net.Conn
-
-	if cp.ssl {
-		tlsConfig := &tls.Config{RootCAs: cp.rootCAs, InsecureSkipVerify: cp.sslSkipVerify}
-		newConn, err = tls.Dial("tcp", cp.address, tlsConfig)
-	} else {
-		newConn, err = net.Dial("tcp", cp.address)
-	}
-
+	newConn, err := cp.dial()
 	if err != nil {
-		return &PooledConnection{}, err
+		if cp.breaker != nil {
+			cp.breaker.Failure(err)
+		}
+		return &PooledConnection{}, newHostUnreachableError(cp.address, err)
 	}
 
 	if cp.postCreateHook != nil {
 		err = cp.postCreateHook(newConn)
 		if err != nil {
 			newConn.Close()
-			return &PooledConnection{}, err
+			if me, ok := err.(MongoError); ok {
+				return &PooledConnection{}, me
+			}
+			return &PooledConnection{}, newHostUnreachableError(cp.address, err)
 		}
 	}
 
@@ -119,6 +192,39 @@ func (cp *ConnectionPool) Get() (*PooledConnection, error) {
 	return &PooledConnection{newConn, 0, cp, false, false}, nil
 }
 
+// dial opens a new connection to the pool's server without running the post create hook
+func (cp *ConnectionPool) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: cp.dialTimeout}
+	if cp.ssl {
+		tlsConfig := &tls.Config{RootCAs: cp.rootCAs, InsecureSkipVerify: cp.sslSkipVerify}
+		return tls.DialWithDialer(dialer, "tcp", cp.address, tlsConfig)
+	}
+	return dialer.Dial("tcp", cp.address)
+}
+
+// Clear closes all idle connections, e.g. after the server went away
+func (cp *ConnectionPool) Clear() {
+	cp.poolMutex.Lock()
+	idle := cp.pool
+	cp.pool = []*PooledConnection{}
+	cp.poolMutex.Unlock()
+
+	for _, conn := range idle {
+		conn.conn.Close()
+	}
+}
+
+// Close clears the pool, connections which are in use are closed when they are put back
+func (cp *ConnectionPool) Close() {
+	cp.poolMutex.Lock()
+	cp.closed = true
+	cp.poolMutex.Unlock()
+	cp.Clear()
+	if cp.breaker != nil {
+		cp.breaker.Close()
+	}
+}
+
 func (cp *ConnectionPool) Put(conn *PooledConnection) {
 	cp.Trace("ConnectionPool::Put\n")
 	if conn.closed {
@@ -134,6 +240,10 @@ func (cp *ConnectionPool) Put(conn *PooledConnection) {
 
 	cp.poolMutex.Lock()
 	defer cp.poolMutex.Unlock()
+	if cp.closed {
+		conn.conn.Close()
+		return
+	}
 	cp.pool = append(cp.pool, conn)
 
 }
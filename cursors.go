@@ -0,0 +1,424 @@
+package mongonet
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type registeredCursor struct {
+	id       int64 // what the client sees
+	remoteId int64 // what the backend handed out
+	ns       string
+	pool     *ConnectionPool // the backend owning the cursor
+	owner    *ProxySession   // the client connection that opened it
+	user     string          // who the client authenticated as against the proxy, empty if nobody
+	lsid     bson.D          // the logical session it was opened in, nil if none
+	lastUsed time.Time
+}
+
+type remoteCursorKey struct {
+	pool     *ConnectionPool
+	remoteId int64
+}
+
+// CursorRegistry hands out proxy level cursor ids, so cursors from different backends can't collide
+// and getMore and killCursors can be routed to the backend which owns the cursor.
+type CursorRegistry struct {
+	lock     sync.Mutex
+	cursors  map[int64]*registeredCursor
+	byRemote map[remoteCursorKey]*registeredCursor
+	owned    map[*ProxySession]int
+}
+
+func NewCursorRegistry() *CursorRegistry {
+	return &CursorRegistry{
+		sync.Mutex{},
+		map[int64]*registeredCursor{},
+		map[remoteCursorKey]*registeredCursor{},
+		map[*ProxySession]int{},
+	}
+}
+
+func randomCursorId() int64 {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	// keep ids positive like mongod does
+	return int64(binary.LittleEndian.Uint64(buf) &^ (1 << 63))
+}
+
+// register returns the proxy id for a backend cursor, creating one if needed
+func (cr *CursorRegistry) register(owner *ProxySession, pool *ConnectionPool, remoteId int64, ns string, lsid bson.D) int64 {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	key := remoteCursorKey{pool, remoteId}
+	if c, ok := cr.byRemote[key]; ok {
+		c.lastUsed = time.Now()
+		return c.id
+	}
+
+	id := randomCursorId()
+	for _, taken := cr.cursors[id]; taken || id == 0; _, taken = cr.cursors[id] {
+		id = randomCursorId()
+	}
+
+	c := &registeredCursor{id, remoteId, ns, pool, owner, owner.cursorUser(), lsid, time.Now()}
+	cr.cursors[id] = c
+	cr.byRemote[key] = c
+	cr.owned[owner]++
+	return id
+}
+
+// lookup finds a cursor for a request on any client connection. Like with mongod a cursor belongs to
+// the user who opened it and to its logical session, other users and sessions don't find it.
+func (cr *CursorRegistry) lookup(ps *ProxySession, lsid bson.D, id int64) (registeredCursor, bool) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	c, ok := cr.cursors[id]
+	if !ok || c.user != ps.cursorUser() {
+		return registeredCursor{}, false
+	}
+	if c.lsid != nil && (lsid == nil || lsidKey(lsid) != lsidKey(c.lsid)) {
+		return registeredCursor{}, false
+	}
+	c.lastUsed = time.Now()
+	return *c, true
+}
+
+func (cr *CursorRegistry) remove(id int64) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	c, ok := cr.cursors[id]
+	if !ok {
+		return
+	}
+	cr.removeLocked(c)
+}
+
+func (cr *CursorRegistry) removeLocked(c *registeredCursor) {
+	delete(cr.cursors, c.id)
+	delete(cr.byRemote, remoteCursorKey{c.pool, c.remoteId})
+	cr.owned[c.owner]--
+	if cr.owned[c.owner] <= 0 {
+		delete(cr.owned, c.owner)
+	}
+}
+
+// ownedBy returns the cursors a session opened which are still open
+func (cr *CursorRegistry) ownedBy(owner *ProxySession) []registeredCursor {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	if cr.owned[owner] == 0 {
+		return nil
+	}
+
+	res := []registeredCursor{}
+	for _, c := range cr.cursors {
+		if c.owner == owner {
+			res = append(res, *c)
+		}
+	}
+	return res
+}
+
+func (cr *CursorRegistry) hasOwnedBy(owner *ProxySession) bool {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	return cr.owned[owner] > 0
+}
+
+func (cr *CursorRegistry) Size() int {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	return len(cr.cursors)
+}
+
+// inUse counts the cursors used within the idle timeout
+func (cr *CursorRegistry) inUse(idle time.Duration) int {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	n := 0
+	for _, c := range cr.cursors {
+		if time.Since(c.lastUsed) < idle {
+			n++
+		}
+	}
+	return n
+}
+
+// takeIdle removes the cursors nobody used within the idle timeout
+func (cr *CursorRegistry) takeIdle(idle time.Duration) []registeredCursor {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	res := []registeredCursor{}
+	for _, c := range cr.cursors {
+		if time.Since(c.lastUsed) >= idle {
+			res = append(res, *c)
+			cr.removeLocked(c)
+		}
+	}
+	return res
+}
+
+// responseCursor returns the cursor id and namespace of a cursor reply
+func responseCursor(doc bson.D) (int64, string, bool) {
+	idx := BSONIndexOf(doc, "cursor")
+	if idx < 0 {
+		return 0, "", false
+	}
+	cursor, _, err := GetAsBSON(doc[idx])
+	if err != nil {
+		return 0, "", false
+	}
+	idIdx := BSONIndexOf(cursor, "id")
+	if idIdx < 0 {
+		return 0, "", false
+	}
+	id, ok := cursorIdValue(cursor[idIdx].Value)
+	if !ok {
+		return 0, "", false
+	}
+	ns := ""
+	if nsIdx := BSONIndexOf(cursor, "ns"); nsIdx >= 0 {
+		ns, _, _ = GetAsString(cursor[nsIdx])
+	}
+	return id, ns, true
+}
+
+func cursorIdValue(raw interface{}) (int64, bool) {
+	switch id := raw.(type) {
+	case int64:
+		return id, true
+	case int:
+		return int64(id), true
+	case int32:
+		return int64(id), true
+	case float64:
+		return int64(id), true
+	}
+	return 0, false
+}
+
+// cursorUser is who the cursors a client opens belong to
+func (ps *ProxySession) cursorUser() string {
+	if ps.authUser == "" {
+		return ""
+	}
+	return ps.authUser + "@" + ps.authDB
+}
+
+// ---
+
+func newCursorNotFoundError(id int64) MongoError {
+	return NewMongoError(fmt.Errorf("cursor id %d not found", id), 43, "CursorNotFound")
+}
+
+// translateCursorRequest rewrites the proxy cursor id of a getMore to the backend's id.
+// It returns the pool of the backend owning the cursor, or nil if the request does not use a cursor.
+func (ps *ProxySession) translateCursorRequest(info *requestInfo) (*ConnectionPool, error) {
+	if gm, ok := info.m.(*GetMoreMessage); ok {
+		c, found := ps.proxy.cursors.lookup(ps, nil, gm.CursorId)
+		if !found {
+			return nil, newCursorNotFoundError(gm.CursorId)
+		}
+		gm.CursorId = c.remoteId
+		info.cursorId = c.id
+		return c.pool, nil
+	}
+
+	if !info.isCommand("getMore") {
+		return nil, nil
+	}
+
+	id, ok := cursorIdValue(info.cmd[0].Value)
+	if !ok {
+		return nil, NewMongoError(fmt.Errorf("getMore cursor id must be a number"), 14, "TypeMismatch")
+	}
+	c, found := ps.proxy.cursors.lookup(ps, info.lsid, id)
+	if !found {
+		return nil, newCursorNotFoundError(id)
+	}
+
+	info.cmd[0].Value = c.remoteId
+	if err := SetCommand(info.m, info.cmd); err != nil {
+		return nil, err
+	}
+	info.cursorId = c.id
+	return c.pool, nil
+}
+
+// rewriteCursorResponse registers cursors a backend opened and replaces their ids with proxy ids
+func (ps *ProxySession) rewriteCursorResponse(info *requestInfo, pool *ConnectionPool, resp Message) error {
+	registry := ps.proxy.cursors
+
+	if rm, ok := resp.(*ReplyMessage); ok && info.cmd == nil {
+		// legacy OP_QUERY and OP_GET_MORE
+		ns := ""
+		switch mm := info.m.(type) {
+		case *QueryMessage:
+			ns = mm.Namespace
+		case *GetMoreMessage:
+			ns = mm.Namespace
+		}
+		// a getMore, or a later reply of an exhaust query, can end the cursor
+		if info.cursorId != 0 && (rm.CursorId == 0 || rm.Flags&1 != 0) { // CursorNotFound
+			registry.remove(info.cursorId)
+			return nil
+		}
+		if rm.CursorId != 0 {
+			rm.CursorId = registry.register(ps, pool, rm.CursorId, ns, nil)
+			info.cursorId = rm.CursorId
+		}
+		return nil
+	}
+
+	if info.cmd == nil {
+		return nil
+	}
+
+	doc, err := GetResponseDocument(resp)
+	if err != nil {
+		return nil
+	}
+
+	remoteId, ns, ok := responseCursor(doc)
+
+	if info.cursorId != 0 {
+		// getMore, the backend is done with the cursor once it is exhausted or the getMore failed,
+		// which includes CursorNotFound for cursors it timed out
+		if !IsResponseOk(doc) || (ok && remoteId == 0) {
+			registry.remove(info.cursorId)
+		}
+	}
+
+	if !ok || remoteId == 0 {
+		return nil
+	}
+
+	id := registry.register(ps, pool, remoteId, ns, info.lsid)
+	cursorIdx := BSONIndexOf(doc, "cursor")
+	cursor, _, _ := GetAsBSON(doc[cursorIdx])
+	cursor[BSONIndexOf(cursor, "id")].Value = id
+	doc[cursorIdx].Value = cursor
+	return SetResponseDocument(resp, doc)
+}
+
+// killCursors answers killCursors in the proxy, since the cursors may live on several backends
+func (ps *ProxySession) killCursors(info *requestInfo, pooledConn *PooledConnection) error {
+	var ids []int64
+	ns := ""
+
+	if km, ok := info.m.(*KillCursorsMessage); ok {
+		ids = km.CursorIds
+	} else {
+		coll, _, _ := GetAsString(info.cmd[0])
+		ns = info.db + "." + coll
+		if idx := BSONIndexOf(info.cmd, "cursors"); idx >= 0 {
+			raw, ok := info.cmd[idx].Value.([]interface{})
+			if !ok {
+				return NewMongoError(fmt.Errorf("cursors must be an array"), 14, "TypeMismatch")
+			}
+			for _, r := range raw {
+				id, ok := cursorIdValue(r)
+				if !ok {
+					return NewMongoError(fmt.Errorf("cursor ids must be numbers"), 14, "TypeMismatch")
+				}
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	killed := []int64{}
+	notFound := []int64{}
+	byPool := map[*ConnectionPool][]registeredCursor{}
+	for _, id := range ids {
+		c, found := ps.proxy.cursors.lookup(ps, info.lsid, id)
+		if !found || (ns != "" && c.ns != "" && c.ns != ns) {
+			notFound = append(notFound, id)
+			continue
+		}
+		byPool[c.pool] = append(byPool[c.pool], c)
+	}
+
+	for pool, cursors := range byPool {
+		err := killRemoteCursors(pool, pooledConn, cursors)
+		if err != nil {
+			ps.logger.Logf(slogger.INFO, "error killing cursors: %s", err)
+		}
+		for _, c := range cursors {
+			ps.proxy.cursors.remove(c.id)
+			killed = append(killed, c.id)
+		}
+	}
+
+	if info.cmd == nil {
+		// OP_KILL_CURSORS has no response
+		return nil
+	}
+
+	return ps.RespondToCommandMakeBSON(info.m,
+		"cursorsKilled", killed,
+		"cursorsNotFound", notFound,
+		"cursorsAlive", []int64{},
+		"cursorsUnknown", []int64{},
+	)
+}
+
+// killRemoteCursors kills cursors on their backend, using pooledConn if it goes there.
+// Cursors opened in a logical session are killed in that session.
+func killRemoteCursors(pool *ConnectionPool, pooledConn *PooledConnection, cursors []registeredCursor) error {
+	conn := pooledConn
+	if conn == nil || conn.bad || conn.pool != pool {
+		var err error
+		conn, err = pool.Get()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+	}
+
+	type killKey struct {
+		ns   string
+		lsid string
+	}
+	kills := map[killKey]bson.D{}
+	for _, c := range cursors {
+		key := killKey{c.ns, ""}
+		if c.lsid != nil {
+			key.lsid = lsidKey(c.lsid)
+		}
+		cmd, ok := kills[key]
+		if !ok {
+			cmd = bson.D{{"killCursors", NamespaceToCollection(c.ns)}, {"cursors", []int64{}}}
+			if c.lsid != nil {
+				cmd = append(cmd, bson.DocElem{"lsid", c.lsid})
+			}
+		}
+		cmd[1].Value = append(cmd[1].Value.([]int64), c.remoteId)
+		kills[key] = cmd
+	}
+
+	for key, cmd := range kills {
+		_, err := RunCommand(conn.conn, NamespaceToDB(key.ns), cmd)
+		if err != nil {
+			if _, ok := err.(MongoError); !ok {
+				conn.bad = true
+			}
+			return err
+		}
+	}
+	return nil
+}
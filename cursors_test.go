@@ -0,0 +1,151 @@
+package mongonet
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func testCursorReply(batch string, id int64) Message {
+	return testReply(bson.D{{"cursor", bson.D{{batch, []bson.D{}}, {"id", id}, {"ns", "foo.bar"}}}, {"ok", 1}})
+}
+
+func TestCursorRemapping(test *testing.T) {
+	ps := &ProxySession{proxy: &Proxy{cursors: NewCursorRegistry()}}
+	poolA := &ConnectionPool{address: "a:27017"}
+	poolB := &ConnectionPool{address: "b:27017"}
+
+	find := newRequestInfo(testCommandMessage(bson.D{{"find", "bar"}, {"$db", "foo"}}))
+
+	replyA := testCursorReply("firstBatch", 55)
+	if err := ps.rewriteCursorResponse(find, poolA, replyA); err != nil {
+		test.Fatal(err)
+	}
+	replyB := testCursorReply("firstBatch", 55)
+	if err := ps.rewriteCursorResponse(find, poolB, replyB); err != nil {
+		test.Fatal(err)
+	}
+
+	docA, _ := GetResponseDocument(replyA)
+	docB, _ := GetResponseDocument(replyB)
+	idA, _, _ := responseCursor(docA)
+	idB, _, _ := responseCursor(docB)
+	if idA == 55 || idB == 55 || idA == idB || idA == 0 || idB == 0 {
+		test.Fatalf("cursor ids not remapped %d %d", idA, idB)
+	}
+	if ps.proxy.cursors.Size() != 2 || !ps.proxy.cursors.hasOwnedBy(ps) {
+		test.Errorf("cursors not registered")
+	}
+
+	getMore := newRequestInfo(testCommandMessage(bson.D{{"getMore", idB}, {"collection", "bar"}, {"$db", "foo"}}))
+	pool, err := ps.translateCursorRequest(getMore)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if pool != poolB {
+		test.Errorf("getMore routed to the wrong backend %s", pool.address)
+	}
+	_, cmd, _ := GetCommand(getMore.m)
+	if id, _ := cursorIdValue(cmd[0].Value); id != 55 {
+		test.Errorf("getMore not translated %v", cmd)
+	}
+
+	if err := ps.rewriteCursorResponse(getMore, pool, testCursorReply("nextBatch", 0)); err != nil {
+		test.Fatal(err)
+	}
+	if ps.proxy.cursors.Size() != 1 {
+		test.Errorf("exhausted cursor still registered")
+	}
+
+	legacy := &GetMoreMessage{MessageHeader{0, 3, 0, OP_GET_MORE}, 0, "foo.bar", 0, idA}
+	pool, err = ps.translateCursorRequest(newRequestInfo(legacy))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if pool != poolA || legacy.CursorId != 55 {
+		test.Errorf("legacy getMore not translated %d", legacy.CursorId)
+	}
+
+	unknown := newRequestInfo(testCommandMessage(bson.D{{"getMore", int64(12345)}, {"collection", "bar"}, {"$db", "foo"}}))
+	if _, err := ps.translateCursorRequest(unknown); err == nil {
+		test.Errorf("unknown cursor should fail")
+	}
+
+	// drivers send a getMore on any pooled connection, but other users can't use the cursor
+	other := &ProxySession{proxy: ps.proxy}
+	pooled := newRequestInfo(testCommandMessage(bson.D{{"getMore", idA}, {"collection", "bar"}, {"$db", "foo"}}))
+	if pool, err = other.translateCursorRequest(pooled); err != nil || pool != poolA {
+		test.Errorf("getMore from another connection should find the cursor, got %v", err)
+	}
+	stranger := &ProxySession{proxy: ps.proxy, authUser: "eve", authDB: "admin"}
+	stolen := newRequestInfo(testCommandMessage(bson.D{{"getMore", idA}, {"collection", "bar"}, {"$db", "foo"}}))
+	if _, err := stranger.translateCursorRequest(stolen); err == nil || err.(MongoError).Code() != 43 {
+		test.Errorf("getMore on another user's cursor should fail with CursorNotFound, got %v", err)
+	}
+	if ps.proxy.cursors.Size() != 1 {
+		test.Errorf("the cursor should still be registered")
+	}
+
+	// a cursor the backend timed out is forgotten
+	getMore = newRequestInfo(testCommandMessage(bson.D{{"getMore", idA}, {"collection", "bar"}, {"$db", "foo"}}))
+	if pool, err = ps.translateCursorRequest(getMore); err != nil {
+		test.Fatal(err)
+	}
+	notFound := testReply(bson.D{{"ok", 0}, {"errmsg", "cursor id 55 not found"}, {"code", 43}, {"codeName", "CursorNotFound"}})
+	if err := ps.rewriteCursorResponse(getMore, pool, notFound); err != nil {
+		test.Fatal(err)
+	}
+	if ps.proxy.cursors.Size() != 0 || ps.proxy.cursors.hasOwnedBy(ps) {
+		test.Errorf("a cursor the backend doesn't know should not stay registered")
+	}
+}
+
+func TestCursorSessionScope(test *testing.T) {
+	ps := &ProxySession{proxy: &Proxy{cursors: NewCursorRegistry()}}
+	pool := &ConnectionPool{address: "a:27017"}
+	lsid := bson.D{{"id", bson.Binary{4, []byte("0123456789abcdef")}}}
+	otherLsid := bson.D{{"id", bson.Binary{4, []byte("fedcba9876543210")}}}
+
+	find := newRequestInfo(testCommandMessage(bson.D{{"find", "bar"}, {"lsid", lsid}, {"$db", "foo"}}))
+	reply := testCursorReply("firstBatch", 55)
+	if err := ps.rewriteCursorResponse(find, pool, reply); err != nil {
+		test.Fatal(err)
+	}
+	doc, _ := GetResponseDocument(reply)
+	id, _, _ := responseCursor(doc)
+
+	other := &ProxySession{proxy: ps.proxy}
+	tests := []struct {
+		cmd   bson.D
+		found bool
+	}{
+		{bson.D{{"getMore", id}, {"collection", "bar"}, {"lsid", lsid}, {"$db", "foo"}}, true},
+		{bson.D{{"getMore", id}, {"collection", "bar"}, {"lsid", otherLsid}, {"$db", "foo"}}, false},
+		{bson.D{{"getMore", id}, {"collection", "bar"}, {"$db", "foo"}}, false},
+	}
+	for _, t := range tests {
+		_, err := other.translateCursorRequest(newRequestInfo(testCommandMessage(t.cmd)))
+		if (err == nil) != t.found {
+			test.Errorf("%v: expected found %v, got %v", t.cmd, t.found, err)
+		}
+	}
+}
+
+func TestExhaustCursorCleanup(test *testing.T) {
+	ps := &ProxySession{proxy: &Proxy{cursors: NewCursorRegistry()}}
+	pool := &ConnectionPool{address: "a:27017"}
+
+	query := newRequestInfo(NewQueryMessage("foo.bar", 1<<6, 0, 0, SimpleBSONEmpty(), SimpleBSONEmpty()))
+	for _, remoteId := range []int64{77, 77, 0} {
+		reply := &ReplyMessage{MessageHeader{0, 1, 0, OP_REPLY}, 0, remoteId, 0, 0, nil}
+		if err := ps.rewriteCursorResponse(query, pool, reply); err != nil {
+			test.Fatal(err)
+		}
+		if remoteId != 0 && (reply.CursorId == remoteId || ps.proxy.cursors.Size() != 1) {
+			test.Errorf("exhaust cursor not registered once: %d, %d cursors", reply.CursorId, ps.proxy.cursors.Size())
+		}
+	}
+	if ps.proxy.cursors.Size() != 0 || ps.proxy.cursors.hasOwnedBy(ps) {
+		test.Errorf("the cursor of a finished exhaust query should be forgotten")
+	}
+}
@@ -0,0 +1,249 @@
+package mongonet
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A cutover moves the proxy to another upstream without failing requests:
+// new work is held, the proxy waits until no request is running and no client has
+// an open cursor or transaction, swaps its connection pool and lets the held requests go.
+// Requests which finish cursors or transactions keep going while it drains.
+// If that doesn't happen within the drain timeout the cutover is given up and nothing changes.
+// Cursors nobody used within ProxyConfig.CutoverCursorIdleTimeout count as abandoned,
+// the cutover doesn't wait for them and kills them on the old upstream.
+
+// name of the admin command running a cutover, see ProxyConfig.CutoverCommand
+const cutoverCommandName = "proxyCutover"
+
+const defaultCutoverDrainTimeout = 30 * time.Second
+
+const defaultCutoverCursorIdleTimeout = 10 * time.Second
+
+// how often a cutover checks if the proxy drained
+const cutoverPollInterval = 10 * time.Millisecond
+
+// cutoverGate holds requests while a cutover runs and guards the connection pool it swaps
+type cutoverGate struct {
+	lock         sync.Mutex
+	resumed      *sync.Cond
+	paused       bool
+	inFlight     int
+	transactions map[*ProxySession]bool // sessions with an open transaction
+
+	// stats
+	cutovers     int
+	failed       int
+	lastDuration time.Duration
+	held         int64 // requests which had to wait
+	heldTotal    time.Duration
+	heldMax      time.Duration
+}
+
+func newCutoverGate() *cutoverGate {
+	g := &cutoverGate{transactions: map[*ProxySession]bool{}}
+	g.resumed = sync.NewCond(&g.lock)
+	return g
+}
+
+// enter waits while a cutover runs and counts the request as running.
+// Requests which drain don't wait, the cutover waits for them.
+func (g *cutoverGate) enter(drains bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.paused && !drains {
+		start := time.Now()
+		for g.paused {
+			g.resumed.Wait()
+		}
+		waited := time.Since(start)
+		g.held++
+		g.heldTotal += waited
+		if waited > g.heldMax {
+			g.heldMax = waited
+		}
+	}
+	g.inFlight++
+}
+
+// leave is called when a request is done, inTransaction says if its session has a transaction open
+func (g *cutoverGate) leave(ps *ProxySession, inTransaction bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.inFlight--
+	if inTransaction {
+		g.transactions[ps] = true
+	} else {
+		delete(g.transactions, ps)
+	}
+}
+
+// drainsState is true if a request has to go through during a cutover, since the session
+// has a cursor or transaction open the cutover waits for, or the request ends one
+func (ps *ProxySession) drainsState(info *requestInfo) bool {
+	switch info.m.Header().OpCode {
+	case OP_GET_MORE, OP_KILL_CURSORS:
+		return true
+	}
+	if info.isCommand("getMore", "killCursors", "commitTransaction", "abortTransaction") {
+		return true
+	}
+	return ps.upstreamState.pinned() || ps.proxy.cursors.hasOwnedBy(ps)
+}
+
+// sessionEnded forgets a session, its transactions were aborted while cleaning up
+func (g *cutoverGate) sessionEnded(ps *ProxySession) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.transactions, ps)
+}
+
+func (g *cutoverGate) stats() bson.D {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	averageHeld := time.Duration(0)
+	if g.held > 0 {
+		averageHeld = g.heldTotal / time.Duration(g.held)
+	}
+	return bson.D{
+		{"paused", g.paused},
+		{"cutovers", g.cutovers},
+		{"failed", g.failed},
+		{"lastDurationMillis", g.lastDuration.Nanoseconds() / int64(time.Millisecond)},
+		{"heldRequests", g.held},
+		{"heldTotalMillis", g.heldTotal.Nanoseconds() / int64(time.Millisecond)},
+		{"heldAverageMillis", averageHeld.Nanoseconds() / int64(time.Millisecond)},
+		{"heldMaxMillis", g.heldMax.Nanoseconds() / int64(time.Millisecond)},
+	}
+}
+
+// ---
+
+// pool returns the connection pool, which a cutover may swap
+func (p *Proxy) pool() *ConnectionPool {
+	p.cutover.lock.Lock()
+	defer p.cutover.lock.Unlock()
+	return p.connPool
+}
+
+// Cutover moves the proxy to the mongod or mongos at address, see above.
+// A drainTimeout of 0 means 30 seconds.
+func (p *Proxy) Cutover(address string, drainTimeout time.Duration) error {
+	if p.topology != nil || p.splitter != nil {
+		return NewMongoError(fmt.Errorf("cutover needs a proxy with a single upstream"), 20, "IllegalOperation")
+	}
+	if drainTimeout <= 0 {
+		drainTimeout = defaultCutoverDrainTimeout
+	}
+	address = normalizeAddress(address)
+	idle := p.config.CutoverCursorIdleTimeout
+	if idle <= 0 {
+		idle = defaultCutoverCursorIdleTimeout
+	}
+
+	g := p.cutover
+	start := time.Now()
+	g.lock.Lock()
+	if g.paused {
+		g.lock.Unlock()
+		return NewMongoError(fmt.Errorf("a cutover is already running"), 117, "ConflictingOperationInProgress")
+	}
+	g.paused = true
+	g.lock.Unlock()
+
+	p.logger.Logf(slogger.INFO, "cutover to %s: holding requests", address)
+
+	resume := func(err error) error {
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		g.paused = false
+		g.lastDuration = time.Since(start)
+		if err != nil {
+			g.failed++
+		} else {
+			g.cutovers++
+		}
+		g.resumed.Broadcast()
+		return err
+	}
+
+	deadline := start.Add(drainTimeout)
+	var abandoned []registeredCursor
+	for {
+		g.lock.Lock()
+		inFlight, transactions := g.inFlight, len(g.transactions)
+		cursors := p.cursors.inUse(idle)
+		drained := inFlight == 0 && transactions == 0 && cursors == 0
+		if drained {
+			// taken while no request can start, so none of them is in use
+			abandoned = p.cursors.takeIdle(idle)
+		}
+		g.lock.Unlock()
+
+		if drained {
+			break
+		}
+		if time.Now().After(deadline) {
+			err := fmt.Errorf("cutover to %s gave up after %s: %d requests running, %d transactions and %d cursors in use",
+				address, drainTimeout, inFlight, transactions, cursors)
+			p.logger.Logf(slogger.WARN, "%s", err)
+			return resume(NewMongoError(err, 50, "MaxTimeMSExpired"))
+		}
+		time.Sleep(cutoverPollInterval)
+	}
+
+	newPool := p.newPool(address)
+	g.lock.Lock()
+	oldPool := p.connPool
+	p.connPool = newPool
+	g.lock.Unlock()
+
+	if len(abandoned) > 0 {
+		p.logger.Logf(slogger.INFO, "cutover to %s: killing %d abandoned cursors", address, len(abandoned))
+		if err := killRemoteCursors(oldPool, nil, abandoned); err != nil {
+			p.logger.Logf(slogger.INFO, "error killing abandoned cursors: %s", err)
+		}
+	}
+	oldPool.Close()
+
+	p.logger.Logf(slogger.INFO, "cutover to %s: done after %s", address, time.Since(start))
+	return resume(nil)
+}
+
+// runCutoverCommand answers {proxyCutover: "host:port", drainTimeoutMS: n} on the admin database
+func (ps *ProxySession) runCutoverCommand(info *requestInfo) error {
+	if !ps.proxy.config.CutoverCommand || info.db != "admin" {
+		return NewMongoError(fmt.Errorf("no such command: '%s'", info.cmdName), 59, "CommandNotFound")
+	}
+	if ps.proxy.config.ClientCredentials != nil && ps.authUser == "" {
+		return NewMongoError(fmt.Errorf("command %s requires authentication", info.cmdName), 13, "Unauthorized")
+	}
+
+	address, _, err := GetAsString(info.cmd[0])
+	if err != nil || address == "" {
+		return newBadValueError("%s needs the address to move to", cutoverCommandName)
+	}
+	drainTimeout := time.Duration(0)
+	if idx := BSONIndexOf(info.cmd, "drainTimeoutMS"); idx >= 0 {
+		ms, _, err := GetAsInt(info.cmd[idx])
+		if err != nil {
+			return newBadValueError("drainTimeoutMS has to be a number")
+		}
+		drainTimeout = time.Duration(ms) * time.Millisecond
+	}
+
+	if err = ps.proxy.Cutover(address, drainTimeout); err != nil {
+		return err
+	}
+	return ps.RespondToCommandMakeBSON(info.m,
+		"upstream", ps.proxy.pool().Address(),
+		"cutover", ps.proxy.cutover.stats(),
+	)
+}
@@ -0,0 +1,232 @@
+package mongonet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCutover(test *testing.T) {
+	blue := startTestShard(test, 9997)
+	defer blue.server.Close()
+	green := startTestShard(test, 9998)
+	defer green.server.Close()
+
+	pc := NewProxyConfig("127.0.0.1", 9999, "127.0.0.1", 9997)
+	pc.CutoverCommand = true
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9999")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+
+	docs := []bson.D{{{"x", 1}}, {{"x", 2}}, {{"x", 3}}}
+	if _, err = RunCommand(conn, "test", bson.D{{"insert", "foo"}, {"documents", docs}}); err != nil {
+		test.Fatal(err)
+	}
+
+	// an open cursor keeps the proxy from draining
+	res, err := RunCommand(conn, "test", bson.D{{"find", "foo"}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	cursorId, _ := cursorIdValue(getDoc(res, "cursor")[BSONIndexOf(getDoc(res, "cursor"), "id")].Value)
+	err = proxy.Cutover("127.0.0.1:9998", 50*time.Millisecond)
+	if me, ok := err.(MongoError); !ok || me.Code() != 50 {
+		test.Fatalf("cutover with an open cursor should time out, got %v", err)
+	}
+	if _, err = RunCommand(conn, "test", bson.D{{"getMore", cursorId}, {"collection", "foo"}}); err != nil {
+		test.Fatalf("the cursor should still work after a failed cutover: %s", err)
+	}
+	blue.takeCommands()
+
+	// a request arriving while another one runs is held until the cutover is done
+	proxy.cutover.enter(false)
+	cutoverDone := make(chan error)
+	go func() {
+		cutoverDone <- proxy.Cutover("127.0.0.1:9998", 5*time.Second)
+	}()
+	for !proxy.cutover.stats()[0].Value.(bool) {
+		time.Sleep(time.Millisecond)
+	}
+	countDone := make(chan error)
+	go func() {
+		_, err := RunCommand(conn, "test", bson.D{{"count", "foo"}})
+		countDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	proxy.cutover.leave(nil, false)
+
+	if err = <-cutoverDone; err != nil {
+		test.Fatalf("cutover failed: %s", err)
+	}
+	if err = <-countDone; err != nil {
+		test.Fatalf("held count failed: %s", err)
+	}
+	if got := blue.takeCommands(); len(got) != 0 {
+		test.Errorf("blue shouldn't get requests after the cutover: %v", got)
+	}
+	if got := green.takeCommands(); len(got) != 1 {
+		test.Errorf("green should have gotten the held count: %v", got)
+	}
+	stats := proxy.cutover.stats()
+	if stats[1].Value != 1 || stats[2].Value != 1 || stats[4].Value != int64(1) || stats[7].Value.(int64) < 40 {
+		test.Errorf("wrong cutover stats: %v", stats)
+	}
+
+	// and back with the admin command
+	res, err = RunCommand(conn, "admin", bson.D{{"proxyCutover", "127.0.0.1:9997"}, {"drainTimeoutMS", 1000}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if res[BSONIndexOf(res, "upstream")].Value != "127.0.0.1:9997" {
+		test.Errorf("the proxy should be back on blue: %v", res)
+	}
+	if _, err = RunCommand(conn, "test", bson.D{{"count", "foo"}}); err != nil {
+		test.Fatal(err)
+	}
+	if got := blue.takeCommands(); len(got) != 1 {
+		test.Errorf("blue should be used again: %v", got)
+	}
+}
+
+func TestCutoverWithOpenCursor(test *testing.T) {
+	blue := startTestShard(test, 9987)
+	defer blue.server.Close()
+	green := startTestShard(test, 9988)
+	defer green.server.Close()
+
+	pc := NewProxyConfig("127.0.0.1", 9989, "127.0.0.1", 9987)
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9989")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+	other, err := net.Dial("tcp", "127.0.0.1:9989")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer other.Close()
+
+	docs := []bson.D{{{"x", 1}}, {{"x", 2}}, {{"x", 3}}, {{"x", 4}}, {{"x", 5}}}
+	if _, err = RunCommand(conn, "test", bson.D{{"insert", "foo"}, {"documents", docs}}); err != nil {
+		test.Fatal(err)
+	}
+	res, err := RunCommand(conn, "test", bson.D{{"find", "foo"}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	cursorId, _ := cursorIdValue(getDoc(res, "cursor")[BSONIndexOf(getDoc(res, "cursor"), "id")].Value)
+	blue.takeCommands()
+
+	cutoverDone := make(chan error)
+	go func() {
+		cutoverDone <- proxy.Cutover("127.0.0.1:9988", 5*time.Second)
+	}()
+	for !proxy.cutover.stats()[0].Value.(bool) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// new work from another client waits
+	countDone := make(chan error)
+	go func() {
+		_, err := RunCommand(other, "test", bson.D{{"count", "foo"}})
+		countDone <- err
+	}()
+
+	// while the cursor is finished on blue
+	for cursorId != 0 {
+		res, err = RunCommand(conn, "test", bson.D{{"getMore", cursorId}, {"collection", "foo"}})
+		if err != nil {
+			test.Fatalf("getMore of an open cursor should go through during a cutover: %s", err)
+		}
+		cursorId, _ = cursorIdValue(getDoc(res, "cursor")[BSONIndexOf(getDoc(res, "cursor"), "id")].Value)
+	}
+
+	if err = <-cutoverDone; err != nil {
+		test.Fatalf("cutover failed: %s", err)
+	}
+	if err = <-countDone; err != nil {
+		test.Fatalf("held count failed: %s", err)
+	}
+	if got := blue.takeCommands(); len(got) != 2 || got[0] != "getMore" || got[1] != "getMore" {
+		test.Errorf("blue should only have gotten the getMores: %v", got)
+	}
+	if got := green.takeCommands(); len(got) != 1 || got[0] != "count" {
+		test.Errorf("green should have gotten the held count: %v", got)
+	}
+}
+
+func TestCutoverWithAbandonedCursor(test *testing.T) {
+	blue := startTestShard(test, 9955)
+	defer blue.server.Close()
+	green := startTestShard(test, 9956)
+	defer green.server.Close()
+
+	pc := NewProxyConfig("127.0.0.1", 9957, "127.0.0.1", 9955)
+	pc.CutoverCursorIdleTimeout = 100 * time.Millisecond
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9957")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+
+	docs := []bson.D{{{"x", 1}}, {{"x", 2}}, {{"x", 3}}, {{"x", 4}}, {{"x", 5}}}
+	if _, err = RunCommand(conn, "test", bson.D{{"insert", "foo"}, {"documents", docs}}); err != nil {
+		test.Fatal(err)
+	}
+	res, err := RunCommand(conn, "test", bson.D{{"find", "foo"}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	cursorId, _ := cursorIdValue(getDoc(res, "cursor")[BSONIndexOf(getDoc(res, "cursor"), "id")].Value)
+	blue.takeCommands()
+
+	// the client never comes back for the rest
+	if err = proxy.Cutover("127.0.0.1:9956", 5*time.Second); err != nil {
+		test.Fatalf("an abandoned cursor should not hold up the cutover: %s", err)
+	}
+	if got := blue.takeCommands(); len(got) != 1 || got[0] != "killCursors" {
+		test.Errorf("the abandoned cursor should have been killed on blue: %v", got)
+	}
+	if proxy.cursors.Size() != 0 {
+		test.Errorf("the abandoned cursor should be gone")
+	}
+
+	_, err = RunCommand(conn, "test", bson.D{{"getMore", cursorId}, {"collection", "foo"}})
+	if me, ok := err.(MongoError); !ok || me.Code() != 43 {
+		test.Errorf("getMore of the killed cursor should fail with CursorNotFound, got %v", err)
+	}
+	if _, err = RunCommand(conn, "test", bson.D{{"count", "foo"}}); err != nil {
+		test.Fatal(err)
+	}
+	if got := green.takeCommands(); len(got) != 1 || got[0] != "count" {
+		test.Errorf("green should have gotten the count: %v", got)
+	}
+}
@@ -0,0 +1,166 @@
+package mongonet
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EventKind int
+
+const (
+	EventSessionOpened    EventKind = iota
+	EventSessionClosed              // Duration is how long the session lasted
+	EventRequestReceived            // Bytes is the size of the request
+	EventUpstreamCheckout           // Duration is how long getting the connection took
+	EventResponseSent               // Bytes is the size of the response, Duration the time since the request arrived
+	EventError                      // Err is what went wrong, the client may have gotten it as a response
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventSessionOpened:
+		return "SessionOpened"
+	case EventSessionClosed:
+		return "SessionClosed"
+	case EventRequestReceived:
+		return "RequestReceived"
+	case EventUpstreamCheckout:
+		return "UpstreamCheckout"
+	case EventResponseSent:
+		return "ResponseSent"
+	case EventError:
+		return "Error"
+	}
+	return "Unknown"
+}
+
+// Event is something which happened in a client session, fields which don't apply to the kind are zero
+type Event struct {
+	Kind       EventKind
+	Time       time.Time
+	RemoteAddr net.Addr
+	RequestID  int32  // of the client's request
+	OpCode     int32  // of the client's request
+	Command    string // name of the command, empty for other messages
+	Upstream   string // address of the upstream server
+	Bytes      int
+	Duration   time.Duration
+	Err        error
+}
+
+const defaultEventQueueSize = 1000
+
+// EventBus hands the events of all sessions to any number of subscribers.
+// Every subscriber has its own bounded queue, events which don't fit are dropped and counted,
+// so a slow subscriber never holds up the proxy.
+type EventBus struct {
+	lock        sync.RWMutex
+	subscribers map[*Subscription]bool
+	count       int32 // subscribers, read without the lock on every event
+}
+
+type Subscription struct {
+	bus     *EventBus
+	events  chan Event
+	dropped int64
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{sync.RWMutex{}, map[*Subscription]bool{}, 0}
+}
+
+// Subscribe starts delivering events, queueSize of them may wait for the subscriber. 0 means 1000.
+func (eb *EventBus) Subscribe(queueSize int) *Subscription {
+	if queueSize <= 0 {
+		queueSize = defaultEventQueueSize
+	}
+	sub := &Subscription{eb, make(chan Event, queueSize), 0}
+
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+	eb.subscribers[sub] = true
+	atomic.StoreInt32(&eb.count, int32(len(eb.subscribers)))
+	return sub
+}
+
+// Events returns the queue of the subscription, it's closed when the subscription is
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns how many events didn't fit in the queue
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Close stops the deliveries
+func (s *Subscription) Close() {
+	eb := s.bus
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+	if !eb.subscribers[s] {
+		return
+	}
+	delete(eb.subscribers, s)
+	atomic.StoreInt32(&eb.count, int32(len(eb.subscribers)))
+	close(s.events)
+}
+
+// active reports if anyone listens, so events are only built when needed
+func (eb *EventBus) active() bool {
+	return atomic.LoadInt32(&eb.count) > 0
+}
+
+func (eb *EventBus) publish(e Event) {
+	if !eb.active() {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	eb.lock.RLock()
+	defer eb.lock.RUnlock()
+	for sub := range eb.subscribers {
+		select {
+		case sub.events <- e:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+	}
+}
+
+// ---
+
+// Events returns the proxy's event bus
+func (p *Proxy) Events() *EventBus {
+	return p.events
+}
+
+// requestEvent builds an event about the request a session is working on
+func (ps *ProxySession) requestEvent(kind EventKind, m Message, cmdName string) Event {
+	e := Event{Kind: kind, RemoteAddr: ps.remoteAddr, Command: cmdName}
+	if m != nil {
+		e.RequestID = m.Header().RequestID
+		e.OpCode = m.Header().OpCode
+	}
+	return e
+}
+
+// publishError reports an error which ended a request
+func (ps *ProxySession) publishError(m Message, err error) {
+	if !ps.proxy.events.active() {
+		return
+	}
+	cmdName := ""
+	if m != nil {
+		if _, cmd, err := GetCommand(m); err == nil {
+			cmdName = CommandName(cmd)
+		}
+	}
+	e := ps.requestEvent(EventError, m, cmdName)
+	e.Err = err
+	ps.proxy.events.publish(e)
+}
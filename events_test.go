@@ -0,0 +1,88 @@
+package mongonet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEventBusDropsWhenFull(test *testing.T) {
+	bus := NewEventBus()
+	if bus.active() {
+		test.Errorf("a bus without subscribers shouldn't be active")
+	}
+
+	slow := bus.Subscribe(2)
+	fast := bus.Subscribe(10)
+	for i := 0; i < 5; i++ {
+		bus.publish(Event{Kind: EventRequestReceived, RequestID: int32(i)})
+	}
+	if slow.Dropped() != 3 || fast.Dropped() != 0 {
+		test.Errorf("slow should have dropped 3 and fast none, got %d and %d", slow.Dropped(), fast.Dropped())
+	}
+	if e := <-slow.Events(); e.RequestID != 0 || e.Time.IsZero() {
+		test.Errorf("the first event should come first with a time: %+v", e)
+	}
+
+	slow.Close()
+	slow.Close()
+	if _, ok := <-slow.Events(); !ok {
+		test.Errorf("queued events should still be delivered")
+	}
+	if _, ok := <-slow.Events(); ok {
+		test.Errorf("a closed subscription's queue should be closed")
+	}
+	fast.Close()
+	if bus.active() {
+		test.Errorf("the bus should be inactive once everyone left")
+	}
+}
+
+func TestProxyEvents(test *testing.T) {
+	upstream := startTestShard(test, 9903)
+	defer upstream.server.Close()
+
+	proxy := NewProxy(NewProxyConfig("127.0.0.1", 9904, "127.0.0.1", 9903))
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	sub := proxy.Events().Subscribe(0)
+	defer sub.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9904")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	if _, err = RunCommand(conn, "test", bson.D{{"count", "foo"}}); err != nil {
+		test.Fatal(err)
+	}
+	conn.Close()
+
+	want := []EventKind{EventSessionOpened, EventRequestReceived, EventUpstreamCheckout, EventResponseSent, EventSessionClosed}
+	for _, kind := range want {
+		select {
+		case e := <-sub.Events():
+			if e.Kind != kind {
+				test.Fatalf("expected %s, got %s", kind, e.Kind)
+			}
+			switch kind {
+			case EventRequestReceived, EventResponseSent:
+				if e.Command != "count" || e.Bytes == 0 {
+					test.Errorf("%s should have the command and its size: %+v", kind, e)
+				}
+			case EventUpstreamCheckout:
+				if e.Upstream != "127.0.0.1:9903" {
+					test.Errorf("the checkout should name the upstream: %+v", e)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			test.Fatalf("no %s event", kind)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package mongonet
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// HelloMode says how the proxy presents itself in hello and isMaster responses
+type HelloMode int
+
+const (
+	HelloPassthrough HelloMode = iota // mongod's response goes to the client as is
+	HelloStandalone                   // the proxy looks like a standalone mongod
+	HelloMongos                       // the proxy looks like a mongos
+	HelloReplicaSet                   // the proxy listeners in ProxyConfig.HelloHosts look like a replica set
+)
+
+// fields of a hello response which describe the upstream deployment rather than the server's limits
+var helloTopologyFields = map[string]bool{
+	"ismaster":          true,
+	"isWritablePrimary": true,
+	"secondary":         true,
+	"arbiterOnly":       true,
+	"passive":           true,
+	"hidden":            true,
+	"setName":           true,
+	"setVersion":        true,
+	"electionId":        true,
+	"hosts":             true,
+	"passives":          true,
+	"arbiters":          true,
+	"primary":           true,
+	"me":                true,
+	"tags":              true,
+	"lastWrite":         true,
+	"isreplicaset":      true,
+	"msg":               true,
+	"topologyVersion":   true, // drivers would start streaming hello, which the proxy doesn't support
+}
+
+// helloRewriter replaces the topology part of hello responses with the proxy's own
+type helloRewriter struct {
+	config       *ProxyConfig
+	writableName string // isWritablePrimary for hello, ismaster for isMaster
+}
+
+// newHelloRewriter returns a response interceptor for hello and isMaster, nil if nothing is rewritten
+func (ps *ProxySession) newHelloRewriter(info *requestInfo) ResponseInterceptor {
+	if ps.proxy.config.HelloMode == HelloPassthrough || !info.isCommand("hello", "isMaster") {
+		return nil
+	}
+	writableName := "ismaster"
+	if strings.ToLower(info.cmdName) == "hello" {
+		writableName = "isWritablePrimary"
+	}
+	return &helloRewriter{&ps.proxy.config, writableName}
+}
+
+func (hr *helloRewriter) InterceptMongoToClient(m Message) (Message, error) {
+	doc, err := GetResponseDocument(m)
+	if err != nil || !IsResponseOk(doc) {
+		return m, nil
+	}
+
+	limits := bson.D{}
+	for _, elem := range doc {
+		if !helloTopologyFields[elem.Name] {
+			limits = append(limits, elem)
+		}
+	}
+
+	return m, SetResponseDocument(m, append(hr.topologyFields(), limits...))
+}
+
+// topologyFields describes the deployment the client should see
+func (hr *helloRewriter) topologyFields() bson.D {
+	pc := hr.config
+	switch pc.HelloMode {
+	case HelloMongos:
+		return bson.D{{hr.writableName, true}, {"msg", "isdbgrid"}}
+
+	case HelloReplicaSet:
+		me := pc.helloMe()
+		hosts := pc.HelloHosts
+		if len(hosts) == 0 {
+			hosts = []string{me}
+		}
+		primary := hosts[0]
+		setName := pc.HelloSetName
+		if setName == "" {
+			setName = "proxy"
+		}
+		return bson.D{
+			{hr.writableName, me == primary},
+			{"secondary", me != primary},
+			{"setName", setName},
+			{"setVersion", 1},
+			{"hosts", hosts},
+			{"primary", primary},
+			{"me", me},
+		}
+	}
+
+	return bson.D{{hr.writableName, true}}
+}
+
+// helloMe is the address the proxy listener announces for itself
+func (pc *ProxyConfig) helloMe() string {
+	if pc.HelloMe != "" {
+		return pc.HelloMe
+	}
+	return fmt.Sprintf("%s:%d", pc.BindHost, pc.BindPort)
+}
@@ -0,0 +1,83 @@
+package mongonet
+
+import (
+	"fmt"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func upstreamHello() bson.D {
+	return bson.D{
+		{"topologyVersion", bson.D{{"processId", bson.NewObjectId()}, {"counter", int64(3)}}},
+		{"hosts", []string{"mongo-0.internal:27017", "mongo-1.internal:27017"}},
+		{"setName", "internal"},
+		{"setVersion", 4},
+		{"isWritablePrimary", true},
+		{"secondary", false},
+		{"primary", "mongo-0.internal:27017"},
+		{"me", "mongo-0.internal:27017"},
+		{"maxBsonObjectSize", 16777216},
+		{"maxWireVersion", 13},
+		{"minWireVersion", 0},
+		{"saslSupportedMechs", []string{"SCRAM-SHA-256"}},
+		{"ok", 1},
+	}
+}
+
+func TestHelloRewriter(test *testing.T) {
+	pc := NewProxyConfig("127.0.0.1", 9999, "mongo-0.internal", 27017)
+	pc.HelloHosts = []string{"proxy-0:9999", "127.0.0.1:9999"}
+	pc.HelloSetName = "public"
+
+	legacyReply := func(doc bson.D) Message {
+		return &ReplyMessage{MessageHeader{0, 2, 1, OP_REPLY}, 0, 0, 0, 1, []SimpleBSON{SimpleBSONConvertOrPanic(doc)}}
+	}
+
+	for _, c := range []struct {
+		mode     HelloMode
+		writable string
+		resp     Message
+		expected bson.D
+	}{
+		{HelloStandalone, "isWritablePrimary", testReply(upstreamHello()), bson.D{{"isWritablePrimary", true}}},
+		{HelloMongos, "ismaster", legacyReply(upstreamHello()), bson.D{{"ismaster", true}, {"msg", "isdbgrid"}}},
+		{HelloReplicaSet, "isWritablePrimary", testReply(upstreamHello()), bson.D{
+			{"isWritablePrimary", false},
+			{"secondary", true},
+			{"setName", "public"},
+			{"setVersion", 1},
+			{"hosts", []interface{}{"proxy-0:9999", "127.0.0.1:9999"}},
+			{"primary", "proxy-0:9999"},
+			{"me", "127.0.0.1:9999"},
+		}},
+	} {
+		pc.HelloMode = c.mode
+		hr := &helloRewriter{&pc, c.writable}
+		resp, err := hr.InterceptMongoToClient(c.resp)
+		if err != nil {
+			test.Fatal(err)
+		}
+		doc, err := GetResponseDocument(resp)
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		expected := append(c.expected,
+			bson.DocElem{"maxBsonObjectSize", 16777216},
+			bson.DocElem{"maxWireVersion", 13},
+			bson.DocElem{"minWireVersion", 0},
+			bson.DocElem{"saslSupportedMechs", []interface{}{"SCRAM-SHA-256"}},
+			bson.DocElem{"ok", 1},
+		)
+		if len(doc) != len(expected) {
+			test.Errorf("mode %d: expected %v got %v", c.mode, expected, doc)
+			continue
+		}
+		for i := range doc {
+			if doc[i].Name != expected[i].Name || fmt.Sprint(doc[i].Value) != fmt.Sprint(expected[i].Value) {
+				test.Errorf("mode %d: expected %v got %v", c.mode, expected[i], doc[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package mongonet
+
+import (
+	"context"
+	"time"
+)
+
+// ProxyInterceptorV2 is a ProxyInterceptor whose hooks get the context of the request.
+// The context ends when the client's session ends or the proxy shuts down,
+// and has the request's maxTimeMS as its deadline.
+type ProxyInterceptorV2 interface {
+	InterceptClientToMongo(ctx context.Context, m Message) (Message, ResponseInterceptorV2, error)
+	Close()
+	TrackRequest(MessageHeader)
+	TrackRequestMessage(Message)
+	TrackResponse(MessageHeader)
+	TrackResponseMessage(Message)
+	CheckConnection() error
+	CheckConnectionInterval() time.Duration
+}
+
+type ResponseInterceptorV2 interface {
+	InterceptMongoToClient(ctx context.Context, m Message) (Message, error)
+}
+
+type ProxyInterceptorFactoryV2 interface {
+	// This has to be thread safe, will be called from many clients
+	NewInterceptor(ps *ProxySession) (ProxyInterceptorV2, error)
+}
+
+// AdaptInterceptor makes a ProxyInterceptor usable where a ProxyInterceptorV2 is expected, it ignores the context
+func AdaptInterceptor(pi ProxyInterceptor) ProxyInterceptorV2 {
+	return interceptorAdapter{pi}
+}
+
+type interceptorAdapter struct {
+	ProxyInterceptor
+}
+
+func (ia interceptorAdapter) InterceptClientToMongo(ctx context.Context, m Message) (Message, ResponseInterceptorV2, error) {
+	m, respInter, err := ia.ProxyInterceptor.InterceptClientToMongo(m)
+	if respInter == nil {
+		return m, nil, err
+	}
+	return m, responseInterceptorAdapter{respInter}, err
+}
+
+type responseInterceptorAdapter struct {
+	ResponseInterceptor
+}
+
+func (ria responseInterceptorAdapter) InterceptMongoToClient(ctx context.Context, m Message) (Message, error) {
+	return ria.ResponseInterceptor.InterceptMongoToClient(m)
+}
+
+// AdaptInterceptorFactory makes a ProxyInterceptorFactory usable where a ProxyInterceptorFactoryV2 is expected,
+// for example as a link of an InterceptorChain
+func AdaptInterceptorFactory(pif ProxyInterceptorFactory) ProxyInterceptorFactoryV2 {
+	return interceptorFactoryAdapter{pif}
+}
+
+type interceptorFactoryAdapter struct {
+	ProxyInterceptorFactory
+}
+
+func (ifa interceptorFactoryAdapter) NewInterceptor(ps *ProxySession) (ProxyInterceptorV2, error) {
+	pi, err := ifa.ProxyInterceptorFactory.NewInterceptor(ps)
+	if err != nil {
+		return nil, err
+	}
+	return AdaptInterceptor(pi), nil
+}
+
+// ---
+
+// Context returns the session's context, which ends when the client goes away or the proxy shuts down
+func (ps *ProxySession) Context() context.Context {
+	return ps.ctx
+}
+
+// requestContext derives the context of a request from the session's, with maxTimeMS as the deadline
+func (ps *ProxySession) requestContext(m Message) (context.Context, context.CancelFunc) {
+	_, cmd, err := GetCommand(m)
+	if err == nil {
+		if idx := BSONIndexOf(cmd, "maxTimeMS"); idx >= 0 {
+			if ms, _, err := GetAsInt(cmd[idx]); err == nil && ms > 0 {
+				return context.WithTimeout(ps.ctx, time.Duration(ms)*time.Millisecond)
+			}
+		}
+	}
+	return context.WithCancel(ps.ctx)
+}
+
+// closeOnShutdown closes the client connection when the session's context ends,
+// so a session waiting for its client's next request notices the proxy shutting down
+func (ps *ProxySession) closeOnShutdown() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ps.ctx.Done():
+			ps.conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
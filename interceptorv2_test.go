@@ -0,0 +1,101 @@
+package mongonet
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// contextInterceptor reports the deadlines it sees and blocks on a "wait" command until the context ends
+type contextInterceptor struct {
+	deadlines chan time.Duration // 0 if there was none
+	ended     chan error
+}
+
+func (ci *contextInterceptor) NewInterceptor(ps *ProxySession) (ProxyInterceptorV2, error) {
+	return ci, nil
+}
+
+func (ci *contextInterceptor) InterceptClientToMongo(ctx context.Context, m Message) (Message, ResponseInterceptorV2, error) {
+	_, cmd, _ := GetCommand(m)
+	if IsCommandNamed(cmd, "wait") {
+		<-ctx.Done()
+		ci.ended <- ctx.Err()
+		return m, nil, NewMongoError(ctx.Err(), 50, "MaxTimeMSExpired")
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		ci.deadlines <- 0
+	} else {
+		ci.deadlines <- time.Until(deadline)
+	}
+	return m, nil, nil
+}
+
+func (ci *contextInterceptor) Close()                                 {}
+func (ci *contextInterceptor) TrackRequest(MessageHeader)             {}
+func (ci *contextInterceptor) TrackRequestMessage(Message)            {}
+func (ci *contextInterceptor) TrackResponse(MessageHeader)            {}
+func (ci *contextInterceptor) TrackResponseMessage(Message)           {}
+func (ci *contextInterceptor) CheckConnection() error                 { return nil }
+func (ci *contextInterceptor) CheckConnectionInterval() time.Duration { return 0 }
+
+func TestInterceptorContext(test *testing.T) {
+	upstream := startTestShard(test, 9901)
+	defer upstream.server.Close()
+
+	ci := &contextInterceptor{make(chan time.Duration, 10), make(chan error, 1)}
+	pc := NewProxyConfig("127.0.0.1", 9902, "127.0.0.1", 9901)
+	pc.InterceptorFactoryV2 = ci
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9902")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err = RunCommand(conn, "test", bson.D{{"count", "foo"}}); err != nil {
+		test.Fatal(err)
+	}
+	if d := <-ci.deadlines; d != 0 {
+		test.Errorf("a request without maxTimeMS shouldn't have a deadline, got %s", d)
+	}
+	if _, err = RunCommand(conn, "test", bson.D{{"count", "foo"}, {"maxTimeMS", 5000}}); err != nil {
+		test.Fatal(err)
+	}
+	if d := <-ci.deadlines; d <= 4*time.Second || d > 5*time.Second {
+		test.Errorf("the deadline should come from maxTimeMS, got %s", d)
+	}
+
+	// shutting down cancels what the interceptor is waiting for, and doesn't wait for the client
+	go RunCommand(conn, "test", bson.D{{"wait", 1}})
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		proxy.Close()
+		close(closed)
+	}()
+	select {
+	case err = <-ci.ended:
+		if err != context.Canceled {
+			test.Errorf("the request should have been canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		test.Fatalf("the request wasn't canceled")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		test.Fatalf("the proxy didn't shut down")
+	}
+}
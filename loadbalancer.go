@@ -0,0 +1,109 @@
+package mongonet
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Drivers connecting with loadBalanced=true say so in their first hello and expect a serviceId back.
+// They treat each serviceId as one backend and pin cursors and transactions to a connection,
+// so with ProxyConfig.LoadBalanced a client connection sticks to the backend chosen at handshake,
+// and the serviceId is that backend's pool. With a topology the backend is picked again once it
+// failed or stepped down.
+
+// stateChangeCodes mean a server isn't primary anymore, from the server discovery and monitoring spec
+var stateChangeCodes = map[int]bool{
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+// interceptLoadBalancedHello handles the loadBalanced handshake, it returns nil if the request isn't one
+func (ps *ProxySession) interceptLoadBalancedHello(info *requestInfo) (ResponseInterceptor, error) {
+	if !ps.proxy.config.LoadBalanced || !info.isCommand("hello", "isMaster") {
+		return nil, nil
+	}
+	idx := BSONIndexOf(info.cmd, "loadBalanced")
+	if idx < 0 {
+		if !ps.loadBalanced {
+			return nil, nil
+		}
+		pool, err := ps.loadBalancedPool()
+		if err != nil {
+			return nil, err
+		}
+		return &serviceIdResponseInterceptor{pool.ServiceId()}, nil
+	}
+	loadBalanced, _, _ := GetAsBool(info.cmd[idx])
+
+	// backends only accept loadBalanced from a real load balancer
+	info.cmd = append(info.cmd[:idx:idx], info.cmd[idx+1:]...)
+	if err := SetCommand(info.m, info.cmd); err != nil {
+		return nil, err
+	}
+
+	if !loadBalanced {
+		return nil, nil
+	}
+
+	ps.loadBalanced = true
+	pool, err := ps.loadBalancedPool()
+	if err != nil {
+		return nil, err
+	}
+	return &serviceIdResponseInterceptor{pool.ServiceId()}, nil
+}
+
+// loadBalancedPool returns the backend a load balanced client sticks to, picking one if needed
+func (ps *ProxySession) loadBalancedPool() (*ConnectionPool, error) {
+	if ps.lbPool == nil {
+		pool, err := ps.defaultPool()
+		if err != nil {
+			return nil, err
+		}
+		ps.lbPool = pool
+	}
+	return ps.lbPool, nil
+}
+
+// checkLoadBalancedPool lets a load balanced client move on once its backend failed or isn't primary anymore
+func (ps *ProxySession) checkLoadBalancedPool(resp Message, err error) {
+	if ps.lbPool == nil || ps.proxy.topology == nil {
+		return
+	}
+	if err == nil {
+		if resp == nil {
+			return
+		}
+		doc, err := GetResponseDocument(resp)
+		if err != nil {
+			return
+		}
+		me, ok := ResponseToError(doc).(MongoError)
+		if !ok || !stateChangeCodes[me.code] {
+			return
+		}
+	}
+	ps.proxy.topology.RequestCheck()
+	ps.lbPool = nil
+}
+
+type serviceIdResponseInterceptor struct {
+	serviceId bson.ObjectId
+}
+
+func (sri *serviceIdResponseInterceptor) InterceptMongoToClient(m Message) (Message, error) {
+	doc, err := GetResponseDocument(m)
+	if err != nil || !IsResponseOk(doc) {
+		return m, nil
+	}
+	if idx := BSONIndexOf(doc, "serviceId"); idx >= 0 {
+		doc[idx].Value = sri.serviceId
+	} else {
+		doc = append(doc, bson.DocElem{"serviceId", sri.serviceId})
+	}
+	return m, SetResponseDocument(m, doc)
+}
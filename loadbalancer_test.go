@@ -0,0 +1,136 @@
+package mongonet
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLoadBalancedMode(test *testing.T) {
+	mongos := []*standInMember{
+		startStandInMember(test, 9971, bson.D{{"ismaster", true}, {"msg", "isdbgrid"}, {"maxWireVersion", 13}}),
+		startStandInMember(test, 9972, bson.D{{"ismaster", true}, {"msg", "isdbgrid"}, {"maxWireVersion", 13}}),
+	}
+	for _, m := range mongos {
+		defer m.server.Close()
+	}
+
+	pc := NewProxyConfig("127.0.0.1", 9973, "", 0)
+	pc.MongoSeeds = []string{"127.0.0.1:9971", "127.0.0.1:9972"}
+	pc.HeartbeatInterval = 50 * time.Millisecond
+	pc.LoadBalanced = true
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+	waitFor(test, "discovery", func() bool {
+		servers := proxy.Topology().Servers()
+		return len(servers) == 2 && servers[0].Kind == ServerMongos && servers[1].Kind == ServerMongos
+	})
+
+	serviceIds := map[bson.ObjectId]bool{}
+	for i := 0; i < 8; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:9973")
+		if err != nil {
+			test.Fatalf("cannot dial proxy: %s", err)
+		}
+
+		hello, err := RunCommand(conn, "admin", bson.D{{"hello", 1}, {"loadBalanced", true}})
+		if err != nil {
+			test.Fatalf("hello failed: %s", err)
+		}
+		idx := BSONIndexOf(hello, "serviceId")
+		if idx < 0 {
+			test.Fatalf("no serviceId in %v", hello)
+		}
+		serviceId := hello[idx].Value.(bson.ObjectId)
+		serviceIds[serviceId] = true
+
+		var before [2]int32
+		for j, m := range mongos {
+			before[j] = atomic.LoadInt32(&m.commands)
+			m.lock.Lock()
+			if BSONIndexOf(m.lastHello, "loadBalanced") >= 0 {
+				test.Errorf("loadBalanced should not reach the backend")
+			}
+			m.lock.Unlock()
+		}
+
+		for j := 0; j < 5; j++ {
+			if _, err := RunCommand(conn, "test", bson.D{{"find", "bar"}}); err != nil {
+				test.Fatalf("find failed: %s", err)
+			}
+		}
+		conn.Close()
+
+		got := [2]int32{atomic.LoadInt32(&mongos[0].commands) - before[0], atomic.LoadInt32(&mongos[1].commands) - before[1]}
+		if got != [2]int32{5, 0} && got != [2]int32{0, 5} {
+			test.Errorf("a load balanced connection should stick to one backend, got %v", got)
+		}
+	}
+
+	if len(serviceIds) > 2 {
+		test.Errorf("there should be one serviceId per backend, got %d", len(serviceIds))
+	}
+}
+
+func TestLoadBalancedFailover(test *testing.T) {
+	hosts := []string{"127.0.0.1:9974", "127.0.0.1:9975"}
+	members := []*standInMember{
+		startStandInMember(test, 9974, memberIsMaster("rs2", true, bson.ObjectIdHex("7fffffff0000000000000001"), hosts...)),
+		startStandInMember(test, 9975, memberIsMaster("rs2", false, "", hosts...)),
+	}
+	for _, m := range members {
+		defer m.server.Close()
+	}
+
+	pc := NewProxyConfig("127.0.0.1", 9976, "", 0)
+	if err := pc.SetMongoURI("mongodb://127.0.0.1:9974/?replicaSet=rs2&heartbeatFrequencyMS=50"); err != nil {
+		test.Fatal(err)
+	}
+	pc.LoadBalanced = true
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+	waitFor(test, "primary", primaryIs(proxy.Topology(), hosts[0]))
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9976")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+	if _, err = RunCommand(conn, "admin", bson.D{{"hello", 1}, {"loadBalanced", true}}); err != nil {
+		test.Fatalf("hello failed: %s", err)
+	}
+
+	insert := bson.D{{"insert", "bar"}, {"documents", []bson.D{{{"x", 1}}}}}
+	if _, err = RunCommand(conn, "test", insert); err != nil {
+		test.Fatal(err)
+	}
+
+	// the old primary steps down and says so, the next write goes to the new one
+	members[0].setIsMaster(memberIsMaster("rs2", false, "", hosts...))
+	members[1].setIsMaster(memberIsMaster("rs2", true, bson.ObjectIdHex("7fffffff0000000000000002"), hosts...))
+	atomic.StoreInt32(&members[0].notPrimaryNext, 1)
+	if _, err = RunCommand(conn, "test", insert); err == nil {
+		test.Fatalf("the stepped down member should have refused the write")
+	}
+	waitFor(test, "failover", primaryIs(proxy.Topology(), hosts[1]))
+	if _, err = RunCommand(conn, "test", insert); err != nil {
+		test.Fatal(err)
+	}
+	if atomic.LoadInt32(&members[0].commands) != 1 || atomic.LoadInt32(&members[1].commands) != 1 {
+		test.Errorf("the write after the failover should go to the new primary, got %d and %d",
+			atomic.LoadInt32(&members[0].commands), atomic.LoadInt32(&members[1].commands))
+	}
+}
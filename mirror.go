@@ -0,0 +1,227 @@
+package mongonet
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Mirror sends copies of client requests to a second deployment, e.g. to rehearse an upgrade.
+// Requests are queued and sent by a fixed number of workers, each using at most one connection,
+// so neither a slow mirror nor a full queue holds up the proxy. Requests which don't fit are dropped.
+// With more than one worker requests may reach the mirror in a different order than the upstream.
+type Mirror struct {
+	pool      *ConnectionPool
+	readRate  float64
+	writeRate float64
+	compare   bool
+	logger    *slogger.Logger
+
+	lock   sync.RWMutex
+	closed bool
+	queue  chan mirrorRequest
+	wg     sync.WaitGroup
+
+	sent       int64
+	dropped    int64
+	failed     int64
+	mismatched int64
+}
+
+type mirrorRequest struct {
+	cmdName  string
+	raw      []byte
+	response bool
+	primary  bson.D // what the upstream answered, nil unless responses are compared
+}
+
+// commands which are mirrored, as they behave the same on any deployment holding the same data
+var mirroredReads = map[string]bool{
+	"find":      true,
+	"aggregate": true,
+	"count":     true,
+	"distinct":  true,
+}
+
+var mirroredWrites = map[string]bool{
+	"insert":        true,
+	"update":        true,
+	"delete":        true,
+	"findandmodify": true,
+	"aggregate":     true, // with $out or $merge
+}
+
+// response fields which differ between deployments even if the data doesn't
+var mirrorVolatileFields = map[string]bool{
+	"$clusterTime":        true,
+	"operationTime":       true,
+	"$gleStats":           true,
+	"$configServerState":  true,
+	"lastCommittedOpTime": true,
+	"electionId":          true,
+	"opTime":              true,
+}
+
+func NewMirror(pool *ConnectionPool, readRate, writeRate float64, compare bool, workers, queueSize int, logger *slogger.Logger) *Mirror {
+	if workers <= 0 {
+		workers = 1
+	}
+	mr := &Mirror{pool, readRate, writeRate, compare, logger, sync.RWMutex{}, false, make(chan mirrorRequest, queueSize), sync.WaitGroup{}, 0, 0, 0, 0}
+	for i := 0; i < workers; i++ {
+		mr.wg.Add(1)
+		go mr.work()
+	}
+	return mr
+}
+
+// Close stops the workers once the queued requests are sent
+func (mr *Mirror) Close() {
+	mr.lock.Lock()
+	if mr.closed {
+		mr.lock.Unlock()
+		return
+	}
+	mr.closed = true
+	close(mr.queue)
+	mr.lock.Unlock()
+
+	mr.wg.Wait()
+	mr.pool.Close()
+}
+
+func (mr *Mirror) Stats() bson.D {
+	return bson.D{
+		{"address", mr.pool.Address()},
+		{"sent", atomic.LoadInt64(&mr.sent)},
+		{"dropped", atomic.LoadInt64(&mr.dropped)},
+		{"failed", atomic.LoadInt64(&mr.failed)},
+		{"mismatched", atomic.LoadInt64(&mr.mismatched)},
+	}
+}
+
+// sample decides if a request is mirrored
+func (mr *Mirror) sample(info *requestInfo) bool {
+	if info.inTransaction() || info.cursorId != 0 {
+		// neither transactions nor cursors exist on the mirror
+		return false
+	}
+	if qm, ok := info.m.(*QueryMessage); ok && qm.Flags&(1<<6) != 0 {
+		// exhaust
+		return false
+	}
+
+	rate := 0.0
+	switch {
+	case info.cmd == nil:
+		if info.isRead() {
+			rate = mr.readRate
+		}
+	case info.isRead():
+		if mirroredReads[strings.ToLower(info.cmdName)] {
+			rate = mr.readRate
+		}
+	default:
+		if mirroredWrites[strings.ToLower(info.cmdName)] {
+			rate = mr.writeRate
+		}
+	}
+	return rate > 0 && rand.Float64() < rate
+}
+
+// submit queues a copy of a request, resp is the upstream's response, nil if there is none.
+// It never blocks.
+func (mr *Mirror) submit(info *requestInfo, raw []byte, resp Message) {
+	req := mirrorRequest{info.cmdName, raw, info.m.HasResponse(), nil}
+	if mr.compare && resp != nil {
+		if doc, err := GetResponseDocument(resp); err == nil {
+			req.primary = doc
+		}
+	}
+
+	mr.lock.RLock()
+	defer mr.lock.RUnlock()
+	if mr.closed {
+		return
+	}
+	select {
+	case mr.queue <- req:
+	default:
+		atomic.AddInt64(&mr.dropped, 1)
+	}
+}
+
+func (mr *Mirror) work() {
+	defer mr.wg.Done()
+	for req := range mr.queue {
+		mr.send(req)
+	}
+}
+
+func (mr *Mirror) send(req mirrorRequest) {
+	conn, err := mr.pool.Get()
+	if err != nil {
+		atomic.AddInt64(&mr.failed, 1)
+		mr.logger.Logf(slogger.DEBUG, "cannot connect to mirror: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.conn.Write(req.raw); err != nil {
+		conn.bad = true
+		atomic.AddInt64(&mr.failed, 1)
+		return
+	}
+	atomic.AddInt64(&mr.sent, 1)
+	if !req.response {
+		return
+	}
+
+	resp, err := ReadMessage(conn.conn)
+	if err != nil {
+		conn.bad = true
+		atomic.AddInt64(&mr.failed, 1)
+		return
+	}
+
+	if req.primary == nil {
+		return
+	}
+	doc, err := GetResponseDocument(resp)
+	if err != nil {
+		atomic.AddInt64(&mr.failed, 1)
+		return
+	}
+	if !responsesMatch(req.primary, doc) {
+		atomic.AddInt64(&mr.mismatched, 1)
+		mr.logger.Logf(slogger.WARN, "mirror answered %s differently, upstream: %v mirror: %v", req.cmdName, req.primary, doc)
+	}
+}
+
+// responsesMatch compares responses, ignoring what depends on the deployment rather than the data
+func responsesMatch(a, b bson.D) bool {
+	return BSONCompare(stripVolatile(a), stripVolatile(b)) == 0
+}
+
+func stripVolatile(doc bson.D) bson.D {
+	res := bson.D{}
+	for _, elem := range doc {
+		if mirrorVolatileFields[elem.Name] {
+			continue
+		}
+		if elem.Name == "cursor" {
+			if cursor, ok := elem.Value.(bson.D); ok {
+				// ids are handed out by each server
+				if idx := BSONIndexOf(cursor, "id"); idx >= 0 {
+					cursor = append(cursor[:idx:idx], cursor[idx+1:]...)
+				}
+				elem.Value = cursor
+			}
+		}
+		res = append(res, elem)
+	}
+	return res
+}
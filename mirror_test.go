@@ -0,0 +1,108 @@
+package mongonet
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestResponsesMatch(test *testing.T) {
+	a := bson.D{{"cursor", bson.D{{"firstBatch", []bson.D{{{"x", 1}}}}, {"id", int64(5)}, {"ns", "test.foo"}}}, {"ok", 1}, {"operationTime", bson.MongoTimestamp(1)}}
+	b := bson.D{{"cursor", bson.D{{"firstBatch", []bson.D{{{"x", 1}}}}, {"id", int64(7)}, {"ns", "test.foo"}}}, {"ok", 1}}
+	if !responsesMatch(a, b) {
+		test.Errorf("cursor ids and operation times should be ignored")
+	}
+	c := bson.D{{"cursor", bson.D{{"firstBatch", []bson.D{{{"x", 2}}}}, {"id", int64(7)}, {"ns", "test.foo"}}}, {"ok", 1}}
+	if responsesMatch(a, c) {
+		test.Errorf("different documents should not match")
+	}
+}
+
+func TestMirrorSample(test *testing.T) {
+	mr := &Mirror{readRate: 1, writeRate: 0}
+	for _, c := range []struct {
+		cmd      bson.D
+		mirrored bool
+	}{
+		{bson.D{{"find", "foo"}}, true},
+		{bson.D{{"aggregate", "foo"}, {"pipeline", []bson.D{}}}, true},
+		{bson.D{{"insert", "foo"}, {"documents", []bson.D{}}}, false},
+		{bson.D{{"isMaster", 1}}, false},
+		{bson.D{{"getMore", int64(5)}, {"collection", "foo"}}, false},
+		{bson.D{{"find", "foo"}, {"lsid", bson.D{}}, {"txnNumber", int64(1)}, {"autocommit", false}}, false},
+	} {
+		info := newRequestInfo(testCommandMessage(c.cmd))
+		if got := mr.sample(info); got != c.mirrored {
+			test.Errorf("%v mirrored: %v, expected %v", c.cmd, got, c.mirrored)
+		}
+	}
+}
+
+func TestMirrorProxy(test *testing.T) {
+	upstream := startTestShard(test, 9991)
+	defer upstream.server.Close()
+	mirror := startTestShard(test, 9992)
+	defer mirror.server.Close()
+
+	pc := NewProxyConfig("127.0.0.1", 9993, "127.0.0.1", 9991)
+	pc.MirrorHost = "127.0.0.1"
+	pc.MirrorPort = 9992
+	pc.MirrorCompare = true
+	pc.MirrorConnections = 1 // keeps the order of requests
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9993")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+
+	waitForMirror := func(cond func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				test.Fatalf("mirror didn't catch up, stats: %v", proxy.mirror.Stats())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if _, err = RunCommand(conn, "test", bson.D{{"insert", "foo"}, {"documents", []bson.D{{{"x", 1}}}}}); err != nil {
+		test.Fatal(err)
+	}
+	if _, err = RunCommand(conn, "test", bson.D{{"find", "foo"}}); err != nil {
+		test.Fatal(err)
+	}
+	// not mirrored
+	if _, err = RunCommand(conn, "admin", bson.D{{"ping", 1}}); err != nil {
+		test.Fatal(err)
+	}
+	seen := []string{}
+	waitForMirror(func() bool {
+		seen = append(seen, mirror.takeCommands()...)
+		return len(seen) >= 2
+	})
+	if len(seen) != 2 || seen[0] != "insert" || seen[1] != "find" {
+		test.Errorf("mirror should have seen the insert and the find, got %v", seen)
+	}
+
+	mirror.lock.Lock()
+	mirror.docs = append(mirror.docs, bson.D{{"x", 2}})
+	mirror.lock.Unlock()
+	if _, err = RunCommand(conn, "test", bson.D{{"find", "foo"}}); err != nil {
+		test.Fatal(err)
+	}
+	waitForMirror(func() bool { return atomic.LoadInt64(&proxy.mirror.mismatched) > 0 })
+	if stats := proxy.mirror.Stats(); stats[4].Value != int64(1) || stats[3].Value != int64(0) {
+		test.Errorf("only the last find should have differed: %v", stats)
+	}
+}
@@ -0,0 +1,683 @@
+package mongotest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/erh/mongonet"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *Server) registerCommands() {
+	s.mux.Handle(s.insert, "insert")
+	s.mux.Handle(s.cursors.CursorCommand(s.find), "find")
+	s.mux.Handle(s.update, "update")
+	s.mux.Handle(s.delete, "delete")
+	s.mux.Handle(s.findAndModify, "findAndModify")
+	s.mux.Handle(s.count, "count")
+	s.mux.Handle(s.cursors.CursorCommand(s.aggregate), "aggregate")
+	s.mux.Handle(s.listDatabases, "listDatabases")
+	s.mux.Handle(s.cursors.CursorCommand(s.listCollections), "listCollections")
+	s.mux.Handle(s.cursors.CursorCommand(s.listIndexes), "listIndexes")
+	s.mux.Handle(s.create, "create")
+	s.mux.Handle(s.drop, "drop")
+	s.mux.Handle(s.dropDatabase, "dropDatabase")
+	s.mux.Handle(s.createIndexes, "createIndexes")
+	s.mux.Handle(s.dropIndexes, "dropIndexes")
+	s.mux.Handle(s.endSessions, "endSessions")
+}
+
+// ---
+
+func collectionName(cmd bson.D) (string, error) {
+	name, ok := cmd[0].Value.(string)
+	if !ok || name == "" {
+		return "", mongoError(73, "InvalidNamespace", "collection name has invalid type %T", cmd[0].Value)
+	}
+	return name, nil
+}
+
+func getDoc(cmd bson.D, name string) bson.D {
+	if idx := mongonet.BSONIndexOf(cmd, name); idx >= 0 {
+		doc, _, _ := mongonet.GetAsBSON(cmd[idx])
+		return doc
+	}
+	return nil
+}
+
+func getInt(cmd bson.D, name string) int {
+	if idx := mongonet.BSONIndexOf(cmd, name); idx >= 0 {
+		n, _, _ := mongonet.GetAsInt(cmd[idx])
+		return n
+	}
+	return 0
+}
+
+func getBool(cmd bson.D, name string) bool {
+	if idx := mongonet.BSONIndexOf(cmd, name); idx >= 0 {
+		return truthy(cmd[idx].Value)
+	}
+	return false
+}
+
+func getDocs(cmd bson.D, name string) ([]bson.D, error) {
+	idx := mongonet.BSONIndexOf(cmd, name)
+	if idx < 0 {
+		return nil, mongoError(40414, "Location40414", "BSON field '%s' is missing but a required field", name)
+	}
+	docs, _, err := mongonet.GetAsBSONDocs(cmd[idx])
+	if err != nil {
+		return nil, mongoError(14, "TypeMismatch", "BSON field '%s' must be an array of documents", name)
+	}
+	return docs, nil
+}
+
+// writeError turns the error of one statement of a write into an entry of writeErrors
+func writeError(i int, err error) bson.D {
+	me, ok := err.(mongonet.MongoError)
+	if !ok {
+		me = mongonet.NewMongoError(err, 1, "InternalError")
+	}
+	res := me.ToBSON()
+	errmsg := ""
+	if idx := mongonet.BSONIndexOf(res, "errmsg"); idx >= 0 {
+		errmsg, _, _ = mongonet.GetAsString(res[idx])
+	}
+	return bson.D{{"index", i}, {"code", me.Code()}, {"errmsg", errmsg}}
+}
+
+func writeReply(reply bson.D, writeErrors []bson.D) bson.D {
+	if len(writeErrors) > 0 {
+		reply = append(reply, bson.DocElem{"writeErrors", writeErrors})
+	}
+	return reply
+}
+
+// ---
+
+func (s *Server) insert(req *mongonet.CommandRequest) (bson.D, error) {
+	name, err := collectionName(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := getDocs(req.Command, "documents")
+	if err != nil {
+		return nil, err
+	}
+	ordered := mongonet.BSONIndexOf(req.Command, "ordered") < 0 || getBool(req.Command, "ordered")
+
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	c := s.store.collection(req.DB, name, true)
+
+	n := 0
+	writeErrors := []bson.D{}
+	for i, doc := range docs {
+		if _, err := c.insert(doc); err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered {
+				break
+			}
+			continue
+		}
+		n++
+	}
+	return writeReply(bson.D{{"n", n}}, writeErrors), nil
+}
+
+func (s *Server) find(req *mongonet.CommandRequest) (mongonet.CursorSource, error) {
+	name, err := collectionName(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	cmd := req.Command
+	skip, limit := getInt(cmd, "skip"), getInt(cmd, "limit")
+	if skip < 0 || limit < 0 {
+		return nil, mongoError(2, "BadValue", "skip and limit must be non-negative")
+	}
+
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	c := s.store.collection(req.DB, name, false)
+	positions, err := query(c, getDoc(cmd, "filter"), getDoc(cmd, "sort"))
+	if err != nil {
+		return nil, err
+	}
+
+	if skip >= len(positions) {
+		positions = nil
+	} else {
+		positions = positions[skip:]
+	}
+	if limit > 0 && limit < len(positions) {
+		positions = positions[:limit]
+	}
+	projection := getDoc(cmd, "projection")
+	docs := make([]bson.D, len(positions))
+	for i, pos := range positions {
+		if docs[i], err = project(c.docs[pos], projection); err != nil {
+			return nil, err
+		}
+	}
+	return mongonet.NewSliceCursorSource(docs), nil
+}
+
+// compileUpdate compiles the update of an update statement or findAndModify, with its arrayFilters
+func compileUpdate(cmd bson.D, update bson.D) (*mongonet.BSONUpdater, error) {
+	var arrayFilters []bson.D
+	if mongonet.BSONIndexOf(cmd, "arrayFilters") >= 0 {
+		var err error
+		if arrayFilters, err = getDocs(cmd, "arrayFilters"); err != nil {
+			return nil, err
+		}
+	}
+	return mongonet.CompileBSONUpdate(update, arrayFilters)
+}
+
+// upsert inserts the document an update of nothing creates
+func upsert(c *collection, filter bson.D, updater *mongonet.BSONUpdater) (bson.D, error) {
+	doc, err := updater.Upsert(filter)
+	if err != nil {
+		return nil, err
+	}
+	return c.insert(doc)
+}
+
+func (s *Server) update(req *mongonet.CommandRequest) (bson.D, error) {
+	name, err := collectionName(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	statements, err := getDocs(req.Command, "updates")
+	if err != nil {
+		return nil, err
+	}
+	ordered := mongonet.BSONIndexOf(req.Command, "ordered") < 0 || getBool(req.Command, "ordered")
+
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	c := s.store.collection(req.DB, name, true)
+
+	n, nModified := 0, 0
+	upserted := []bson.D{}
+	writeErrors := []bson.D{}
+	for i, statement := range statements {
+		matched, modified, id, err := updateOne(c, statement)
+		if err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered {
+				break
+			}
+			continue
+		}
+		n += matched
+		nModified += modified
+		if id != nil {
+			n++
+			upserted = append(upserted, bson.D{{"index", i}, {"_id", id}})
+		}
+	}
+
+	reply := bson.D{{"n", n}, {"nModified", nModified}}
+	if len(upserted) > 0 {
+		reply = append(reply, bson.DocElem{"upserted", upserted})
+	}
+	return writeReply(reply, writeErrors), nil
+}
+
+// updateOne runs one statement of an update, returning the _id of an upserted document
+func updateOne(c *collection, statement bson.D) (int, int, interface{}, error) {
+	filter := getDoc(statement, "q")
+	idx := mongonet.BSONIndexOf(statement, "u")
+	if idx < 0 {
+		return 0, 0, nil, mongoError(9, "FailedToParse", "update statements need a u field")
+	}
+	update, ok := statement[idx].Value.(bson.D)
+	if !ok {
+		return 0, 0, nil, mongoError(2, "BadValue", "unsupported update of type %T, pipelines aren't supported", statement[idx].Value)
+	}
+	updater, err := compileUpdate(statement, update)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	multi := getBool(statement, "multi")
+	if multi && updater.IsReplacement() {
+		return 0, 0, nil, mongoError(9, "FailedToParse", "multi update is not supported for replacement-style update")
+	}
+
+	positions, err := query(c, filter, nil)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(positions) == 0 {
+		if !getBool(statement, "upsert") {
+			return 0, 0, nil, nil
+		}
+		doc, err := upsert(c, filter, updater)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		id, _ := mongonet.BSONGetPath(doc, "_id")
+		return 0, 0, id, nil
+	}
+	if !multi {
+		positions = positions[:1]
+	}
+
+	modified := 0
+	for _, pos := range positions {
+		doc, err := updater.Apply(c.docs[pos], filter)
+		if err != nil {
+			return 0, modified, nil, err
+		}
+		if mongonet.BSONCompare(doc, c.docs[pos]) == 0 {
+			continue
+		}
+		if err := c.replace(pos, doc); err != nil {
+			return 0, modified, nil, err
+		}
+		modified++
+	}
+	return len(positions), modified, nil, nil
+}
+
+func (s *Server) delete(req *mongonet.CommandRequest) (bson.D, error) {
+	name, err := collectionName(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	statements, err := getDocs(req.Command, "deletes")
+	if err != nil {
+		return nil, err
+	}
+	ordered := mongonet.BSONIndexOf(req.Command, "ordered") < 0 || getBool(req.Command, "ordered")
+
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	c := s.store.collection(req.DB, name, false)
+
+	n := 0
+	writeErrors := []bson.D{}
+	for i, statement := range statements {
+		positions, err := query(c, getDoc(statement, "q"), nil)
+		if err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered {
+				break
+			}
+			continue
+		}
+		if getInt(statement, "limit") == 1 && len(positions) > 1 {
+			positions = positions[:1]
+		}
+		// from the back, so the positions stay valid
+		for j := len(positions) - 1; j >= 0; j-- {
+			c.remove(positions[j])
+		}
+		n += len(positions)
+	}
+	return writeReply(bson.D{{"n", n}}, writeErrors), nil
+}
+
+func (s *Server) findAndModify(req *mongonet.CommandRequest) (bson.D, error) {
+	name, err := collectionName(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	cmd := req.Command
+	filter := getDoc(cmd, "query")
+	remove := getBool(cmd, "remove")
+	update := getDoc(cmd, "update")
+	if remove == (mongonet.BSONIndexOf(cmd, "update") >= 0) {
+		return nil, mongoError(9, "FailedToParse", "either an update or remove=true must be specified")
+	}
+	var updater *mongonet.BSONUpdater
+	if !remove {
+		if updater, err = compileUpdate(cmd, update); err != nil {
+			return nil, err
+		}
+	}
+
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	c := s.store.collection(req.DB, name, true)
+
+	positions, err := query(c, filter, getDoc(cmd, "sort"))
+	if err != nil {
+		return nil, err
+	}
+
+	var value bson.D
+	lastError := bson.D{}
+	switch {
+	case len(positions) == 0 && !remove && getBool(cmd, "upsert"):
+		doc, err := upsert(c, filter, updater)
+		if err != nil {
+			return nil, err
+		}
+		if getBool(cmd, "new") {
+			value = doc
+		}
+		id, _ := mongonet.BSONGetPath(doc, "_id")
+		lastError = bson.D{{"n", 1}, {"updatedExisting", false}, {"upserted", id}}
+
+	case len(positions) == 0:
+		lastError = bson.D{{"n", 0}}
+		if !remove {
+			lastError = append(lastError, bson.DocElem{"updatedExisting", false})
+		}
+
+	case remove:
+		value = c.docs[positions[0]]
+		c.remove(positions[0])
+		lastError = bson.D{{"n", 1}}
+
+	default:
+		old := c.docs[positions[0]]
+		doc, err := updater.Apply(old, filter)
+		if err != nil {
+			return nil, err
+		}
+		if err = c.replace(positions[0], doc); err != nil {
+			return nil, err
+		}
+		value = old
+		if getBool(cmd, "new") {
+			value = doc
+		}
+		lastError = bson.D{{"n", 1}, {"updatedExisting", true}}
+	}
+
+	if value != nil {
+		if value, err = project(value, getDoc(cmd, "fields")); err != nil {
+			return nil, err
+		}
+	}
+	var result interface{}
+	if value != nil {
+		result = value
+	}
+	return bson.D{{"lastErrorObject", lastError}, {"value", result}}, nil
+}
+
+func (s *Server) count(req *mongonet.CommandRequest) (bson.D, error) {
+	name, err := collectionName(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	positions, err := query(s.store.collection(req.DB, name, false), getDoc(req.Command, "query"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(positions) - getInt(req.Command, "skip")
+	if n < 0 {
+		n = 0
+	}
+	if limit := getInt(req.Command, "limit"); limit != 0 {
+		if limit < 0 {
+			limit = -limit
+		}
+		if limit < n {
+			n = limit
+		}
+	}
+	return bson.D{{"n", n}}, nil
+}
+
+// aggregate runs the pipeline over the collection, $lookup reads the other collections of the database
+func (s *Server) aggregate(req *mongonet.CommandRequest) (mongonet.CursorSource, error) {
+	name, err := collectionName(req.Command)
+	if err != nil {
+		return nil, mongoError(2, "BadValue", "database level aggregations aren't supported")
+	}
+	pipeline, err := getDocs(req.Command, "pipeline")
+	if err != nil {
+		return nil, err
+	}
+	lookup := func(collection string) ([]bson.D, error) {
+		return s.snapshot(req.DB, collection), nil
+	}
+	docs, err := mongonet.BSONAggregate(s.snapshot(req.DB, name), pipeline, lookup)
+	if err != nil {
+		return nil, err
+	}
+	return mongonet.NewSliceCursorSource(docs), nil
+}
+
+// snapshot returns the documents of a collection, which stay valid since documents are never changed in place
+func (s *Server) snapshot(db, name string) []bson.D {
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	docs := []bson.D{}
+	if c := s.store.collection(db, name, false); c != nil {
+		docs = append(docs, c.docs...)
+	}
+	return docs
+}
+
+// ---
+
+func (s *Server) listDatabases(req *mongonet.CommandRequest) (bson.D, error) {
+	filter := getDoc(req.Command, "filter")
+	nameOnly := getBool(req.Command, "nameOnly")
+
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	matcher, err := mongonet.CompileBSONFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	databases := []bson.D{}
+	for _, name := range s.store.databaseNames() {
+		entry := bson.D{{"name", name}}
+		if !nameOnly {
+			entry = append(entry, bson.DocElem{"sizeOnDisk", int64(0)}, bson.DocElem{"empty", false})
+		}
+		if matcher.Matches(entry) {
+			databases = append(databases, entry)
+		}
+	}
+	reply := bson.D{{"databases", databases}}
+	if !nameOnly {
+		reply = append(reply, bson.DocElem{"totalSize", int64(0)})
+	}
+	return reply, nil
+}
+
+func (s *Server) listCollections(req *mongonet.CommandRequest) (mongonet.CursorSource, error) {
+	filter := getDoc(req.Command, "filter")
+	nameOnly := getBool(req.Command, "nameOnly")
+
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	matcher, err := mongonet.CompileBSONFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	entries := []bson.D{}
+	for _, name := range s.store.collectionNames(req.DB) {
+		entry := bson.D{{"name", name}, {"type", "collection"}}
+		if !nameOnly {
+			entry = append(entry,
+				bson.DocElem{"options", bson.D{}},
+				bson.DocElem{"info", bson.D{{"readOnly", false}}},
+				bson.DocElem{"idIndex", s.store.dbs[req.DB][name].indexes[0].spec()})
+		}
+		if matcher.Matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return mongonet.NewSliceCursorSource(entries), nil
+}
+
+func (s *Server) listIndexes(req *mongonet.CommandRequest) (mongonet.CursorSource, error) {
+	name, err := collectionName(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	c := s.store.collection(req.DB, name, false)
+	if c == nil {
+		return nil, mongoError(26, "NamespaceNotFound", "ns does not exist: %s.%s", req.DB, name)
+	}
+	specs := make([]bson.D, len(c.indexes))
+	for i, idx := range c.indexes {
+		specs[i] = idx.spec()
+	}
+	return mongonet.NewSliceCursorSource(specs), nil
+}
+
+func (s *Server) create(req *mongonet.CommandRequest) (bson.D, error) {
+	name, err := collectionName(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	if s.store.collection(req.DB, name, false) != nil {
+		return nil, mongoError(48, "NamespaceExists", "Collection %s.%s already exists.", req.DB, name)
+	}
+	s.store.collection(req.DB, name, true)
+	return bson.D{}, nil
+}
+
+func (s *Server) drop(req *mongonet.CommandRequest) (bson.D, error) {
+	name, err := collectionName(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	c := s.store.dropCollection(req.DB, name)
+	if c == nil {
+		return nil, mongoError(26, "NamespaceNotFound", "ns not found")
+	}
+	return bson.D{{"nIndexesWas", len(c.indexes)}, {"ns", c.ns}}, nil
+}
+
+func (s *Server) dropDatabase(req *mongonet.CommandRequest) (bson.D, error) {
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	delete(s.store.dbs, req.DB)
+	return bson.D{{"dropped", req.DB}}, nil
+}
+
+// indexName is the name mongod gives an index, like a_1_b_-1
+func indexName(key bson.D) string {
+	pieces := make([]string, 0, 2*len(key))
+	for _, elem := range key {
+		pieces = append(pieces, elem.Name, fmt.Sprint(elem.Value))
+	}
+	return strings.Join(pieces, "_")
+}
+
+func (s *Server) createIndexes(req *mongonet.CommandRequest) (bson.D, error) {
+	name, err := collectionName(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	specs, err := getDocs(req.Command, "indexes")
+	if err != nil {
+		return nil, err
+	}
+
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	created := s.store.collection(req.DB, name, false) == nil
+	c := s.store.collection(req.DB, name, true)
+	before := len(c.indexes)
+
+	for _, spec := range specs {
+		key := getDoc(spec, "key")
+		if len(key) == 0 {
+			return nil, mongoError(67, "CannotCreateIndex", "index specification must have a non-empty key")
+		}
+		idx := &index{indexName(key), key, getBool(spec, "unique")}
+		if i := mongonet.BSONIndexOf(spec, "name"); i >= 0 {
+			idx.name, _, _ = mongonet.GetAsString(spec[i])
+		}
+
+		if i := c.findIndex(idx.name); i >= 0 {
+			if mongonet.BSONCompare(c.indexes[i].key, key) != 0 {
+				return nil, mongoError(86, "IndexKeySpecsConflict", "an existing index has the same name as the requested index: %s", idx.name)
+			}
+			continue
+		}
+		for _, other := range c.indexes {
+			if mongonet.BSONCompare(other.key, key) == 0 {
+				return nil, mongoError(85, "IndexOptionsConflict", "index with name: %s already exists with a different name", other.name)
+			}
+		}
+
+		if idx.unique {
+			for i, doc := range c.docs {
+				values := idx.keyValues(doc)
+				for _, other := range c.docs[i+1:] {
+					if mongonet.BSONCompare(values, idx.keyValues(other)) == 0 {
+						return nil, dupKeyError(c.ns, idx, values)
+					}
+				}
+			}
+		}
+		c.indexes = append(c.indexes, idx)
+	}
+
+	return bson.D{
+		{"createdCollectionAutomatically", created},
+		{"numIndexesBefore", before},
+		{"numIndexesAfter", len(c.indexes)},
+	}, nil
+}
+
+func (s *Server) dropIndexes(req *mongonet.CommandRequest) (bson.D, error) {
+	name, err := collectionName(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	idx := mongonet.BSONIndexOf(req.Command, "index")
+	if idx < 0 {
+		return nil, mongoError(40414, "Location40414", "BSON field 'index' is missing but a required field")
+	}
+	which := req.Command[idx].Value
+
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	c := s.store.collection(req.DB, name, false)
+	if c == nil {
+		return nil, mongoError(26, "NamespaceNotFound", "ns not found %s.%s", req.DB, name)
+	}
+	was := len(c.indexes)
+
+	if which == "*" {
+		c.indexes = c.indexes[:1]
+		return bson.D{{"nIndexesWas", was}}, nil
+	}
+
+	pos := -1
+	switch w := which.(type) {
+	case string:
+		pos = c.findIndex(w)
+	case bson.D:
+		for i, index := range c.indexes {
+			if mongonet.BSONCompare(index.key, w) == 0 {
+				pos = i
+			}
+		}
+	}
+	if pos < 0 {
+		return nil, mongoError(27, "IndexNotFound", "index not found with name [%v]", which)
+	}
+	if pos == 0 {
+		return nil, mongoError(72, "InvalidOptions", "cannot drop _id index")
+	}
+	c.indexes = append(c.indexes[:pos:pos], c.indexes[pos+1:]...)
+	return bson.D{{"nIndexesWas", was}}, nil
+}
+
+func (s *Server) endSessions(req *mongonet.CommandRequest) (bson.D, error) {
+	return bson.D{}, nil
+}
@@ -0,0 +1,83 @@
+package mongotest
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/erh/mongonet"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func isOperatorDoc(v interface{}) bool {
+	doc, ok := v.(bson.D)
+	return ok && len(doc) > 0 && strings.HasPrefix(doc[0].Name, "$")
+}
+
+// query returns the positions of the matching documents, in storage order or sorted
+func query(c *collection, filter bson.D, sortSpec bson.D) ([]int, error) {
+	matcher, err := mongonet.CompileBSONFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	positions := []int{}
+	if c == nil {
+		return positions, nil
+	}
+	for i, doc := range c.docs {
+		if matcher.Matches(doc) {
+			positions = append(positions, i)
+		}
+	}
+	if len(sortSpec) > 0 {
+		sort.SliceStable(positions, func(i, j int) bool {
+			return mongonet.BSONCompareBySort(c.docs[positions[i]], c.docs[positions[j]], sortSpec) < 0
+		})
+	}
+	return positions, nil
+}
+
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	n, ok := mongonet.BSONNumber(v)
+	return !ok || n != 0
+}
+
+// project applies an inclusion or exclusion projection of top level fields
+func project(doc bson.D, projection bson.D) (bson.D, error) {
+	if len(projection) == 0 {
+		return doc, nil
+	}
+	include := map[string]bool{}
+	inclusion, keepId := false, true
+	for _, elem := range projection {
+		if strings.Contains(elem.Name, ".") || strings.HasPrefix(elem.Name, "$") || isOperatorDoc(elem.Value) {
+			return nil, mongoError(2, "BadValue", "unsupported projection %v", elem)
+		}
+		if elem.Name == "_id" {
+			keepId = truthy(elem.Value)
+			continue
+		}
+		include[elem.Name] = truthy(elem.Value)
+		inclusion = inclusion || truthy(elem.Value)
+	}
+
+	res := bson.D{}
+	for _, elem := range doc {
+		keep := false
+		switch {
+		case elem.Name == "_id":
+			keep = keepId
+		case inclusion:
+			keep = include[elem.Name]
+		default:
+			_, excluded := include[elem.Name]
+			keep = !excluded
+		}
+		if keep {
+			res = append(res, elem)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,313 @@
+package mongotest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erh/mongonet"
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Expectation is one command a ScriptedServer waits for and how it answers it
+type Expectation struct {
+	name    string
+	ns      string // db.coll, or only db, empty for any
+	partial bson.D
+
+	reply      bson.D
+	docs       []bson.D // answered as a cursor if not nil
+	err        error
+	delay      time.Duration
+	drop       bool // close the connection instead of answering
+	closeAfter bool // close the connection after answering
+}
+
+// On restricts the expectation to a namespace, db.coll or only db
+func (e *Expectation) On(ns string) *Expectation {
+	e.ns = ns
+	return e
+}
+
+// With requires the command to contain these fields, documents match if they contain the expected fields
+func (e *Expectation) With(partial bson.D) *Expectation {
+	e.partial = partial
+	return e
+}
+
+// Reply sets the response, ok: 1 is added if missing
+func (e *Expectation) Reply(doc bson.D) *Expectation {
+	e.reply = doc
+	return e
+}
+
+// ReplyDocs answers with an exhausted cursor holding docs
+func (e *Expectation) ReplyDocs(docs ...bson.D) *Expectation {
+	e.docs = append([]bson.D{}, docs...)
+	return e
+}
+
+// ReplyError fails the command
+func (e *Expectation) ReplyError(code int, codeName string, errmsg string) *Expectation {
+	e.err = mongonet.NewMongoError(fmt.Errorf("%s", errmsg), code, codeName)
+	return e
+}
+
+// ReplyWriteError answers a write with a writeError for its first document, like a duplicate key
+func (e *Expectation) ReplyWriteError(code int, errmsg string) *Expectation {
+	e.reply = bson.D{{"n", 0}, {"writeErrors", []bson.D{{{"index", 0}, {"code", code}, {"errmsg", errmsg}}}}}
+	return e
+}
+
+// Delay waits before answering
+func (e *Expectation) Delay(d time.Duration) *Expectation {
+	e.delay = d
+	return e
+}
+
+// DropConnection closes the client's connection instead of answering
+func (e *Expectation) DropConnection() *Expectation {
+	e.drop = true
+	return e
+}
+
+// ThenClose closes the client's connection after answering
+func (e *Expectation) ThenClose() *Expectation {
+	e.closeAfter = true
+	return e
+}
+
+func (e *Expectation) String() string {
+	s := e.name
+	if e.ns != "" {
+		s += " on " + e.ns
+	}
+	if len(e.partial) > 0 {
+		s += fmt.Sprintf(" with %v", e.partial)
+	}
+	return s
+}
+
+func (e *Expectation) matches(db string, cmd bson.D) bool {
+	if !mongonet.IsCommandNamed(cmd, e.name) {
+		return false
+	}
+	if e.ns != "" {
+		ns := db
+		if coll, ok := cmd[0].Value.(string); ok && strings.Contains(e.ns, ".") {
+			ns = db + "." + coll
+		}
+		if ns != e.ns {
+			return false
+		}
+	}
+	return containsPartial(cmd, e.partial)
+}
+
+// containsPartial checks that actual has everything expected has, documents may have more fields
+func containsPartial(actual, expected interface{}) bool {
+	switch exp := expected.(type) {
+	case bson.D:
+		doc, ok := actual.(bson.D)
+		if !ok {
+			return false
+		}
+		for _, elem := range exp {
+			idx := mongonet.BSONIndexOf(doc, elem.Name)
+			if idx < 0 || !containsPartial(doc[idx].Value, elem.Value) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		arr, ok := actual.([]interface{})
+		if !ok || len(arr) != len(exp) {
+			return false
+		}
+		for i := range exp {
+			if !containsPartial(arr[i], exp[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return mongonet.BSONCompare(actual, expected) == 0
+}
+
+// ---
+
+// handshakeCommands are answered without expectations, unless the next expectation is for them
+var handshakeCommands = []string{"hello", "isMaster", "ping", "buildInfo", "getnonce", "getLastError", "endSessions"}
+
+// ScriptedServer answers commands from a list of expectations, in order.
+// Commands which don't match the next expectation fail the test, and so do expectations left when it finishes.
+type ScriptedServer struct {
+	test         testing.TB
+	server       *mongonet.Server
+	handshake    *mongonet.CommandMux
+	lock         sync.Mutex
+	expectations []*Expectation
+	next         int
+}
+
+// NewScriptedServer starts a server on an ephemeral port of 127.0.0.1, call Finish when done
+func NewScriptedServer(test testing.TB) *ScriptedServer {
+	ss := &ScriptedServer{test: test, handshake: mongonet.NewCommandMux()}
+	ss.handshake.Handle(func(req *mongonet.CommandRequest) (bson.D, error) { return bson.D{}, nil }, "endSessions")
+	server := mongonet.NewServer(
+		mongonet.ServerConfig{"127.0.0.1", 0, false, nil, mongonet.NewSyncTlsConfig(), 0, 0, nil, slogger.OFF, nil},
+		ss,
+	)
+	ss.server = &server
+	go server.Run()
+	if err := <-server.InitChannel(); err != nil {
+		test.Fatalf("cannot start scripted server: %s", err)
+	}
+	return ss
+}
+
+// Addr returns the host:port the server listens on
+func (ss *ScriptedServer) Addr() string {
+	return ss.server.Addr.String()
+}
+
+// URI returns a connection string for drivers
+func (ss *ScriptedServer) URI() string {
+	return fmt.Sprintf("mongodb://%s/?directConnection=true", ss.Addr())
+}
+
+// Expect adds a command to wait for after the ones already expected, it answers ok: 1 unless told otherwise
+func (ss *ScriptedServer) Expect(command string) *Expectation {
+	e := &Expectation{name: command}
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.expectations = append(ss.expectations, e)
+	return e
+}
+
+// Pending returns how many expectations are still waiting, for commands which arrive in the background
+func (ss *ScriptedServer) Pending() int {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return len(ss.expectations) - ss.next
+}
+
+// Finish stops the server and fails the test for every expectation which wasn't met
+func (ss *ScriptedServer) Finish() {
+	ss.server.Close()
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	for _, e := range ss.expectations[ss.next:] {
+		ss.test.Errorf("mongotest: expected %s, which never came", e)
+	}
+}
+
+// take returns the expectation a command meets, nil if it's unexpected
+func (ss *ScriptedServer) take(db string, cmd bson.D) *Expectation {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if ss.next < len(ss.expectations) && ss.expectations[ss.next].matches(db, cmd) {
+		e := ss.expectations[ss.next]
+		ss.next++
+		return e
+	}
+	return nil
+}
+
+func (ss *ScriptedServer) CreateWorker(session *mongonet.Session) (mongonet.ServerWorker, error) {
+	return ss.CreateWorkerWithContext(session, nil)
+}
+
+// CreateWorkerWithContext makes Finish wait for the sessions, so none reports to a finished test
+func (ss *ScriptedServer) CreateWorkerWithContext(session *mongonet.Session, ctx *context.Context) (mongonet.ServerWorker, error) {
+	return &scriptedWorker{ss, session, ctx}, nil
+}
+
+func (ss *ScriptedServer) GetConnection(conn net.Conn) io.ReadWriteCloser {
+	return conn
+}
+
+type scriptedWorker struct {
+	ss      *ScriptedServer
+	session *mongonet.Session
+	ctx     *context.Context
+}
+
+func (sw *scriptedWorker) DoLoopTemp() {
+	if sw.ctx != nil {
+		// unblock ReadMessage when the server shuts down
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-(*sw.ctx).Done():
+				sw.session.Connection().Close()
+			case <-done:
+			}
+		}()
+	}
+	for {
+		m, err := sw.session.ReadMessage()
+		if err != nil {
+			return
+		}
+		if !sw.answer(m) {
+			return
+		}
+	}
+}
+
+// answer responds to one message, returning false once the connection should close
+func (sw *scriptedWorker) answer(m mongonet.Message) bool {
+	ss := sw.ss
+	db, cmd, err := mongonet.GetCommand(m)
+	if err != nil || len(cmd) == 0 {
+		ss.test.Errorf("mongotest: unexpected message %s", m.ToString())
+		return sw.session.RespondWithError(m, mongonet.NewMongoError(fmt.Errorf("unexpected message"), 59, "CommandNotFound")) == nil
+	}
+
+	e := ss.take(db, cmd)
+	if e == nil {
+		if mongonet.IsCommandNamed(cmd, handshakeCommands...) {
+			return ss.handshake.Serve(sw.session, m) == nil
+		}
+		ss.test.Errorf("mongotest: unexpected command %v on %s", cmd, db)
+		return sw.session.RespondWithError(m, mongonet.NewMongoError(fmt.Errorf("unexpected command %s", mongonet.CommandName(cmd)), 59, "CommandNotFound")) == nil
+	}
+
+	if e.delay > 0 {
+		time.Sleep(e.delay)
+	}
+	if e.drop {
+		return false
+	}
+	if e.err != nil {
+		err = sw.session.RespondWithError(m, e.err)
+	} else {
+		reply := append(bson.D{}, e.reply...)
+		if e.docs != nil {
+			ns := db + ".$cmd." + mongonet.CommandName(cmd)
+			if coll, ok := cmd[0].Value.(string); ok {
+				ns = db + "." + coll
+			}
+			reply = mongonet.CursorReply(ns, 0, "firstBatch", e.docs)
+		}
+		if mongonet.BSONIndexOf(reply, "ok") < 0 {
+			reply = append(reply, bson.DocElem{"ok", 1})
+		}
+		var doc mongonet.SimpleBSON
+		if doc, err = mongonet.SimpleBSONConvert(reply); err == nil {
+			err = sw.session.RespondToCommand(m, doc)
+		}
+	}
+	return err == nil && !e.closeAfter
+}
+
+func (sw *scriptedWorker) Close() {
+}
@@ -0,0 +1,113 @@
+package mongotest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erh/mongonet"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestScriptedServer(test *testing.T) {
+	ss := NewScriptedServer(test)
+	ss.Expect("find").On("test.foo").With(bson.D{{"filter", bson.D{{"x", 1}}}}).ReplyDocs(bson.D{{"_id", 1}, {"x", 1}})
+	ss.Expect("insert").On("test.foo").ReplyWriteError(11000, "E11000 duplicate key error")
+	defer ss.Finish()
+
+	session, err := mgo.Dial(ss.Addr())
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer session.Close()
+	coll := session.DB("test").C("foo")
+
+	var doc bson.D
+	if err = coll.Find(bson.D{{"x", 1}}).One(&doc); err != nil || len(doc) != 2 {
+		test.Errorf("expected the scripted document, got %v %v", doc, err)
+	}
+	if err = coll.Insert(bson.D{{"_id", 1}}); !mgo.IsDup(err) {
+		test.Errorf("expected a duplicate key error, got %v", err)
+	}
+}
+
+func TestScriptedServerFailures(test *testing.T) {
+	ss := NewScriptedServer(test)
+	ss.Expect("ping").Delay(100 * time.Millisecond)
+	ss.Expect("count").ReplyError(50, "MaxTimeMSExpired", "operation exceeded time limit")
+	ss.Expect("count").Reply(bson.D{{"n", 3}}).ThenClose()
+	ss.Expect("find").DropConnection()
+	defer ss.Finish()
+
+	conn, err := net.Dial("tcp", ss.Addr())
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err = mongonet.RunCommand(conn, "test", bson.D{{"ping", 1}}); err != nil || time.Since(start) < 100*time.Millisecond {
+		test.Errorf("ping should be answered late, got %v after %s", err, time.Since(start))
+	}
+	_, err = mongonet.RunCommand(conn, "test", bson.D{{"count", "foo"}})
+	if me, ok := err.(mongonet.MongoError); !ok || me.Code() != 50 {
+		test.Errorf("expected MaxTimeMSExpired, got %v", err)
+	}
+	if res, err := mongonet.RunCommand(conn, "test", bson.D{{"count", "foo"}}); err != nil || res[0].Value != 3 {
+		test.Errorf("expected a count of 3, got %v %v", res, err)
+	}
+	if _, err = mongonet.RunCommand(conn, "test", bson.D{{"ping", 1}}); err == nil {
+		test.Errorf("the connection should have been closed after the count")
+	}
+
+	conn2, err := net.Dial("tcp", ss.Addr())
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer conn2.Close()
+	if _, err = mongonet.RunCommand(conn2, "test", bson.D{{"find", "foo"}}); err == nil {
+		test.Errorf("the find should have dropped the connection")
+	}
+}
+
+// recorder collects what a ScriptedServer reports instead of failing the test
+type recorder struct {
+	testing.TB
+	lock   sync.Mutex
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestScriptedServerReports(test *testing.T) {
+	r := &recorder{TB: test}
+	ss := NewScriptedServer(r)
+	ss.Expect("insert").On("test.foo")
+	ss.Expect("delete")
+
+	conn, err := net.Dial("tcp", ss.Addr())
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err = mongonet.RunCommand(conn, "test", bson.D{{"insert", "bar"}}); err == nil {
+		test.Errorf("an insert on the wrong collection should fail")
+	}
+	if _, err = mongonet.RunCommand(conn, "test", bson.D{{"insert", "foo"}}); err != nil {
+		test.Errorf("the expected insert should work, got %v", err)
+	}
+	ss.Finish()
+
+	if len(r.errors) != 2 || !strings.Contains(r.errors[0], "unexpected command") || !strings.Contains(r.errors[1], "expected delete") {
+		test.Errorf("expected the bad insert and the missing delete to be reported, got %q", r.errors)
+	}
+}
@@ -0,0 +1,57 @@
+// Package mongotest runs an in-memory stand-in for mongod which speaks the wire protocol,
+// so tests can point real drivers at it without a database.
+package mongotest
+
+import (
+	"fmt"
+
+	"github.com/erh/mongonet"
+	"github.com/mongodb/slogger/v2/slogger"
+)
+
+type Server struct {
+	server  *mongonet.Server
+	mux     *mongonet.CommandMux
+	cursors *mongonet.CursorManager
+	store   *store
+}
+
+// NewServer starts a server on an ephemeral port of 127.0.0.1
+func NewServer() (*Server, error) {
+	mux := mongonet.NewCommandMux()
+	server := mongonet.NewServer(
+		mongonet.ServerConfig{"127.0.0.1", 0, false, nil, mongonet.NewSyncTlsConfig(), 0, 0, nil, slogger.OFF, nil},
+		mux,
+	)
+	s := &Server{&server, mux, mongonet.NewCursorManager(0), newStore()}
+	s.cursors.Install(mux)
+	s.registerCommands()
+
+	go server.Run()
+	if err := <-server.InitChannel(); err != nil {
+		s.cursors.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close stops the server, the data goes away with it
+func (s *Server) Close() {
+	s.server.Close()
+	s.cursors.Close()
+}
+
+// Addr returns the host:port the server listens on
+func (s *Server) Addr() string {
+	return s.server.Addr.String()
+}
+
+// URI returns a connection string for drivers
+func (s *Server) URI() string {
+	return fmt.Sprintf("mongodb://%s/?directConnection=true", s.Addr())
+}
+
+// Mux returns the command router, so tests can add or replace commands
+func (s *Server) Mux() *mongonet.CommandMux {
+	return s.mux
+}
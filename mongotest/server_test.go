@@ -0,0 +1,256 @@
+package mongotest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/erh/mongonet"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func startServer(test *testing.T) *Server {
+	s, err := NewServer()
+	if err != nil {
+		test.Fatalf("cannot start server: %s", err)
+	}
+	return s
+}
+
+func TestCRUD(test *testing.T) {
+	s := startServer(test)
+	defer s.Close()
+
+	session, err := mgo.Dial(s.Addr())
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer session.Close()
+	coll := session.DB("test").C("foo")
+
+	for i := 0; i < 150; i++ {
+		if err = coll.Insert(bson.D{{"x", i % 10}, {"i", i}}); err != nil {
+			test.Fatalf("can't insert: %s", err)
+		}
+	}
+	if n, err := coll.Find(bson.D{{"x", 3}}).Count(); err != nil || n != 15 {
+		test.Errorf("expected 15 documents with x 3, got %d %v", n, err)
+	}
+	filter := bson.D{{"i", bson.D{{"$gte", 100}}}, {"$or", []interface{}{bson.D{{"x", bson.D{{"$in", []interface{}{1, 2}}}}}, bson.D{{"i", 149}}}}}
+	if n, err := coll.Find(filter).Count(); err != nil || n != 11 {
+		test.Errorf("expected 11 documents matching the operators, got %d %v", n, err)
+	}
+
+	// more than a batch, sorted, through getMore
+	var all []bson.D
+	if err = coll.Find(nil).Sort("-i").Batch(40).All(&all); err != nil || len(all) != 150 {
+		test.Fatalf("expected all 150 documents, got %d %v", len(all), err)
+	}
+	if all[0][2].Value != 149 || all[149][2].Value != 0 {
+		test.Errorf("the documents should be sorted by i descending: %v %v", all[0], all[149])
+	}
+
+	var doc bson.D
+	if err = coll.Find(bson.D{{"i", 7}}).Select(bson.D{{"_id", 0}, {"i", 1}}).One(&doc); err != nil || len(doc) != 1 || doc[0].Name != "i" {
+		test.Errorf("the projection should only keep i, got %v %v", doc, err)
+	}
+
+	info, err := coll.UpdateAll(bson.D{{"x", 1}}, bson.D{{"$inc", bson.D{{"i", 1000}}}, {"$set", bson.D{{"y", true}}}})
+	if err != nil || info.Matched != 15 || info.Updated != 15 {
+		test.Errorf("expected 15 updates, got %+v %v", info, err)
+	}
+	if n, _ := coll.Find(bson.D{{"y", true}}).Count(); n != 15 {
+		test.Errorf("the updates should be visible, got %d", n)
+	}
+	info, err = coll.Upsert(bson.D{{"name", "new"}}, bson.D{{"$set", bson.D{{"z", 1}}}})
+	if err != nil || info.UpsertedId == nil {
+		test.Fatalf("expected an upsert, got %+v %v", info, err)
+	}
+	if err = coll.FindId(info.UpsertedId).One(&doc); err != nil || len(doc) != 3 {
+		test.Errorf("the upserted document should have _id, name and z: %v %v", doc, err)
+	}
+
+	var changed bson.M
+	change := mgo.Change{Update: bson.D{{"$set", bson.D{{"name", "newer"}}}}, ReturnNew: true}
+	if _, err = coll.Find(bson.D{{"name", "new"}}).Apply(change, &changed); err != nil || changed["name"] != "newer" {
+		test.Errorf("findAndModify should return the new document, got %v %v", changed, err)
+	}
+
+	if info, err = coll.RemoveAll(bson.D{{"x", 2}}); err != nil || info.Removed != 15 {
+		test.Errorf("expected 15 removals, got %+v %v", info, err)
+	}
+	if n, _ := coll.Count(); n != 136 {
+		test.Errorf("expected 136 documents left, got %d", n)
+	}
+}
+
+func TestIndexesAndCatalog(test *testing.T) {
+	s := startServer(test)
+	defer s.Close()
+
+	session, err := mgo.Dial(s.Addr())
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer session.Close()
+	coll := session.DB("shop").C("users")
+
+	if err = coll.EnsureIndex(mgo.Index{Key: []string{"email"}, Unique: true}); err != nil {
+		test.Fatalf("can't create index: %s", err)
+	}
+	if err = coll.Insert(bson.D{{"email", "a@b.c"}}); err != nil {
+		test.Fatal(err)
+	}
+	if err = coll.Insert(bson.D{{"email", "a@b.c"}}); !mgo.IsDup(err) {
+		test.Errorf("a second a@b.c should be a duplicate, got %v", err)
+	}
+	indexes, err := coll.Indexes()
+	if err != nil || len(indexes) != 2 || indexes[1].Name != "email_1" || !indexes[1].Unique {
+		test.Errorf("expected _id_ and email_1, got %+v %v", indexes, err)
+	}
+	if err = coll.DropIndexName("email_1"); err != nil {
+		test.Errorf("can't drop index: %s", err)
+	}
+	if err = coll.Insert(bson.D{{"email", "a@b.c"}}); err != nil {
+		test.Errorf("without the index duplicates are fine, got %v", err)
+	}
+
+	session.DB("shop").C("orders").Insert(bson.D{{"n", 1}})
+	if names, err := session.DB("shop").CollectionNames(); err != nil || len(names) != 2 || names[0] != "orders" {
+		test.Errorf("expected orders and users, got %v %v", names, err)
+	}
+	if names, err := session.DatabaseNames(); err != nil || len(names) != 1 || names[0] != "shop" {
+		test.Errorf("expected the shop database, got %v %v", names, err)
+	}
+	if err = session.DB("shop").C("orders").DropCollection(); err != nil {
+		test.Errorf("can't drop: %s", err)
+	}
+	if err = session.DB("shop").C("orders").DropCollection(); err == nil {
+		test.Errorf("dropping a missing collection should fail")
+	}
+}
+
+func TestCountDocuments(test *testing.T) {
+	s := startServer(test)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer conn.Close()
+
+	docs := []interface{}{bson.D{{"a", 1}}, bson.D{{"a", 1}}, bson.D{{"a", 2}}}
+	if _, err = mongonet.RunCommand(conn, "test", bson.D{{"insert", "foo"}, {"documents", docs}}); err != nil {
+		test.Fatal(err)
+	}
+
+	// what drivers send for countDocuments
+	pipeline := []interface{}{
+		bson.D{{"$match", bson.D{{"a", 1}}}},
+		bson.D{{"$group", bson.D{{"_id", 1}, {"n", bson.D{{"$sum", 1}}}}}},
+	}
+	res, err := mongonet.RunCommand(conn, "test", bson.D{{"aggregate", "foo"}, {"pipeline", pipeline}, {"cursor", bson.D{}}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	batch, _ := mongonet.BSONGetPath(res, "cursor.firstBatch")
+	if arr, _ := batch.([]interface{}); len(arr) != 1 || arr[0].(bson.D)[1].Value != 2 {
+		test.Errorf("expected a count of 2, got %v", res)
+	}
+}
+
+func TestArrayUpdates(test *testing.T) {
+	s := startServer(test)
+	defer s.Close()
+
+	session, err := mgo.Dial(s.Addr())
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer session.Close()
+	coll := session.DB("test").C("students")
+
+	grades := []interface{}{bson.D{{"grade", 80}, {"mean", 75}}, bson.D{{"grade", 85}, {"mean", 90}}}
+	if err = coll.Insert(bson.D{{"_id", 1}, {"grades", grades}, {"tags", []interface{}{"a"}}}); err != nil {
+		test.Fatal(err)
+	}
+	if err = coll.Update(bson.D{{"grades.grade", 85}}, bson.D{{"$set", bson.D{{"grades.$.mean", 100}}}, {"$push", bson.D{{"tags", "b"}}}}); err != nil {
+		test.Fatalf("positional update failed: %s", err)
+	}
+	var doc bson.D
+	if err = coll.FindId(1).One(&doc); err != nil {
+		test.Fatal(err)
+	}
+	if mean, _ := mongonet.BSONGetPath(doc, "grades.1.mean"); mean != 100 {
+		test.Errorf("the matched grade should be updated, got %v", doc)
+	}
+	if tags, _ := mongonet.BSONGetPath(doc, "tags.1"); tags != "b" {
+		test.Errorf("b should be pushed, got %v", doc)
+	}
+
+	update := bson.D{
+		{"update", "students"},
+		{"updates", []interface{}{bson.D{
+			{"q", bson.D{}},
+			{"u", bson.D{{"$inc", bson.D{{"grades.$[g].grade", 5}}}}},
+			{"arrayFilters", []interface{}{bson.D{{"g.grade", bson.D{{"$lt", 85}}}}}},
+		}}},
+	}
+	var reply bson.D
+	if err = session.DB("test").Run(update, &reply); err != nil {
+		test.Fatalf("arrayFilters update failed: %s", err)
+	}
+	if n, _ := mongonet.BSONGetPath(reply, "nModified"); n != 1 {
+		test.Errorf("the arrayFilters update should modify one document, got %v", reply)
+	}
+	if err = coll.FindId(1).One(&doc); err != nil {
+		test.Fatal(err)
+	}
+	if grade, _ := mongonet.BSONGetPath(doc, "grades.0.grade"); grade != 85 {
+		test.Errorf("the first grade should be 85, got %v", doc)
+	}
+
+	if err = coll.UpdateId(1, bson.D{{"$inc", bson.D{{"tags", 1}}}}); err == nil || err.(*mgo.LastError).Code != 14 {
+		test.Errorf("$inc of an array should be a TypeMismatch, got %v", err)
+	}
+}
+
+func TestAggregate(test *testing.T) {
+	s := startServer(test)
+	defer s.Close()
+
+	session, err := mgo.Dial(s.Addr())
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer session.Close()
+	db := session.DB("shop")
+
+	for i := 0; i < 120; i++ {
+		if err = db.C("orders").Insert(bson.D{{"_id", i}, {"sku", i % 3}, {"qty", i}}); err != nil {
+			test.Fatal(err)
+		}
+	}
+	db.C("items").Insert(bson.D{{"sku", 0}, {"name", "zero"}}, bson.D{{"sku", 1}, {"name", "one"}})
+
+	// more results than a batch, so the cursor has to page
+	var unwound []bson.D
+	pipeline := []bson.D{{{"$project", bson.D{{"copies", []interface{}{1, 2}}}}}, {{"$unwind", "$copies"}}}
+	if err = db.C("orders").Pipe(pipeline).Batch(50).All(&unwound); err != nil || len(unwound) != 240 {
+		test.Errorf("expected 240 unwound documents, got %d %v", len(unwound), err)
+	}
+
+	var groups []bson.M
+	pipeline = []bson.D{
+		{{"$group", bson.D{{"_id", "$sku"}, {"total", bson.D{{"$sum", "$qty"}}}}}},
+		{{"$lookup", bson.D{{"from", "items"}, {"localField", "_id"}, {"foreignField", "sku"}, {"as", "item"}}}},
+		{{"$sort", bson.D{{"_id", 1}}}},
+	}
+	if err = db.C("orders").Pipe(pipeline).All(&groups); err != nil || len(groups) != 3 {
+		test.Fatalf("expected 3 groups, got %v %v", groups, err)
+	}
+	if groups[0]["total"] != 2340 || len(groups[0]["item"].([]interface{})) != 1 || len(groups[2]["item"].([]interface{})) != 0 {
+		test.Errorf("unexpected groups %v", groups)
+	}
+}
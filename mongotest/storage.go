@@ -0,0 +1,169 @@
+package mongotest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/erh/mongonet"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func mongoError(code int, codeName string, format string, args ...interface{}) mongonet.MongoError {
+	return mongonet.NewMongoError(fmt.Errorf(format, args...), code, codeName)
+}
+
+// index only enforces uniqueness, queries always scan the collection
+type index struct {
+	name   string
+	key    bson.D
+	unique bool
+}
+
+func (idx *index) spec() bson.D {
+	spec := bson.D{{"v", 2}, {"key", idx.key}, {"name", idx.name}}
+	if idx.unique && idx.name != "_id_" {
+		spec = append(spec, bson.DocElem{"unique", true})
+	}
+	return spec
+}
+
+// keyValues returns what a document is indexed by, missing fields count as null
+func (idx *index) keyValues(doc bson.D) bson.D {
+	values := make(bson.D, len(idx.key))
+	for i, elem := range idx.key {
+		v, _ := mongonet.BSONGetPath(doc, elem.Name)
+		values[i] = bson.DocElem{elem.Name, v}
+	}
+	return values
+}
+
+// collection documents are never changed in place, updates store new documents,
+// so what a cursor returns stays as it was when the query ran
+type collection struct {
+	ns      string
+	docs    []bson.D
+	indexes []*index
+}
+
+func newCollection(ns string) *collection {
+	return &collection{ns, nil, []*index{{"_id_", bson.D{{"_id", 1}}, true}}}
+}
+
+func (c *collection) findIndex(name string) int {
+	for i, idx := range c.indexes {
+		if idx.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkUnique looks for documents other than position skip which doc would collide with
+func (c *collection) checkUnique(doc bson.D, skip int) error {
+	for _, idx := range c.indexes {
+		if !idx.unique {
+			continue
+		}
+		values := idx.keyValues(doc)
+		for i, other := range c.docs {
+			if i != skip && mongonet.BSONCompare(values, idx.keyValues(other)) == 0 {
+				return dupKeyError(c.ns, idx, values)
+			}
+		}
+	}
+	return nil
+}
+
+func dupKeyError(ns string, idx *index, values bson.D) error {
+	pieces := make([]string, len(values))
+	for i, elem := range values {
+		pieces[i] = fmt.Sprintf("%s: %v", elem.Name, elem.Value)
+	}
+	return mongoError(11000, "DuplicateKey", "E11000 duplicate key error collection: %s index: %s dup key: { %s }",
+		ns, idx.name, strings.Join(pieces, ", "))
+}
+
+// insert adds an _id if the document has none
+func (c *collection) insert(doc bson.D) (bson.D, error) {
+	if mongonet.BSONIndexOf(doc, "_id") < 0 {
+		doc = append(bson.D{{"_id", bson.NewObjectId()}}, doc...)
+	}
+	if err := c.checkUnique(doc, -1); err != nil {
+		return nil, err
+	}
+	c.docs = append(c.docs, doc)
+	return doc, nil
+}
+
+func (c *collection) replace(pos int, doc bson.D) error {
+	if err := c.checkUnique(doc, pos); err != nil {
+		return err
+	}
+	c.docs[pos] = doc
+	return nil
+}
+
+func (c *collection) remove(pos int) {
+	c.docs = append(c.docs[:pos:pos], c.docs[pos+1:]...)
+}
+
+// ---
+
+type store struct {
+	lock sync.Mutex
+	dbs  map[string]map[string]*collection
+}
+
+func newStore() *store {
+	return &store{sync.Mutex{}, map[string]map[string]*collection{}}
+}
+
+// collection returns a collection, creating it if asked to. The caller holds the lock.
+func (st *store) collection(db, name string, create bool) *collection {
+	colls, ok := st.dbs[db]
+	if !ok {
+		if !create {
+			return nil
+		}
+		colls = map[string]*collection{}
+		st.dbs[db] = colls
+	}
+	c, ok := colls[name]
+	if !ok && create {
+		c = newCollection(db + "." + name)
+		colls[name] = c
+	}
+	return c
+}
+
+func (st *store) dropCollection(db, name string) *collection {
+	c := st.dbs[db][name]
+	if c == nil {
+		return nil
+	}
+	delete(st.dbs[db], name)
+	if len(st.dbs[db]) == 0 {
+		delete(st.dbs, db)
+	}
+	return c
+}
+
+func (st *store) databaseNames() []string {
+	names := make([]string, 0, len(st.dbs))
+	for name := range st.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (st *store) collectionNames(db string) []string {
+	names := make([]string, 0, len(st.dbs[db]))
+	for name := range st.dbs[db] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
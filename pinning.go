@@ -0,0 +1,282 @@
+package mongonet
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// requestInfo is what the proxy learned about a client request before forwarding it
+type requestInfo struct {
+	m         Message
+	db        string
+	cmd       bson.D // nil if not a command
+	cmdName   string
+	lsid      bson.D // nil if the command is not part of a logical session
+	txnNumber int64
+	cursorId  int64 // proxy cursor id of a getMore, or of an exhaust query once it opened one
+}
+
+func newRequestInfo(m Message) *requestInfo {
+	info := &requestInfo{m: m}
+
+	db, cmd, err := GetCommand(m)
+	if err != nil {
+		return info
+	}
+	info.db = db
+	info.cmd = cmd
+	info.cmdName = CommandName(cmd)
+
+	if idx := BSONIndexOf(cmd, "lsid"); idx >= 0 {
+		info.lsid, _, _ = GetAsBSON(cmd[idx])
+	}
+	if idx := BSONIndexOf(cmd, "txnNumber"); idx >= 0 {
+		if n, _, err := GetAsInt(cmd[idx]); err == nil {
+			info.txnNumber = int64(n)
+		}
+	}
+
+	return info
+}
+
+func (info *requestInfo) isCommand(names ...string) bool {
+	return info.cmd != nil && IsCommandNamed(info.cmd, names...)
+}
+
+// inTransaction reports if the command runs inside a multi-document transaction
+func (info *requestInfo) inTransaction() bool {
+	if info.lsid == nil || info.cmd == nil {
+		return false
+	}
+	idx := BSONIndexOf(info.cmd, "autocommit")
+	if idx < 0 {
+		return false
+	}
+	autocommit, _, err := GetAsBool(info.cmd[idx])
+	return err == nil && !autocommit
+}
+
+func (info *requestInfo) startsTransaction() bool {
+	if !info.inTransaction() {
+		return false
+	}
+	idx := BSONIndexOf(info.cmd, "startTransaction")
+	if idx < 0 {
+		return false
+	}
+	start, _, err := GetAsBool(info.cmd[idx])
+	return err == nil && start
+}
+
+// lsidKey turns a logical session id into a map key
+func lsidKey(lsid bson.D) string {
+	if idx := BSONIndexOf(lsid, "id"); idx >= 0 {
+		switch id := lsid[idx].Value.(type) {
+		case bson.Binary:
+			return fmt.Sprintf("%x", id.Data)
+		case []byte:
+			return fmt.Sprintf("%x", id)
+		}
+	}
+	return fmt.Sprintf("%v", lsid)
+}
+
+// ---
+
+type openTransaction struct {
+	lsid      bson.D
+	txnNumber int64
+}
+
+// upstreamState follows the transactions a client has open on its upstream connection.
+// While any of them is open the session keeps that connection.
+// Cursors are followed by the proxy's CursorRegistry.
+type upstreamState struct {
+	transactions map[string]*openTransaction
+	lsids        map[string]bson.D // every logical session the client used
+}
+
+func newUpstreamState() upstreamState {
+	return upstreamState{map[string]*openTransaction{}, map[string]bson.D{}}
+}
+
+func (us *upstreamState) observeRequest(info *requestInfo) {
+	if info.lsid != nil {
+		us.lsids[lsidKey(info.lsid)] = info.lsid
+	}
+
+	if info.isCommand("endSessions") {
+		if docs, _, err := GetAsBSONDocs(info.cmd[0]); err == nil {
+			for _, lsid := range docs {
+				delete(us.lsids, lsidKey(lsid))
+			}
+		}
+	}
+
+	if info.startsTransaction() {
+		us.transactions[lsidKey(info.lsid)] = &openTransaction{info.lsid, info.txnNumber}
+	}
+}
+
+func (us *upstreamState) observeResponse(info *requestInfo, resp Message) {
+	if info.lsid == nil {
+		return
+	}
+	key := lsidKey(info.lsid)
+	if txn := us.transactions[key]; txn == nil || txn.txnNumber != info.txnNumber {
+		return
+	}
+	doc, err := GetResponseDocument(resp)
+	if err != nil {
+		return
+	}
+	if transactionEnded(info, doc) {
+		delete(us.transactions, key)
+	}
+}
+
+// transactionEnded decides from a response if the server has no open transaction for the request's session anymore
+func transactionEnded(info *requestInfo, resp bson.D) bool {
+	err := ResponseToError(resp)
+	if err == nil {
+		return info.isCommand("commitTransaction", "abortTransaction")
+	}
+	if info.startsTransaction() {
+		// the first statement failed, so the transaction never started
+		return true
+	}
+	// the server aborted it, a commit with an unknown result can be retried and keeps it
+	me := err.(MongoError)
+	return me.Code() == 251 || me.HasErrorLabel(TransientTransactionErrorLabel)
+}
+
+func (us *upstreamState) pinned() bool {
+	return len(us.transactions) > 0
+}
+
+// ---
+
+// authPassthrough follows authentication conversations a client runs against mongod through the proxy.
+// Credentials live on the upstream connection, so once a client authenticated that connection
+// has to stay with the session and must never go back to the shared pool.
+type authPassthrough struct {
+	inConversation bool
+	authenticated  bool
+	loggedOut      bool
+}
+
+// isAuthCommand is true for commands which authenticate, drivers can start that in their
+// handshake with speculativeAuthenticate
+func isAuthCommand(cmd bson.D) bool {
+	switch strings.ToLower(CommandName(cmd)) {
+	case "saslstart", "saslcontinue", "authenticate", "logout":
+		return true
+	case "hello", "ismaster":
+		return BSONIndexOf(cmd, "speculativeAuthenticate") >= 0
+	}
+	return false
+}
+
+func (ap *authPassthrough) observeResponse(cmdName string, resp bson.D) {
+	ok := IsResponseOk(resp)
+
+	switch strings.ToLower(cmdName) {
+	case "hello", "ismaster":
+		// without speculativeAuthenticate in the reply it failed and the driver authenticates again
+		idx := BSONIndexOf(resp, "speculativeAuthenticate")
+		if !ok || idx < 0 {
+			return
+		}
+		spec, _, err := GetAsBSON(resp[idx])
+		if err != nil {
+			return
+		}
+		// SCRAM goes on with saslContinue, X.509 is done at once
+		done := true
+		if idx := BSONIndexOf(spec, "done"); idx >= 0 {
+			done, _, _ = GetAsBool(spec[idx])
+		}
+		ap.inConversation = !done
+		if done {
+			ap.authenticated = true
+		}
+	case "saslstart", "saslcontinue":
+		if !ok {
+			ap.inConversation = false
+			return
+		}
+		done := false
+		if idx := BSONIndexOf(resp, "done"); idx >= 0 {
+			done, _, _ = GetAsBool(resp[idx])
+		}
+		ap.inConversation = !done
+		if done {
+			ap.authenticated = true
+		}
+	case "authenticate":
+		ap.inConversation = false
+		if ok {
+			ap.authenticated = true
+		}
+	case "logout":
+		if ok && ap.authenticated {
+			ap.authenticated = false
+			ap.loggedOut = true
+		}
+	}
+}
+
+// pinned reports if the session has to keep its upstream connection for the next request
+func (ap *authPassthrough) pinned() bool {
+	return ap.inConversation || ap.authenticated
+}
+
+// ---
+
+// pinConnection is called after a request completed and decides if the session keeps its connection
+func (ps *ProxySession) pinConnection() bool {
+	if ps.proxy.config.PinAuthenticatedConnections && ps.authPassthrough.pinned() {
+		return true
+	}
+	return ps.upstreamState.pinned() || ps.proxy.cursors.hasOwnedBy(ps)
+}
+
+// acquireConnection returns a connection to the pool's backend for the next request.
+// The session's connection is used if it goes there, otherwise it is released unless it is pinned,
+// in which case a transient connection is returned that has to be given back after the request.
+func (ps *ProxySession) acquireConnection(pooledConn *PooledConnection, pool *ConnectionPool) (*PooledConnection, bool, error) {
+	if pooledConn != nil && pooledConn.pool == pool {
+		return pooledConn, false, nil
+	}
+	if pooledConn != nil && ps.proxy.config.PinAuthenticatedConnections && ps.authPassthrough.pinned() {
+		// the client's credentials only exist on this connection, another member wouldn't know it
+		return pooledConn, false, nil
+	}
+
+	transient := false
+	if pooledConn != nil {
+		if ps.pinConnection() {
+			transient = true
+		} else {
+			ps.releaseConnection(pooledConn)
+		}
+	}
+
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, transient, err
+	}
+	return conn, transient, nil
+}
+
+// releaseConnection gives a connection back to the pool.
+// Connections which carry a client's credentials are closed instead.
+func (ps *ProxySession) releaseConnection(pc *PooledConnection) {
+	if ps.authPassthrough.authenticated || ps.authPassthrough.inConversation || ps.authPassthrough.loggedOut {
+		pc.bad = true
+		ps.authPassthrough = authPassthrough{}
+	}
+	pc.Close()
+}
@@ -0,0 +1,144 @@
+package mongonet
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func testCommandMessage(cmd bson.D) Message {
+	return &MessageMessage{
+		MessageHeader{0, 1, 0, OP_MSG},
+		0,
+		[]MessageMessageSection{&BodySection{SimpleBSONConvertOrPanic(cmd)}},
+	}
+}
+
+func testReply(doc bson.D) Message {
+	return &MessageMessage{
+		MessageHeader{0, 2, 1, OP_MSG},
+		0,
+		[]MessageMessageSection{&BodySection{SimpleBSONConvertOrPanic(doc)}},
+	}
+}
+
+func TestUpstreamStateTransactions(test *testing.T) {
+	us := newUpstreamState()
+	lsid := bson.D{{"id", bson.Binary{4, []byte("0123456789abcdef")}}}
+
+	insert := newRequestInfo(testCommandMessage(bson.D{
+		{"insert", "bar"}, {"lsid", lsid}, {"txnNumber", int64(1)},
+		{"startTransaction", true}, {"autocommit", false}, {"$db", "foo"}}))
+	us.observeRequest(insert)
+	us.observeResponse(insert, testReply(bson.D{{"n", 1}, {"ok", 1}}))
+	if !us.pinned() {
+		test.Errorf("open transaction should pin")
+	}
+
+	commit := newRequestInfo(testCommandMessage(bson.D{
+		{"commitTransaction", 1}, {"lsid", lsid}, {"txnNumber", int64(1)},
+		{"autocommit", false}, {"$db", "admin"}}))
+	us.observeRequest(commit)
+	us.observeResponse(commit, testReply(bson.D{{"ok", 0}, {"code", 50}, {"codeName", "MaxTimeMSExpired"}, {"errorLabels", []interface{}{UnknownCommitResultLabel}}}))
+	if !us.pinned() {
+		test.Errorf("a commit with an unknown result can be retried and should still pin")
+	}
+	us.observeResponse(commit, testReply(bson.D{{"ok", 1}}))
+	if us.pinned() {
+		test.Errorf("committed transaction should not pin")
+	}
+
+	// the server aborting the transaction ends it too
+	for _, resp := range []bson.D{
+		{{"ok", 0}, {"code", 251}, {"codeName", "NoSuchTransaction"}},
+		{{"ok", 0}, {"code", 112}, {"codeName", "WriteConflict"}, {"errorLabels", []interface{}{TransientTransactionErrorLabel}}},
+	} {
+		start := newRequestInfo(testCommandMessage(bson.D{
+			{"insert", "bar"}, {"lsid", lsid}, {"txnNumber", int64(2)},
+			{"startTransaction", true}, {"autocommit", false}, {"$db", "foo"}}))
+		us.observeRequest(start)
+		us.observeResponse(start, testReply(bson.D{{"n", 1}, {"ok", 1}}))
+
+		update := newRequestInfo(testCommandMessage(bson.D{
+			{"update", "bar"}, {"lsid", lsid}, {"txnNumber", int64(2)},
+			{"autocommit", false}, {"$db", "foo"}}))
+		us.observeRequest(update)
+		us.observeResponse(update, testReply(resp))
+		if us.pinned() {
+			test.Errorf("a transaction the server aborted should not pin: %v", resp)
+		}
+	}
+
+	// as does a failed first statement
+	start := newRequestInfo(testCommandMessage(bson.D{
+		{"insert", "bar"}, {"lsid", lsid}, {"txnNumber", int64(3)},
+		{"startTransaction", true}, {"autocommit", false}, {"$db", "foo"}}))
+	us.observeRequest(start)
+	us.observeResponse(start, testReply(bson.D{{"ok", 0}, {"code", 13}, {"codeName", "Unauthorized"}}))
+	if us.pinned() {
+		test.Errorf("a transaction which never started should not pin")
+	}
+}
+
+func TestAuthenticatedSessionPinning(test *testing.T) {
+	hosts := []string{"127.0.0.1:9944", "127.0.0.1:9945"}
+	primary := startStandInMember(test, 9944, memberIsMaster("rs1", true, bson.ObjectIdHex("7fffffff0000000000000001"), hosts...))
+	secondary := startStandInMember(test, 9945, memberIsMaster("rs1", false, "", hosts...))
+	defer primary.server.Close()
+	defer secondary.server.Close()
+
+	pc := NewProxyConfig("127.0.0.1", 9946, "", 0)
+	if err := pc.SetMongoURI("mongodb://127.0.0.1:9944/?replicaSet=rs1&heartbeatFrequencyMS=50"); err != nil {
+		test.Fatal(err)
+	}
+	pc.PinAuthenticatedConnections = true
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+	waitFor(test, "discovery", func() bool { return len(proxy.Topology().Servers()) == 2 })
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", "127.0.0.1:9946")
+		if err != nil {
+			test.Fatalf("cannot dial proxy: %s", err)
+		}
+		return conn
+	}
+	client := dial()
+	defer client.Close()
+	other := dial()
+	defer other.Close()
+
+	// the handshake starts authentication, so its upstream connection can't go back to the pool
+	// where the other client would pick it up and keep it with a transaction
+	hello := bson.D{{"hello", 1}, {"speculativeAuthenticate", bson.D{{"saslStart", 1}, {"mechanism", "SCRAM-SHA-256"}, {"payload", []byte{}}, {"db", "admin"}}}}
+	res, err := RunCommand(client, "admin", hello)
+	if err != nil || BSONIndexOf(res, "speculativeAuthenticate") < 0 {
+		test.Fatalf("hello failed: %v %s", res, err)
+	}
+	lsid := bson.D{{"id", bson.Binary{4, []byte("0123456789abcdef")}}}
+	txn := bson.D{{"insert", "bar"}, {"documents", []bson.D{{{"x", 1}}}}, {"lsid", lsid}, {"txnNumber", int64(1)}, {"startTransaction", true}, {"autocommit", false}}
+	if _, err = RunCommand(other, "test", txn); err != nil {
+		test.Fatal(err)
+	}
+	if _, err = RunCommand(client, "admin", bson.D{{"saslContinue", 1}, {"conversationId", 1}, {"payload", []byte{}}}); err != nil {
+		test.Fatalf("saslContinue should run on the connection the handshake used: %s", err)
+	}
+
+	// reads which prefer the secondary stay on the authenticated connection
+	before := atomic.LoadInt32(&secondary.commands)
+	read := bson.D{{"find", "bar"}, {"$readPreference", bson.D{{"mode", "secondary"}}}}
+	if _, err = RunCommand(client, "test", read); err != nil {
+		test.Fatal(err)
+	}
+	if atomic.LoadInt32(&primary.authed) != 1 || atomic.LoadInt32(&secondary.commands) != before {
+		test.Errorf("the read should have run authenticated on the primary, primary %d secondary %d",
+			atomic.LoadInt32(&primary.authed), atomic.LoadInt32(&secondary.commands)-before)
+	}
+}
@@ -1,6 +1,7 @@
 package mongonet
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -12,8 +13,16 @@ import (
 
 type Proxy struct {
 	config   ProxyConfig
-	connPool *ConnectionPool
+	connPool *ConnectionPool // nil if the proxy follows a topology or splits clients between upstreams
+	topology *Topology
+	splitter *UpstreamSplitter
 	server   *Server
+	cursors  *CursorRegistry
+	mirror   *Mirror // nil unless ProxyConfig.MirrorHost is set
+
+	newPool func(address string) *ConnectionPool
+	cutover *cutoverGate
+	events  *EventBus
 
 	logger *slogger.Logger
 }
@@ -22,18 +31,61 @@ type ProxySession struct {
 	*Session
 
 	proxy       *Proxy
-	interceptor ProxyInterceptor
+	interceptor ProxyInterceptorV2
 	pooledConn  *PooledConnection
+
+	// client authentication state, see auth.go
+	authUser               string
+	authDB                 string
+	scram                  *scramServerConversation
+	scramSkipEmptyExchange bool
+
+	// authentication a client runs against mongod, see pinning.go
+	authPassthrough authPassthrough
+
+	// cursors and transactions open on pooledConn, see pinning.go
+	upstreamState upstreamState
+
+	// the backend a load balanced client sticks to, see loadbalancer.go
+	loadBalanced bool
+	lbPool       *ConnectionPool
+
+	// the upstream the session was assigned to, see splitter.go
+	upstream *splitUpstream
+
+	// ends with the session, see interceptorv2.go
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 type MongoError struct {
 	err      error
 	code     int
 	codeName string
+	labels   []string
 }
 
 func NewMongoError(err error, code int, codeName string) MongoError {
-	return MongoError{err, code, codeName}
+	return MongoError{err, code, codeName, nil}
+}
+
+// WithLabels returns a copy of the error with error labels added, like RetryableWriteError
+func (me MongoError) WithLabels(labels ...string) MongoError {
+	me.labels = append(append([]string{}, me.labels...), labels...)
+	return me
+}
+
+func (me MongoError) HasErrorLabel(label string) bool {
+	for _, l := range me.labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+func (me MongoError) Code() int {
+	return me.code
 }
 
 func (me MongoError) ToBSON() bson.D {
@@ -47,6 +99,10 @@ func (me MongoError) ToBSON() bson.D {
 		bson.DocElem{"code", me.code},
 		bson.DocElem{"codeName", me.codeName})
 
+	if len(me.labels) > 0 {
+		doc = append(doc, bson.DocElem{"errorLabels", me.labels})
+	}
+
 	return doc
 }
 
@@ -94,103 +150,66 @@ func (ps *ProxySession) ServerPort() int {
 }
 
 func (ps *ProxySession) Stats() bson.D {
-	return bson.D{
-		{"connectionPool", bson.D{
-			{"totalCreated", ps.proxy.connPool.totalCreated},
-		},
-		},
+	var stats bson.D
+	if ps.proxy.splitter != nil {
+		stats = bson.D{
+			{"upstreams", ps.proxy.splitter.Stats()},
+		}
+	} else if ps.proxy.topology != nil {
+		stats = bson.D{
+			{"topology", ps.proxy.topology.Stats()},
+		}
+	} else {
+		connPool := ps.proxy.pool()
+		pool := bson.D{
+			{"address", connPool.Address()},
+			{"totalCreated", connPool.LoadTotalCreated()},
+		}
+		if breaker := connPool.Breaker(); breaker != nil {
+			pool = append(pool, bson.DocElem{"breaker", breaker.State().String()})
+		}
+		stats = bson.D{
+			{"connectionPool", pool},
+			{"cutover", ps.proxy.cutover.stats()},
+		}
 	}
+	if ps.proxy.mirror != nil {
+		stats = append(stats, bson.DocElem{"mirror", ps.proxy.mirror.Stats()})
+	}
+	return stats
 }
 
 func (ps *ProxySession) DoLoopTemp() {
+	defer ps.cancel()
+	stopWatching := ps.closeOnShutdown()
+	defer stopWatching()
+
+	events := ps.proxy.events
+	opened := time.Now()
+	events.publish(Event{Kind: EventSessionOpened, Time: opened, RemoteAddr: ps.remoteAddr})
+	defer func() {
+		events.publish(Event{Kind: EventSessionClosed, RemoteAddr: ps.remoteAddr, Duration: time.Since(opened)})
+	}()
+
 	var err error
 	for {
 		ps.pooledConn, err = ps.doLoop(ps.pooledConn)
 		if err != nil {
+			ps.pooledConn = ps.cleanupUpstream(ps.pooledConn)
 			if ps.pooledConn != nil {
-				ps.pooledConn.Close()
+				ps.releaseConnection(ps.pooledConn)
 			}
-			if err != io.EOF {
+			if ps.upstream != nil {
+				ps.proxy.splitter.release(ps.upstream)
+			}
+			ps.proxy.cutover.sessionEnded(ps)
+			if err != io.EOF && ps.ctx.Err() == nil {
+				events.publish(Event{Kind: EventError, RemoteAddr: ps.remoteAddr, Err: err})
 				ps.logger.Logf(slogger.WARN, "error doing loop: %s", err)
 			}
 			return
 		}
 	}
-
-	if ps.pooledConn != nil {
-		ps.pooledConn.Close()
-	}
-}
-
-func (ps *ProxySession) respondWithError(clientMessage Message, err error) error {
-	ps.logger.Logf(slogger.INFO, "respondWithError %v", err)
-
-	var errBSON bson.D
-	if err == nil {
-		errBSON = bson.D{{"ok", 1}}
-	} else if mongoErr, ok := err.(MongoError); ok {
-		errBSON = mongoErr.ToBSON()
-	} else {
-		errBSON = bson.D{{"ok", 0}, {"errmsg", err.Error()}}
-	}
-
-	doc, myErr := SimpleBSONConvert(errBSON)
-	if myErr != nil {
-		return myErr
-	}
-
-	switch clientMessage.Header().OpCode {
-	case OP_QUERY, OP_GET_MORE:
-		rm := &ReplyMessage{
-			MessageHeader{
-				0,
-				17, // TODO
-				clientMessage.Header().RequestID,
-				OP_REPLY},
-
-			// We should not set the error bit because we are
-			// responding with errmsg instead of $err
-			0, // flags - error bit
-
-			0, // cursor id
-			0, // StartingFrom
-			1, // NumberReturned
-			[]SimpleBSON{doc},
-		}
-		return SendMessage(rm, ps.conn)
-
-	case OP_COMMAND:
-		rm := &CommandReplyMessage{
-			MessageHeader{
-				0,
-				17, // TODO
-				clientMessage.Header().RequestID,
-				OP_COMMAND_REPLY},
-			doc,
-			SimpleBSONEmpty(),
-			[]SimpleBSON{},
-		}
-		return SendMessage(rm, ps.conn)
-
-	case OP_MSG:
-		rm := &MessageMessage{
-			MessageHeader{
-				0,
-				17, // TODO
-				clientMessage.Header().RequestID,
-				OP_MSG},
-			0,
-			[]MessageMessageSection{
-				&BodySection{
-					doc,
-				},
-			},
-		}
-		return SendMessage(rm, ps.conn)
-
-	default:
-		panic("impossible")
-	}
 }
 
 func (ps *ProxySession) Close() {
@@ -202,6 +221,30 @@ func (ps *ProxySession) Close() {
 	}
 }
 
+// finishIntercepted handles a request an interceptor either answered itself or failed
+func (ps *ProxySession) finishIntercepted(pooledConn *PooledConnection, m Message, err error) (*PooledConnection, error) {
+	if err == nil {
+		// already responded
+		return pooledConn, nil
+	}
+	if m == nil {
+		if pooledConn != nil {
+			ps.releaseConnection(pooledConn)
+		}
+		return nil, err
+	}
+	if !m.HasResponse() {
+		// we can't respond, so we just fail
+		return pooledConn, err
+	}
+	ps.publishError(m, err)
+	err = ps.RespondWithError(m, err)
+	if err != nil {
+		return pooledConn, NewStackErrorf("couldn't send error response to client %s", err)
+	}
+	return pooledConn, nil
+}
+
 func (ps *ProxySession) doLoop(pooledConn *PooledConnection) (*PooledConnection, error) {
 	m, err := ReadMessage(ps.conn)
 	if err != nil {
@@ -211,80 +254,262 @@ func (ps *ProxySession) doLoop(pooledConn *PooledConnection) (*PooledConnection,
 		return pooledConn, NewStackErrorf("got error reading from client: %s", err)
 	}
 
-	var respInter ResponseInterceptor
+	received := time.Now()
+	cmdName := ""
+	if ps.proxy.events.active() {
+		if _, cmd, err := GetCommand(m); err == nil {
+			cmdName = CommandName(cmd)
+		}
+		e := ps.requestEvent(EventRequestReceived, m, cmdName)
+		e.Time = received
+		e.Bytes = int(m.Header().Size)
+		ps.proxy.events.publish(e)
+	}
+
 	if ps.interceptor != nil {
 		ps.interceptor.TrackRequest(m.Header())
 		ps.interceptor.TrackRequestMessage(m)
+	}
 
-		m, respInter, err = ps.interceptor.InterceptClientToMongo(m)
+	var authRespInter ResponseInterceptor
+	if ps.proxy.config.ClientCredentials != nil {
+		m, authRespInter, err = ps.interceptClientAuth(m)
+		if err != nil || m == nil {
+			return ps.finishIntercepted(pooledConn, m, err)
+		}
+	}
+
+	var respInter ResponseInterceptorV2
+	var ctx context.Context
+	if ps.interceptor != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = ps.requestContext(m)
+		defer cancel()
+		m, respInter, err = ps.interceptor.InterceptClientToMongo(ctx, m)
+		if err != nil || m == nil {
+			return ps.finishIntercepted(pooledConn, m, err)
+		}
+	}
+
+	info := newRequestInfo(m)
+	if info.isCommand(cutoverCommandName) {
+		// not held, it's what holds the other requests
+		return ps.finishIntercepted(pooledConn, m, ps.runCutoverCommand(info))
+	}
+
+	ps.proxy.cutover.enter(ps.drainsState(info))
+	defer func() {
+		ps.proxy.cutover.leave(ps, ps.upstreamState.pinned())
+	}()
+
+	if err = ps.assignUpstream(info); err != nil {
+		return ps.finishIntercepted(pooledConn, m, err)
+	}
+	trackAuth := ps.proxy.config.PinAuthenticatedConnections && info.cmd != nil && isAuthCommand(info.cmd)
+	helloRespInter := ps.newHelloRewriter(info)
+	lbRespInter, err := ps.interceptLoadBalancedHello(info)
+	if err != nil {
+		return ps.finishIntercepted(pooledConn, m, err)
+	}
+	ps.upstreamState.observeRequest(info)
+
+	if m.Header().OpCode == OP_KILL_CURSORS || info.isCommand("killCursors") {
+		err = ps.killCursors(info, pooledConn)
+		if err != nil && m.HasResponse() {
+			return ps.finishIntercepted(pooledConn, m, err)
+		}
+		return pooledConn, nil
+	}
+
+	pool, err := ps.translateCursorRequest(info)
+	if err != nil {
+		return ps.finishIntercepted(pooledConn, m, err)
+	}
+	if pool == nil {
+		pool, err = ps.selectPool(info)
 		if err != nil {
-			if m == nil {
-				if pooledConn != nil {
-					pooledConn.Close()
-				}
-				return nil, err
-			}
-			if !m.HasResponse() {
-				// we can't respond, so we just fail
-				return pooledConn, err
-			}
-			err = ps.RespondWithError(m, err)
-			if err != nil {
+			return ps.finishIntercepted(pooledConn, m, err)
+		}
+	}
+
+	checkoutStart := time.Now()
+	conn, transient, err := ps.acquireConnection(pooledConn, pool)
+	if err != nil {
+		if !transient {
+			// the session's connection was released
+			pooledConn = nil
+		}
+		if _, ok := err.(MongoError); ok && m.HasResponse() {
+			// mongo is unreachable, fail fast and keep the client
+			ps.publishError(m, err)
+			if err = ps.RespondWithError(m, err); err != nil {
 				return pooledConn, NewStackErrorf("couldn't send error response to client %s", err)
 			}
 			return pooledConn, nil
 		}
-		if m == nil {
-			// already responded
-			return pooledConn, nil
+		return pooledConn, NewStackErrorf("cannot get connection to mongo %s", err)
+	}
+	if !transient {
+		pooledConn = conn
+	}
+	if ps.proxy.events.active() {
+		e := ps.requestEvent(EventUpstreamCheckout, m, cmdName)
+		e.Upstream = conn.pool.Address()
+		e.Duration = time.Since(checkoutStart)
+		ps.proxy.events.publish(e)
+	}
+
+	if conn.closed {
+		panic("oh no!")
+	}
+
+	// what the session holds on to once this request is done
+	sessionConn := func() *PooledConnection {
+		if transient {
+			return pooledConn
 		}
+		return nil
 	}
 
-	if pooledConn == nil {
-		pooledConn, err = ps.proxy.connPool.Get()
-		if err != nil {
-			return nil, NewStackErrorf("cannot get connection to mongo %s", err)
+	// giveBack returns a connection the request is done with
+	giveBack := func(c *PooledConnection) {
+		if transient {
+			c.Close()
+		} else {
+			ps.releaseConnection(c)
+			pooledConn = nil
 		}
 	}
 
-	if pooledConn.closed {
-		panic("oh no!")
+	inExhaustMode :=
+		m.Header().OpCode == OP_QUERY &&
+			m.(*QueryMessage).Flags&(1<<6) != 0
+
+	retry := ps.retryability(info, inExhaustMode)
+
+	var mirrored []byte
+	if ps.proxy.mirror != nil && ps.proxy.mirror.sample(info) {
+		mirrored = m.Serialize()
+	}
+
+	resp, err := roundTrip(conn, m)
+	ps.checkLoadBalancedPool(resp, err)
+	if retry != retryNone && (err != nil || shouldRetry(retry, resp)) {
+		ps.logger.Logf(slogger.INFO, "retrying %s on a new connection, first attempt: %v", info.cmdName, err)
+		giveBack(conn)
+		conn = nil
+
+		pool, err = ps.retryPool(info, pool)
+		if err == nil {
+			conn, transient, err = ps.acquireConnection(pooledConn, pool)
+			if err == nil && !transient {
+				pooledConn = conn
+			}
+		}
+		if err != nil {
+			conn = nil
+			if !transient {
+				pooledConn = nil
+			}
+		} else {
+			resp, err = roundTrip(conn, m)
+			ps.checkLoadBalancedPool(resp, err)
+		}
 	}
-	mongoConn := pooledConn.conn
 
-	err = SendMessage(m, mongoConn)
 	if err != nil {
-		pooledConn.bad = true
-		return pooledConn, NewStackErrorf("error writing to mongo: %s", err)
+		if conn != nil {
+			giveBack(conn)
+		}
+		return ps.upstreamFailed(pooledConn, info, retry, err)
 	}
 
-	if !m.HasResponse() {
+	if mirrored != nil {
+		ps.proxy.mirror.submit(info, mirrored, resp)
+	}
+
+	if resp == nil {
+		// no response expected
+		if transient {
+			conn.Close()
+		}
 		return pooledConn, nil
 	}
 
-	defer pooledConn.Close()
+	if retry == retryWrite {
+		labelRetryableWriteError(resp)
+	}
 
-	inExhaustMode :=
-		m.Header().OpCode == OP_QUERY &&
-			m.(*QueryMessage).Flags&(1<<6) != 0
+	release := true
+	defer func() {
+		if !release {
+			return
+		}
+		if transient {
+			conn.Close()
+		} else {
+			ps.releaseConnection(conn)
+		}
+	}()
 
 	for {
-		resp, err := ReadMessage(mongoConn)
+		exhausted := true
+		if rm, ok := resp.(*ReplyMessage); ok && rm.CursorId != 0 {
+			exhausted = false
+		}
+
+		ps.upstreamState.observeResponse(info, resp)
+
+		if trackAuth {
+			if doc, err := GetResponseDocument(resp); err == nil {
+				ps.authPassthrough.observeResponse(info.cmdName, doc)
+			}
+		}
+
+		err = ps.rewriteCursorResponse(info, conn.pool, resp)
 		if err != nil {
-			pooledConn.bad = true
-			return nil, NewStackErrorf("got error reading response from mongo %s", err)
+			return sessionConn(), NewStackErrorf("error rewriting cursor in response %s", err)
+		}
+
+		if helloRespInter != nil {
+			resp, err = helloRespInter.InterceptMongoToClient(resp)
+			if err != nil {
+				return sessionConn(), NewStackErrorf("error rewriting hello response %s", err)
+			}
+		}
+
+		if lbRespInter != nil {
+			resp, err = lbRespInter.InterceptMongoToClient(resp)
+			if err != nil {
+				return sessionConn(), NewStackErrorf("error adding serviceId to hello response %s", err)
+			}
 		}
 
 		if respInter != nil {
-			resp, err = respInter.InterceptMongoToClient(resp)
+			resp, err = respInter.InterceptMongoToClient(ctx, resp)
+			if err != nil {
+				return sessionConn(), NewStackErrorf("error intercepting message %s", err)
+			}
+		}
+
+		if authRespInter != nil {
+			resp, err = authRespInter.InterceptMongoToClient(resp)
 			if err != nil {
-				return nil, NewStackErrorf("error intercepting message %s", err)
+				return sessionConn(), NewStackErrorf("error intercepting message %s", err)
 			}
 		}
 
-		err = SendMessage(resp, ps.conn)
+		raw := resp.Serialize()
+		err = sendBytes(ps.conn, raw)
 		if err != nil {
-			return nil, NewStackErrorf("got error sending response to client %s", err)
+			return sessionConn(), NewStackErrorf("got error sending response to client %s", err)
+		}
+		if ps.proxy.events.active() {
+			e := ps.requestEvent(EventResponseSent, m, cmdName)
+			e.Upstream = conn.pool.Address()
+			e.Bytes = len(raw)
+			e.Duration = time.Since(received)
+			ps.proxy.events.publish(e)
 		}
 
 		if ps.interceptor != nil {
@@ -292,35 +517,84 @@ func (ps *ProxySession) doLoop(pooledConn *PooledConnection) (*PooledConnection,
 			ps.interceptor.TrackResponseMessage(resp)
 		}
 
-		if !inExhaustMode {
-			return nil, nil
+		if !inExhaustMode || exhausted {
+			if !transient && ps.pinConnection() {
+				release = false
+				return conn, nil
+			}
+			return sessionConn(), nil
 		}
 
-		if resp.(*ReplyMessage).CursorId == 0 {
-			return nil, nil
+		resp, err = ReadMessage(conn.conn)
+		if err != nil {
+			conn.ioFailed(err)
+			return sessionConn(), NewStackErrorf("got error reading response from mongo %s", err)
 		}
 	}
 }
 
 func NewProxy(pc ProxyConfig) Proxy {
-	p := Proxy{pc, NewConnectionPool(pc.MongoAddress(), pc.MongoSSL, pc.MongoRootCAs, pc.MongoSSLSkipVerify, pc.ConnectionPoolHook), nil, nil}
+	hook := pc.ConnectionPoolHook
+	if pc.MongoUser != "" {
+		hook = upstreamAuthHook(pc, hook)
+	}
+
+	newPool := func(address string) *ConnectionPool {
+		pool := NewConnectionPool(address, pc.MongoSSL, pc.MongoRootCAs, pc.MongoSSLSkipVerify, hook)
+		pool.SetDialTimeout(pc.MongoDialTimeout)
+		if pc.CircuitBreakerThreshold > 0 {
+			pool.EnableCircuitBreaker(pc.CircuitBreakerThreshold, pc.CircuitBreakerProbeInterval)
+		}
+		return pool
+	}
+
+	p := Proxy{pc, nil, nil, nil, nil, NewCursorRegistry(), nil, newPool, newCutoverGate(), NewEventBus(), nil}
 
 	p.logger = p.NewLogger("proxy")
 
+	if len(pc.Upstreams) > 0 {
+		p.splitter = NewUpstreamSplitter(pc.Upstreams, pc.UpstreamAssignment, newPool)
+	} else if pc.UsesTopology() {
+		seeds := pc.MongoSeeds
+		if len(seeds) == 0 {
+			seeds = []string{pc.MongoAddress()}
+		}
+		p.topology = NewTopology(seeds, pc.ReplicaSetName, pc.heartbeatInterval(), newPool, p.NewLogger("topology"))
+	} else {
+		p.connPool = newPool(pc.MongoAddress())
+	}
+
+	if pc.MirrorHost != "" {
+		// no circuit breaker, failing mirror requests don't bother clients
+		pool := NewConnectionPool(pc.MirrorAddress(), pc.MirrorSSL, pc.MongoRootCAs, pc.MongoSSLSkipVerify, hook)
+		pool.SetDialTimeout(pc.MongoDialTimeout)
+		p.mirror = NewMirror(pool, pc.MirrorReadSampleRate, pc.MirrorWriteSampleRate, pc.MirrorCompare, pc.MirrorConnections, pc.MirrorQueueSize, p.NewLogger("mirror"))
+	}
+
 	return p
 }
 
-func (p *Proxy) InitializeServer() {
-	server := Server{
-		p.config.ServerConfig,
-		p.logger,
-		p,
-		make(chan struct{}),
-		make(chan error, 1),
-		make(chan struct{}),
-		nil,
-		nil,
+// Topology returns what the proxy knows about its replica set, nil if it uses a single server
+func (p *Proxy) Topology() *Topology {
+	return p.topology
+}
+
+// Splitter returns what splits clients between ProxyConfig.Upstreams, nil if there are none
+func (p *Proxy) Splitter() *UpstreamSplitter {
+	return p.splitter
+}
+
+// defaultPool returns the pool requests go to unless something else decided
+func (p *Proxy) defaultPool() (*ConnectionPool, error) {
+	if p.topology == nil {
+		return p.pool(), nil
 	}
+	return p.topology.SelectPrimary(p.config.serverSelectionTimeout())
+}
+
+func (p *Proxy) InitializeServer() {
+	server := NewServer(p.config.ServerConfig, p)
+	server.logger = p.logger
 	p.server = &server
 }
 
@@ -328,6 +602,23 @@ func (p *Proxy) Run() error {
 	return p.server.Run()
 }
 
+// InitChannel returns a channel that will send nil once the proxy has started
+// listening, or an error indicating why it failed to start
+func (p *Proxy) InitChannel() <-chan error {
+	return p.server.InitChannel()
+}
+
+// Close stops the proxy listening and monitoring its upstream servers
+func (p *Proxy) Close() {
+	p.server.Close()
+	if p.topology != nil {
+		p.topology.Close()
+	}
+	if p.mirror != nil {
+		p.mirror.Close()
+	}
+}
+
 // called by a syched method
 func (p *Proxy) OnSSLConfig(sslPairs []*SSLPair) {
 	p.server.OnSSLConfig(sslPairs)
@@ -345,15 +636,31 @@ func (p *Proxy) NewLogger(prefix string) *slogger.Logger {
 }
 
 func (p *Proxy) CreateWorker(session *Session) (ServerWorker, error) {
+	return p.createWorker(session, context.Background())
+}
+
+// CreateWorkerWithContext ties the sessions to the server, which ends their contexts when it shuts down
+func (p *Proxy) CreateWorkerWithContext(session *Session, ctx *context.Context) (ServerWorker, error) {
+	return p.createWorker(session, *ctx)
+}
+
+func (p *Proxy) createWorker(session *Session, ctx context.Context) (ServerWorker, error) {
 	var err error
 
-	ps := &ProxySession{session, p, nil, nil}
-	if p.config.InterceptorFactory != nil {
-		ps.interceptor, err = ps.proxy.config.InterceptorFactory.NewInterceptor(ps)
-		if err != nil {
-			return nil, err
-		}
+	ctx, cancel := context.WithCancel(ctx)
+	ps := &ProxySession{session, p, nil, nil, "", "", nil, false, authPassthrough{}, newUpstreamState(), false, nil, nil, ctx, cancel}
 
+	switch {
+	case p.config.InterceptorFactoryV2 != nil:
+		ps.interceptor, err = p.config.InterceptorFactoryV2.NewInterceptor(ps)
+	case p.config.InterceptorFactory != nil:
+		ps.interceptor, err = AdaptInterceptorFactory(p.config.InterceptorFactory).NewInterceptor(ps)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if ps.interceptor != nil {
 		session.conn = CheckedConn{session.conn.(net.Conn), ps.interceptor}
 	}
 
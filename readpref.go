@@ -0,0 +1,361 @@
+package mongonet
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type ReadPreferenceMode int
+
+const (
+	ReadPrimary ReadPreferenceMode = iota
+	ReadPrimaryPreferred
+	ReadSecondary
+	ReadSecondaryPreferred
+	ReadNearest
+)
+
+var readPreferenceModes = map[string]ReadPreferenceMode{
+	"primary":            ReadPrimary,
+	"primarypreferred":   ReadPrimaryPreferred,
+	"secondary":          ReadSecondary,
+	"secondarypreferred": ReadSecondaryPreferred,
+	"nearest":            ReadNearest,
+}
+
+// ReadPreference says which replica set members a client is willing to read from
+type ReadPreference struct {
+	Mode         ReadPreferenceMode
+	TagSets      []map[string]string // the first set matching any server is used, an empty set matches all
+	MaxStaleness time.Duration       // 0 means no limit
+}
+
+// the smallest maxStalenessSeconds servers accept
+const minMaxStaleness = 90 * time.Second
+
+// secondaryOk bit of OP_QUERY
+const queryFlagSecondaryOk = 1 << 2
+
+// window above the fastest server within which servers are picked at random
+const localThreshold = 15 * time.Millisecond
+
+func newBadValueError(format string, args ...interface{}) MongoError {
+	return NewMongoError(fmt.Errorf(format, args...), 2, "BadValue")
+}
+
+// ParseReadPreference parses a $readPreference document
+func ParseReadPreference(doc bson.D) (ReadPreference, error) {
+	rp := ReadPreference{}
+
+	idx := BSONIndexOf(doc, "mode")
+	if idx < 0 {
+		return rp, newBadValueError("read preference has no mode")
+	}
+	name, _, err := GetAsString(doc[idx])
+	if err != nil {
+		return rp, newBadValueError("read preference mode has to be a string")
+	}
+	mode, ok := readPreferenceModes[strings.ToLower(name)]
+	if !ok {
+		return rp, newBadValueError("unknown read preference mode %s", name)
+	}
+	rp.Mode = mode
+
+	if idx := BSONIndexOf(doc, "tags"); idx >= 0 {
+		sets, _, err := GetAsBSONDocs(doc[idx])
+		if err != nil {
+			return rp, newBadValueError("read preference tags have to be an array of documents")
+		}
+		for _, set := range sets {
+			tags := map[string]string{}
+			for _, tag := range set {
+				value, ok := tag.Value.(string)
+				if !ok {
+					return rp, newBadValueError("read preference tag %s has to be a string", tag.Name)
+				}
+				tags[tag.Name] = value
+			}
+			rp.TagSets = append(rp.TagSets, tags)
+		}
+	}
+
+	if idx := BSONIndexOf(doc, "maxStalenessSeconds"); idx >= 0 {
+		seconds, _, err := GetAsInt(doc[idx])
+		if err != nil {
+			return rp, newBadValueError("maxStalenessSeconds has to be a number")
+		}
+		if seconds > 0 {
+			rp.MaxStaleness = time.Duration(seconds) * time.Second
+			if rp.MaxStaleness < minMaxStaleness {
+				return rp, newBadValueError("maxStalenessSeconds must be at least %d", int(minMaxStaleness.Seconds()))
+			}
+		}
+	}
+
+	if rp.Mode == ReadPrimary && (len(rp.TagSets) > 0 || rp.MaxStaleness > 0) {
+		return rp, newBadValueError("primary read preference can't have tags or maxStalenessSeconds")
+	}
+
+	return rp, nil
+}
+
+// GetReadPreference returns the read preference of a request.
+// OP_MSG carries it in $readPreference, OP_QUERY in the $query wrapper or as the secondaryOk flag.
+// Requests without one read from the primary.
+func GetReadPreference(m Message) (ReadPreference, error) {
+	var doc bson.D
+	switch mm := m.(type) {
+	case *MessageMessage:
+		_, cmd, err := GetCommand(mm)
+		if err != nil {
+			return ReadPreference{}, err
+		}
+		doc = cmd
+	case *QueryMessage:
+		query, err := mm.Query.ToBSOND()
+		if err != nil {
+			return ReadPreference{}, err
+		}
+		doc = query
+		if BSONIndexOf(doc, "$readPreference") < 0 && mm.Flags&queryFlagSecondaryOk != 0 {
+			return ReadPreference{Mode: ReadSecondaryPreferred}, nil
+		}
+	default:
+		return ReadPreference{}, nil
+	}
+
+	idx := BSONIndexOf(doc, "$readPreference")
+	if idx < 0 {
+		return ReadPreference{}, nil
+	}
+	rpDoc, _, err := GetAsBSON(doc[idx])
+	if err != nil {
+		return ReadPreference{}, newBadValueError("$readPreference has to be a document")
+	}
+	return ParseReadPreference(rpDoc)
+}
+
+// ---
+
+// readCommands can be sent to secondaries
+var readCommands = map[string]bool{
+	"find":            true,
+	"aggregate":       true,
+	"count":           true,
+	"distinct":        true,
+	"geonear":         true,
+	"geosearch":       true,
+	"listcollections": true,
+	"listindexes":     true,
+	"collstats":       true,
+	"dbstats":         true,
+	"datasize":        true,
+	"explain":         true,
+	"ping":            true,
+	"buildinfo":       true,
+	"serverstatus":    true,
+}
+
+// isRead reports if the request may honor a read preference, everything else goes to the primary
+func (info *requestInfo) isRead() bool {
+	if info.cmd == nil {
+		qm, ok := info.m.(*QueryMessage)
+		return ok && !NamespaceIsCommand(qm.Namespace)
+	}
+	if !readCommands[strings.ToLower(info.cmdName)] {
+		return false
+	}
+	if info.isCommand("aggregate") {
+		// $out and $merge write
+		if idx := BSONIndexOf(info.cmd, "pipeline"); idx >= 0 {
+			stages, _, _ := GetAsBSONDocs(info.cmd[idx])
+			if len(stages) > 0 {
+				last := CommandName(stages[len(stages)-1])
+				if last == "$out" || last == "$merge" {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// ---
+
+// SelectForRead picks a server following a read preference
+func (t *Topology) SelectForRead(rp ReadPreference, timeout time.Duration) (ServerDescription, *ConnectionPool, error) {
+	return t.SelectServer(func(servers []ServerDescription) []ServerDescription {
+		return rp.suitable(servers, t.heartbeatInterval)
+	}, timeout)
+}
+
+// suitable returns the servers a read may go to
+func (rp ReadPreference) suitable(servers []ServerDescription, heartbeatInterval time.Duration) []ServerDescription {
+	var primary *ServerDescription
+	secondaries := []ServerDescription{}
+	routers := []ServerDescription{}
+	for i, s := range servers {
+		switch s.Kind {
+		case ServerStandalone, ServerMongos:
+			routers = append(routers, s)
+		case ServerRSPrimary:
+			primary = &servers[i]
+		case ServerRSSecondary:
+			secondaries = append(secondaries, s)
+		}
+	}
+
+	if len(routers) > 0 {
+		// not a replica set, the servers deal with the read preference
+		return routers
+	}
+
+	eligible := func(candidates []ServerDescription) []ServerDescription {
+		return rp.matchTags(rp.filterStale(candidates, primary, secondaries, heartbeatInterval))
+	}
+
+	switch rp.Mode {
+	case ReadPrimary:
+		if primary != nil {
+			return []ServerDescription{*primary}
+		}
+	case ReadPrimaryPreferred:
+		if primary != nil {
+			return []ServerDescription{*primary}
+		}
+		return eligible(secondaries)
+	case ReadSecondary:
+		return eligible(secondaries)
+	case ReadSecondaryPreferred:
+		if res := eligible(secondaries); len(res) > 0 {
+			return res
+		}
+		if primary != nil {
+			return []ServerDescription{*primary}
+		}
+	case ReadNearest:
+		candidates := secondaries
+		if primary != nil {
+			candidates = append(candidates, *primary)
+		}
+		return eligible(candidates)
+	}
+	return nil
+}
+
+// filterStale drops secondaries which are further behind than MaxStaleness, estimated like drivers do
+func (rp ReadPreference) filterStale(candidates []ServerDescription, primary *ServerDescription, secondaries []ServerDescription, heartbeatInterval time.Duration) []ServerDescription {
+	if rp.MaxStaleness == 0 {
+		return candidates
+	}
+
+	var newestWrite time.Time
+	for _, s := range secondaries {
+		if s.LastWriteDate.After(newestWrite) {
+			newestWrite = s.LastWriteDate
+		}
+	}
+
+	res := []ServerDescription{}
+	for _, s := range candidates {
+		var staleness time.Duration
+		switch {
+		case s.Kind == ServerRSPrimary:
+		case primary != nil:
+			staleness = s.LastUpdate.Sub(s.LastWriteDate) - primary.LastUpdate.Sub(primary.LastWriteDate) + heartbeatInterval
+		default:
+			staleness = newestWrite.Sub(s.LastWriteDate) + heartbeatInterval
+		}
+		if staleness <= rp.MaxStaleness {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// matchTags returns the servers matching the first tag set any server matches
+func (rp ReadPreference) matchTags(candidates []ServerDescription) []ServerDescription {
+	if len(rp.TagSets) == 0 {
+		return candidates
+	}
+	for _, set := range rp.TagSets {
+		res := []ServerDescription{}
+		for _, s := range candidates {
+			if hasTags(s, set) {
+				res = append(res, s)
+			}
+		}
+		if len(res) > 0 {
+			return res
+		}
+	}
+	return nil
+}
+
+func hasTags(s ServerDescription, tags map[string]string) bool {
+	for name, value := range tags {
+		if s.Tags[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// pickNearest picks a random server among those within localThreshold of the fastest one
+func pickNearest(servers []ServerDescription) ServerDescription {
+	fastest := servers[0].RTT
+	for _, s := range servers {
+		if s.RTT < fastest {
+			fastest = s.RTT
+		}
+	}
+	near := []ServerDescription{}
+	for _, s := range servers {
+		if s.RTT <= fastest+localThreshold {
+			near = append(near, s)
+		}
+	}
+	return near[rand.Intn(len(near))]
+}
+
+// ---
+
+// selectPool picks the pool of the server a request goes to when nothing else decided
+func (ps *ProxySession) selectPool(info *requestInfo) (*ConnectionPool, error) {
+	if ps.loadBalanced {
+		return ps.loadBalancedPool()
+	}
+	if ps.proxy.splitter != nil {
+		return ps.defaultPool()
+	}
+
+	topology := ps.proxy.topology
+	if topology == nil {
+		return ps.proxy.pool(), nil
+	}
+
+	timeout := ps.proxy.config.serverSelectionTimeout()
+	if !info.isRead() || info.inTransaction() {
+		return topology.SelectPrimary(timeout)
+	}
+
+	rp, err := GetReadPreference(info.m)
+	if err != nil {
+		return nil, err
+	}
+
+	server, pool, err := topology.SelectForRead(rp, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if qm, ok := info.m.(*QueryMessage); ok && server.Kind == ServerRSSecondary {
+		// secondaries refuse legacy queries without it
+		qm.Flags |= queryFlagSecondaryOk
+	}
+	return pool, nil
+}
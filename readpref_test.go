@@ -0,0 +1,151 @@
+package mongonet
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestGetReadPreference(test *testing.T) {
+	rp, err := GetReadPreference(testCommandMessage(bson.D{
+		{"find", "bar"},
+		{"$db", "foo"},
+		{"$readPreference", bson.D{
+			{"mode", "secondaryPreferred"},
+			{"tags", []bson.D{{{"dc", "east"}}, {}}},
+			{"maxStalenessSeconds", 120},
+		}},
+	}))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if rp.Mode != ReadSecondaryPreferred || len(rp.TagSets) != 2 || rp.TagSets[0]["dc"] != "east" || rp.MaxStaleness != 120*time.Second {
+		test.Errorf("bad read preference %#v", rp)
+	}
+
+	wrapped := NewQueryMessage("foo.$cmd", 0, 0, -1, SimpleBSONConvertOrPanic(bson.D{
+		{"$query", bson.D{{"count", "bar"}}},
+		{"$readPreference", bson.D{{"mode", "nearest"}}},
+	}), SimpleBSONEmpty())
+	if rp, err = GetReadPreference(wrapped); err != nil || rp.Mode != ReadNearest {
+		test.Errorf("bad wrapped read preference %#v %s", rp, err)
+	}
+
+	flagged := NewQueryMessage("foo.bar", queryFlagSecondaryOk, 0, 0, SimpleBSONConvertOrPanic(bson.D{}), SimpleBSONEmpty())
+	if rp, err = GetReadPreference(flagged); err != nil || rp.Mode != ReadSecondaryPreferred {
+		test.Errorf("secondaryOk should mean secondaryPreferred %#v %s", rp, err)
+	}
+
+	for _, bad := range []bson.D{
+		{{"mode", "sometimes"}},
+		{{"mode", "secondary"}, {"maxStalenessSeconds", 10}},
+		{{"mode", "primary"}, {"tags", []bson.D{{{"dc", "east"}}}}},
+	} {
+		if _, err := ParseReadPreference(bad); err == nil {
+			test.Errorf("%v should not parse", bad)
+		}
+	}
+}
+
+func TestReadPreferenceSuitable(test *testing.T) {
+	now := time.Now()
+	primary := ServerDescription{Address: "p", Kind: ServerRSPrimary, LastUpdate: now, LastWriteDate: now}
+	east := ServerDescription{Address: "east", Kind: ServerRSSecondary, LastUpdate: now, LastWriteDate: now.Add(-time.Second), Tags: map[string]string{"dc": "east"}}
+	stale := ServerDescription{Address: "stale", Kind: ServerRSSecondary, LastUpdate: now, LastWriteDate: now.Add(-time.Hour), Tags: map[string]string{"dc": "west"}}
+	servers := []ServerDescription{primary, east, stale}
+
+	addresses := func(rp ReadPreference, servers []ServerDescription) string {
+		res := ""
+		for _, s := range rp.suitable(servers, 10*time.Second) {
+			res += s.Address + " "
+		}
+		return res
+	}
+
+	for _, c := range []struct {
+		rp       ReadPreference
+		servers  []ServerDescription
+		expected string
+	}{
+		{ReadPreference{Mode: ReadPrimary}, servers, "p "},
+		{ReadPreference{Mode: ReadPrimary}, servers[1:], ""},
+		{ReadPreference{Mode: ReadPrimaryPreferred}, servers[1:], "east stale "},
+		{ReadPreference{Mode: ReadSecondary}, servers, "east stale "},
+		{ReadPreference{Mode: ReadSecondary, TagSets: []map[string]string{{"dc": "west"}}}, servers, "stale "},
+		{ReadPreference{Mode: ReadSecondary, TagSets: []map[string]string{{"dc": "north"}, {}}}, servers, "east stale "},
+		{ReadPreference{Mode: ReadSecondary, TagSets: []map[string]string{{"dc": "north"}}}, servers, ""},
+		{ReadPreference{Mode: ReadSecondary, MaxStaleness: 90 * time.Second}, servers, "east "},
+		{ReadPreference{Mode: ReadSecondaryPreferred, TagSets: []map[string]string{{"dc": "north"}}}, servers, "p "},
+		{ReadPreference{Mode: ReadNearest, MaxStaleness: 90 * time.Second}, servers, "east p "},
+	} {
+		if got := addresses(c.rp, c.servers); got != c.expected {
+			test.Errorf("%#v: expected %q got %q", c.rp, c.expected, got)
+		}
+	}
+}
+
+func TestRequestIsRead(test *testing.T) {
+	for _, c := range []struct {
+		cmd  bson.D
+		read bool
+	}{
+		{bson.D{{"find", "bar"}}, true},
+		{bson.D{{"insert", "bar"}}, false},
+		{bson.D{{"aggregate", "bar"}, {"pipeline", []bson.D{{{"$match", bson.D{}}}}}}, true},
+		{bson.D{{"aggregate", "bar"}, {"pipeline", []bson.D{{{"$out", "baz"}}}}}, false},
+		{bson.D{{"someNewCommand", 1}}, false},
+	} {
+		cmd := append(c.cmd, bson.DocElem{"$db", "foo"})
+		if newRequestInfo(testCommandMessage(cmd)).isRead() != c.read {
+			test.Errorf("%v should be read: %v", c.cmd, c.read)
+		}
+	}
+}
+
+func TestReadPreferenceRouting(test *testing.T) {
+	hosts := []string{"127.0.0.1:9941", "127.0.0.1:9942"}
+	primary := startStandInMember(test, 9941, memberIsMaster("rs1", true, bson.ObjectIdHex("7fffffff0000000000000001"), hosts...))
+	secondary := startStandInMember(test, 9942, memberIsMaster("rs1", false, "", hosts...))
+	defer primary.server.Close()
+	defer secondary.server.Close()
+
+	pc := NewProxyConfig("127.0.0.1", 9943, "", 0)
+	if err := pc.SetMongoURI("mongodb://127.0.0.1:9941/?replicaSet=rs1&heartbeatFrequencyMS=50"); err != nil {
+		test.Fatal(err)
+	}
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+	waitFor(test, "discovery", func() bool { return len(proxy.Topology().Servers()) == 2 })
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9943")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+
+	secondaryRead := bson.DocElem{"$readPreference", bson.D{{"mode", "secondary"}}}
+	for _, c := range []struct {
+		cmd    bson.D
+		member *standInMember
+	}{
+		{bson.D{{"find", "bar"}, secondaryRead}, secondary},
+		{bson.D{{"insert", "bar"}, {"documents", []bson.D{{{"x", 1}}}}, secondaryRead}, primary},
+		{bson.D{{"find", "bar"}}, primary},
+	} {
+		before := atomic.LoadInt32(&c.member.commands)
+		if _, err := RunCommand(conn, "test", c.cmd); err != nil {
+			test.Fatalf("%v failed: %s", c.cmd, err)
+		}
+		if atomic.LoadInt32(&c.member.commands) != before+1 {
+			test.Errorf("%v went to the wrong member", c.cmd)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package mongonet
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type retryKind int
+
+const (
+	retryNone retryKind = iota
+	retryRead
+	retryWrite
+)
+
+const (
+	RetryableWriteErrorLabel       = "RetryableWriteError"
+	TransientTransactionErrorLabel = "TransientTransactionError"
+	UnknownCommitResultLabel       = "UnknownTransactionCommitResult"
+)
+
+// error codes which mean the command may succeed somewhere else, from the drivers' retryable writes spec
+var retryableWriteCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	262:   true, // ExceededTimeLimit
+	9001:  true, // SocketException
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+func isRetryableCode(retry retryKind, code int) bool {
+	if retry == retryRead && code == 134 { // ReadConcernMajorityNotAvailableYet
+		return true
+	}
+	return retryableWriteCodes[code]
+}
+
+// retryability decides if a request may be sent a second time
+func (ps *ProxySession) retryability(info *requestInfo, exhaust bool) retryKind {
+	if exhaust || info.cursorId != 0 || !info.m.HasResponse() {
+		return retryNone
+	}
+	if ps.authPassthrough.authenticated || ps.authPassthrough.inConversation {
+		// the client's credentials only exist on the connection that failed
+		return retryNone
+	}
+	if ps.proxy.config.RetryWrites && info.isRetryableWrite() {
+		return retryWrite
+	}
+	if ps.proxy.config.RetryReads && info.isRead() && !info.inTransaction() {
+		return retryRead
+	}
+	return retryNone
+}
+
+// isRetryableWrite reports if the client made a write retryable.
+// Drivers only send a txnNumber outside of transactions with writes mongod can retry.
+func (info *requestInfo) isRetryableWrite() bool {
+	if info.lsid == nil || BSONIndexOf(info.cmd, "txnNumber") < 0 {
+		return false
+	}
+	if info.isCommand("commitTransaction", "abortTransaction") {
+		return true
+	}
+	return !info.inTransaction() && !info.isRead()
+}
+
+// roundTrip sends a request upstream and reads its first response, nil if the request has none
+func roundTrip(conn *PooledConnection, m Message) (Message, error) {
+	err := SendMessage(m, conn.conn)
+	if err != nil {
+		conn.ioFailed(err)
+		return nil, err
+	}
+	if !m.HasResponse() {
+		return nil, nil
+	}
+	resp, err := ReadMessage(conn.conn)
+	if err != nil {
+		conn.ioFailed(err)
+		return nil, err
+	}
+	conn.ioSucceeded()
+	return resp, nil
+}
+
+// shouldRetry reports if a response is an error another attempt may not run into
+func shouldRetry(retry retryKind, resp Message) bool {
+	doc, err := GetResponseDocument(resp)
+	if err != nil {
+		return false
+	}
+
+	if me, ok := ResponseToError(doc).(MongoError); ok {
+		if isRetryableCode(retry, me.code) {
+			return true
+		}
+		return retry == retryWrite && me.HasErrorLabel(RetryableWriteErrorLabel)
+	}
+
+	if retry == retryWrite {
+		if idx := BSONIndexOf(doc, "writeConcernError"); idx >= 0 {
+			wce, _, _ := GetAsBSON(doc[idx])
+			if codeIdx := BSONIndexOf(wce, "code"); codeIdx >= 0 {
+				code, _, _ := GetAsInt(wce[codeIdx])
+				return isRetryableCode(retry, code)
+			}
+		}
+	}
+	return false
+}
+
+// labelRetryableWriteError adds the RetryableWriteError label servers before 4.4 don't add themselves
+func labelRetryableWriteError(resp Message) {
+	doc, err := GetResponseDocument(resp)
+	if err != nil || IsResponseOk(doc) || BSONIndexOf(doc, "errorLabels") >= 0 {
+		return
+	}
+	if me, ok := ResponseToError(doc).(MongoError); ok && retryableWriteCodes[me.code] {
+		doc = append(doc, bson.DocElem{"errorLabels", []string{RetryableWriteErrorLabel}})
+		SetResponseDocument(resp, doc)
+	}
+}
+
+// retryPool picks the server for the second attempt, after a failover that is the new primary
+func (ps *ProxySession) retryPool(info *requestInfo, pool *ConnectionPool) (*ConnectionPool, error) {
+	if ps.proxy.topology == nil {
+		return pool, nil
+	}
+	ps.proxy.topology.RequestCheck()
+	return ps.selectPool(info)
+}
+
+// upstreamFailed answers a request whose upstream connection broke, so the client can carry on
+func (ps *ProxySession) upstreamFailed(pooledConn *PooledConnection, info *requestInfo, retry retryKind, err error) (*PooledConnection, error) {
+	if !info.m.HasResponse() {
+		return pooledConn, NewStackErrorf("error talking to mongo: %s", err)
+	}
+
+	if ps.proxy.topology != nil {
+		ps.proxy.topology.RequestCheck()
+	}
+
+	me, ok := err.(MongoError)
+	if !ok {
+		me = NewMongoError(fmt.Errorf("error talking to mongo: %s", err), 6, "HostUnreachable")
+	}
+	if retry == retryWrite && isRetryableCode(retry, me.code) {
+		me = me.WithLabels(RetryableWriteErrorLabel)
+	}
+	if info.isCommand("commitTransaction") {
+		me = me.WithLabels(UnknownCommitResultLabel)
+	} else if info.inTransaction() {
+		me = me.WithLabels(TransientTransactionErrorLabel)
+	}
+
+	return ps.finishIntercepted(pooledConn, info.m, me)
+}
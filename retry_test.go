@@ -0,0 +1,113 @@
+package mongonet
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRetries(test *testing.T) {
+	member := startStandInMember(test, 9951, bson.D{{"ismaster", true}, {"maxWireVersion", 8}})
+	defer member.server.Close()
+
+	pc := NewProxyConfig("127.0.0.1", 9952, "127.0.0.1", 9951)
+	pc.RetryReads = true
+	pc.RetryWrites = true
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9952")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+
+	lsid := bson.D{{"id", bson.Binary{4, []byte("0123456789abcdef")}}}
+	retryableInsert := bson.D{{"insert", "bar"}, {"documents", []bson.D{{{"x", 1}}}}, {"lsid", lsid}, {"txnNumber", int64(1)}}
+	plainInsert := bson.D{{"insert", "bar"}, {"documents", []bson.D{{{"x", 1}}}}}
+
+	for _, c := range []struct {
+		cmd        bson.D
+		drop       int32
+		notPrimary int32
+		label      string // empty if the command should succeed
+	}{
+		{bson.D{{"find", "bar"}}, 1, 0, ""},
+		{retryableInsert, 1, 0, ""},
+		{retryableInsert, 0, 1, ""},
+		{retryableInsert, 2, 0, RetryableWriteErrorLabel},
+		{retryableInsert, 0, 2, RetryableWriteErrorLabel},
+		{plainInsert, 1, 0, "none"},
+	} {
+		atomic.StoreInt32(&member.dropNext, c.drop)
+		atomic.StoreInt32(&member.notPrimaryNext, c.notPrimary)
+
+		_, err := RunCommand(conn, "test", c.cmd)
+		if c.label == "" {
+			if err != nil {
+				test.Errorf("%v should have been retried: %s", c.cmd, err)
+			}
+			continue
+		}
+
+		me, ok := err.(MongoError)
+		if !ok {
+			test.Errorf("%v should have failed with a mongo error, got %v", c.cmd, err)
+			continue
+		}
+		if me.HasErrorLabel(RetryableWriteErrorLabel) != (c.label == RetryableWriteErrorLabel) {
+			test.Errorf("%v has the wrong labels: %s", c.cmd, me.ToBSON())
+		}
+	}
+
+	// the client connection survived all of that
+	if _, err = RunCommand(conn, "admin", bson.D{{"ping", 1}}); err != nil {
+		test.Errorf("ping failed: %s", err)
+	}
+}
+
+func TestNoRetryAfterAuthentication(test *testing.T) {
+	member := startStandInMember(test, 9953, bson.D{{"ismaster", true}, {"maxWireVersion", 8}})
+	defer member.server.Close()
+
+	pc := NewProxyConfig("127.0.0.1", 9954, "127.0.0.1", 9953)
+	pc.RetryReads = true
+	pc.PinAuthenticatedConnections = true
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9954")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err = RunCommand(conn, "admin", bson.D{{"saslStart", 1}, {"mechanism", "SCRAM-SHA-256"}, {"payload", []byte{}}}); err != nil {
+		test.Fatal(err)
+	}
+	if _, err = RunCommand(conn, "admin", bson.D{{"saslContinue", 1}, {"conversationId", 1}, {"payload", []byte{}}}); err != nil {
+		test.Fatal(err)
+	}
+
+	// another connection would run the read without the client's credentials
+	atomic.StoreInt32(&member.dropNext, 1)
+	_, err = RunCommand(conn, "test", bson.D{{"find", "bar"}})
+	if me, ok := err.(MongoError); !ok || me.code != 6 {
+		test.Errorf("the read should have failed with HostUnreachable, got %v", err)
+	}
+	if n := atomic.LoadInt32(&member.commands); n != 0 {
+		test.Errorf("the read should not have been retried, ran %d times", n)
+	}
+}
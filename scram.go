@@ -0,0 +1,432 @@
+package mongonet
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const ScramSHA256 = "SCRAM-SHA-256"
+
+const defaultScramIterations = 15000
+
+// ScramCredential is what a server stores for a SCRAM-SHA-256 user, the password itself is not kept
+type ScramCredential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramSHA256Credential derives a credential from a password with a random salt.
+// Passwords are used as is, no SASLprep normalization is done.
+func NewScramSHA256Credential(password string, iterations int) (*ScramCredential, error) {
+	if iterations <= 0 {
+		iterations = defaultScramIterations
+	}
+	salt := make([]byte, 28)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return newScramCredential(password, salt, iterations), nil
+}
+
+func newScramCredential(password string, salt []byte, iterations int) *ScramCredential {
+	salted := pbkdf2SHA256([]byte(password), salt, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSHA256(salted, []byte("Server Key"))
+	return &ScramCredential{salt, iterations, storedKey[:], serverKey}
+}
+
+// CredentialStore is consulted by the proxy to authenticate clients
+type CredentialStore interface {
+	// GetCredential returns nil with no error for unknown users.
+	// This has to be thread safe, will be called from many clients
+	GetCredential(db, username string) (*ScramCredential, error)
+}
+
+// MapCredentialStore is a CredentialStore held in memory
+type MapCredentialStore struct {
+	lock  sync.RWMutex
+	creds map[string]*ScramCredential
+}
+
+func NewMapCredentialStore() *MapCredentialStore {
+	return &MapCredentialStore{sync.RWMutex{}, map[string]*ScramCredential{}}
+}
+
+func (s *MapCredentialStore) AddUser(db, username, password string) error {
+	cred, err := NewScramSHA256Credential(password, 0)
+	if err != nil {
+		return err
+	}
+	s.SetCredential(db, username, cred)
+	return nil
+}
+
+func (s *MapCredentialStore) SetCredential(db, username string, cred *ScramCredential) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.creds[db+"."+username] = cred
+}
+
+func (s *MapCredentialStore) RemoveUser(db, username string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.creds, db+"."+username)
+}
+
+func (s *MapCredentialStore) GetCredential(db, username string) (*ScramCredential, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.creds[db+"."+username], nil
+}
+
+// ---
+
+// scramServerConversation is the server side of a SCRAM-SHA-256 exchange (RFC 5802, RFC 7677)
+type scramServerConversation struct {
+	store CredentialStore
+	db    string
+
+	username        string
+	cred            *ScramCredential
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+
+	step          int
+	authenticated bool
+
+	// for tests
+	serverNonce string
+}
+
+func newScramServerConversation(store CredentialStore, db string) *scramServerConversation {
+	return &scramServerConversation{store: store, db: db}
+}
+
+var errScramAuthFailed = NewMongoError(fmt.Errorf("Authentication failed."), 18, "AuthenticationFailed")
+
+// scramFakeSaltKey keys the salts made up for unknown users, so they stay the same between attempts
+// but can't be told apart from real ones
+var scramFakeSaltKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// scramFakeCredential stands in for an unknown user, like mongod the exchange goes on and fails at the proof
+func scramFakeCredential(db, username string) *ScramCredential {
+	salt := hmacSHA256(scramFakeSaltKey, []byte(db+"."+username))[:28]
+	return &ScramCredential{salt, defaultScramIterations, nil, nil}
+}
+
+// Step consumes a client payload and returns the server payload and whether the conversation is done
+func (c *scramServerConversation) Step(payload []byte) ([]byte, bool, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		return c.firstStep(string(payload))
+	case 2:
+		return c.finalStep(string(payload))
+	case 3:
+		if !c.authenticated || len(payload) != 0 {
+			return nil, false, errScramAuthFailed
+		}
+		return []byte{}, true, nil
+	}
+	return nil, false, errScramAuthFailed
+}
+
+func (c *scramServerConversation) firstStep(clientFirst string) ([]byte, bool, error) {
+	if !strings.HasPrefix(clientFirst, "n,") {
+		return nil, false, NewMongoError(fmt.Errorf("channel binding is not supported"), 2, "BadValue")
+	}
+	// skip the gs2 header, the authzid is ignored
+	parts := strings.SplitN(clientFirst, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, NewMongoError(fmt.Errorf("invalid SCRAM client first message"), 17, "ProtocolError")
+	}
+	c.clientFirstBare = parts[2]
+
+	attrs := scramAttributes(c.clientFirstBare)
+	user, nonce := attrs["n"], attrs["r"]
+	if user == "" || nonce == "" {
+		return nil, false, NewMongoError(fmt.Errorf("invalid SCRAM client first message"), 17, "ProtocolError")
+	}
+	c.username = strings.Replace(strings.Replace(user, "=2C", ",", -1), "=3D", "=", -1)
+
+	cred, err := c.store.GetCredential(c.db, c.username)
+	if err != nil {
+		return nil, false, err
+	}
+	if cred == nil {
+		cred = scramFakeCredential(c.db, c.username)
+	}
+	c.cred = cred
+
+	serverNonce := c.serverNonce
+	if serverNonce == "" {
+		serverNonce, err = scramNonce()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	c.nonce = nonce + serverNonce
+	c.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", c.nonce, base64.StdEncoding.EncodeToString(cred.Salt), cred.Iterations)
+	return []byte(c.serverFirst), false, nil
+}
+
+func (c *scramServerConversation) finalStep(clientFinal string) ([]byte, bool, error) {
+	idx := strings.LastIndex(clientFinal, ",p=")
+	if idx < 0 {
+		return nil, false, NewMongoError(fmt.Errorf("invalid SCRAM client final message"), 17, "ProtocolError")
+	}
+	withoutProof := clientFinal[:idx]
+	attrs := scramAttributes(clientFinal)
+
+	if attrs["r"] != c.nonce {
+		return nil, false, errScramAuthFailed
+	}
+	if attrs["c"] != "biws" { // base64 of "n,,"
+		return nil, false, errScramAuthFailed
+	}
+	proof, err := base64.StdEncoding.DecodeString(attrs["p"])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, false, errScramAuthFailed
+	}
+
+	if c.cred.StoredKey == nil {
+		return nil, false, errScramAuthFailed
+	}
+
+	authMessage := []byte(c.clientFirstBare + "," + c.serverFirst + "," + withoutProof)
+	clientSignature := hmacSHA256(c.cred.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], c.cred.StoredKey) {
+		return nil, false, errScramAuthFailed
+	}
+
+	c.authenticated = true
+	serverSignature := hmacSHA256(c.cred.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), false, nil
+}
+
+// ---
+
+// ScramSHA256Authenticate authenticates a raw connection to a mongod as the given user
+func ScramSHA256Authenticate(conn io.ReadWriter, db, username, password string) error {
+	client := &scramClientConversation{username: username, password: password}
+
+	payload, err := client.Step(nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := RunCommand(conn, db, bson.D{
+		{"saslStart", 1},
+		{"mechanism", ScramSHA256},
+		{"payload", payload},
+		{"options", bson.D{{"skipEmptyExchange", true}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		serverPayload, done, conversationId, err := parseSaslResponse(resp)
+		if err != nil {
+			return err
+		}
+
+		payload, err = client.Step(serverPayload)
+		if err != nil {
+			return err
+		}
+
+		if done {
+			if !client.verified {
+				return NewStackErrorf("server finished SCRAM conversation without proving itself")
+			}
+			return nil
+		}
+
+		resp, err = RunCommand(conn, db, bson.D{
+			{"saslContinue", 1},
+			{"conversationId", conversationId},
+			{"payload", payload},
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func parseSaslResponse(resp bson.D) ([]byte, bool, interface{}, error) {
+	var payload []byte
+	if idx := BSONIndexOf(resp, "payload"); idx >= 0 {
+		switch val := resp[idx].Value.(type) {
+		case []byte:
+			payload = val
+		case bson.Binary:
+			payload = val.Data
+		case string:
+			payload = []byte(val)
+		default:
+			return nil, false, nil, NewStackErrorf("sasl payload has unexpected type %T", val)
+		}
+	}
+
+	done := false
+	if idx := BSONIndexOf(resp, "done"); idx >= 0 {
+		done, _, _ = GetAsBool(resp[idx])
+	}
+
+	var conversationId interface{}
+	if idx := BSONIndexOf(resp, "conversationId"); idx >= 0 {
+		conversationId = resp[idx].Value
+	}
+
+	return payload, done, conversationId, nil
+}
+
+// scramClientConversation is the client side of a SCRAM-SHA-256 exchange
+type scramClientConversation struct {
+	username string
+	password string
+
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+
+	step     int
+	verified bool
+}
+
+func (c *scramClientConversation) Step(serverPayload []byte) ([]byte, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		if c.nonce == "" {
+			nonce, err := scramNonce()
+			if err != nil {
+				return nil, err
+			}
+			c.nonce = nonce
+		}
+		user := strings.Replace(strings.Replace(c.username, "=", "=3D", -1), ",", "=2C", -1)
+		c.clientFirstBare = "n=" + user + ",r=" + c.nonce
+		return []byte("n,," + c.clientFirstBare), nil
+
+	case 2:
+		serverFirst := string(serverPayload)
+		attrs := scramAttributes(serverFirst)
+		if !strings.HasPrefix(attrs["r"], c.nonce) {
+			return nil, NewStackErrorf("server SCRAM nonce does not start with the client nonce")
+		}
+		salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+		if err != nil {
+			return nil, NewStackErrorf("invalid SCRAM salt: %s", err)
+		}
+		iterations, err := strconv.Atoi(attrs["i"])
+		if err != nil || iterations <= 0 {
+			return nil, NewStackErrorf("invalid SCRAM iteration count %q", attrs["i"])
+		}
+
+		salted := pbkdf2SHA256([]byte(c.password), salt, iterations)
+		clientKey := hmacSHA256(salted, []byte("Client Key"))
+		storedKey := sha256.Sum256(clientKey)
+		serverKey := hmacSHA256(salted, []byte("Server Key"))
+
+		withoutProof := "c=biws,r=" + attrs["r"]
+		authMessage := []byte(c.clientFirstBare + "," + serverFirst + "," + withoutProof)
+		clientSignature := hmacSHA256(storedKey[:], authMessage)
+		proof := make([]byte, len(clientKey))
+		for i := range clientKey {
+			proof[i] = clientKey[i] ^ clientSignature[i]
+		}
+		c.serverSignature = hmacSHA256(serverKey, authMessage)
+
+		return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+
+	case 3:
+		attrs := scramAttributes(string(serverPayload))
+		if e, ok := attrs["e"]; ok {
+			return nil, NewStackErrorf("SCRAM authentication failed: %s", e)
+		}
+		signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+		if err != nil || !hmac.Equal(signature, c.serverSignature) {
+			return nil, NewStackErrorf("invalid SCRAM server signature")
+		}
+		c.verified = true
+		return []byte{}, nil
+	}
+
+	// any further step is the empty exchange
+	return []byte{}, nil
+}
+
+// ---
+
+func scramAttributes(s string) map[string]string {
+	attrs := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		if len(part) < 2 || part[1] != '=' {
+			continue
+		}
+		attrs[part[:1]] = part[2:]
+	}
+	return attrs
+}
+
+func scramNonce() (string, error) {
+	raw := make([]byte, 24)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// pbkdf2SHA256 computes Hi() from RFC 5802, which is PBKDF2 with a single output block
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	h := hmac.New(sha256.New, password)
+	h.Write(salt)
+	h.Write([]byte{0, 0, 0, 1})
+	u := h.Sum(nil)
+
+	result := make([]byte, len(u))
+	copy(result, u)
+
+	for i := 1; i < iterations; i++ {
+		h.Reset()
+		h.Write(u)
+		u = h.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,101 @@
+package mongonet
+
+import (
+	"encoding/base64"
+	"strconv"
+	"testing"
+)
+
+// test vector from RFC 7677
+func TestScramServerRFC7677(test *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	store := NewMapCredentialStore()
+	store.SetCredential("admin", "user", newScramCredential("pencil", salt, 4096))
+
+	conv := newScramServerConversation(store, "admin")
+	conv.serverNonce = "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+
+	resp, done, err := conv.Step([]byte("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"))
+	if err != nil {
+		test.Fatalf("first step failed %s", err)
+	}
+	if done {
+		test.Errorf("done too early")
+	}
+	if string(resp) != "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096" {
+		test.Errorf("wrong server first message %s", resp)
+	}
+
+	resp, _, err = conv.Step([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+	if err != nil {
+		test.Fatalf("final step failed %s", err)
+	}
+	if string(resp) != "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" {
+		test.Errorf("wrong server final message %s", resp)
+	}
+
+	_, done, err = conv.Step([]byte{})
+	if err != nil || !done {
+		test.Errorf("empty exchange failed %v %s", done, err)
+	}
+}
+
+func runScram(store CredentialStore, username, password string) error {
+	client := &scramClientConversation{username: username, password: password}
+	server := newScramServerConversation(store, "admin")
+
+	var serverPayload []byte
+	for {
+		payload, err := client.Step(serverPayload)
+		if err != nil {
+			return err
+		}
+		var done bool
+		serverPayload, done, err = server.Step(payload)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+func TestScramClientServer(test *testing.T) {
+	store := NewMapCredentialStore()
+	if err := store.AddUser("admin", "bob,=x", "secret"); err != nil {
+		test.Fatal(err)
+	}
+
+	if err := runScram(store, "bob,=x", "secret"); err != nil {
+		test.Errorf("good password failed %s", err)
+	}
+
+	if err := runScram(store, "bob,=x", "wrong"); err == nil {
+		test.Errorf("bad password worked")
+	}
+
+	if err := runScram(store, "alice", "secret"); err == nil {
+		test.Errorf("unknown user worked")
+	}
+
+	// unknown users get a salt too and only fail at the proof, the same one every time
+	serverFirst := func(username string) string {
+		conv := newScramServerConversation(store, "admin")
+		resp, _, err := conv.Step([]byte("n,,n=" + username + ",r=abc"))
+		if err != nil {
+			test.Fatalf("first step for %s failed %s", username, err)
+		}
+		return string(resp)
+	}
+	alice := scramAttributes(serverFirst("alice"))
+	if alice["s"] == "" || alice["i"] != strconv.Itoa(defaultScramIterations) {
+		test.Errorf("expected a salt and iteration count for an unknown user, got %v", alice)
+	}
+	if again := scramAttributes(serverFirst("alice")); again["s"] != alice["s"] {
+		test.Errorf("the made up salt should not change, got %s and %s", alice["s"], again["s"])
+	}
+	if carol := scramAttributes(serverFirst("carol")); carol["s"] == alice["s"] {
+		test.Errorf("unknown users should not share a salt")
+	}
+}
@@ -0,0 +1,359 @@
+package mongonet
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	defaultCursorIdleTimeout = 10 * time.Minute
+	maxBatchBytes            = 16 * 1024 * 1024
+)
+
+// CursorReply builds the {cursor: {...}} part of a find, aggregate or getMore response,
+// batchField is firstBatch or nextBatch, an id of 0 tells the client there is nothing left
+func CursorReply(ns string, id int64, batchField string, docs []bson.D) bson.D {
+	if docs == nil {
+		docs = []bson.D{}
+	}
+	return bson.D{{"cursor", bson.D{{batchField, docs}, {"id", id}, {"ns", ns}}}}
+}
+
+// CursorSource produces the documents of a cursor
+type CursorSource interface {
+	// Next returns the next document, nil when there are no more
+	Next() (bson.D, error)
+	Close()
+}
+
+type sliceCursorSource struct {
+	docs []bson.D
+}
+
+// NewSliceCursorSource makes a source which returns docs
+func NewSliceCursorSource(docs []bson.D) CursorSource {
+	return &sliceCursorSource{docs}
+}
+
+func (scs *sliceCursorSource) Next() (bson.D, error) {
+	if len(scs.docs) == 0 {
+		return nil, nil
+	}
+	doc := scs.docs[0]
+	scs.docs = scs.docs[1:]
+	return doc, nil
+}
+
+func (scs *sliceCursorSource) Close() {
+	scs.docs = nil
+}
+
+// CursorOpener runs a find or aggregate, the CursorManager pages through what it returns
+type CursorOpener func(req *CommandRequest) (CursorSource, error)
+
+type serverCursor struct {
+	id       int64
+	ns       string
+	source   CursorSource
+	pending  bson.D // read, but didn't fit in the last batch
+	lastUsed time.Time
+	busy     bool
+}
+
+// CursorManager keeps the cursors of a server built with CommandMux.
+// It cuts what a CursorSource produces into batches by batchSize and the 16MB reply limit,
+// and closes cursors which weren't used for the idle timeout.
+type CursorManager struct {
+	lock        sync.Mutex
+	cursors     map[int64]*serverCursor
+	idleTimeout time.Duration
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewCursorManager starts a manager, an idleTimeout of 0 means 10 minutes like mongod
+func NewCursorManager(idleTimeout time.Duration) *CursorManager {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultCursorIdleTimeout
+	}
+	cm := &CursorManager{sync.Mutex{}, map[int64]*serverCursor{}, idleTimeout, make(chan struct{}), sync.Once{}}
+	go cm.reapLoop()
+	return cm
+}
+
+// Close stops the idle timeouts and closes every cursor
+func (cm *CursorManager) Close() {
+	cm.closeOnce.Do(func() {
+		close(cm.done)
+		cm.lock.Lock()
+		defer cm.lock.Unlock()
+		for id, c := range cm.cursors {
+			c.source.Close()
+			delete(cm.cursors, id)
+		}
+	})
+}
+
+// Size returns how many cursors are open
+func (cm *CursorManager) Size() int {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	return len(cm.cursors)
+}
+
+func (cm *CursorManager) reapLoop() {
+	ticker := time.NewTicker(cm.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cm.done:
+			return
+		case now := <-ticker.C:
+			cm.reap(now)
+		}
+	}
+}
+
+func (cm *CursorManager) reap(now time.Time) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	for id, c := range cm.cursors {
+		if !c.busy && now.Sub(c.lastUsed) >= cm.idleTimeout {
+			c.source.Close()
+			delete(cm.cursors, id)
+		}
+	}
+}
+
+// batch reads up to batchSize documents, 0 meaning only the 16MB limit applies.
+// At least one document is returned if there is any, even a huge one.
+func (c *serverCursor) batch(batchSize int) ([]bson.D, bool, error) {
+	docs := []bson.D{}
+	bytes := 0
+	for batchSize == 0 || len(docs) < batchSize {
+		doc := c.pending
+		c.pending = nil
+		if doc == nil {
+			var err error
+			if doc, err = c.source.Next(); err != nil {
+				return nil, false, err
+			}
+			if doc == nil {
+				return docs, true, nil
+			}
+		}
+
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, false, NewStackErrorf("cannot encode cursor document: %s", err)
+		}
+		if len(docs) > 0 && bytes+len(raw) > maxBatchBytes {
+			c.pending = doc
+			break
+		}
+		bytes += len(raw)
+		docs = append(docs, doc)
+	}
+
+	if c.pending == nil {
+		// look ahead, so the client learns the cursor is done without another getMore
+		doc, err := c.source.Next()
+		if err != nil {
+			return nil, false, err
+		}
+		if doc == nil {
+			return docs, true, nil
+		}
+		c.pending = doc
+	}
+	return docs, false, nil
+}
+
+// Open returns the first batch of a new cursor, the cursor is only kept if documents are left.
+// Like with find a batchSize of 0 returns an empty first batch, unless singleBatch asks for all there is.
+func (cm *CursorManager) Open(ns string, source CursorSource, batchSize int, singleBatch bool) (bson.D, error) {
+	c := &serverCursor{0, ns, source, nil, time.Now(), false}
+	var docs []bson.D
+	var exhausted bool
+	var err error
+	if batchSize == 0 && !singleBatch {
+		docs = []bson.D{}
+		c.pending, err = source.Next()
+		exhausted = c.pending == nil
+	} else {
+		docs, exhausted, err = c.batch(batchSize)
+	}
+	if err != nil || exhausted || singleBatch {
+		source.Close()
+		if err != nil {
+			return nil, err
+		}
+		return CursorReply(ns, 0, "firstBatch", docs), nil
+	}
+
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	c.id = randomCursorId()
+	for _, taken := cm.cursors[c.id]; taken || c.id == 0; _, taken = cm.cursors[c.id] {
+		c.id = randomCursorId()
+	}
+	cm.cursors[c.id] = c
+	return CursorReply(ns, c.id, "firstBatch", docs), nil
+}
+
+// GetMore returns the next batch of a cursor, a batchSize of 0 fills up the batch to 16MB
+func (cm *CursorManager) GetMore(ns string, id int64, batchSize int) (bson.D, error) {
+	cm.lock.Lock()
+	c, ok := cm.cursors[id]
+	if !ok {
+		cm.lock.Unlock()
+		return nil, newCursorNotFoundError(id)
+	}
+	if ns != c.ns {
+		cm.lock.Unlock()
+		return nil, NewMongoError(
+			fmt.Errorf("requested getMore on namespace '%s', but cursor belongs to a different namespace %s", ns, c.ns),
+			13, "Unauthorized")
+	}
+	if c.busy {
+		cm.lock.Unlock()
+		return nil, NewMongoError(fmt.Errorf("cursor id %d is already in use", id), 292, "CursorInUse")
+	}
+	c.busy = true
+	cm.lock.Unlock()
+
+	docs, exhausted, err := c.batch(batchSize)
+
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	c.busy = false
+	c.lastUsed = time.Now()
+	if cm.cursors[id] != c {
+		// killed while we were reading
+		c.source.Close()
+		if err != nil {
+			return nil, err
+		}
+		return CursorReply(ns, 0, "nextBatch", docs), nil
+	}
+	if err != nil || exhausted {
+		c.source.Close()
+		delete(cm.cursors, id)
+		if err != nil {
+			return nil, err
+		}
+		return CursorReply(ns, 0, "nextBatch", docs), nil
+	}
+	return CursorReply(ns, id, "nextBatch", docs), nil
+}
+
+// Kill closes cursors, reporting which ids existed
+func (cm *CursorManager) Kill(ids ...int64) (killed, notFound []int64) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	killed, notFound = []int64{}, []int64{}
+	for _, id := range ids {
+		c, ok := cm.cursors[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		// a getMore reading it closes the source once it's done
+		if !c.busy {
+			c.source.Close()
+		}
+		delete(cm.cursors, id)
+		killed = append(killed, id)
+	}
+	return killed, notFound
+}
+
+// ---
+
+// cursorNamespace is the namespace of a find or aggregate, aggregate: 1 has no collection
+func cursorNamespace(db string, cmd bson.D) string {
+	if coll, ok := cmd[0].Value.(string); ok {
+		return db + "." + coll
+	}
+	return db + ".$cmd." + cmd[0].Name
+}
+
+// CursorCommand turns an opener into the handler of a find or aggregate,
+// paging by the command's batchSize (cursor.batchSize for aggregate) and singleBatch.
+// Without a batchSize the first batch holds up to 101 documents.
+func (cm *CursorManager) CursorCommand(open CursorOpener) CommandHandler {
+	return func(req *CommandRequest) (bson.D, error) {
+		cmd := req.Command
+		batchSize := defaultFirstBatchSize
+		if idx := BSONIndexOf(cmd, "cursor"); idx >= 0 {
+			if cursor, _, err := GetAsBSON(cmd[idx]); err == nil {
+				if idx = BSONIndexOf(cursor, "batchSize"); idx >= 0 {
+					batchSize, _, _ = GetAsInt(cursor[idx])
+				}
+			}
+		} else if idx := BSONIndexOf(cmd, "batchSize"); idx >= 0 {
+			batchSize, _, _ = GetAsInt(cmd[idx])
+		}
+		if batchSize < 0 {
+			return nil, newBadValueError("batchSize must be non-negative")
+		}
+		singleBatch := false
+		if idx := BSONIndexOf(cmd, "singleBatch"); idx >= 0 {
+			singleBatch, _, _ = GetAsBool(cmd[idx])
+		}
+
+		source, err := open(req)
+		if err != nil {
+			return nil, err
+		}
+		return cm.Open(cursorNamespace(req.DB, cmd), source, batchSize, singleBatch)
+	}
+}
+
+// Install makes mux answer getMore and killCursors from the manager
+func (cm *CursorManager) Install(mux *CommandMux) {
+	mux.Handle(cm.getMoreCommand, "getMore")
+	mux.Handle(cm.killCursorsCommand, "killCursors")
+}
+
+func (cm *CursorManager) getMoreCommand(req *CommandRequest) (bson.D, error) {
+	cmd := req.Command
+	id, ok := cursorIdValue(cmd[0].Value)
+	if !ok {
+		return nil, NewMongoError(fmt.Errorf("getMore cursor id must be a number"), 14, "TypeMismatch")
+	}
+	coll := ""
+	if idx := BSONIndexOf(cmd, "collection"); idx >= 0 {
+		coll, _, _ = GetAsString(cmd[idx])
+	}
+	batchSize := 0
+	if idx := BSONIndexOf(cmd, "batchSize"); idx >= 0 {
+		batchSize, _, _ = GetAsInt(cmd[idx])
+	}
+	if batchSize < 0 {
+		return nil, newBadValueError("batchSize must be non-negative")
+	}
+	return cm.GetMore(req.DB+"."+coll, id, batchSize)
+}
+
+func (cm *CursorManager) killCursorsCommand(req *CommandRequest) (bson.D, error) {
+	var ids []int64
+	if idx := BSONIndexOf(req.Command, "cursors"); idx >= 0 {
+		raw, _ := req.Command[idx].Value.([]interface{})
+		for _, v := range raw {
+			if id, ok := cursorIdValue(v); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	killed, notFound := cm.Kill(ids...)
+	return bson.D{
+		{"cursorsKilled", killed},
+		{"cursorsNotFound", notFound},
+		{"cursorsAlive", []int64{}},
+		{"cursorsUnknown", []int64{}},
+	}, nil
+}
@@ -0,0 +1,263 @@
+package mongonet
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func numberedDocs(n int) []bson.D {
+	docs := make([]bson.D, n)
+	for i := range docs {
+		docs[i] = bson.D{{"_id", i}}
+	}
+	return docs
+}
+
+// cursorBatch pulls the batch and the id out of a cursor reply
+func cursorBatch(test *testing.T, reply bson.D, batchField string) ([]bson.D, int64) {
+	docs, id, err := parseCursorReply(reply, batchField)
+	if err != nil {
+		test.Fatalf("bad cursor reply %v: %s", reply, err)
+	}
+	return docs, id
+}
+
+func TestCursorManagerBatches(test *testing.T) {
+	cm := NewCursorManager(0)
+	defer cm.Close()
+
+	docs, id := cursorBatch(test, mustReply(cm.Open("test.foo", NewSliceCursorSource(numberedDocs(5)), 2, false)), "firstBatch")
+	if len(docs) != 2 || id == 0 || cm.Size() != 1 {
+		test.Fatalf("expected 2 documents and a cursor, got %v %d", docs, id)
+	}
+	if _, err := cm.GetMore("test.bar", id, 2); err == nil || err.(MongoError).Code() != 13 {
+		test.Errorf("a getMore on another namespace should fail, got %v", err)
+	}
+	docs, next := cursorBatch(test, mustReply(cm.GetMore("test.foo", id, 2)), "nextBatch")
+	if len(docs) != 2 || next != id {
+		test.Errorf("expected 2 more documents on the same cursor, got %v %d", docs, next)
+	}
+	docs, next = cursorBatch(test, mustReply(cm.GetMore("test.foo", id, 0)), "nextBatch")
+	if len(docs) != 1 || docs[0][0].Value != 4 || next != 0 || cm.Size() != 0 {
+		test.Errorf("the last getMore should finish the cursor, got %v %d", docs, next)
+	}
+	if _, err := cm.GetMore("test.foo", id, 0); err == nil || err.(MongoError).Code() != 43 {
+		test.Errorf("a finished cursor should be gone, got %v", err)
+	}
+
+	// a source which fits in the first batch never becomes a cursor
+	if _, id = cursorBatch(test, mustReply(cm.Open("test.foo", NewSliceCursorSource(numberedDocs(2)), 2, false)), "firstBatch"); id != 0 {
+		test.Errorf("an exhausted source shouldn't leave a cursor")
+	}
+	if _, id = cursorBatch(test, mustReply(cm.Open("test.foo", NewSliceCursorSource(numberedDocs(5)), 2, true)), "firstBatch"); id != 0 {
+		test.Errorf("singleBatch shouldn't leave a cursor")
+	}
+
+	// a batchSize of 0 only opens the cursor
+	docs, id = cursorBatch(test, mustReply(cm.Open("test.foo", NewSliceCursorSource(numberedDocs(5)), 0, false)), "firstBatch")
+	if len(docs) != 0 || id == 0 {
+		test.Fatalf("expected an empty first batch and a cursor, got %v %d", docs, id)
+	}
+	if docs, next = cursorBatch(test, mustReply(cm.GetMore("test.foo", id, 0)), "nextBatch"); len(docs) != 5 || next != 0 {
+		test.Errorf("the getMore should return all documents, got %v %d", docs, next)
+	}
+	if _, id = cursorBatch(test, mustReply(cm.Open("test.foo", NewSliceCursorSource(nil), 0, false)), "firstBatch"); id != 0 {
+		test.Errorf("an empty source shouldn't leave a cursor")
+	}
+
+	// batches stop at 16MB, but always hold a document
+	big := strings.Repeat("x", 7*1024*1024)
+	bigDocs := []bson.D{{{"s", big}}, {{"s", big}}, {{"s", big}}, {{"s", big + big + big}}}
+	_, id = cursorBatch(test, mustReply(cm.Open("test.big", NewSliceCursorSource(bigDocs), 1, false)), "firstBatch")
+	if docs, _ = cursorBatch(test, mustReply(cm.GetMore("test.big", id, 0)), "nextBatch"); len(docs) != 2 {
+		test.Errorf("two 7MB documents fit in a batch, got %d", len(docs))
+	}
+	if docs, next = cursorBatch(test, mustReply(cm.GetMore("test.big", id, 0)), "nextBatch"); len(docs) != 1 || next != 0 {
+		test.Errorf("a document over 16MB still goes alone, got %d", len(docs))
+	}
+
+	killed, notFound := cm.Kill(mustCursor(test, cm), 17)
+	if len(killed) != 1 || len(notFound) != 1 || notFound[0] != 17 || cm.Size() != 0 {
+		test.Errorf("expected one cursor killed and 17 not found, got %v %v", killed, notFound)
+	}
+}
+
+func mustReply(reply bson.D, err error) bson.D {
+	if err != nil {
+		panic(err)
+	}
+	return reply
+}
+
+func mustCursor(test *testing.T, cm *CursorManager) int64 {
+	_, id := cursorBatch(test, mustReply(cm.Open("test.foo", NewSliceCursorSource(numberedDocs(5)), 1, false)), "firstBatch")
+	return id
+}
+
+func TestCursorManagerIdleTimeout(test *testing.T) {
+	cm := NewCursorManager(50 * time.Millisecond)
+	defer cm.Close()
+	mustCursor(test, cm)
+	for i := 0; i < 100 && cm.Size() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cm.Size() != 0 {
+		test.Errorf("the idle cursor should have been closed")
+	}
+}
+
+func TestCursorManagerServer(test *testing.T) {
+	cm := NewCursorManager(0)
+	defer cm.Close()
+	mux := NewCommandMux()
+	cm.Install(mux)
+	mux.Handle(cm.CursorCommand(func(req *CommandRequest) (CursorSource, error) {
+		return NewSliceCursorSource(numberedDocs(5)), nil
+	}), "find", "aggregate")
+
+	server := NewServer(ServerConfig{"127.0.0.1", 9906, false, nil, NewSyncTlsConfig(), 0, 0, nil, slogger.OFF, nil}, mux)
+	go server.Run()
+	defer server.Close()
+	if err := <-server.InitChannel(); err != nil {
+		test.Fatalf("cannot start server: %s", err)
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:9906")
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer conn.Close()
+
+	// commands
+	res, err := RunCommand(conn, "test", bson.D{{"aggregate", 1}, {"pipeline", []interface{}{}}, {"cursor", bson.D{{"batchSize", 3}}}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	docs, id := cursorBatch(test, res, "firstBatch")
+	if len(docs) != 3 || id == 0 {
+		test.Fatalf("expected 3 documents and a cursor, got %v", res)
+	}
+	if res, err = RunCommand(conn, "test", bson.D{{"getMore", id}, {"collection", "$cmd.aggregate"}}); err != nil {
+		test.Fatal(err)
+	}
+	if docs, id = cursorBatch(test, res, "nextBatch"); len(docs) != 2 || id != 0 {
+		test.Errorf("getMore should return the rest, got %v", res)
+	}
+
+	// without a batchSize the first batch holds up to 101 documents, with 0 none
+	res, _ = RunCommand(conn, "test", bson.D{{"find", "foo"}})
+	if docs, id = cursorBatch(test, res, "firstBatch"); len(docs) != 5 || id != 0 {
+		test.Errorf("find without a batchSize should return everything, got %v", res)
+	}
+	res, _ = RunCommand(conn, "test", bson.D{{"find", "foo"}, {"batchSize", 0}})
+	if docs, id = cursorBatch(test, res, "firstBatch"); len(docs) != 0 || id == 0 {
+		test.Errorf("find with batchSize 0 should only open a cursor, got %v", res)
+	}
+	cm.Kill(id)
+
+	res, _ = RunCommand(conn, "test", bson.D{{"find", "foo"}, {"batchSize", 1}})
+	_, id = cursorBatch(test, res, "firstBatch")
+	if res, err = RunCommand(conn, "test", bson.D{{"killCursors", "foo"}, {"cursors", []interface{}{id}}}); err != nil {
+		test.Fatal(err)
+	}
+	if killed, _ := res[0].Value.([]interface{}); cm.Size() != 0 || res[0].Name != "cursorsKilled" || len(killed) != 1 {
+		test.Errorf("the cursor should have been killed: %v", res)
+	}
+
+	// legacy OP_QUERY and OP_GET_MORE
+	query, _ := SimpleBSONConvert(bson.D{})
+	if err = SendMessage(NewQueryMessage("test.foo", 0, 0, 2, query, SimpleBSON{}), conn); err != nil {
+		test.Fatal(err)
+	}
+	resp, err := ReadMessage(conn)
+	if err != nil {
+		test.Fatal(err)
+	}
+	reply, ok := resp.(*ReplyMessage)
+	if !ok || reply.NumberReturned != 2 || reply.CursorId == 0 {
+		test.Fatalf("expected an OP_REPLY with 2 documents and a cursor, got %s", resp.ToString())
+	}
+	getMore := &GetMoreMessage{MessageHeader{0, 18, 0, OP_GET_MORE}, 0, "test.foo", 0, reply.CursorId}
+	if err = SendMessage(getMore, conn); err != nil {
+		test.Fatal(err)
+	}
+	if resp, err = ReadMessage(conn); err != nil {
+		test.Fatal(err)
+	}
+	if reply, ok = resp.(*ReplyMessage); !ok || reply.NumberReturned != 3 || reply.CursorId != 0 {
+		test.Errorf("expected the last 3 documents, got %s", resp.ToString())
+	}
+	if err = SendMessage(getMore, conn); err != nil {
+		test.Fatal(err)
+	}
+	if resp, err = ReadMessage(conn); err != nil {
+		test.Fatal(err)
+	}
+	if reply, ok = resp.(*ReplyMessage); !ok || reply.Flags&1 == 0 {
+		test.Errorf("a getMore on a finished cursor should set CursorNotFound, got %s", resp.ToString())
+	}
+}
+
+type plainReplyWorker struct {
+	session *Session
+}
+
+func (w *plainReplyWorker) DoLoopTemp() {
+	for {
+		m, err := w.session.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err = w.session.RespondToCommand(m, SimpleBSONConvertOrPanic(bson.D{{"x", 1}})); err != nil {
+			return
+		}
+	}
+}
+
+func (w *plainReplyWorker) Close() {
+}
+
+type plainReplyFactory struct{}
+
+func (f plainReplyFactory) CreateWorker(session *Session) (ServerWorker, error) {
+	return &plainReplyWorker{session}, nil
+}
+
+func (f plainReplyFactory) GetConnection(conn net.Conn) io.ReadWriteCloser {
+	return conn
+}
+
+func TestLegacyQueryPlainReply(test *testing.T) {
+	server := NewServer(ServerConfig{"127.0.0.1", 9907, false, nil, NewSyncTlsConfig(), 0, 0, nil, slogger.OFF, nil}, plainReplyFactory{})
+	go server.Run()
+	defer server.Close()
+	if err := <-server.InitChannel(); err != nil {
+		test.Fatalf("cannot start server: %s", err)
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:9907")
+	if err != nil {
+		test.Fatalf("cannot dial: %s", err)
+	}
+	defer conn.Close()
+
+	// a reply without a cursor goes back as the single document of an OP_REPLY
+	if err = SendMessage(NewQueryMessage("test.foo", 0, 0, 1, SimpleBSONEmpty(), SimpleBSON{}), conn); err != nil {
+		test.Fatal(err)
+	}
+	resp, err := ReadMessage(conn)
+	if err != nil {
+		test.Fatal(err)
+	}
+	reply, ok := resp.(*ReplyMessage)
+	if !ok || reply.NumberReturned != 1 || reply.Flags != 0 {
+		test.Fatalf("expected an OP_REPLY with one document, got %s", resp.ToString())
+	}
+	if doc, _ := reply.Docs[0].ToBSOND(); BSONCompare(doc, bson.D{{"x", 1}}) != 0 {
+		test.Errorf("expected the plain document, got %v", doc)
+	}
+}
@@ -116,6 +116,9 @@ func (s *Session) RespondToCommand(clientMessage Message, doc SimpleBSON) error
 	switch clientMessage.Header().OpCode {
 
 	case OP_QUERY:
+		if isLegacyRead(clientMessage) && hasCursor(doc) {
+			return s.respondWithBatch(clientMessage, doc)
+		}
 		rm := &ReplyMessage{
 			MessageHeader{
 				0,
@@ -130,7 +133,10 @@ func (s *Session) RespondToCommand(clientMessage Message, doc SimpleBSON) error
 		}
 		return SendMessage(rm, s.conn)
 
-	case OP_INSERT, OP_UPDATE, OP_DELETE:
+	case OP_GET_MORE:
+		return s.respondWithBatch(clientMessage, doc)
+
+	case OP_INSERT, OP_UPDATE, OP_DELETE, OP_KILL_CURSORS:
 		// For MongoDB 2.6+, and wpv 3+, these are only used for unacknowledged writes, so do nothing
 		return nil
 
@@ -169,6 +175,75 @@ func (s *Session) RespondToCommand(clientMessage Message, doc SimpleBSON) error
 
 }
 
+// isLegacyRead is true for OP_QUERY against a collection and OP_GET_MORE,
+// which are answered with documents in an OP_REPLY rather than a command response
+func isLegacyRead(m Message) bool {
+	switch mm := m.(type) {
+	case *QueryMessage:
+		return !NamespaceIsCommand(mm.Namespace)
+	case *GetMoreMessage:
+		return true
+	}
+	return false
+}
+
+// hasCursor is true for find and getMore style responses, other documents are sent as they are
+func hasCursor(doc SimpleBSON) bool {
+	resp, err := doc.ToBSOND()
+	return err == nil && BSONIndexOf(resp, "cursor") >= 0
+}
+
+// respondWithBatch answers a legacy read with the batch of a find or getMore response
+func (s *Session) respondWithBatch(clientMessage Message, doc SimpleBSON) error {
+	resp, err := doc.ToBSOND()
+	if err != nil {
+		return err
+	}
+	idx := BSONIndexOf(resp, "cursor")
+	if idx < 0 {
+		return NewStackErrorf("legacy reads can only be answered with a cursor, got %v", resp)
+	}
+	cursor, _, err := GetAsBSON(resp[idx])
+	if err != nil {
+		return err
+	}
+
+	var cursorId int64
+	if idx = BSONIndexOf(cursor, "id"); idx >= 0 {
+		cursorId, _ = cursorIdValue(cursor[idx].Value)
+	}
+	batchField := "firstBatch"
+	if clientMessage.Header().OpCode == OP_GET_MORE {
+		batchField = "nextBatch"
+	}
+	var batch []bson.D
+	if idx = BSONIndexOf(cursor, batchField); idx >= 0 {
+		if batch, _, err = GetAsBSONDocs(cursor[idx]); err != nil {
+			return err
+		}
+	}
+
+	docs := make([]SimpleBSON, len(batch))
+	for i, d := range batch {
+		if docs[i], err = SimpleBSONConvert(d); err != nil {
+			return err
+		}
+	}
+	rm := &ReplyMessage{
+		MessageHeader{
+			0,
+			17, // TODO
+			clientMessage.Header().RequestID,
+			OP_REPLY},
+		0,
+		cursorId,
+		0, // StartingFrom, drivers don't look at it
+		int32(len(docs)),
+		docs,
+	}
+	return SendMessage(rm, s.conn)
+}
+
 func (s *Session) RespondWithError(clientMessage Message, err error) error {
 	s.logger.Logf(slogger.INFO, "RespondWithError %v", err)
 	var errBSON bson.D
@@ -180,6 +255,20 @@ func (s *Session) RespondWithError(clientMessage Message, err error) error {
 		errBSON = bson.D{{"ok", 0}, {"errmsg", err.Error()}}
 	}
 
+	// legacy reads report errors as $err with the QueryFailure flag
+	flags := int32(0)
+	if err != nil && isLegacyRead(clientMessage) {
+		msg, code := err.Error(), 0
+		if mongoErr, ok := err.(MongoError); ok {
+			msg, code = mongoErr.err.Error(), mongoErr.Code()
+		}
+		errBSON = bson.D{{"$err", msg}, {"code", code}}
+		flags = 2
+		if code == 43 && clientMessage.Header().OpCode == OP_GET_MORE {
+			flags = 1 // CursorNotFound
+		}
+	}
+
 	doc, myErr := SimpleBSONConvert(errBSON)
 	if myErr != nil {
 		return myErr
@@ -194,9 +283,9 @@ func (s *Session) RespondWithError(clientMessage Message, err error) error {
 				clientMessage.Header().RequestID,
 				OP_REPLY},
 
-			// We should not set the error bit because we are
+			// We should not set the error bit for commands because we are
 			// responding with errmsg instead of $err
-			0, // flags - error bit
+			flags,
 
 			0, // cursor id
 			0, // StartingFrom
@@ -0,0 +1,365 @@
+package mongonet
+
+import (
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// default size of a find's first batch, getMore returns everything left without a batchSize
+// as long as it fits into maxBatchBytes
+const defaultFirstBatchSize = 101
+
+// shardStream is what's left of one shard's part of a merged cursor
+type shardStream struct {
+	shard    string
+	docs     []bson.D // fetched, not returned yet
+	remoteId int64    // 0 once the shard is exhausted
+}
+
+// mergedCursor combines the cursors of a broadcast find into one, keeping the sort order
+type mergedCursor struct {
+	db      string
+	coll    string
+	sort    bson.D
+	streams []*shardStream
+	limit   int    // 0 means no limit
+	sent    int    // including skipped documents
+	session bson.D // lsid and transaction fields of the find, the shard cursors belong to that session
+
+	owner *shardRouterSession // the client connection that opened it
+	user  string              // who the client authenticated as against the proxy, empty if nobody
+}
+
+func (mc *mergedCursor) ns() string {
+	return mc.db + "." + mc.coll
+}
+
+func (mc *mergedCursor) lsid() bson.D {
+	if idx := BSONIndexOf(mc.session, "lsid"); idx >= 0 {
+		lsid, _, _ := GetAsBSON(mc.session[idx])
+		return lsid
+	}
+	return nil
+}
+
+func (mc *mergedCursor) exhausted() bool {
+	if mc.limit > 0 && mc.sent >= mc.limit {
+		return true
+	}
+	for _, s := range mc.streams {
+		if len(s.docs) > 0 || s.remoteId != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// fill fetches the next batch of a stream if it ran dry
+func (srs *shardRouterSession) fill(mc *mergedCursor, s *shardStream) error {
+	for len(s.docs) == 0 && s.remoteId != 0 {
+		doc, err := srs.run(s.shard, mc.db, append(bson.D{{"getMore", s.remoteId}, {"collection", mc.coll}}, mc.session...))
+		if err != nil {
+			return err
+		}
+		docs, id, err := parseCursorReply(doc, "nextBatch")
+		if err != nil {
+			return err
+		}
+		s.docs, s.remoteId = docs, id
+	}
+	return nil
+}
+
+// next returns up to n documents, all that are left if n is 0.
+// With maxBytes set the batch stops before it grows beyond that, but holds at least one document.
+func (srs *shardRouterSession) next(mc *mergedCursor, n int, maxBytes int) ([]bson.D, error) {
+	res := []bson.D{}
+	bytes := 0
+	for (n <= 0 || len(res) < n) && !(mc.limit > 0 && mc.sent >= mc.limit) {
+		var pick *shardStream
+		for _, s := range mc.streams {
+			if err := srs.fill(mc, s); err != nil {
+				return nil, err
+			}
+			if len(s.docs) == 0 {
+				continue
+			}
+			if pick == nil || BSONCompareBySort(s.docs[0], pick.docs[0], mc.sort) < 0 {
+				pick = s
+			}
+			if len(mc.sort) == 0 {
+				// no order to keep, drain the shards one after the other
+				break
+			}
+		}
+		if pick == nil {
+			break
+		}
+		if maxBytes > 0 {
+			raw, err := bson.Marshal(pick.docs[0])
+			if err != nil {
+				return nil, NewStackErrorf("cannot encode cursor document: %s", err)
+			}
+			if len(res) > 0 && bytes+len(raw) > maxBytes {
+				break
+			}
+			bytes += len(raw)
+		}
+		res = append(res, pick.docs[0])
+		pick.docs = pick.docs[1:]
+		mc.sent++
+	}
+	return res, nil
+}
+
+// sessionFields returns the fields tying a command to a logical session and its transaction
+func sessionFields(cmd bson.D) bson.D {
+	res := bson.D{}
+	for _, elem := range cmd {
+		switch elem.Name {
+		case "lsid", "txnNumber", "autocommit":
+			res = append(res, elem)
+		}
+	}
+	return res
+}
+
+func parseCursorReply(doc bson.D, batchField string) ([]bson.D, int64, error) {
+	idx := BSONIndexOf(doc, "cursor")
+	if idx < 0 {
+		return nil, 0, NewStackErrorf("shard reply has no cursor: %v", doc)
+	}
+	cursor, _, err := GetAsBSON(doc[idx])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var docs []bson.D
+	if idx := BSONIndexOf(cursor, batchField); idx >= 0 {
+		docs, _, err = GetAsBSONDocs(cursor[idx])
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	var id int64
+	if idx := BSONIndexOf(cursor, "id"); idx >= 0 {
+		id, _ = cursorIdValue(cursor[idx].Value)
+	}
+	return docs, id, nil
+}
+
+// find broadcasts or targets a find and merges the shards' cursors
+func (srs *shardRouterSession) find(db, coll string, key ShardKey, cmd bson.D) (bson.D, error) {
+	skip, limit := getInt(cmd, "skip"), getInt(cmd, "limit")
+	singleBatch := getBool(cmd, "singleBatch", false)
+	if limit < 0 {
+		limit, singleBatch = -limit, true
+	}
+	batchSize := defaultFirstBatchSize
+	if BSONIndexOf(cmd, "batchSize") >= 0 {
+		batchSize = getInt(cmd, "batchSize")
+	}
+
+	// every shard may hold the documents the skip passes over
+	shardCmd := withField(withField(cmd, "skip", nil), "singleBatch", nil)
+	if limit > 0 {
+		shardCmd = withField(shardCmd, "limit", skip+limit)
+	}
+
+	cmds := map[string]bson.D{}
+	for _, shard := range srs.router.targetShards(key, getDoc(cmd, "filter")) {
+		cmds[shard] = shardCmd
+	}
+
+	// the skipped documents count against the limit, they go through the cursor too
+	mc := &mergedCursor{db, coll, getDoc(cmd, "sort"), nil, 0, 0, sessionFields(cmd), srs, srs.ps.cursorUser()}
+	if limit > 0 {
+		mc.limit = skip + limit
+	}
+	var firstErr error
+	for _, r := range srs.runAll(db, cmds) {
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		docs, id, err := parseCursorReply(r.doc, "firstBatch")
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		mc.streams = append(mc.streams, &shardStream{r.shard, docs, id})
+	}
+	if firstErr != nil {
+		srs.killRemote(mc)
+		return nil, firstErr
+	}
+
+	if skip > 0 {
+		if _, err := srs.next(mc, skip, 0); err != nil {
+			srs.killRemote(mc)
+			return nil, err
+		}
+	}
+	if batchSize == 0 && !singleBatch {
+		return srs.cursorReply(mc, []bson.D{}, "firstBatch"), nil
+	}
+	docs, err := srs.next(mc, batchSize, maxBatchBytes)
+	if err != nil {
+		srs.killRemote(mc)
+		return nil, err
+	}
+	if singleBatch {
+		srs.killRemote(mc)
+		return CursorReply(mc.ns(), 0, "firstBatch", docs), nil
+	}
+	return srs.cursorReply(mc, docs, "firstBatch"), nil
+}
+
+// cursorReply registers the cursor if documents are left and builds the response
+func (srs *shardRouterSession) cursorReply(mc *mergedCursor, docs []bson.D, batchField string) bson.D {
+	var id int64
+	if mc.exhausted() {
+		srs.killRemote(mc)
+	} else {
+		id = srs.router.addCursor(mc)
+	}
+	return CursorReply(mc.ns(), id, batchField, docs)
+}
+
+// getMore continues a merged cursor taken from the router, it goes back unless it's done
+func (srs *shardRouterSession) getMore(id int64, mc *mergedCursor, cmd bson.D) (bson.D, error) {
+	docs, err := srs.next(mc, getInt(cmd, "batchSize"), maxBatchBytes)
+	if err != nil {
+		srs.killRemote(mc)
+		return nil, err
+	}
+	if mc.exhausted() {
+		srs.killRemote(mc)
+		return CursorReply(mc.ns(), 0, "nextBatch", docs), nil
+	}
+	srs.router.putCursor(id, mc)
+	return CursorReply(mc.ns(), id, "nextBatch", docs), nil
+}
+
+// killCursors answers killCursors if it names merged cursors, the rest of the ids are reported not found
+func (srs *shardRouterSession) killCursors(m Message, cmd bson.D) (Message, ResponseInterceptor, error) {
+	var ids []int64
+	if idx := BSONIndexOf(cmd, "cursors"); idx >= 0 {
+		raw, _ := cmd[idx].Value.([]interface{})
+		for _, r := range raw {
+			if id, ok := cursorIdValue(r); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	lsid := getDoc(cmd, "lsid")
+	killed := []int64{}
+	notFound := []int64{}
+	for _, id := range ids {
+		mc, ok := srs.router.takeCursor(id, srs.ps.cursorUser(), lsid)
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		srs.killRemote(mc)
+		killed = append(killed, id)
+	}
+	if len(killed) == 0 {
+		return m, nil, nil
+	}
+
+	return srs.answer(m, bson.D{
+		{"cursorsKilled", killed},
+		{"cursorsNotFound", notFound},
+		{"cursorsAlive", []int64{}},
+		{"cursorsUnknown", []int64{}},
+	}, nil)
+}
+
+// killRemote kills what's left of a merged cursor on the shards
+func (srs *shardRouterSession) killRemote(mc *mergedCursor) {
+	for _, s := range mc.streams {
+		if s.remoteId == 0 {
+			continue
+		}
+		_, err := srs.run(s.shard, mc.db, append(bson.D{{"killCursors", mc.coll}, {"cursors", []int64{s.remoteId}}}, mc.session...))
+		if err != nil {
+			srs.ps.GetLogger().Logf(slogger.INFO, "error killing cursor %d on shard %s: %s", s.remoteId, s.shard, err)
+		}
+		s.remoteId = 0
+		s.docs = nil
+	}
+}
+
+// ---
+
+// addCursor keeps a merged cursor on the router, drivers send getMore and killCursors on any pooled connection
+func (sr *ShardRouter) addCursor(mc *mergedCursor) int64 {
+	sr.cursorLock.Lock()
+	defer sr.cursorLock.Unlock()
+
+	id := randomCursorId()
+	for _, taken := sr.cursors[id]; taken || id == 0; _, taken = sr.cursors[id] {
+		id = randomCursorId()
+	}
+	sr.cursors[id] = mc
+	return id
+}
+
+// takeCursor removes a merged cursor for a request to use it, like with mongod a cursor belongs
+// to the user who opened it and to its logical session
+func (sr *ShardRouter) takeCursor(id int64, user string, lsid bson.D) (*mergedCursor, bool) {
+	sr.cursorLock.Lock()
+	defer sr.cursorLock.Unlock()
+
+	mc, ok := sr.cursors[id]
+	if !ok || mc.user != user {
+		return nil, false
+	}
+	if own := mc.lsid(); own != nil && (len(lsid) == 0 || lsidKey(lsid) != lsidKey(own)) {
+		return nil, false
+	}
+	delete(sr.cursors, id)
+	return mc, true
+}
+
+func (sr *ShardRouter) putCursor(id int64, mc *mergedCursor) {
+	sr.cursorLock.Lock()
+	defer sr.cursorLock.Unlock()
+	sr.cursors[id] = mc
+}
+
+// takeCursorsWhere removes the merged cursors matching a condition
+func (sr *ShardRouter) takeCursorsWhere(match func(*mergedCursor) bool) []*mergedCursor {
+	sr.cursorLock.Lock()
+	defer sr.cursorLock.Unlock()
+
+	res := []*mergedCursor{}
+	for id, mc := range sr.cursors {
+		if match(mc) {
+			res = append(res, mc)
+			delete(sr.cursors, id)
+		}
+	}
+	return res
+}
+
+// endSessions kills the merged cursors of logical sessions the client ends
+func (srs *shardRouterSession) endSessions(cmd bson.D) {
+	docs, _, err := GetAsBSONDocs(cmd[0])
+	if err != nil {
+		return
+	}
+	ended := map[string]bool{}
+	for _, lsid := range docs {
+		ended[lsidKey(lsid)] = true
+	}
+	for _, mc := range srs.router.takeCursorsWhere(func(mc *mergedCursor) bool {
+		lsid := mc.lsid()
+		return lsid != nil && ended[lsidKey(lsid)]
+	}) {
+		srs.killRemote(mc)
+	}
+}
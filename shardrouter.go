@@ -0,0 +1,630 @@
+package mongonet
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ShardRouter is a ProxyInterceptorFactory which spreads collections over independent mongods by a shard key.
+// Requests which carry the shard key go to the backend owning it, everything else is broadcast
+// and the results are merged. Namespaces without a shard key pass through to the proxy's upstream.
+//
+// The shard key is a single field which documents must not change. Sorted finds are merged
+// on the sort fields, so a projection must not drop them.
+type ShardRouter struct {
+	shards map[string]*ConnectionPool
+	names  []string // sorted, hashed values are spread over them
+
+	lock sync.RWMutex
+	keys map[string]ShardKey // by namespace
+
+	cursorLock sync.Mutex
+	cursors    map[int64]*mergedCursor // of all clients
+}
+
+type ShardKeyStrategy int
+
+const (
+	ShardKeyRanged ShardKeyStrategy = iota
+	ShardKeyHashed
+)
+
+// ShardChunk says values from Min up to the next chunk's Min live on Shard
+type ShardChunk struct {
+	Min   interface{}
+	Shard string
+}
+
+type ShardKey struct {
+	Field    string
+	Strategy ShardKeyStrategy
+	Chunks   []ShardChunk // ranged keys only, ordered by Min and the first one starting at bson.MinKey
+}
+
+func NewShardRouter(shards map[string]*ConnectionPool) *ShardRouter {
+	names := make([]string, 0, len(shards))
+	for name := range shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &ShardRouter{shards, names, sync.RWMutex{}, map[string]ShardKey{}, sync.Mutex{}, map[int64]*mergedCursor{}}
+}
+
+// SetShardKey shards a namespace, replacing its previous key
+func (sr *ShardRouter) SetShardKey(ns string, key ShardKey) error {
+	if key.Field == "" {
+		return fmt.Errorf("shard key of %s has no field", ns)
+	}
+	if key.Strategy == ShardKeyRanged {
+		if len(key.Chunks) == 0 || key.Chunks[0].Min != bson.MinKey {
+			return fmt.Errorf("chunks of %s have to start at MinKey", ns)
+		}
+		for i, c := range key.Chunks {
+			if _, ok := sr.shards[c.Shard]; !ok {
+				return fmt.Errorf("chunk %d of %s is on unknown shard %s", i, ns, c.Shard)
+			}
+			if i > 0 && BSONCompare(key.Chunks[i-1].Min, c.Min) >= 0 {
+				return fmt.Errorf("chunks of %s are not ordered", ns)
+			}
+		}
+	}
+	if len(sr.names) == 0 {
+		return fmt.Errorf("no shards")
+	}
+
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	sr.keys[ns] = key
+	return nil
+}
+
+func (sr *ShardRouter) shardKey(ns string) (ShardKey, bool) {
+	sr.lock.RLock()
+	defer sr.lock.RUnlock()
+	key, ok := sr.keys[ns]
+	return key, ok
+}
+
+// ---
+
+// shardFor returns the shard owning a shard key value
+func (sr *ShardRouter) shardFor(key ShardKey, value interface{}) string {
+	if key.Strategy == ShardKeyHashed {
+		return sr.names[hashShardKeyValue(value)%uint64(len(sr.names))]
+	}
+	owner := key.Chunks[0].Shard
+	for _, c := range key.Chunks[1:] {
+		if BSONCompare(value, c.Min) < 0 {
+			break
+		}
+		owner = c.Shard
+	}
+	return owner
+}
+
+func hashShardKeyValue(value interface{}) uint64 {
+	if n, ok := BSONNumber(value); ok {
+		// 1, int64(1) and 1.0 are the same key
+		value = n
+	}
+	raw, err := bson.Marshal(bson.D{{"v", value}})
+	if err != nil {
+		raw = []byte(fmt.Sprint(value))
+	}
+	h := fnv.New64a()
+	h.Write(raw)
+	return h.Sum64()
+}
+
+// shardsBetween returns the shards owning a range of a ranged key
+func (sr *ShardRouter) shardsBetween(key ShardKey, lo, hi interface{}) []string {
+	res := []string{}
+	for i, c := range key.Chunks {
+		if BSONCompare(c.Min, hi) > 0 {
+			break
+		}
+		if i+1 < len(key.Chunks) && BSONCompare(key.Chunks[i+1].Min, lo) <= 0 {
+			continue
+		}
+		res = append(res, c.Shard)
+	}
+	return dedupStrings(res)
+}
+
+// targetShards returns the shards which can hold documents matching a filter
+func (sr *ShardRouter) targetShards(key ShardKey, filter bson.D) []string {
+	value, ok := BSONGetPath(filter, key.Field)
+	if !ok {
+		if idx := BSONIndexOf(filter, key.Field); idx >= 0 {
+			value, ok = filter[idx].Value, true
+		}
+	}
+	if !ok {
+		return sr.names
+	}
+
+	ops, isDoc := value.(bson.D)
+	if !isDoc || len(ops) == 0 || !strings.HasPrefix(ops[0].Name, "$") {
+		return []string{sr.shardFor(key, value)}
+	}
+
+	var lo, hi interface{} = bson.MinKey, bson.MaxKey
+	var in []string
+	for _, op := range ops {
+		switch op.Name {
+		case "$eq":
+			return []string{sr.shardFor(key, op.Value)}
+		case "$in":
+			values, _ := op.Value.([]interface{})
+			for _, v := range values {
+				in = append(in, sr.shardFor(key, v))
+			}
+		case "$gt", "$gte":
+			if key.Strategy == ShardKeyHashed {
+				return sr.names
+			}
+			lo = op.Value
+		case "$lt", "$lte":
+			if key.Strategy == ShardKeyHashed {
+				return sr.names
+			}
+			hi = op.Value
+		default:
+			return sr.names
+		}
+	}
+	if in != nil {
+		return dedupStrings(in)
+	}
+	return sr.shardsBetween(key, lo, hi)
+}
+
+func dedupStrings(in []string) []string {
+	seen := map[string]bool{}
+	res := []string{}
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			res = append(res, s)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ---
+
+func (sr *ShardRouter) NewInterceptor(ps *ProxySession) (ProxyInterceptor, error) {
+	return &shardRouterSession{sr, ps}, nil
+}
+
+// shardRouterSession routes the requests of one client
+type shardRouterSession struct {
+	router *ShardRouter
+	ps     *ProxySession
+}
+
+func newCommandNotSupportedError(cmdName, ns string) MongoError {
+	return NewMongoError(fmt.Errorf("%s is not supported on sharded collection %s", cmdName, ns), 115, "CommandNotSupported")
+}
+
+func newShardKeyNotFoundError(cmdName string, key ShardKey) MongoError {
+	return NewMongoError(fmt.Errorf("%s has to target a single shard, its query needs the shard key %s", cmdName, key.Field), 61, "ShardKeyNotFound")
+}
+
+func (srs *shardRouterSession) InterceptClientToMongo(m Message) (Message, ResponseInterceptor, error) {
+	db, cmd, err := GetCommand(m)
+	if err != nil || len(cmd) == 0 {
+		return m, nil, nil
+	}
+
+	cmdName := strings.ToLower(CommandName(cmd))
+	switch cmdName {
+	case "getmore":
+		id, _ := cursorIdValue(cmd[0].Value)
+		c, ok := srs.router.takeCursor(id, srs.ps.cursorUser(), getDoc(cmd, "lsid"))
+		if !ok {
+			return m, nil, nil
+		}
+		doc, err := srs.getMore(id, c, cmd)
+		return srs.answer(m, doc, err)
+	case "killcursors":
+		return srs.killCursors(m, cmd)
+	case "endsessions":
+		// mongod ends the sessions' cursors too
+		srs.endSessions(cmd)
+		return m, nil, nil
+	}
+
+	coll, ok := cmd[0].Value.(string)
+	if !ok {
+		return m, nil, nil
+	}
+	ns := db + "." + coll
+	key, sharded := srs.router.shardKey(ns)
+	if !sharded {
+		return m, nil, nil
+	}
+
+	cmd = shardCommand(cmd)
+
+	var doc bson.D
+	switch cmdName {
+	case "find":
+		doc, err = srs.find(db, coll, key, cmd)
+	case "insert":
+		doc, err = srs.write(db, key, cmd, "documents")
+	case "update":
+		doc, err = srs.write(db, key, cmd, "updates")
+	case "delete":
+		doc, err = srs.write(db, key, cmd, "deletes")
+	case "findandmodify":
+		doc, err = srs.findAndModify(db, key, cmd)
+	case "count":
+		doc, err = srs.count(db, key, cmd)
+	case "drop", "createindexes", "dropindexes":
+		doc, err = srs.broadcast(db, cmd)
+	default:
+		err = newCommandNotSupportedError(CommandName(cmd), ns)
+	}
+	return srs.answer(m, doc, err)
+}
+
+// answer responds to the client, following the ProxyInterceptor conventions
+func (srs *shardRouterSession) answer(m Message, doc bson.D, err error) (Message, ResponseInterceptor, error) {
+	if err != nil {
+		return m, nil, err
+	}
+	if BSONIndexOf(doc, "ok") < 0 {
+		doc = append(doc, bson.DocElem{"ok", 1})
+	}
+	raw, err := SimpleBSONConvert(doc)
+	if err != nil {
+		return m, nil, err
+	}
+	return nil, nil, srs.ps.RespondToCommand(m, raw)
+}
+
+// shardCommand strips what a standalone mongod doesn't accept from a command
+func shardCommand(cmd bson.D) bson.D {
+	res := make(bson.D, 0, len(cmd))
+	for _, elem := range cmd {
+		switch elem.Name {
+		case "$db", "$clusterTime":
+			continue
+		}
+		res = append(res, elem)
+	}
+	return res
+}
+
+func withField(cmd bson.D, name string, value interface{}) bson.D {
+	res := make(bson.D, 0, len(cmd)+1)
+	found := false
+	for _, elem := range cmd {
+		if elem.Name == name {
+			found = true
+			if value == nil {
+				continue
+			}
+			elem.Value = value
+		}
+		res = append(res, elem)
+	}
+	if !found && value != nil {
+		res = append(res, bson.DocElem{name, value})
+	}
+	return res
+}
+
+func getDoc(cmd bson.D, name string) bson.D {
+	if idx := BSONIndexOf(cmd, name); idx >= 0 {
+		doc, _, _ := GetAsBSON(cmd[idx])
+		return doc
+	}
+	return bson.D{}
+}
+
+func getInt(cmd bson.D, name string) int {
+	if idx := BSONIndexOf(cmd, name); idx >= 0 {
+		n, _, _ := GetAsInt(cmd[idx])
+		return n
+	}
+	return 0
+}
+
+func getBool(cmd bson.D, name string, def bool) bool {
+	if idx := BSONIndexOf(cmd, name); idx >= 0 {
+		b, _, err := GetAsBool(cmd[idx])
+		if err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+// run sends a command to a shard
+func (srs *shardRouterSession) run(shard, db string, cmd bson.D) (bson.D, error) {
+	conn, err := srs.router.shards[shard].Get()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	res, err := RunCommand(conn.conn, db, cmd)
+	if err != nil {
+		if _, ok := err.(MongoError); !ok {
+			conn.bad = true
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+type shardResult struct {
+	shard string
+	doc   bson.D
+	err   error
+}
+
+// runAll sends commands to several shards at once
+func (srs *shardRouterSession) runAll(db string, cmds map[string]bson.D) []shardResult {
+	shards := make([]string, 0, len(cmds))
+	for shard := range cmds {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	results := make([]shardResult, len(shards))
+	wg := sync.WaitGroup{}
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard string) {
+			defer wg.Done()
+			doc, err := srs.run(shard, db, cmds[shard])
+			results[i] = shardResult{shard, doc, err}
+		}(i, shard)
+	}
+	wg.Wait()
+	return results
+}
+
+func (srs *shardRouterSession) broadcast(db string, cmd bson.D) (bson.D, error) {
+	cmds := map[string]bson.D{}
+	for _, shard := range srs.router.names {
+		cmds[shard] = cmd
+	}
+	results := srs.runAll(db, cmds)
+	for _, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+	return results[0].doc, nil
+}
+
+func (srs *shardRouterSession) findAndModify(db string, key ShardKey, cmd bson.D) (bson.D, error) {
+	shards := srs.router.targetShards(key, getDoc(cmd, "query"))
+	if len(shards) != 1 {
+		return nil, newShardKeyNotFoundError("findAndModify", key)
+	}
+	return srs.run(shards[0], db, cmd)
+}
+
+func (srs *shardRouterSession) count(db string, key ShardKey, cmd bson.D) (bson.D, error) {
+	skip, limit := getInt(cmd, "skip"), getInt(cmd, "limit")
+	if limit < 0 {
+		limit = -limit
+	}
+	shardCmd := withField(withField(cmd, "skip", nil), "limit", nil)
+
+	cmds := map[string]bson.D{}
+	for _, shard := range srs.router.targetShards(key, getDoc(cmd, "query")) {
+		cmds[shard] = shardCmd
+	}
+
+	total := 0
+	for _, r := range srs.runAll(db, cmds) {
+		if r.err != nil {
+			return nil, r.err
+		}
+		total += getInt(r.doc, "n")
+	}
+
+	total -= skip
+	if total < 0 {
+		total = 0
+	}
+	if limit > 0 && total > limit {
+		total = limit
+	}
+	return bson.D{{"n", total}, {"ok", 1}}, nil
+}
+
+// ---
+
+// writeBatch is a part of a write command going to shards, each statement keeps its index in the client's command
+type writeBatch map[string][]int
+
+// write splits insert, update and delete commands by shard and merges the results like mongos
+func (srs *shardRouterSession) write(db string, key ShardKey, cmd bson.D, statementsField string) (bson.D, error) {
+	idx := BSONIndexOf(cmd, statementsField)
+	if idx < 0 {
+		return nil, newBadValueError("%s is missing", statementsField)
+	}
+	statements, _, err := GetAsBSONDocs(cmd[idx])
+	if err != nil {
+		return nil, newBadValueError("%s has to be an array of documents", statementsField)
+	}
+	ordered := getBool(cmd, "ordered", true)
+
+	targets := make([][]string, len(statements))
+	for i, s := range statements {
+		switch statementsField {
+		case "documents":
+			value, ok := BSONGetPath(s, key.Field)
+			if !ok {
+				value = nil
+			}
+			targets[i] = []string{srs.router.shardFor(key, value)}
+		case "updates":
+			targets[i] = srs.router.targetShards(key, getDoc(s, "q"))
+			if len(targets[i]) > 1 && (!getBool(s, "multi", false) || getBool(s, "upsert", false)) {
+				return nil, newShardKeyNotFoundError("single update", key)
+			}
+		case "deletes":
+			targets[i] = srs.router.targetShards(key, getDoc(s, "q"))
+			if len(targets[i]) > 1 && getInt(s, "limit") != 0 {
+				return nil, newShardKeyNotFoundError("single delete", key)
+			}
+		}
+	}
+
+	batches := []writeBatch{}
+	if ordered {
+		// consecutive statements for one shard go together, the order is kept between batches
+		var current writeBatch
+		currentShard := ""
+		for i, shards := range targets {
+			if len(shards) == 1 && current != nil && shards[0] == currentShard {
+				current[currentShard] = append(current[currentShard], i)
+				continue
+			}
+			current = writeBatch{}
+			for _, shard := range shards {
+				current[shard] = []int{i}
+			}
+			currentShard = ""
+			if len(shards) == 1 {
+				currentShard = shards[0]
+			}
+			batches = append(batches, current)
+		}
+	} else {
+		batch := writeBatch{}
+		for i, shards := range targets {
+			for _, shard := range shards {
+				batch[shard] = append(batch[shard], i)
+			}
+		}
+		batches = append(batches, batch)
+	}
+
+	merged := &writeResult{}
+	for _, batch := range batches {
+		cmds := map[string]bson.D{}
+		for shard, indexes := range batch {
+			subset := make([]bson.D, len(indexes))
+			for j, i := range indexes {
+				subset[j] = statements[i]
+			}
+			cmds[shard] = withField(cmd, statementsField, subset)
+		}
+		for _, r := range srs.runAll(db, cmds) {
+			merged.add(r, batch[r.shard])
+		}
+		if ordered && len(merged.writeErrors) > 0 {
+			break
+		}
+	}
+
+	return merged.toBSON(statementsField == "updates"), nil
+}
+
+type writeResult struct {
+	n                 int
+	nModified         int
+	upserted          []bson.D
+	writeErrors       []bson.D
+	writeConcernError interface{}
+}
+
+func remapIndex(doc bson.D, indexes []int) bson.D {
+	res := append(bson.D{}, doc...)
+	if idx := BSONIndexOf(res, "index"); idx >= 0 {
+		if i, _, err := GetAsInt(res[idx]); err == nil && i >= 0 && i < len(indexes) {
+			res[idx].Value = indexes[i]
+		}
+	}
+	return res
+}
+
+// add merges a shard's reply, indexes maps the shard's statement indexes to the client's
+func (wr *writeResult) add(r shardResult, indexes []int) {
+	if r.err != nil {
+		// every statement the shard got failed
+		code, codeName := 6, "HostUnreachable"
+		if me, ok := r.err.(MongoError); ok {
+			code, codeName = me.code, me.codeName
+		}
+		for _, i := range indexes {
+			wr.writeErrors = append(wr.writeErrors, bson.D{{"index", i}, {"code", code}, {"codeName", codeName}, {"errmsg", r.err.Error()}})
+		}
+		return
+	}
+
+	wr.n += getInt(r.doc, "n")
+	wr.nModified += getInt(r.doc, "nModified")
+	if idx := BSONIndexOf(r.doc, "upserted"); idx >= 0 {
+		docs, _, _ := GetAsBSONDocs(r.doc[idx])
+		for _, d := range docs {
+			wr.upserted = append(wr.upserted, remapIndex(d, indexes))
+		}
+	}
+	if idx := BSONIndexOf(r.doc, "writeErrors"); idx >= 0 {
+		docs, _, _ := GetAsBSONDocs(r.doc[idx])
+		for _, d := range docs {
+			wr.writeErrors = append(wr.writeErrors, remapIndex(d, indexes))
+		}
+	}
+	if idx := BSONIndexOf(r.doc, "writeConcernError"); idx >= 0 && wr.writeConcernError == nil {
+		wr.writeConcernError = r.doc[idx].Value
+	}
+}
+
+func (wr *writeResult) toBSON(isUpdate bool) bson.D {
+	byIndex := func(docs []bson.D) {
+		sort.SliceStable(docs, func(i, j int) bool {
+			return getInt(docs[i], "index") < getInt(docs[j], "index")
+		})
+	}
+
+	doc := bson.D{{"n", wr.n}}
+	if isUpdate {
+		doc = append(doc, bson.DocElem{"nModified", wr.nModified})
+	}
+	if len(wr.upserted) > 0 {
+		byIndex(wr.upserted)
+		doc = append(doc, bson.DocElem{"upserted", wr.upserted})
+	}
+	if len(wr.writeErrors) > 0 {
+		byIndex(wr.writeErrors)
+		doc = append(doc, bson.DocElem{"writeErrors", wr.writeErrors})
+	}
+	if wr.writeConcernError != nil {
+		doc = append(doc, bson.DocElem{"writeConcernError", wr.writeConcernError})
+	}
+	return append(doc, bson.DocElem{"ok", 1})
+}
+
+// ---
+
+// Close kills the merged cursors the client opened, like the proxy does with its own cursors
+func (srs *shardRouterSession) Close() {
+	for _, mc := range srs.router.takeCursorsWhere(func(mc *mergedCursor) bool { return mc.owner == srs }) {
+		srs.killRemote(mc)
+	}
+}
+
+func (srs *shardRouterSession) TrackRequest(MessageHeader)             {}
+func (srs *shardRouterSession) TrackRequestMessage(Message)            {}
+func (srs *shardRouterSession) TrackResponse(MessageHeader)            {}
+func (srs *shardRouterSession) TrackResponseMessage(Message)           {}
+func (srs *shardRouterSession) CheckConnection() error                 { return nil }
+func (srs *shardRouterSession) CheckConnectionInterval() time.Duration { return 0 }
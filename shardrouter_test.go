@@ -0,0 +1,431 @@
+package mongonet
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestShardTargeting(test *testing.T) {
+	sr := NewShardRouter(map[string]*ConnectionPool{"a": nil, "b": nil, "c": nil})
+	ranged := ShardKey{"x", ShardKeyRanged, []ShardChunk{{bson.MinKey, "a"}, {10, "b"}, {20, "c"}}}
+	if err := sr.SetShardKey("test.foo", ranged); err != nil {
+		test.Fatal(err)
+	}
+	if err := sr.SetShardKey("test.bad", ShardKey{"x", ShardKeyRanged, []ShardChunk{{0, "a"}}}); err == nil {
+		test.Errorf("chunks not starting at MinKey should be refused")
+	}
+
+	for _, c := range []struct {
+		filter bson.D
+		shards []string
+	}{
+		{bson.D{{"x", 5}}, []string{"a"}},
+		{bson.D{{"x", 10}}, []string{"b"}},
+		{bson.D{{"x", bson.D{{"$eq", 25}}}}, []string{"c"}},
+		{bson.D{{"x", bson.D{{"$in", []interface{}{1, 25}}}}}, []string{"a", "c"}},
+		{bson.D{{"x", bson.D{{"$gte", 12}, {"$lt", 15}}}}, []string{"b"}},
+		{bson.D{{"x", bson.D{{"$gt", 15}}}}, []string{"b", "c"}},
+		{bson.D{{"x", bson.D{{"$ne", 5}}}}, []string{"a", "b", "c"}},
+		{bson.D{{"y", 5}}, []string{"a", "b", "c"}},
+	} {
+		got := sr.targetShards(ranged, c.filter)
+		if len(got) != len(c.shards) {
+			test.Errorf("%v should target %v, got %v", c.filter, c.shards, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.shards[i] {
+				test.Errorf("%v should target %v, got %v", c.filter, c.shards, got)
+			}
+		}
+	}
+
+	hashed := ShardKey{"x", ShardKeyHashed, nil}
+	if sr.shardFor(hashed, 7) != sr.shardFor(hashed, 7.0) {
+		test.Errorf("hashing should not depend on the number type")
+	}
+	if len(sr.targetShards(hashed, bson.D{{"x", bson.D{{"$gt", 1}}}})) != 3 {
+		test.Errorf("ranges on a hashed key should be broadcast")
+	}
+}
+
+// testShard is an in-memory mongod holding one collection, it answers find in batches of two
+type testShard struct {
+	lock        sync.Mutex
+	docs        []bson.D
+	cursors     map[int64][]bson.D
+	commands    []string
+	sessionless []string // commands which came without an lsid
+	server      *Server
+}
+
+func (ts *testShard) CreateWorker(session *Session) (ServerWorker, error) {
+	return &testShardSession{ts, session}, nil
+}
+
+func (ts *testShard) GetConnection(conn net.Conn) io.ReadWriteCloser {
+	return conn
+}
+
+func (ts *testShard) matching(filter bson.D) []bson.D {
+	res := []bson.D{}
+	for _, doc := range ts.docs {
+		matches := true
+		for _, elem := range filter {
+			if v, ok := BSONGetPath(doc, elem.Name); !ok || BSONCompare(v, elem.Value) != 0 {
+				matches = false
+			}
+		}
+		if matches {
+			res = append(res, doc)
+		}
+	}
+	return res
+}
+
+func (ts *testShard) batch(docs []bson.D) ([]bson.D, int64) {
+	if len(docs) <= 2 {
+		return docs, 0
+	}
+	id := randomCursorId()
+	ts.cursors[id] = docs[2:]
+	return docs[:2], id
+}
+
+func (ts *testShard) run(cmd bson.D) bson.D {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	name := CommandName(cmd)
+	if name != "isMaster" {
+		ts.commands = append(ts.commands, name)
+		if BSONIndexOf(cmd, "lsid") < 0 {
+			ts.sessionless = append(ts.sessionless, name)
+		}
+	}
+	switch name {
+	case "insert":
+		docs, _, _ := GetAsBSONDocs(cmd[BSONIndexOf(cmd, "documents")])
+		ts.docs = append(ts.docs, docs...)
+		return bson.D{{"n", len(docs)}}
+	case "delete":
+		deletes, _, _ := GetAsBSONDocs(cmd[BSONIndexOf(cmd, "deletes")])
+		n := 0
+		for _, d := range deletes {
+			gone := ts.matching(getDoc(d, "q"))
+			n += len(gone)
+			kept := []bson.D{}
+			for _, doc := range ts.docs {
+				if !containsDoc(gone, doc) {
+					kept = append(kept, doc)
+				}
+			}
+			ts.docs = kept
+		}
+		return bson.D{{"n", n}}
+	case "count":
+		return bson.D{{"n", len(ts.matching(getDoc(cmd, "query")))}}
+	case "find":
+		docs := ts.matching(getDoc(cmd, "filter"))
+		sortSpec := getDoc(cmd, "sort")
+		sort.SliceStable(docs, func(i, j int) bool { return BSONCompareBySort(docs[i], docs[j], sortSpec) < 0 })
+		if limit := getInt(cmd, "limit"); limit > 0 && limit < len(docs) {
+			docs = docs[:limit]
+		}
+		batch, id := ts.batch(docs)
+		return bson.D{{"cursor", bson.D{{"firstBatch", batch}, {"id", id}, {"ns", "test.foo"}}}}
+	case "getMore":
+		id, _ := cursorIdValue(cmd[0].Value)
+		docs := ts.cursors[id]
+		delete(ts.cursors, id)
+		// like mongod the cursor keeps its id
+		batch := docs
+		if len(docs) > 2 {
+			ts.cursors[id] = docs[2:]
+			batch = docs[:2]
+		} else {
+			id = 0
+		}
+		return bson.D{{"cursor", bson.D{{"nextBatch", batch}, {"id", id}, {"ns", "test.foo"}}}}
+	case "killCursors":
+		raw, _ := cmd[BSONIndexOf(cmd, "cursors")].Value.([]interface{})
+		for _, r := range raw {
+			id, _ := cursorIdValue(r)
+			delete(ts.cursors, id)
+		}
+		return bson.D{}
+	}
+	return bson.D{{"ismaster", true}, {"maxWireVersion", 8}}
+}
+
+func containsDoc(docs []bson.D, doc bson.D) bool {
+	for _, d := range docs {
+		if BSONCompare(d, doc) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type testShardSession struct {
+	shard   *testShard
+	session *Session
+}
+
+func (tss *testShardSession) DoLoopTemp() {
+	for {
+		m, err := tss.session.ReadMessage()
+		if err != nil {
+			return
+		}
+		_, cmd, err := GetCommand(m)
+		if err != nil {
+			return
+		}
+		raw, err := SimpleBSONConvert(append(tss.shard.run(cmd), bson.DocElem{"ok", 1}))
+		if err != nil {
+			panic(err)
+		}
+		if err = tss.session.RespondToCommand(m, raw); err != nil {
+			return
+		}
+	}
+}
+
+func (tss *testShardSession) Close() {
+}
+
+func startTestShard(test *testing.T, port int) *testShard {
+	ts := &testShard{cursors: map[int64][]bson.D{}}
+	server := NewServer(
+		ServerConfig{"127.0.0.1", port, false, nil, NewSyncTlsConfig(), 0, 0, nil, slogger.OFF, nil},
+		ts,
+	)
+	ts.server = &server
+	go server.Run()
+	if err := <-server.InitChannel(); err != nil {
+		test.Fatalf("cannot start shard on %d: %s", port, err)
+	}
+	return ts
+}
+
+func (ts *testShard) takeCommands() []string {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	res := ts.commands
+	ts.commands = nil
+	ts.sessionless = nil
+	return res
+}
+
+func TestShardRouterProxy(test *testing.T) {
+	shards := map[string]*testShard{"a": startTestShard(test, 9981), "b": startTestShard(test, 9982)}
+	defer shards["a"].server.Close()
+	defer shards["b"].server.Close()
+
+	router := NewShardRouter(map[string]*ConnectionPool{
+		"a": NewConnectionPool("127.0.0.1:9981", false, nil, false, nil),
+		"b": NewConnectionPool("127.0.0.1:9982", false, nil, false, nil),
+	})
+	err := router.SetShardKey("test.foo", ShardKey{"x", ShardKeyRanged, []ShardChunk{{bson.MinKey, "a"}, {10, "b"}}})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	pc := NewProxyConfig("127.0.0.1", 9983, "127.0.0.1", 9981)
+	pc.InterceptorFactory = router
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9983")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+
+	docs := []bson.D{}
+	for _, x := range []int{15, 3, 12, 7, 1, 18, 9, 11} {
+		docs = append(docs, bson.D{{"x", x}})
+	}
+	res, err := RunCommand(conn, "test", bson.D{{"insert", "foo"}, {"documents", docs}, {"ordered", false}})
+	if err != nil || getInt(res, "n") != 8 {
+		test.Fatalf("insert failed: %v %s", res, err)
+	}
+	if len(shards["a"].docs) != 4 || len(shards["b"].docs) != 4 {
+		test.Fatalf("documents weren't split by shard key: %d on a, %d on b", len(shards["a"].docs), len(shards["b"].docs))
+	}
+	shards["a"].takeCommands()
+	shards["b"].takeCommands()
+
+	// targeted
+	res, err = RunCommand(conn, "test", bson.D{{"find", "foo"}, {"filter", bson.D{{"x", 12}}}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if got := shards["a"].takeCommands(); len(got) != 0 {
+		test.Errorf("a targeted find went to shard a: %v", got)
+	}
+	if got := shards["b"].takeCommands(); len(got) != 1 {
+		test.Errorf("a targeted find should have gone to shard b once: %v", got)
+	}
+
+	// broadcast, merged by sort and skip and limit applied, fetched in small batches
+	res, err = RunCommand(conn, "test", bson.D{{"find", "foo"}, {"sort", bson.D{{"x", -1}}}, {"skip", 1}, {"limit", 5}, {"batchSize", 3}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	cursor := getDoc(res, "cursor")
+	batch, _, _ := GetAsBSONDocs(cursor[BSONIndexOf(cursor, "firstBatch")])
+	id, _ := cursorIdValue(cursor[BSONIndexOf(cursor, "id")].Value)
+	for id != 0 {
+		res, err = RunCommand(conn, "test", bson.D{{"getMore", id}, {"collection", "foo"}})
+		if err != nil {
+			test.Fatal(err)
+		}
+		cursor = getDoc(res, "cursor")
+		more, _, _ := GetAsBSONDocs(cursor[BSONIndexOf(cursor, "nextBatch")])
+		batch = append(batch, more...)
+		id, _ = cursorIdValue(cursor[BSONIndexOf(cursor, "id")].Value)
+	}
+	got := []int{}
+	for _, doc := range batch {
+		got = append(got, getInt(doc, "x"))
+	}
+	if fmt.Sprint(got) != fmt.Sprint([]int{15, 12, 11, 9, 7}) {
+		test.Errorf("merged find returned %v", got)
+	}
+	for name, shard := range shards {
+		shard.lock.Lock()
+		if len(shard.cursors) != 0 {
+			test.Errorf("cursors are left on shard %s", name)
+		}
+		shard.lock.Unlock()
+	}
+
+	res, err = RunCommand(conn, "test", bson.D{{"count", "foo"}, {"query", bson.D{}}, {"limit", 6}})
+	if err != nil || getInt(res, "n") != 6 {
+		test.Errorf("count should be 6: %v %s", res, err)
+	}
+
+	res, err = RunCommand(conn, "test", bson.D{{"delete", "foo"}, {"deletes", []bson.D{
+		{{"q", bson.D{{"x", 3}}}, {"limit", 1}},
+		{{"q", bson.D{{"x", 18}}}, {"limit", 1}},
+	}}})
+	if err != nil || getInt(res, "n") != 2 {
+		test.Errorf("delete should have removed 2: %v %s", res, err)
+	}
+
+	_, err = RunCommand(conn, "test", bson.D{{"delete", "foo"}, {"deletes", []bson.D{{{"q", bson.D{}}, {"limit", 1}}}}})
+	if me, ok := err.(MongoError); !ok || me.Code() != 61 {
+		test.Errorf("an untargeted single delete should fail with ShardKeyNotFound, got %v", err)
+	}
+
+	_, err = RunCommand(conn, "test", bson.D{{"distinct", "foo"}, {"key", "x"}})
+	if me, ok := err.(MongoError); !ok || me.Code() != 115 {
+		test.Errorf("distinct should fail with CommandNotSupported, got %v", err)
+	}
+}
+
+func TestShardCursorSession(test *testing.T) {
+	shards := map[string]*testShard{"a": startTestShard(test, 9984), "b": startTestShard(test, 9985)}
+	defer shards["a"].server.Close()
+	defer shards["b"].server.Close()
+
+	router := NewShardRouter(map[string]*ConnectionPool{
+		"a": NewConnectionPool("127.0.0.1:9984", false, nil, false, nil),
+		"b": NewConnectionPool("127.0.0.1:9985", false, nil, false, nil),
+	})
+	err := router.SetShardKey("test.foo", ShardKey{"x", ShardKeyRanged, []ShardChunk{{bson.MinKey, "a"}, {10, "b"}}})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	pc := NewProxyConfig("127.0.0.1", 9986, "127.0.0.1", 9984)
+	pc.InterceptorFactory = router
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9986")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer conn.Close()
+	// drivers send getMore and killCursors on whichever pooled connection is free
+	other, err := net.Dial("tcp", "127.0.0.1:9986")
+	if err != nil {
+		test.Fatalf("cannot dial proxy: %s", err)
+	}
+	defer other.Close()
+
+	// 20 documents of 1MB, which don't fit into one batch
+	pad := string(make([]byte, 1024*1024))
+	for x := 0; x < 20; x++ {
+		res, err := RunCommand(conn, "test", bson.D{{"insert", "foo"}, {"documents", []bson.D{{{"x", x}, {"pad", pad}}}}})
+		if err != nil || getInt(res, "n") != 1 {
+			test.Fatalf("insert failed: %v %s", res, err)
+		}
+	}
+	shards["a"].takeCommands()
+	shards["b"].takeCommands()
+
+	lsid := bson.D{{"id", bson.Binary{4, []byte("0123456789abcdef")}}}
+	res, err := RunCommand(conn, "test", bson.D{{"find", "foo"}, {"sort", bson.D{{"x", 1}}}, {"batchSize", 1}, {"lsid", lsid}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	id, _ := cursorIdValue(getDoc(res, "cursor")[BSONIndexOf(getDoc(res, "cursor"), "id")].Value)
+
+	res, err = RunCommand(other, "test", bson.D{{"getMore", id}, {"collection", "foo"}, {"lsid", lsid}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	cursor := getDoc(res, "cursor")
+	batch, _, _ := GetAsBSONDocs(cursor[BSONIndexOf(cursor, "nextBatch")])
+	if len(batch) == 0 || len(batch) >= 19 {
+		test.Errorf("a getMore without batchSize should stop at 16MB, got %d documents", len(batch))
+	}
+
+	res, err = RunCommand(other, "test", bson.D{{"killCursors", "foo"}, {"cursors", []interface{}{id}}, {"lsid", lsid}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if killed, _ := res[0].Value.([]interface{}); len(killed) != 1 {
+		test.Errorf("the merged cursor should have been killed: %v", res)
+	}
+
+	// ending the session kills its cursors
+	if _, err = RunCommand(conn, "test", bson.D{{"find", "foo"}, {"batchSize", 1}, {"lsid", lsid}}); err != nil {
+		test.Fatal(err)
+	}
+	if _, err = RunCommand(other, "admin", bson.D{{"endSessions", []interface{}{lsid}}, {"lsid", lsid}}); err != nil {
+		test.Fatal(err)
+	}
+
+	for name, shard := range shards {
+		shard.lock.Lock()
+		if len(shard.sessionless) != 0 {
+			test.Errorf("shard %s got commands outside the client's session: %v", name, shard.sessionless)
+		}
+		if len(shard.cursors) != 0 {
+			test.Errorf("cursors are left on shard %s", name)
+		}
+		shard.lock.Unlock()
+	}
+}
@@ -0,0 +1,189 @@
+package mongonet
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// UpstreamAssignment says how a new client session picks one of several upstreams
+type UpstreamAssignment int
+
+const (
+	AssignByWeight   UpstreamAssignment = iota // at random, in proportion to the weights
+	AssignByClientIP                           // a client host lands on the same upstream as long as the weights stay
+	AssignByAppName                            // like AssignByClientIP, by the appName drivers send in their first hello
+)
+
+// Upstream is a deployment the proxy splits clients between, e.g. the mongos of an old and a new cluster
+type Upstream struct {
+	Name    string
+	Address string
+	Weight  int // 0 takes no new sessions
+}
+
+// UpstreamSplitter assigns each client session to one of several upstreams.
+// A session sticks to its upstream until it ends, changing the weights only affects new sessions.
+type UpstreamSplitter struct {
+	mode UpstreamAssignment
+
+	lock      sync.RWMutex
+	upstreams []*splitUpstream
+}
+
+type splitUpstream struct {
+	name     string
+	pool     *ConnectionPool
+	weight   int
+	sessions int64 // assigned and not ended yet
+}
+
+func NewUpstreamSplitter(upstreams []Upstream, mode UpstreamAssignment, newPool func(address string) *ConnectionPool) *UpstreamSplitter {
+	us := &UpstreamSplitter{mode, sync.RWMutex{}, nil}
+	for _, u := range upstreams {
+		weight := u.Weight
+		if weight < 0 {
+			weight = 0
+		}
+		us.upstreams = append(us.upstreams, &splitUpstream{u.Name, newPool(normalizeAddress(u.Address)), weight, 0})
+	}
+	return us
+}
+
+// SetWeight changes the share of new sessions an upstream gets
+func (us *UpstreamSplitter) SetWeight(name string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("weight of %s can't be negative", name)
+	}
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	for _, u := range us.upstreams {
+		if u.name == name {
+			u.weight = weight
+			return nil
+		}
+	}
+	return fmt.Errorf("no upstream named %s", name)
+}
+
+func (us *UpstreamSplitter) Weights() map[string]int {
+	us.lock.RLock()
+	defer us.lock.RUnlock()
+	res := map[string]int{}
+	for _, u := range us.upstreams {
+		res[u.name] = u.weight
+	}
+	return res
+}
+
+// assign picks the upstream of a new session
+func (us *UpstreamSplitter) assign(remoteAddr net.Addr, appName string) (*splitUpstream, error) {
+	us.lock.RLock()
+	defer us.lock.RUnlock()
+
+	total := 0
+	for _, u := range us.upstreams {
+		total += u.weight
+	}
+	if total == 0 {
+		return nil, newHostUnreachableError("any upstream", fmt.Errorf("no upstream takes new sessions"))
+	}
+
+	var point int
+	switch us.mode {
+	case AssignByClientIP:
+		host := ""
+		if remoteAddr != nil {
+			host, _, _ = net.SplitHostPort(remoteAddr.String())
+		}
+		point = hashPoint(host, total)
+	case AssignByAppName:
+		point = hashPoint(appName, total)
+	default:
+		point = rand.Intn(total)
+	}
+
+	for _, u := range us.upstreams {
+		if point < u.weight {
+			atomic.AddInt64(&u.sessions, 1)
+			return u, nil
+		}
+		point -= u.weight
+	}
+	panic("impossible")
+}
+
+func hashPoint(key string, total int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(total))
+}
+
+// release is called when a session ends
+func (us *UpstreamSplitter) release(u *splitUpstream) {
+	atomic.AddInt64(&u.sessions, -1)
+}
+
+func (us *UpstreamSplitter) Stats() bson.D {
+	us.lock.RLock()
+	defer us.lock.RUnlock()
+	stats := bson.D{}
+	for _, u := range us.upstreams {
+		upstream := bson.D{
+			{"address", u.pool.Address()},
+			{"weight", u.weight},
+			{"sessions", atomic.LoadInt64(&u.sessions)},
+			{"totalCreated", u.pool.LoadTotalCreated()},
+		}
+		if breaker := u.pool.Breaker(); breaker != nil {
+			upstream = append(upstream, bson.DocElem{"breaker", breaker.State().String()})
+		}
+		stats = append(stats, bson.DocElem{u.name, upstream})
+	}
+	return stats
+}
+
+// ---
+
+// clientAppName is the application name drivers put in the metadata of their first hello
+func clientAppName(info *requestInfo) string {
+	if !info.isCommand("hello", "isMaster") {
+		return ""
+	}
+	name, _ := BSONGetPath(info.cmd, "client.application.name")
+	s, _ := name.(string)
+	return s
+}
+
+// assignUpstream sticks the session to an upstream on its first request, if the proxy splits clients
+func (ps *ProxySession) assignUpstream(info *requestInfo) error {
+	if ps.proxy.splitter == nil || ps.upstream != nil {
+		return nil
+	}
+	u, err := ps.proxy.splitter.assign(ps.remoteAddr, clientAppName(info))
+	if err != nil {
+		return err
+	}
+	ps.upstream = u
+	return nil
+}
+
+// defaultPool returns the pool the session's requests go to unless something else decided
+func (ps *ProxySession) defaultPool() (*ConnectionPool, error) {
+	if ps.proxy.splitter == nil {
+		return ps.proxy.defaultPool()
+	}
+	if ps.upstream == nil {
+		u, err := ps.proxy.splitter.assign(ps.remoteAddr, "")
+		if err != nil {
+			return nil, err
+		}
+		ps.upstream = u
+	}
+	return ps.upstream.pool, nil
+}
@@ -0,0 +1,129 @@
+package mongonet
+
+import (
+	"net"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func testSplitter(mode UpstreamAssignment, upstreams ...Upstream) *UpstreamSplitter {
+	return NewUpstreamSplitter(upstreams, mode, func(address string) *ConnectionPool {
+		return NewConnectionPool(address, false, nil, false, nil)
+	})
+}
+
+func TestUpstreamSplitterAssign(test *testing.T) {
+	us := testSplitter(AssignByWeight, Upstream{"old", "old.example.com", 1}, Upstream{"new", "new.example.com", 0})
+	for i := 0; i < 20; i++ {
+		u, err := us.assign(nil, "")
+		if err != nil || u.name != "old" {
+			test.Fatalf("everything should go to old: %v %s", u, err)
+		}
+	}
+
+	if err := us.SetWeight("new", 3); err != nil {
+		test.Fatal(err)
+	}
+	if err := us.SetWeight("nope", 3); err == nil {
+		test.Errorf("unknown upstreams should be refused")
+	}
+	if err := us.SetWeight("old", 0); err != nil {
+		test.Fatal(err)
+	}
+	u, err := us.assign(nil, "")
+	if err != nil || u.name != "new" {
+		test.Fatalf("everything should go to new: %v %s", u, err)
+	}
+	us.release(u)
+
+	us.SetWeight("new", 0)
+	if _, err := us.assign(nil, ""); err == nil {
+		test.Errorf("without weights sessions can't be assigned")
+	}
+
+	us = testSplitter(AssignByClientIP, Upstream{"a", "a", 1}, Upstream{"b", "b", 1}, Upstream{"c", "c", 1})
+	client := &net.TCPAddr{net.ParseIP("10.1.2.3"), 1234, ""}
+	sameHost := &net.TCPAddr{net.ParseIP("10.1.2.3"), 5678, ""}
+	first, _ := us.assign(client, "")
+	for i := 0; i < 10; i++ {
+		if u, _ := us.assign(sameHost, ""); u != first {
+			test.Errorf("a client host should always land on %s, got %s", first.name, u.name)
+		}
+	}
+
+	us = testSplitter(AssignByAppName, Upstream{"a", "a", 1}, Upstream{"b", "b", 1}, Upstream{"c", "c", 1})
+	first, _ = us.assign(client, "billing")
+	for i := 0; i < 10; i++ {
+		if u, _ := us.assign(nil, "billing"); u != first {
+			test.Errorf("an app should always land on %s, got %s", first.name, u.name)
+		}
+	}
+}
+
+func TestClientAppName(test *testing.T) {
+	hello := bson.D{{"isMaster", 1}, {"client", bson.D{{"application", bson.D{{"name", "billing"}}}}}}
+	if name := clientAppName(newRequestInfo(testCommandMessage(hello))); name != "billing" {
+		test.Errorf("appName should be billing, got %s", name)
+	}
+	if name := clientAppName(newRequestInfo(testCommandMessage(bson.D{{"find", "foo"}}))); name != "" {
+		test.Errorf("find has no appName, got %s", name)
+	}
+}
+
+func TestSplitterProxy(test *testing.T) {
+	oldCluster := startTestShard(test, 9994)
+	defer oldCluster.server.Close()
+	newCluster := startTestShard(test, 9995)
+	defer newCluster.server.Close()
+
+	pc := NewProxyConfig("127.0.0.1", 9996, "", 0)
+	pc.Upstreams = []Upstream{{"old", "127.0.0.1:9994", 1}, {"new", "127.0.0.1:9995", 0}}
+	proxy := NewProxy(pc)
+	proxy.InitializeServer()
+	go proxy.Run()
+	defer proxy.Close()
+	if err := <-proxy.InitChannel(); err != nil {
+		test.Fatalf("cannot start proxy: %s", err)
+	}
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", "127.0.0.1:9996")
+		if err != nil {
+			test.Fatalf("cannot dial proxy: %s", err)
+		}
+		return conn
+	}
+	count := func(conn net.Conn) {
+		if _, err := RunCommand(conn, "test", bson.D{{"count", "foo"}}); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	first := dial()
+	defer first.Close()
+	count(first)
+
+	// the first client stays where it is
+	proxy.Splitter().SetWeight("old", 0)
+	proxy.Splitter().SetWeight("new", 1)
+	second := dial()
+	defer second.Close()
+	count(second)
+	count(first)
+
+	if got := oldCluster.takeCommands(); len(got) != 2 {
+		test.Errorf("old should have seen the first client's commands, got %v", got)
+	}
+	if got := newCluster.takeCommands(); len(got) != 1 {
+		test.Errorf("new should have seen the second client's command, got %v", got)
+	}
+
+	stats := proxy.Splitter().Stats()
+	for i, name := range []string{"old", "new"} {
+		upstream := stats[i].Value.(bson.D)
+		if stats[i].Name != name || upstream[BSONIndexOf(upstream, "sessions")].Value != int64(1) {
+			test.Errorf("%s should have one session: %v", name, stats)
+		}
+	}
+}
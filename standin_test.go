@@ -0,0 +1,175 @@
+package mongonet
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// standInMember is a server which answers isMaster like a replica set member and ok to anything else
+type standInMember struct {
+	lock      sync.Mutex
+	isMaster  bson.D
+	lastHello bson.D // the last isMaster or hello a client sent
+	commands  int32  // commands other than isMaster
+	authed    int32  // commands on connections which authenticated
+	server    *Server
+
+	// how many of the next commands fail by dropping the connection or as if the member stepped down
+	dropNext       int32
+	notPrimaryNext int32
+}
+
+func takeOne(counter *int32) bool {
+	for {
+		n := atomic.LoadInt32(counter)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(counter, n, n-1) {
+			return true
+		}
+	}
+}
+
+func (sm *standInMember) setIsMaster(doc bson.D) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	sm.isMaster = doc
+}
+
+func (sm *standInMember) CreateWorker(session *Session) (ServerWorker, error) {
+	return &standInSession{sm, session, false, false}, nil
+}
+
+func (sm *standInMember) GetConnection(conn net.Conn) io.ReadWriteCloser {
+	return conn
+}
+
+type standInSession struct {
+	member  *standInMember
+	session *Session
+
+	// a two step SASL conversation, started by saslStart or speculativeAuthenticate
+	conversing    bool
+	authenticated bool
+}
+
+func (ss *standInSession) DoLoopTemp() {
+	for {
+		m, err := ss.session.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		_, cmd, err := GetCommand(m)
+		if err != nil {
+			return
+		}
+
+		doc := bson.D{{"ok", 1}}
+		if IsCommandNamed(cmd, "isMaster", "hello") {
+			ss.member.lock.Lock()
+			ss.member.lastHello = cmd
+			doc = append(ss.member.isMaster, doc...)
+			ss.member.lock.Unlock()
+			if BSONIndexOf(cmd, "speculativeAuthenticate") >= 0 {
+				ss.conversing = true
+				doc = append(doc, bson.DocElem{"speculativeAuthenticate", bson.D{{"conversationId", 1}, {"done", false}, {"payload", []byte{}}}})
+			}
+		} else if IsCommandNamed(cmd, "saslStart") {
+			ss.conversing = true
+			doc = bson.D{{"conversationId", 1}, {"done", false}, {"payload", []byte{}}, {"ok", 1}}
+		} else if IsCommandNamed(cmd, "saslContinue") {
+			if ss.conversing {
+				ss.conversing, ss.authenticated = false, true
+				doc = bson.D{{"conversationId", 1}, {"done", true}, {"payload", []byte{}}, {"ok", 1}}
+			} else {
+				doc = bson.D{{"ok", 0}, {"errmsg", "No SASL session state found"}, {"code", 17}, {"codeName", "ProtocolError"}}
+			}
+		} else if takeOne(&ss.member.dropNext) {
+			return
+		} else if takeOne(&ss.member.notPrimaryNext) {
+			doc = bson.D{{"ok", 0}, {"errmsg", "not primary"}, {"code", 10107}, {"codeName", "NotWritablePrimary"}}
+		} else {
+			atomic.AddInt32(&ss.member.commands, 1)
+			if ss.authenticated {
+				atomic.AddInt32(&ss.member.authed, 1)
+			}
+		}
+
+		raw, err := SimpleBSONConvert(doc)
+		if err != nil {
+			panic(err)
+		}
+		if err = ss.session.RespondToCommand(m, raw); err != nil {
+			return
+		}
+	}
+}
+
+func (ss *standInSession) Close() {
+}
+
+func startStandInMember(test *testing.T, port int, isMaster bson.D) *standInMember {
+	sm := &standInMember{isMaster: isMaster}
+	server := NewServer(
+		ServerConfig{
+			"127.0.0.1",
+			port,
+			false,
+			nil,
+			NewSyncTlsConfig(),
+			0,
+			0,
+			nil,
+			slogger.OFF,
+			nil,
+		},
+		sm,
+	)
+	sm.server = &server
+	go server.Run()
+	if err := <-server.InitChannel(); err != nil {
+		test.Fatalf("cannot start stand-in on %d: %s", port, err)
+	}
+	return sm
+}
+
+func memberIsMaster(setName string, primary bool, electionId bson.ObjectId, hosts ...string) bson.D {
+	doc := bson.D{
+		{"ismaster", primary},
+		{"secondary", !primary},
+		{"setName", setName},
+		{"setVersion", 1},
+		{"hosts", hosts},
+		{"maxWireVersion", 8},
+	}
+	if primary {
+		doc = append(doc, bson.DocElem{"electionId", electionId})
+	}
+	return doc
+}
+
+func waitFor(test *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			test.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func primaryIs(topology *Topology, address string) func() bool {
+	return func() bool {
+		primary, ok := topology.Primary()
+		return ok && primary.Address == address
+	}
+}
@@ -0,0 +1,595 @@
+package mongonet
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mongodb/slogger/v2/slogger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type ServerKind int
+
+const (
+	ServerUnknown ServerKind = iota
+	ServerStandalone
+	ServerMongos
+	ServerRSPrimary
+	ServerRSSecondary
+	ServerRSArbiter
+	ServerRSOther
+	ServerRSGhost
+)
+
+func (k ServerKind) String() string {
+	switch k {
+	case ServerStandalone:
+		return "Standalone"
+	case ServerMongos:
+		return "Mongos"
+	case ServerRSPrimary:
+		return "RSPrimary"
+	case ServerRSSecondary:
+		return "RSSecondary"
+	case ServerRSArbiter:
+		return "RSArbiter"
+	case ServerRSOther:
+		return "RSOther"
+	case ServerRSGhost:
+		return "RSGhost"
+	}
+	return "Unknown"
+}
+
+// ServerDescription is what the last heartbeat told about a server
+type ServerDescription struct {
+	Address string
+	Kind    ServerKind
+	Error   error // why the server is unknown
+
+	RTT        time.Duration // moving average of the heartbeat round trips
+	LastUpdate time.Time
+
+	SetName    string
+	SetVersion int
+	ElectionId bson.ObjectId
+	Primary    string   // who the server thinks is primary
+	Hosts      []string // members the server reports, including passives and arbiters
+	Tags       map[string]string
+
+	LastWriteDate  time.Time
+	MaxWireVersion int
+}
+
+// parseServerDescription builds a description from an isMaster response
+func parseServerDescription(address string, doc bson.D, rtt time.Duration) ServerDescription {
+	desc := ServerDescription{Address: address, RTT: rtt, LastUpdate: time.Now(), Tags: map[string]string{}}
+
+	getBool := func(name string) bool {
+		idx := BSONIndexOf(doc, name)
+		if idx < 0 {
+			return false
+		}
+		b, _, _ := GetAsBool(doc[idx])
+		return b
+	}
+	getString := func(name string) string {
+		idx := BSONIndexOf(doc, name)
+		if idx < 0 {
+			return ""
+		}
+		s, _, _ := GetAsString(doc[idx])
+		return s
+	}
+
+	desc.SetName = getString("setName")
+	if p := getString("primary"); p != "" {
+		desc.Primary = normalizeAddress(p)
+	}
+	if idx := BSONIndexOf(doc, "setVersion"); idx >= 0 {
+		desc.SetVersion, _, _ = GetAsInt(doc[idx])
+	}
+	if idx := BSONIndexOf(doc, "maxWireVersion"); idx >= 0 {
+		desc.MaxWireVersion, _, _ = GetAsInt(doc[idx])
+	}
+	if idx := BSONIndexOf(doc, "electionId"); idx >= 0 {
+		desc.ElectionId, _ = doc[idx].Value.(bson.ObjectId)
+	}
+
+	for _, name := range []string{"hosts", "passives", "arbiters"} {
+		idx := BSONIndexOf(doc, name)
+		if idx < 0 {
+			continue
+		}
+		hosts, _ := doc[idx].Value.([]interface{})
+		for _, h := range hosts {
+			if s, ok := h.(string); ok {
+				desc.Hosts = append(desc.Hosts, normalizeAddress(s))
+			}
+		}
+	}
+
+	if idx := BSONIndexOf(doc, "tags"); idx >= 0 {
+		tags, _, _ := GetAsBSON(doc[idx])
+		for _, t := range tags {
+			if s, ok := t.Value.(string); ok {
+				desc.Tags[t.Name] = s
+			}
+		}
+	}
+
+	if idx := BSONIndexOf(doc, "lastWrite"); idx >= 0 {
+		lastWrite, _, _ := GetAsBSON(doc[idx])
+		if wIdx := BSONIndexOf(lastWrite, "lastWriteDate"); wIdx >= 0 {
+			desc.LastWriteDate, _ = lastWrite[wIdx].Value.(time.Time)
+		}
+	}
+
+	switch {
+	case getBool("isreplicaset"):
+		desc.Kind = ServerRSGhost
+	case getString("msg") == "isdbgrid":
+		desc.Kind = ServerMongos
+	case desc.SetName == "":
+		desc.Kind = ServerStandalone
+	case getBool("ismaster") || getBool("isWritablePrimary"):
+		desc.Kind = ServerRSPrimary
+	case getBool("secondary"):
+		desc.Kind = ServerRSSecondary
+	case getBool("arbiterOnly"):
+		desc.Kind = ServerRSArbiter
+	default:
+		desc.Kind = ServerRSOther
+	}
+
+	return desc
+}
+
+// ---
+
+const minHeartbeatInterval = 500 * time.Millisecond
+
+type serverMonitor struct {
+	pool  *ConnectionPool
+	stop  chan struct{}
+	check chan struct{}
+}
+
+// Topology monitors a replica set, or a list of servers, and keeps a connection pool per member
+type Topology struct {
+	setName           string
+	heartbeatInterval time.Duration
+	newPool           func(address string) *ConnectionPool
+
+	lock          sync.RWMutex
+	servers       map[string]*ServerDescription
+	monitors      map[string]*serverMonitor
+	maxSetVersion int
+	maxElectionId bson.ObjectId
+	changed       chan struct{} // closed and replaced whenever a description changes
+	closed        bool
+
+	logger *slogger.Logger
+}
+
+// NewTopology starts monitoring the seeds.
+// If setName is empty the topology follows the first replica set a seed reports.
+func NewTopology(seeds []string, setName string, heartbeatInterval time.Duration, newPool func(address string) *ConnectionPool, logger *slogger.Logger) *Topology {
+	t := &Topology{
+		setName,
+		heartbeatInterval,
+		newPool,
+		sync.RWMutex{},
+		map[string]*ServerDescription{},
+		map[string]*serverMonitor{},
+		0,
+		"",
+		make(chan struct{}),
+		false,
+		logger,
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, seed := range seeds {
+		t.addServer(normalizeAddress(seed))
+	}
+	return t
+}
+
+// Close stops monitoring and closes all pools
+func (t *Topology) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	for address := range t.monitors {
+		t.removeServer(address)
+	}
+}
+
+// SetName returns the name of the replica set, empty if none was found yet
+func (t *Topology) SetName() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.setName
+}
+
+// Servers returns the description of every known server ordered by address
+func (t *Topology) Servers() []ServerDescription {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	res := make([]ServerDescription, 0, len(t.servers))
+	for _, desc := range t.servers {
+		res = append(res, *desc)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Address < res[j].Address })
+	return res
+}
+
+func (t *Topology) Primary() (ServerDescription, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for _, desc := range t.servers {
+		if desc.Kind == ServerRSPrimary {
+			return *desc, true
+		}
+	}
+	return ServerDescription{}, false
+}
+
+// Pool returns the connection pool of a member, nil if the server is not part of the topology
+func (t *Topology) Pool(address string) *ConnectionPool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	m, ok := t.monitors[address]
+	if !ok {
+		return nil
+	}
+	return m.pool
+}
+
+// RequestCheck makes every monitor run its heartbeat now, e.g. after a network error
+func (t *Topology) RequestCheck() {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for _, m := range t.monitors {
+		select {
+		case m.check <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ServerSelector narrows the known servers down to those a request may go to
+type ServerSelector func(servers []ServerDescription) []ServerDescription
+
+// SelectServer waits until the selector accepts a server, or the timeout passes.
+// Among the accepted servers one close to the fastest is picked at random.
+func (t *Topology) SelectServer(selector ServerSelector, timeout time.Duration) (ServerDescription, *ConnectionPool, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	requested := false
+	for {
+		t.lock.RLock()
+		known := make([]ServerDescription, 0, len(t.servers))
+		for _, desc := range t.servers {
+			if desc.Kind != ServerUnknown {
+				known = append(known, *desc)
+			}
+		}
+		if selected := selector(known); len(selected) > 0 {
+			res := pickNearest(selected)
+			pool := t.monitors[res.Address].pool
+			t.lock.RUnlock()
+			return res, pool, nil
+		}
+		changed := t.changed
+		closed := t.closed
+		t.lock.RUnlock()
+
+		if closed {
+			return ServerDescription{}, nil, fmt.Errorf("topology is closed")
+		}
+
+		if !requested {
+			t.RequestCheck()
+			requested = true
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return ServerDescription{}, nil, NewMongoError(
+				fmt.Errorf("no matching server found within %s", timeout), 133, "FailedToSatisfyReadPreference")
+		}
+	}
+}
+
+// SelectPrimary returns the pool of the server writes go to
+func (t *Topology) SelectPrimary(timeout time.Duration) (*ConnectionPool, error) {
+	_, pool, err := t.SelectServer(func(servers []ServerDescription) []ServerDescription {
+		writable := []ServerDescription{}
+		for _, s := range servers {
+			if s.IsWritable() {
+				writable = append(writable, s)
+			}
+		}
+		return writable
+	}, timeout)
+	return pool, err
+}
+
+// IsWritable reports if a server accepts writes
+func (desc ServerDescription) IsWritable() bool {
+	switch desc.Kind {
+	case ServerRSPrimary, ServerStandalone, ServerMongos:
+		return true
+	}
+	return false
+}
+
+// ---
+
+// addServer and removeServer have to be called with the lock held
+
+func (t *Topology) addServer(address string) {
+	if _, ok := t.monitors[address]; ok || t.closed {
+		return
+	}
+	m := &serverMonitor{t.newPool(address), make(chan struct{}), make(chan struct{}, 1)}
+	t.monitors[address] = m
+	t.servers[address] = &ServerDescription{Address: address, Kind: ServerUnknown}
+	t.logger.Logf(slogger.INFO, "monitoring %s", address)
+	go t.monitor(address, m)
+}
+
+func (t *Topology) removeServer(address string) {
+	m, ok := t.monitors[address]
+	if !ok {
+		return
+	}
+	close(m.stop)
+	m.pool.Close()
+	delete(t.monitors, address)
+	delete(t.servers, address)
+	t.logger.Logf(slogger.INFO, "stopped monitoring %s", address)
+}
+
+func (t *Topology) notifyChanged() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func (t *Topology) monitor(address string, m *serverMonitor) {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	// checks requested right after a heartbeat wait a little, so a flapping server isn't hammered
+	minInterval := minHeartbeatInterval
+	if t.heartbeatInterval < minInterval {
+		minInterval = t.heartbeatInterval
+	}
+
+	var rtt time.Duration
+	for {
+		checked := time.Now()
+		desc := t.checkServer(address, m.pool, &conn, rtt)
+		if desc.Kind == ServerUnknown {
+			rtt = 0
+		} else {
+			rtt = desc.RTT
+		}
+
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+		t.update(desc)
+
+		select {
+		case <-m.stop:
+			return
+		case <-m.check:
+			select {
+			case <-m.stop:
+				return
+			case <-time.After(minInterval - time.Since(checked)):
+			}
+		case <-time.After(t.heartbeatInterval):
+		}
+	}
+}
+
+// checkServer runs isMaster against a server, reusing the monitor's connection
+func (t *Topology) checkServer(address string, pool *ConnectionPool, conn *net.Conn, prevRTT time.Duration) ServerDescription {
+	fail := func(err error) ServerDescription {
+		if *conn != nil {
+			(*conn).Close()
+			*conn = nil
+		}
+		return ServerDescription{Address: address, Kind: ServerUnknown, Error: err, LastUpdate: time.Now()}
+	}
+
+	if *conn == nil {
+		c, err := pool.dial()
+		if err != nil {
+			return fail(err)
+		}
+		*conn = c
+	}
+
+	// a server which doesn't answer within a heartbeat or a few seconds is unknown
+	timeout := t.heartbeatInterval
+	if timeout < 5*time.Second {
+		timeout = 5 * time.Second
+	}
+	(*conn).SetDeadline(time.Now().Add(timeout))
+
+	start := time.Now()
+	doc, err := RunCommand(*conn, "admin", bson.D{{"isMaster", 1}})
+	if err != nil {
+		return fail(err)
+	}
+	rtt := time.Since(start)
+	if prevRTT > 0 {
+		// same weighting drivers use
+		rtt = time.Duration(0.2*float64(rtt) + 0.8*float64(prevRTT))
+	}
+
+	return parseServerDescription(address, doc, rtt)
+}
+
+// update applies a heartbeat result to the topology, following the server discovery rules of the drivers
+func (t *Topology) update(desc ServerDescription) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	old, ok := t.servers[desc.Address]
+	if !ok || t.closed {
+		// removed while the heartbeat ran
+		return
+	}
+
+	if desc.Kind == ServerUnknown && old.Kind != ServerUnknown {
+		t.logger.Logf(slogger.WARN, "lost %s: %v", desc.Address, desc.Error)
+		t.monitors[desc.Address].pool.Clear()
+	}
+
+	switch desc.Kind {
+	case ServerStandalone, ServerMongos:
+		if t.setName != "" {
+			t.logger.Logf(slogger.WARN, "%s is a %s and not part of replica set %s", desc.Address, desc.Kind, t.setName)
+			t.removeServer(desc.Address)
+			t.notifyChanged()
+			return
+		}
+
+	case ServerRSPrimary, ServerRSSecondary, ServerRSArbiter, ServerRSOther:
+		if t.setName == "" {
+			t.setName = desc.SetName
+		} else if desc.SetName != t.setName {
+			t.logger.Logf(slogger.WARN, "%s is part of replica set %s, not %s", desc.Address, desc.SetName, t.setName)
+			t.removeServer(desc.Address)
+			t.notifyChanged()
+			return
+		}
+
+		if desc.Kind == ServerRSPrimary {
+			if !t.updatePrimary(&desc) {
+				break
+			}
+		} else if _, hasPrimary := t.primaryAddress(); !hasPrimary {
+			for _, host := range desc.Hosts {
+				t.addServer(host)
+			}
+			if desc.Primary != "" {
+				t.addServer(desc.Primary)
+			}
+		}
+	}
+
+	if _, ok := t.monitors[desc.Address]; !ok {
+		// the primary doesn't list it as a member
+		t.notifyChanged()
+		return
+	}
+
+	if old.Kind != desc.Kind {
+		t.logger.Logf(slogger.INFO, "%s is now %s", desc.Address, desc.Kind)
+	}
+	t.servers[desc.Address] = &desc
+	t.notifyChanged()
+}
+
+// updatePrimary handles a server claiming to be primary.
+// It returns false if the claim is stale, in which case desc is turned into an unknown server.
+func (t *Topology) updatePrimary(desc *ServerDescription) bool {
+	if desc.ElectionId != "" {
+		if t.maxElectionId != "" &&
+			(t.maxSetVersion > desc.SetVersion ||
+				(t.maxSetVersion == desc.SetVersion && t.maxElectionId > desc.ElectionId)) {
+			*desc = ServerDescription{
+				Address:    desc.Address,
+				Kind:       ServerUnknown,
+				Error:      fmt.Errorf("stale primary, election id %s", desc.ElectionId.Hex()),
+				LastUpdate: desc.LastUpdate,
+			}
+			return false
+		}
+		t.maxElectionId = desc.ElectionId
+	}
+	if desc.SetVersion > t.maxSetVersion {
+		t.maxSetVersion = desc.SetVersion
+	}
+
+	for address, other := range t.servers {
+		if address != desc.Address && other.Kind == ServerRSPrimary {
+			// the old primary stepped down, we'll learn its new state with its next heartbeat
+			t.servers[address] = &ServerDescription{Address: address, Kind: ServerUnknown, Error: fmt.Errorf("replaced by primary %s", desc.Address)}
+			select {
+			case t.monitors[address].check <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	members := map[string]bool{}
+	for _, host := range desc.Hosts {
+		members[host] = true
+		t.addServer(host)
+	}
+	for address := range t.monitors {
+		if !members[address] {
+			t.removeServer(address)
+		}
+	}
+	return true
+}
+
+func (t *Topology) primaryAddress() (string, bool) {
+	for address, desc := range t.servers {
+		if desc.Kind == ServerRSPrimary {
+			return address, true
+		}
+	}
+	return "", false
+}
+
+// Stats describes the topology for ProxySession.Stats
+func (t *Topology) Stats() bson.D {
+	servers := []bson.D{}
+	for _, desc := range t.Servers() {
+		s := bson.D{
+			{"address", desc.Address},
+			{"kind", desc.Kind.String()},
+			{"rttMicros", desc.RTT.Nanoseconds() / 1000},
+		}
+		if desc.Error != nil {
+			s = append(s, bson.DocElem{"error", desc.Error.Error()})
+		}
+		if pool := t.Pool(desc.Address); pool != nil {
+			s = append(s, bson.DocElem{"totalCreated", pool.LoadTotalCreated()})
+			if breaker := pool.Breaker(); breaker != nil {
+				s = append(s, bson.DocElem{"breaker", breaker.State().String()})
+			}
+		}
+		servers = append(servers, s)
+	}
+	return bson.D{
+		{"setName", t.SetName()},
+		{"servers", servers},
+	}
+}
@@ -0,0 +1,133 @@
+package mongonet
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MongoURI is what the proxy understands of a mongodb:// connection string
+type MongoURI struct {
+	Hosts    []string // host:port
+	Username string
+	Password string
+	Database string
+
+	ReplicaSet             string
+	SSL                    bool
+	SSLSkipVerify          bool
+	AuthSource             string
+	HeartbeatInterval      time.Duration
+	ServerSelectionTimeout time.Duration
+}
+
+const defaultMongoPort = 27017
+
+// ParseMongoURI parses a mongodb:// connection string.
+// mongodb+srv:// is not supported since it needs DNS lookups.
+func ParseMongoURI(uri string) (*MongoURI, error) {
+	const scheme = "mongodb://"
+	if !strings.HasPrefix(uri, scheme) {
+		return nil, fmt.Errorf("mongo uri has to start with %s", scheme)
+	}
+	rest := uri[len(scheme):]
+
+	res := &MongoURI{}
+
+	query := ""
+	if idx := strings.Index(rest, "?"); idx >= 0 {
+		query = rest[idx+1:]
+		rest = rest[:idx]
+	}
+
+	if idx := strings.Index(rest, "/"); idx >= 0 {
+		db, err := url.PathUnescape(rest[idx+1:])
+		if err != nil {
+			return nil, fmt.Errorf("bad database in mongo uri: %s", err)
+		}
+		res.Database = db
+		rest = rest[:idx]
+	}
+
+	if idx := strings.LastIndex(rest, "@"); idx >= 0 {
+		userInfo := rest[:idx]
+		rest = rest[idx+1:]
+
+		password := ""
+		if pIdx := strings.Index(userInfo, ":"); pIdx >= 0 {
+			password = userInfo[pIdx+1:]
+			userInfo = userInfo[:pIdx]
+		}
+		var err error
+		if res.Username, err = url.PathUnescape(userInfo); err != nil {
+			return nil, fmt.Errorf("bad username in mongo uri: %s", err)
+		}
+		if res.Password, err = url.PathUnescape(password); err != nil {
+			return nil, fmt.Errorf("bad password in mongo uri: %s", err)
+		}
+	}
+
+	if rest == "" {
+		return nil, fmt.Errorf("no hosts in mongo uri")
+	}
+	for _, host := range strings.Split(rest, ",") {
+		if host == "" {
+			return nil, fmt.Errorf("empty host in mongo uri")
+		}
+		res.Hosts = append(res.Hosts, normalizeAddress(host))
+	}
+
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("bad options in mongo uri: %s", err)
+	}
+	for name, values := range options {
+		value := values[len(values)-1]
+		switch strings.ToLower(name) {
+		case "replicaset":
+			res.ReplicaSet = value
+		case "ssl", "tls":
+			res.SSL = value == "true"
+		case "tlsinsecure", "tlsallowinvalidcertificates":
+			res.SSLSkipVerify = value == "true"
+		case "authsource":
+			res.AuthSource = value
+		case "heartbeatfrequencyms":
+			if res.HeartbeatInterval, err = uriMillis(name, value); err != nil {
+				return nil, err
+			}
+		case "serverselectiontimeoutms":
+			if res.ServerSelectionTimeout, err = uriMillis(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func uriMillis(name, value string) (time.Duration, error) {
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("bad value for %s in mongo uri: %s", name, value)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// normalizeAddress lower cases a host and adds the default port if there is none
+func normalizeAddress(address string) string {
+	address = strings.ToLower(address)
+	if strings.HasPrefix(address, "[") {
+		// ipv6
+		if strings.HasSuffix(address, "]") {
+			return fmt.Sprintf("%s:%d", address, defaultMongoPort)
+		}
+		return address
+	}
+	if !strings.Contains(address, ":") {
+		return fmt.Sprintf("%s:%d", address, defaultMongoPort)
+	}
+	return address
+}